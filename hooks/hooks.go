@@ -0,0 +1,115 @@
+// Package hooks lets a program that builds valence extend its request
+// handling without changing valence itself: Go middleware around every
+// request, and functions that add to the environment PHP sees, such as a
+// user name from an SSO proxy or a tenant ID.
+//
+// Hooks are registered from an init function. To build them in, write a
+// main package that imports the package registering them and runs valence:
+//
+//	package main
+//
+//	import (
+//		"github.com/artefactual-labs/valence/server"
+//
+//		_ "example.org/valence-sso"
+//	)
+//
+//	func main() {
+//		server.Main()
+//	}
+//
+// where the imported package does something like:
+//
+//	func init() {
+//		hooks.Use(func(next http.Handler) http.Handler {
+//			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+//				// ...
+//				next.ServeHTTP(w, r)
+//			})
+//		})
+//		hooks.UsePHPEnv(func(r *http.Request, env map[string]string) {
+//			env["REMOTE_USER"] = r.Header.Get("X-Forwarded-User")
+//		})
+//	}
+//
+// Valence reads the hooks once, when the server starts; registering one
+// later panics.
+package hooks
+
+import (
+	"net/http"
+	"sync"
+)
+
+// Middleware wraps the handler valence serves every request with: the
+// sites, valence's own endpoints and health checks alike. It runs inside
+// the access log, error reporting, redirects and audit log, so what it
+// answers is logged as usual.
+type Middleware func(next http.Handler) http.Handler
+
+// PHPEnv changes the environment of a request for PHP, which sees it in
+// $_SERVER. r is the request as it reaches PHP, after routing. Changes to
+// the variables valence sets to run the front controller (SCRIPT_FILENAME,
+// SCRIPT_NAME, PATH_INFO and ATOM_DATA_DIR) are ignored. It is not called
+// for requests proxied to an HTTP PHP backend.
+type PHPEnv func(r *http.Request, env map[string]string)
+
+var (
+	mu          sync.Mutex
+	started     bool
+	middlewares []Middleware
+	phpEnvs     []PHPEnv
+)
+
+// Use registers middleware. The first registered is the outermost.
+func Use(mw Middleware) {
+	mu.Lock()
+	defer mu.Unlock()
+	if started {
+		panic("hooks: Use called after valence started")
+	}
+	middlewares = append(middlewares, mw)
+}
+
+// UsePHPEnv registers fn to run, in registration order, on every request
+// for PHP.
+func UsePHPEnv(fn PHPEnv) {
+	mu.Lock()
+	defer mu.Unlock()
+	if started {
+		panic("hooks: UsePHPEnv called after valence started")
+	}
+	phpEnvs = append(phpEnvs, fn)
+}
+
+// Wrap returns h wrapped in the registered middleware. Valence calls it
+// once, as the server starts.
+func Wrap(h http.Handler) http.Handler {
+	mu.Lock()
+	defer mu.Unlock()
+	started = true
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
+
+// SetPHPEnv runs the registered PHPEnv functions on env. Valence calls it
+// for each request it hands to PHP.
+func SetPHPEnv(r *http.Request, env map[string]string) {
+	mu.Lock()
+	fns := phpEnvs
+	started = true
+	mu.Unlock()
+	for _, fn := range fns {
+		fn(r, env)
+	}
+}
+
+// Registered reports how many middleware and PHPEnv functions are
+// registered.
+func Registered() (middleware, phpEnv int) {
+	mu.Lock()
+	defer mu.Unlock()
+	return len(middlewares), len(phpEnvs)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"strings"
+)
+
+// pathFilter decides which source paths go into the archive. Patterns are
+// path.Match globs against slash-separated paths relative to the source,
+// as in .gitignore: a pattern containing "/" (e.g. "/cache" or
+// "plugins/arFoo*") is anchored at the source and matches a path or any of
+// its parent directories, and one without (e.g. "*.md") matches any single
+// path element. Includes win over excludes.
+//
+// With layerDirs set, the tree is split in two layers: the vendor layer
+// keeps only what is under layerDirs (and the directories leading to
+// them), the application layer everything else.
+type pathFilter struct {
+	excludes []string
+	includes []string
+
+	layerDirs []string
+	vendor    bool
+}
+
+func (f pathFilter) excluded(rel string) bool {
+	if len(f.layerDirs) > 0 {
+		inVendor := matchAny(f.layerDirs, rel)
+		if f.vendor && !inVendor && !leadsToAny(f.layerDirs, rel) {
+			return true
+		}
+		if !f.vendor && inVendor {
+			return true
+		}
+	}
+	return matchAny(f.excludes, rel) && !matchAny(f.includes, rel)
+}
+
+// layer returns the filter for one side of the split at dirs.
+func (f pathFilter) layer(dirs []string, vendor bool) pathFilter {
+	f.layerDirs = make([]string, len(dirs))
+	for i, dir := range dirs {
+		f.layerDirs[i] = "/" + strings.Trim(dir, "/")
+	}
+	f.vendor = vendor
+	return f
+}
+
+// mayInclude reports whether an include could match below the excluded
+// directory dir, in which case it must still be walked.
+func (f pathFilter) mayInclude(dir string) bool {
+	for _, pattern := range f.includes {
+		if !strings.Contains(pattern, "/") || strings.HasPrefix(strings.TrimPrefix(pattern, "/"), dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAny(patterns []string, rel string) bool {
+	for _, pattern := range patterns {
+		if matchPattern(pattern, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchPattern(pattern, rel string) bool {
+	anchored := strings.Contains(pattern, "/")
+	pattern = strings.Trim(pattern, "/")
+	parts := strings.Split(rel, "/")
+	if !anchored {
+		for _, part := range parts {
+			if ok, _ := path.Match(pattern, part); ok {
+				return true
+			}
+		}
+		return false
+	}
+	for i := range parts {
+		if ok, _ := path.Match(pattern, strings.Join(parts[:i+1], "/")); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// leadsToAny reports whether the directory rel is a parent of a path an
+// anchored pattern could match.
+func leadsToAny(patterns []string, rel string) bool {
+	parts := strings.Split(rel, "/")
+	for _, pattern := range patterns {
+		elems := strings.Split(strings.Trim(pattern, "/"), "/")
+		if len(parts) >= len(elems) {
+			continue
+		}
+		leads := true
+		for i, part := range parts {
+			if ok, _ := path.Match(elems[i], part); !ok {
+				leads = false
+				break
+			}
+		}
+		if leads {
+			return true
+		}
+	}
+	return false
+}
+
+// readPatterns reads one pattern per line, skipping blanks and # comments.
+func readPatterns(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var patterns []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	return patterns, sc.Err()
+}
+
+// stringList collects a repeatable flag.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// infoFile matches atomembed's metadata entry name.
+const infoFile = ".valence-atom.json"
+
+// archiveInfo mirrors atomembed.ArchiveInfo.
+type archiveInfo struct {
+	Commit      string    `json:"commit,omitempty"`
+	AtomVersion string    `json:"atom_version,omitempty"`
+	BuiltAt     time.Time `json:"built_at"`
+}
+
+var atomVersionRe = regexp.MustCompile(`const VERSION = '([^']+)'`)
+
+// writeInfo records what the archive was built from, right after the
+// manifest. BuiltAt comes from SOURCE_DATE_EPOCH or the commit time rather
+// than the clock, so the archive stays reproducible.
+func writeInfo(tw entryWriter, src string, info archiveInfo) error {
+	if info.Commit == "" {
+		info.Commit = gitOutput(src, "rev-parse", "HEAD")
+	}
+	if info.AtomVersion == "" {
+		if php, err := os.ReadFile(filepath.Join(src, "apps/qubit/lib/qubitConfiguration.class.php")); err == nil {
+			if m := atomVersionRe.FindSubmatch(php); m != nil {
+				info.AtomVersion = string(m[1])
+			}
+		}
+	}
+	epoch := os.Getenv("SOURCE_DATE_EPOCH")
+	if epoch == "" {
+		epoch = gitOutput(src, "log", "-1", "--format=%ct")
+	}
+	if secs, err := strconv.ParseInt(epoch, 10, 64); err == nil {
+		info.BuiltAt = time.Unix(secs, 0).UTC()
+	}
+
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     infoFile,
+		Mode:     0644,
+		Size:     int64(len(data)),
+		ModTime:  time.Unix(0, 0),
+		Typeflag: tar.TypeReg,
+	}); err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
+
+func gitOutput(dir string, args ...string) string {
+	out, err := exec.Command("git", append([]string{"-C", dir}, args...)...).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
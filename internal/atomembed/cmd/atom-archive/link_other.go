@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "io/fs"
+
+type fileID struct{}
+
+func hardLinkID(fs.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
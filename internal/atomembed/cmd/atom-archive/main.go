@@ -2,7 +2,8 @@ package main
 
 import (
 	"archive/tar"
-	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"io"
@@ -14,24 +15,66 @@ import (
 )
 
 type config struct {
-	src string
-	dst string
+	src         string
+	dst         string
+	filter      pathFilter
+	verify      bool
+	manifestOut string
+	info        archiveInfo
+	vendorDst   string
+	vendorDirs  []string
+	format      string
 }
 
 func main() {
-	cfg := parseFlags()
-	if err := buildArchive(cfg); err != nil {
+	cfg, err := parseFlags()
+	if err == nil {
+		err = buildArchive(cfg)
+	}
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "atom-archive: %v\n", err)
 		os.Exit(1)
 	}
 }
 
-func parseFlags() config {
+func parseFlags() (config, error) {
 	cfg := config{}
+	var excludes, includes, vendorDirs stringList
 	flag.StringVar(&cfg.src, "src", "./atom", "path to atom source directory")
 	flag.StringVar(&cfg.dst, "dst", "./internal/atomembed/atom.tar.gz", "path to output tar.gz")
+	flag.Var(&excludes, "exclude", "glob of paths to leave out (repeatable)")
+	flag.Var(&includes, "include", "glob of paths to keep even if excluded (repeatable)")
+	excludeFrom := flag.String("exclude-from", "", "file of exclude globs, one per line")
+	flag.StringVar(&cfg.info.Commit, "commit", "", "AtoM git commit to record (default: git rev-parse HEAD in src)")
+	flag.StringVar(&cfg.info.AtomVersion, "atom-version", "", "AtoM version to record (default: read from src)")
+	flag.StringVar(&cfg.vendorDst, "vendor-dst", "", "write the --vendor-dir trees to this separate tar.gz layer")
+	flag.Var(&vendorDirs, "vendor-dir", "directory that goes in the vendor layer (repeatable, default vendor)")
+	flag.StringVar(&cfg.format, "format", "tar.gz", "archive format: tar.gz or zip")
+	flag.BoolVar(&cfg.verify, "verify", false, "rebuild in memory and check that dst is identical instead of writing it")
+	flag.StringVar(&cfg.manifestOut, "manifest", "", "also write the content manifest to this file")
+	noDefaults := flag.Bool("no-default-excludes", false, "do not exclude .git, cache, log and uploads")
 	flag.Parse()
-	return cfg
+
+	if cfg.format != "tar.gz" && cfg.format != "zip" {
+		return cfg, fmt.Errorf("unsupported format %q (want tar.gz or zip)", cfg.format)
+	}
+	if !*noDefaults {
+		cfg.filter.excludes = defaultExcludes()
+	}
+	if *excludeFrom != "" {
+		patterns, err := readPatterns(*excludeFrom)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.filter.excludes = append(cfg.filter.excludes, patterns...)
+	}
+	cfg.filter.excludes = append(cfg.filter.excludes, excludes...)
+	cfg.filter.includes = includes
+	cfg.vendorDirs = vendorDirs
+	if len(cfg.vendorDirs) == 0 {
+		cfg.vendorDirs = []string{"vendor"}
+	}
+	return cfg, nil
 }
 
 func buildArchive(cfg config) error {
@@ -47,29 +90,124 @@ func buildArchive(cfg config) error {
 		return fmt.Errorf("source is not a directory: %s", srcAbs)
 	}
 
-	if err := os.MkdirAll(filepath.Dir(cfg.dst), 0755); err != nil {
-		return err
+	var manifest []byte
+	for _, l := range cfg.layers() {
+		var m []byte
+		if cfg.verify {
+			m, err = verifyArchive(l, srcAbs)
+		} else {
+			m, err = createArchive(l, srcAbs)
+		}
+		if err != nil {
+			return err
+		}
+		manifest = append(manifest, m...)
+	}
+	if cfg.manifestOut != "" {
+		return os.WriteFile(cfg.manifestOut, manifest, 0644)
 	}
+	return nil
+}
+
+// layer is one output archive. The vendor layer has its own manifest
+// entry and no build metadata, so it stays byte-identical across AtoM
+// changes that leave vendor alone.
+type layer struct {
+	dst      string
+	filter   pathFilter
+	manifest string
+	info     *archiveInfo
+	format   string
+}
 
-	out, err := os.Create(cfg.dst)
+func (cfg config) layers() []layer {
+	if cfg.vendorDst == "" {
+		return []layer{{dst: cfg.dst, filter: cfg.filter, manifest: manifestFile, info: &cfg.info, format: cfg.format}}
+	}
+	return []layer{
+		{dst: cfg.vendorDst, filter: cfg.filter.layer(cfg.vendorDirs, true), manifest: vendorManifestFile, format: cfg.format},
+		{dst: cfg.dst, filter: cfg.filter.layer(cfg.vendorDirs, false), manifest: manifestFile, info: &cfg.info, format: cfg.format},
+	}
+}
+
+func createArchive(l layer, src string) ([]byte, error) {
+	if err := os.MkdirAll(filepath.Dir(l.dst), 0755); err != nil {
+		return nil, err
+	}
+	out, err := os.Create(l.dst)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	manifest, err := writeArchive(out, src, l)
+	if err != nil {
+		_ = out.Close()
+		return nil, err
 	}
-	defer out.Close()
+	return manifest, out.Close()
+}
 
-	gz := gzip.NewWriter(out)
-	defer gz.Close()
+// verifyArchive rebuilds the archive in memory and checks that it is
+// byte-identical to l.dst.
+func verifyArchive(l layer, src string) ([]byte, error) {
+	existing, err := os.ReadFile(l.dst)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	manifest, err := writeArchive(h, src, l)
+	if err != nil {
+		return nil, err
+	}
+	want := sha256.Sum256(existing)
+	got := hex.EncodeToString(h.Sum(nil))
+	if got != hex.EncodeToString(want[:]) {
+		return nil, fmt.Errorf("%s does not match %s: rebuilt %s, existing %s", l.dst, src, got, hex.EncodeToString(want[:]))
+	}
+	fmt.Printf("%s  %s\n", got, l.dst)
+	return manifest, nil
+}
 
-	tw := tar.NewWriter(gz)
-	defer tw.Close()
+// writeArchive writes the tar.gz or zip of src to w and returns its
+// manifest. The output depends only on the file tree: entries are in
+// lexical order with zeroed times and owners and normalized modes, so
+// rebuilding from the same commit with the same Go version gives the same
+// bytes.
+func writeArchive(w io.Writer, src string, l layer) ([]byte, error) {
+	tw := newEntryWriter(w, l.format)
+	filter := l.filter
 
-	excludes := defaultExcludes()
+	// The manifest goes first so valence can read it without inflating
+	// the whole archive.
+	manifest, err := buildManifest(src, filter)
+	if err != nil {
+		return nil, err
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     l.manifest,
+		Mode:     0644,
+		Size:     int64(len(manifest)),
+		ModTime:  time.Unix(0, 0),
+		Typeflag: tar.TypeReg,
+	}); err != nil {
+		return nil, err
+	}
+	if _, err := tw.Write(manifest); err != nil {
+		return nil, err
+	}
+	if l.info != nil {
+		if err := writeInfo(tw, src, *l.info); err != nil {
+			return nil, err
+		}
+	}
+
+	// Hard-linked files are stored once and linked to on extraction.
+	linked := map[fileID]string{}
 
 	walkFn := func(path string, d fs.DirEntry, walkErr error) error {
 		if walkErr != nil {
 			return walkErr
 		}
-		rel, err := filepath.Rel(srcAbs, path)
+		rel, err := filepath.Rel(src, path)
 		if err != nil {
 			return err
 		}
@@ -78,7 +216,10 @@ func buildArchive(cfg config) error {
 		}
 
 		relSlash := filepath.ToSlash(rel)
-		if shouldExclude(relSlash, excludes) {
+		if filter.excluded(relSlash) {
+			if d.IsDir() && filter.mayInclude(relSlash) {
+				return nil
+			}
 			if d.IsDir() {
 				return fs.SkipDir
 			}
@@ -103,15 +244,27 @@ func buildArchive(cfg config) error {
 			return err
 		}
 		hdr.Name = relSlash
+		if id, ok := hardLinkID(info); ok && l.format != "zip" {
+			if first, seen := linked[id]; seen {
+				hdr.Typeflag = tar.TypeLink
+				hdr.Linkname = first
+				hdr.Size = 0
+			} else {
+				linked[id] = relSlash
+			}
+		}
+		hdr.Mode = normalizedMode(info.Mode())
+		hdr.Uid, hdr.Gid = 0, 0
+		hdr.Uname, hdr.Gname = "", ""
 		hdr.ModTime = time.Unix(0, 0)
-		hdr.AccessTime = time.Unix(0, 0)
-		hdr.ChangeTime = time.Unix(0, 0)
+		hdr.AccessTime = time.Time{}
+		hdr.ChangeTime = time.Time{}
 
 		if err := tw.WriteHeader(hdr); err != nil {
 			return err
 		}
 
-		if info.Mode().IsRegular() {
+		if hdr.Typeflag == tar.TypeReg {
 			file, err := os.Open(path)
 			if err != nil {
 				return err
@@ -126,29 +279,84 @@ func buildArchive(cfg config) error {
 		return nil
 	}
 
-	return filepath.WalkDir(srcAbs, walkFn)
+	if err := filepath.WalkDir(src, walkFn); err != nil {
+		return nil, err
+	}
+	return manifest, tw.Close()
 }
 
-func defaultExcludes() []string {
-	return []string{
-		".git",
-		"cache",
-		"log",
-		"uploads",
-		"web/uploads",
+// normalizedMode keeps only whether a file is executable.
+func normalizedMode(mode fs.FileMode) int64 {
+	switch {
+	case mode&fs.ModeSymlink != 0:
+		return 0777
+	case mode.IsDir(), mode&0111 != 0:
+		return 0755
+	default:
+		return 0644
 	}
 }
 
-func shouldExclude(rel string, excludes []string) bool {
-	clean := strings.TrimSuffix(rel, "/")
-	for _, exclude := range excludes {
-		ex := strings.TrimSuffix(exclude, "/")
-		if clean == ex {
-			return true
+// manifestFile and vendorManifestFile match atomembed's manifest entry
+// names.
+const (
+	manifestFile       = ".valence-manifest"
+	vendorManifestFile = ".valence-vendor-manifest"
+)
+
+// buildManifest lists the SHA-256 of every regular file under src, one
+// "<hex>  <path>" line each in sha256sum format, in walk order.
+func buildManifest(src string, filter pathFilter) ([]byte, error) {
+	var lines []string
+	err := filepath.WalkDir(src, func(path string, d fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		relSlash := filepath.ToSlash(rel)
+		if filter.excluded(relSlash) {
+			if d.IsDir() && filter.mayInclude(relSlash) {
+				return nil
+			}
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
 		}
-		if strings.HasPrefix(clean, ex+"/") {
-			return true
+		defer file.Close()
+		h := sha256.New()
+		if _, err := io.Copy(h, file); err != nil {
+			return err
 		}
+		lines = append(lines, hex.EncodeToString(h.Sum(nil))+"  "+relSlash+"\n")
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return []byte(strings.Join(lines, "")), nil
+}
+
+func defaultExcludes() []string {
+	return []string{
+		"/.git",
+		"/cache",
+		"/log",
+		"/uploads",
+		"/web/uploads",
 	}
-	return false
 }
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// entryWriter is the part of tar.Writer writeArchive uses, so the same
+// walk can produce a tar.gz or a zip.
+type entryWriter interface {
+	WriteHeader(hdr *tar.Header) error
+	io.Writer
+	Close() error
+}
+
+func newEntryWriter(w io.Writer, format string) entryWriter {
+	if format == "zip" {
+		return &zipWriter{zw: zip.NewWriter(w)}
+	}
+	gz := gzip.NewWriter(w)
+	return &tarGzWriter{Writer: tar.NewWriter(gz), gz: gz}
+}
+
+type tarGzWriter struct {
+	*tar.Writer
+	gz *gzip.Writer
+}
+
+func (w *tarGzWriter) Close() error {
+	if err := w.Writer.Close(); err != nil {
+		return err
+	}
+	return w.gz.Close()
+}
+
+// zipWriter stores tar headers as zip entries. Modes, including the
+// symlink bit, go in the Unix external attributes as Info-ZIP does, and a
+// symlink's target is its content. Zip has no hard links, so writeArchive
+// stores hard-linked files as copies.
+type zipWriter struct {
+	zw  *zip.Writer
+	cur io.Writer
+}
+
+func (w *zipWriter) WriteHeader(hdr *tar.Header) error {
+	// Modified is left zero so the output stays reproducible.
+	fh := &zip.FileHeader{Name: hdr.Name, Method: zip.Deflate}
+	fh.SetMode(hdr.FileInfo().Mode())
+
+	var err error
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		fh.Name += "/"
+		fh.Method = zip.Store
+		w.cur, err = w.zw.CreateHeader(fh)
+	case tar.TypeSymlink:
+		fh.Method = zip.Store
+		if w.cur, err = w.zw.CreateHeader(fh); err == nil {
+			_, err = io.WriteString(w.cur, hdr.Linkname)
+		}
+	case tar.TypeReg:
+		w.cur, err = w.zw.CreateHeader(fh)
+	default:
+		return fmt.Errorf("%s: entry type %q cannot be stored in a zip", hdr.Name, hdr.Typeflag)
+	}
+	return err
+}
+
+func (w *zipWriter) Write(p []byte) (int, error) {
+	return w.cur.Write(p)
+}
+
+func (w *zipWriter) Close() error {
+	return w.zw.Close()
+}
@@ -2,19 +2,18 @@ package atomembed
 
 import (
 	"archive/tar"
-	"bytes"
-	"compress/gzip"
 	"crypto/sha256"
 	_ "embed"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"strings"
 )
 
-//go:generate go run ./cmd/atom-archive --src ../../atom --dst atom.tar.gz
+//go:generate go run ./cmd/atom-archive --src ../../atom --dst atom.tar.gz --vendor-dst vendor.tar.gz
 
 //go:embed atom.tar.gz
 var archiveData []byte
@@ -27,8 +26,14 @@ func ArchiveAvailable() bool {
 	return len(archiveData) > 0
 }
 
+// ArchiveHash identifies the loaded archive: the SHA-256 of the
+// application layer, or of both layer hashes when there is a vendor layer.
 func ArchiveHash() string {
 	sum := sha256.Sum256(archiveData)
+	if len(vendorData) > 0 {
+		vendor := sha256.Sum256(vendorData)
+		sum = sha256.Sum256(append(sum[:], vendor[:]...))
+	}
 	return hex.EncodeToString(sum[:])
 }
 
@@ -36,6 +41,7 @@ func EnsureExtracted(target string, force bool) (bool, error) {
 	if strings.TrimSpace(target) == "" {
 		return false, errors.New("atom root path is empty")
 	}
+	removeStaleStaging(target)
 
 	info, err := os.Stat(target)
 	if err == nil {
@@ -47,28 +53,171 @@ func EnsureExtracted(target string, force bool) (bool, error) {
 			return false, nil
 		}
 
-		if force {
-			if err := os.RemoveAll(target); err != nil {
+		if exists(filepath.Join(target, extractingFile)) {
+			// An in-place extraction was interrupted; nothing there is ours
+			// to keep.
+			force = true
+		}
+		if force || dirEmpty(target) {
+			return true, install(target, true)
+		}
+		if previous, err := readManifestFile(target, manifestFile); err == nil {
+			if err := update(target, previous); err != nil {
 				return false, err
 			}
-		} else if dirEmpty(target) {
-			// ok to proceed
-		} else {
-			return false, ErrAtomRootExists
+			return true, writeMarker(target)
 		}
+		return false, ErrAtomRootExists
 	} else if !errors.Is(err, os.ErrNotExist) {
 		return false, err
 	}
 
-	if err := extractArchive(target); err != nil {
-		return false, err
+	return true, install(target, false)
+}
+
+// extractingFile marks an atom root being extracted in place, when it
+// cannot be swapped in by rename (e.g. it is a mount point).
+const extractingFile = ".valence-extracting"
+
+// install extracts the archive into a staging directory next to target and
+// renames it into place, so target is never seen half-populated. With
+// replace, the existing target is swapped out and removed afterwards.
+func install(target string, replace bool) error {
+	parent, base := filepath.Split(filepath.Clean(target))
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return err
+	}
+	staging, err := os.MkdirTemp(parent, "."+base+".extract-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+	if err := os.Chmod(staging, 0755); err != nil {
+		return err
+	}
+	if err := applyOwnership(staging, 0755, false); err != nil {
+		return err
+	}
+	if err := extractLayers(staging); err != nil {
+		return err
+	}
+	if err := writeMarker(staging); err != nil {
+		return err
+	}
+
+	if !replace {
+		return os.Rename(staging, target)
 	}
+	old := staging + ".old"
+	if err := os.Rename(target, old); err != nil {
+		// Mount points cannot be renamed; fall back to extracting in place.
+		return installInPlace(target)
+	}
+	if err := os.Rename(staging, target); err != nil {
+		return errors.Join(err, os.Rename(old, target))
+	}
+	return os.RemoveAll(old)
+}
 
-	if err := os.WriteFile(filepath.Join(target, markerFile), []byte(ArchiveHash()), 0644); err != nil {
-		return true, err
+// installInPlace empties target and extracts into it, flagging the root
+// with extractingFile until the marker is written.
+func installInPlace(target string) error {
+	entries, err := os.ReadDir(target)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(target, entry.Name())); err != nil {
+			return err
+		}
+	}
+	sentinel := filepath.Join(target, extractingFile)
+	if err := os.WriteFile(sentinel, nil, 0644); err != nil {
+		return err
 	}
+	if err := extractLayers(target); err != nil {
+		return err
+	}
+	if err := writeMarker(target); err != nil {
+		return err
+	}
+	return os.Remove(sentinel)
+}
 
-	return true, nil
+// removeStaleStaging clears staging directories left by a crash.
+func removeStaleStaging(target string) {
+	parent, base := filepath.Split(filepath.Clean(target))
+	matches, _ := filepath.Glob(filepath.Join(parent, "."+base+".extract-*"))
+	for _, match := range matches {
+		_ = os.RemoveAll(match)
+	}
+}
+
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+func writeMarker(target string) error {
+	if err := writeVendorMarker(target); err != nil {
+		return err
+	}
+	marker := filepath.Join(target, markerFile)
+	if err := os.WriteFile(marker, []byte(ArchiveHash()), 0644); err != nil {
+		return err
+	}
+	return applyOwnership(marker, 0644, false)
+}
+
+// extractHardLink links dstPath to the already extracted linkname, copying
+// it instead when the filesystem refuses hard links.
+func extractHardLink(target, dstPath, linkname string) error {
+	cleanLink := filepath.Clean(linkname)
+	if strings.HasPrefix(cleanLink, "..") || filepath.IsAbs(cleanLink) {
+		return errors.New("archive contains invalid hard link")
+	}
+	src := filepath.Join(target, cleanLink)
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
+		return err
+	}
+	if err := os.Remove(dstPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := os.Link(src, dstPath); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dstPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return applyOwnership(dstPath, info.Mode().Perm(), false)
+}
+
+// InstalledHash returns the hash of the archive last extracted to target,
+// or "" if none was.
+func InstalledHash(target string) string {
+	contents, err := os.ReadFile(filepath.Join(target, markerFile))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(contents))
 }
 
 func markerMatches(target string) bool {
@@ -87,8 +236,10 @@ func dirEmpty(target string) bool {
 	return len(entries) == 0
 }
 
-func extractArchive(target string) error {
-	if !ArchiveAvailable() {
+// extractArchive writes the archive layer data under target. Regular
+// files for which skip returns true are left as they are.
+func extractArchive(target string, data []byte, skip func(name string) bool) error {
+	if len(data) == 0 {
 		return errors.New("embedded atom archive not available")
 	}
 
@@ -96,14 +247,12 @@ func extractArchive(target string) error {
 		return err
 	}
 
-	reader := bytes.NewReader(archiveData)
-	gz, err := gzip.NewReader(reader)
+	tr, err := openArchive(data)
 	if err != nil {
 		return err
 	}
-	defer gz.Close()
+	defer tr.Close()
 
-	tr := tar.NewReader(gz)
 	for {
 		hdr, err := tr.Next()
 		if errors.Is(err, io.EOF) {
@@ -129,6 +278,9 @@ func extractArchive(target string) error {
 			if err := os.MkdirAll(dstPath, hdr.FileInfo().Mode().Perm()); err != nil {
 				return err
 			}
+			if err := applyOwnership(dstPath, hdr.FileInfo().Mode().Perm(), false); err != nil {
+				return err
+			}
 		case tar.TypeSymlink:
 			if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
 				return err
@@ -136,7 +288,13 @@ func extractArchive(target string) error {
 			if err := os.Symlink(hdr.Linkname, dstPath); err != nil && !errors.Is(err, os.ErrExist) {
 				return err
 			}
+			if err := applyOwnership(dstPath, 0, true); err != nil {
+				return err
+			}
 		case tar.TypeReg, tar.TypeRegA:
+			if skip != nil && skip(filepath.ToSlash(cleanName)) {
+				continue
+			}
 			if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
 				return err
 			}
@@ -151,8 +309,21 @@ func extractArchive(target string) error {
 			if err := out.Close(); err != nil {
 				return err
 			}
+			if err := applyOwnership(dstPath, hdr.FileInfo().Mode().Perm(), false); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			if skip != nil && skip(filepath.ToSlash(cleanName)) {
+				continue
+			}
+			if err := extractHardLink(target, dstPath, hdr.Linkname); err != nil {
+				return err
+			}
+		case tar.TypeXGlobalHeader:
+			// PAX global headers carry no file; per-file PAX records and
+			// GNU long names are already folded into hdr by tar.Reader.
 		default:
-			// skip other file types
+			return fmt.Errorf("archive entry %s has unsupported type %q", hdr.Name, hdr.Typeflag)
 		}
 	}
 
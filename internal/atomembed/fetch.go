@@ -0,0 +1,239 @@
+package atomembed
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/artefactual-labs/valence/internal/awssig"
+)
+
+// FetchOptions describe a remote AtoM archive. At least one of SHA256 and
+// PublicKey must be set; an unverified archive is never used.
+type FetchOptions struct {
+	// URL is https://... (including presigned S3 URLs) or s3://bucket/key.
+	URL string
+	// SHA256 is the expected hex digest of the archive.
+	SHA256 string
+	// PublicKey verifies an ed25519 signature of the archive fetched from
+	// SignatureURL, which defaults to URL + ".sig".
+	PublicKey    ed25519.PublicKey
+	SignatureURL string
+
+	// S3 settings for s3:// URLs. Endpoint, when set, is used path-style
+	// (e.g. MinIO).
+	AWS        awssig.Credentials
+	AWSRegion  string
+	S3Endpoint string
+
+	// CacheDir, when set along with SHA256, keeps verified downloads so an
+	// unchanged archive (typically the vendor layer) is not fetched again.
+	CacheDir string
+
+	Client *http.Client
+}
+
+// maxArchiveSize bounds a download held in memory.
+const maxArchiveSize = 2 << 30
+
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// Fetch downloads and verifies the archive described by opts.
+func Fetch(ctx context.Context, opts FetchOptions) ([]byte, error) {
+	if opts.SHA256 == "" && opts.PublicKey == nil {
+		return nil, errors.New("remote archive needs a checksum or a public key to verify it")
+	}
+	if data, ok := readCached(opts); ok {
+		return data, nil
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: 10 * time.Minute}
+	}
+
+	data, err := download(ctx, opts, opts.URL)
+	if err != nil {
+		return nil, fmt.Errorf("download %s: %w", opts.URL, err)
+	}
+	if opts.SHA256 != "" {
+		sum := sha256.Sum256(data)
+		if got := hex.EncodeToString(sum[:]); !strings.EqualFold(got, opts.SHA256) {
+			return nil, fmt.Errorf("archive checksum mismatch: got %s, want %s", got, opts.SHA256)
+		}
+	}
+	if opts.PublicKey != nil {
+		sigURL := opts.SignatureURL
+		if sigURL == "" {
+			sigURL = opts.URL + ".sig"
+		}
+		sig, err := download(ctx, opts, sigURL)
+		if err != nil {
+			return nil, fmt.Errorf("download signature %s: %w", sigURL, err)
+		}
+		if !ed25519.Verify(opts.PublicKey, data, decodeSignature(sig)) {
+			return nil, errors.New("archive signature does not verify")
+		}
+	}
+	if bytes.HasPrefix(data, zstdMagic) {
+		return nil, errors.New("zstd-compressed archives are not supported; use tar.gz or zip")
+	}
+	writeCached(opts, data)
+	return data, nil
+}
+
+func cachePath(opts FetchOptions) string {
+	if opts.CacheDir == "" || opts.SHA256 == "" {
+		return ""
+	}
+	return filepath.Join(opts.CacheDir, strings.ToLower(opts.SHA256)+".tar.gz")
+}
+
+// readCached returns a cached copy of the archive if its checksum still
+// matches.
+func readCached(opts FetchOptions) ([]byte, bool) {
+	path := cachePath(opts)
+	if path == "" {
+		return nil, false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	sum := sha256.Sum256(data)
+	if !strings.EqualFold(hex.EncodeToString(sum[:]), opts.SHA256) {
+		_ = os.Remove(path)
+		return nil, false
+	}
+	return data, true
+}
+
+// writeCached stores a verified archive. The cache is an optimization, so
+// failures are ignored.
+func writeCached(opts FetchOptions, data []byte) {
+	path := cachePath(opts)
+	if path == "" {
+		return
+	}
+	if err := os.MkdirAll(opts.CacheDir, 0755); err != nil {
+		return
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		_ = os.Remove(tmp)
+		return
+	}
+	_ = os.Rename(tmp, path)
+}
+
+// UseArchive replaces the embedded archive with data, e.g. one returned by
+// Fetch. It must be called before EnsureExtracted.
+func UseArchive(data []byte) {
+	archiveData = data
+}
+
+func download(ctx context.Context, opts FetchOptions, rawURL string) ([]byte, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	var req *http.Request
+	switch u.Scheme {
+	case "https":
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	case "s3":
+		req, err = s3Request(ctx, opts, u)
+	default:
+		return nil, fmt.Errorf("unsupported archive URL scheme %q (want https or s3)", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := opts.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxArchiveSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxArchiveSize {
+		return nil, errors.New("archive too large")
+	}
+	return data, nil
+}
+
+func s3Request(ctx context.Context, opts FetchOptions, u *url.URL) (*http.Request, error) {
+	if opts.AWSRegion == "" || opts.AWS.AccessKey == "" || opts.AWS.SecretKey == "" {
+		return nil, errors.New("s3 URLs need AWS_REGION, AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	bucket, key := u.Host, strings.TrimPrefix(u.Path, "/")
+	target := &url.URL{Scheme: "https", Host: bucket + ".s3." + opts.AWSRegion + ".amazonaws.com", Path: "/" + key}
+	if opts.S3Endpoint != "" {
+		endpoint, err := url.Parse(opts.S3Endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("parse s3 endpoint: %w", err)
+		}
+		target = endpoint.JoinPath(bucket, key)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	awssig.Sign(req, opts.AWS, opts.AWSRegion, "s3", awssig.UnsignedPayload, time.Now())
+	return req, nil
+}
+
+// decodeSignature accepts a raw or base64-encoded signature.
+func decodeSignature(sig []byte) []byte {
+	if len(sig) == ed25519.SignatureSize {
+		return sig
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+	if err != nil {
+		return sig
+	}
+	return decoded
+}
+
+// ParsePublicKey accepts an ed25519 public key as PEM (PKIX) or as the
+// base64 of its 32 raw bytes.
+func ParsePublicKey(value string) (ed25519.PublicKey, error) {
+	if block, _ := pem.Decode([]byte(value)); block != nil {
+		parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := parsed.(ed25519.PublicKey)
+		if !ok {
+			return nil, errors.New("public key is not ed25519")
+		}
+		return key, nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+	if err != nil {
+		return nil, fmt.Errorf("decode public key: %w", err)
+	}
+	if len(raw) != ed25519.PublicKeySize {
+		return nil, errors.New("public key is not ed25519")
+	}
+	return ed25519.PublicKey(raw), nil
+}
@@ -0,0 +1,118 @@
+package atomembed
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/fs"
+)
+
+var zipMagic = []byte("PK\x03\x04")
+
+// archiveReader walks the entries of an archive layer, tar.gz or zip, as
+// tar headers.
+type archiveReader interface {
+	Next() (*tar.Header, error)
+	io.Reader
+	Close() error
+}
+
+func openArchive(data []byte) (archiveReader, error) {
+	if bytes.HasPrefix(data, zipMagic) {
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return nil, err
+		}
+		return &zipReader{files: zr.File}, nil
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return &tarGzReader{Reader: tar.NewReader(gz), gz: gz}, nil
+}
+
+type tarGzReader struct {
+	*tar.Reader
+	gz *gzip.Reader
+}
+
+func (r *tarGzReader) Close() error {
+	return r.gz.Close()
+}
+
+// zipReader maps zip entries written by atom-archive --format=zip: modes
+// come from the Unix external attributes and a symlink's content is its
+// target.
+type zipReader struct {
+	files []*zip.File
+	cur   io.ReadCloser
+}
+
+func (r *zipReader) Next() (*tar.Header, error) {
+	if r.cur != nil {
+		_ = r.cur.Close()
+		r.cur = nil
+	}
+	if len(r.files) == 0 {
+		return nil, io.EOF
+	}
+	f := r.files[0]
+	r.files = r.files[1:]
+
+	mode := f.Mode()
+	hdr := &tar.Header{
+		Name: f.Name,
+		Mode: int64(mode.Perm()),
+	}
+	switch {
+	case mode.IsDir():
+		hdr.Typeflag = tar.TypeDir
+		return hdr, nil
+	case mode&fs.ModeSymlink != 0:
+		hdr.Typeflag = tar.TypeSymlink
+		target, err := readZipFile(f)
+		if err != nil {
+			return nil, err
+		}
+		hdr.Linkname = string(target)
+		return hdr, nil
+	case mode.IsRegular():
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = int64(f.UncompressedSize64)
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		r.cur = rc
+		return hdr, nil
+	default:
+		return nil, errors.New("zip entry " + f.Name + " has an unsupported mode")
+	}
+}
+
+func (r *zipReader) Read(p []byte) (int, error) {
+	if r.cur == nil {
+		return 0, io.EOF
+	}
+	return r.cur.Read(p)
+}
+
+func (r *zipReader) Close() error {
+	if r.cur != nil {
+		return r.cur.Close()
+	}
+	return nil
+}
+
+func readZipFile(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
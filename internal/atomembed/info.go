@@ -0,0 +1,61 @@
+package atomembed
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+)
+
+// infoFile follows the manifest at the start of the archive.
+const infoFile = ".valence-atom.json"
+
+// ArchiveInfo describes what the loaded archive was built from.
+type ArchiveInfo struct {
+	Commit      string    `json:"commit,omitempty"`
+	AtomVersion string    `json:"atom_version,omitempty"`
+	BuiltAt     time.Time `json:"built_at"`
+	SHA256      string    `json:"sha256"`
+	// VendorSHA256 is set when the archive has a separate vendor layer.
+	VendorSHA256 string `json:"vendor_sha256,omitempty"`
+}
+
+// Info reads the metadata atom-archive recorded in the loaded archive.
+// Archives built before it did so report only their hash.
+func Info() (ArchiveInfo, error) {
+	info := ArchiveInfo{SHA256: ArchiveHash(), VendorSHA256: VendorHash()}
+	if !ArchiveAvailable() {
+		return info, errors.New("embedded atom archive not available")
+	}
+	tr, err := openArchive(archiveData)
+	if err != nil {
+		return info, err
+	}
+	defer tr.Close()
+
+	for range 2 {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return info, err
+		}
+		if hdr.Name != infoFile {
+			continue
+		}
+		if err := json.NewDecoder(tr).Decode(&info); err != nil {
+			return info, err
+		}
+		info.SHA256 = ArchiveHash()
+		break
+	}
+	return info, nil
+}
+
+// AtomVersion returns the AtoM version recorded in the loaded archive, or
+// "" when it has none.
+func AtomVersion() string {
+	info, _ := Info()
+	return info.AtomVersion
+}
@@ -0,0 +1,73 @@
+package atomembed
+
+import (
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// The archive may be split in two layers built by atom-archive
+// --vendor-dst: a vendor layer holding third-party code, which rarely
+// changes, and the application layer. Each layer carries its own manifest,
+// and the vendor layer is recorded in the atom root by its own marker, so
+// updating to an archive with the same vendor layer does not read it.
+
+// vendorData is empty when the archive is not layered.
+//
+//go:embed vendor.tar.gz
+var vendorData []byte
+
+const (
+	vendorManifestFile = ".valence-vendor-manifest"
+	vendorMarkerFile   = ".valence-vendor-version"
+)
+
+// UseVendorArchive replaces the embedded vendor layer with data, e.g. one
+// returned by Fetch. It must be called before EnsureExtracted.
+func UseVendorArchive(data []byte) {
+	vendorData = data
+}
+
+// VendorHash returns the SHA-256 of the vendor layer, or "" when the
+// archive has none.
+func VendorHash() string {
+	if len(vendorData) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(vendorData)
+	return hex.EncodeToString(sum[:])
+}
+
+// extractLayers writes the vendor layer, if any, then the application
+// layer under target.
+func extractLayers(target string) error {
+	if !ArchiveAvailable() {
+		return errors.New("embedded atom archive not available")
+	}
+	if len(vendorData) > 0 {
+		if err := extractArchive(target, vendorData, nil); err != nil {
+			return err
+		}
+	}
+	return extractArchive(target, archiveData, nil)
+}
+
+// writeVendorMarker records the vendor layer extracted to target, or
+// removes the record when the archive has no vendor layer.
+func writeVendorMarker(target string) error {
+	marker := filepath.Join(target, vendorMarkerFile)
+	hash := VendorHash()
+	if hash == "" {
+		if err := os.Remove(marker); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	if err := os.WriteFile(marker, []byte(hash), 0644); err != nil {
+		return err
+	}
+	return applyOwnership(marker, 0644, false)
+}
@@ -0,0 +1,30 @@
+package atomembed
+
+import "os"
+
+// ownership is applied to everything extracted. UID and GID -1 keep the
+// extracting user; a nil umask keeps the archive's modes as filtered by the
+// process umask.
+var ownership = struct {
+	uid, gid int
+	umask    *os.FileMode
+}{uid: -1, gid: -1}
+
+// SetOwnership makes extraction chown entries to uid:gid (-1 leaves either
+// unchanged) and set their modes to the archive's mode minus umask. Call it
+// before EnsureExtracted.
+func SetOwnership(uid, gid int, umask *os.FileMode) {
+	ownership.uid, ownership.gid, ownership.umask = uid, gid, umask
+}
+
+func applyOwnership(path string, mode os.FileMode, symlink bool) error {
+	if ownership.umask != nil && !symlink {
+		if err := os.Chmod(path, mode&^*ownership.umask); err != nil {
+			return err
+		}
+	}
+	if ownership.uid >= 0 || ownership.gid >= 0 {
+		return os.Lchown(path, ownership.uid, ownership.gid)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package atomembed
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// update upgrades root in place from the archive it was extracted from,
+// described by previous, to the embedded one. Only files whose contents
+// changed between the two are rewritten, files dropped from the archive are
+// removed unless edited locally, and files neither archive knows about
+// (custom plugins and themes) are left alone. A vendor layer that matches
+// the one recorded in root is not read at all.
+func update(root string, previous map[string]string) error {
+	if readName(root, vendorMarkerFile) != VendorHash() {
+		// A missing vendor manifest means root had no vendor layer; every
+		// vendor file is then written.
+		previousVendor, err := readManifestFile(root, vendorManifestFile)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if err := updateLayer(root, vendorData, vendorManifestFile, previousVendor); err != nil {
+			return err
+		}
+	}
+	return updateLayer(root, archiveData, manifestFile, previous)
+}
+
+// updateLayer brings the files of one archive layer, whose manifest entry
+// is manifestName, up to date. An empty layer removes what the previous
+// one installed.
+func updateLayer(root string, data []byte, manifestName string, previous map[string]string) error {
+	next, err := layerManifest(data, manifestName)
+	if err != nil {
+		return err
+	}
+
+	// The manifest is replaced last so an interrupted update is retried
+	// against the old one.
+	unchanged := func(name string) bool {
+		if name == manifestName {
+			return true
+		}
+		if previous[name] == "" || previous[name] != next[name] {
+			return false
+		}
+		_, err := os.Lstat(filepath.Join(root, filepath.FromSlash(name)))
+		return err == nil
+	}
+	if len(data) > 0 {
+		if err := extractArchive(root, data, unchanged); err != nil {
+			return err
+		}
+	}
+
+	for name, sum := range previous {
+		if _, ok := next[name]; ok {
+			continue
+		}
+		path := filepath.Join(root, filepath.FromSlash(name))
+		current, err := fileSHA256(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if current != sum {
+			continue
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if len(data) == 0 {
+		err := os.Remove(filepath.Join(root, manifestName))
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	return writeManifestFile(root, manifestName, next)
+}
+
+func writeManifestFile(root, name string, manifest map[string]string) error {
+	var buf bytes.Buffer
+	for _, name := range slices.Sorted(maps.Keys(manifest)) {
+		fmt.Fprintf(&buf, "%s  %s\n", manifest[name], name)
+	}
+	path := filepath.Join(root, name)
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return applyOwnership(path, 0644, false)
+}
@@ -0,0 +1,193 @@
+package atomembed
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// manifestFile is the archive's first entry, written by atom-archive.
+const manifestFile = ".valence-manifest"
+
+var ErrNoManifest = errors.New("embedded atom archive has no manifest")
+
+// DefaultAuditIgnores are paths atom-archive leaves out or that exist only
+// at runtime.
+var DefaultAuditIgnores = []string{".git", "cache", "log", "uploads", "web/uploads", markerFile, manifestFile, infoFile, vendorMarkerFile, vendorManifestFile}
+
+// AuditReport lists how an extracted atom root differs from the archive.
+// Paths are slash-separated and relative to the root.
+type AuditReport struct {
+	Modified []string `json:"modified"`
+	Missing  []string `json:"missing"`
+	Extra    []string `json:"extra"`
+}
+
+func (r AuditReport) Clean() bool {
+	return len(r.Modified) == 0 && len(r.Missing) == 0 && len(r.Extra) == 0
+}
+
+// Manifest returns the SHA-256 of each regular file in the embedded
+// archive, both layers included, keyed by path.
+func Manifest() (map[string]string, error) {
+	if !ArchiveAvailable() {
+		return nil, errors.New("embedded atom archive not available")
+	}
+	manifest := map[string]string{}
+	if len(vendorData) > 0 {
+		vendor, err := layerManifest(vendorData, vendorManifestFile)
+		if err != nil {
+			return nil, err
+		}
+		maps.Copy(manifest, vendor)
+	}
+	app, err := layerManifest(archiveData, manifestFile)
+	if err != nil {
+		return nil, err
+	}
+	maps.Copy(manifest, app)
+	return manifest, nil
+}
+
+// layerManifest reads the manifest entry name at the start of an archive
+// layer. An empty layer has an empty manifest.
+func layerManifest(data []byte, name string) (map[string]string, error) {
+	if len(data) == 0 {
+		return map[string]string{}, nil
+	}
+	tr, err := openArchive(data)
+	if err != nil {
+		return nil, err
+	}
+	defer tr.Close()
+
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, err
+	}
+	if hdr.Name != name {
+		return nil, ErrNoManifest
+	}
+	return parseManifest(tr)
+}
+
+// readManifestFile reads the manifest name extracted with the archive
+// currently in root.
+func readManifestFile(root, name string) (map[string]string, error) {
+	f, err := os.Open(filepath.Join(root, name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseManifest(f)
+}
+
+func parseManifest(r io.Reader) (map[string]string, error) {
+	manifest := map[string]string{}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		sum, path, ok := strings.Cut(sc.Text(), "  ")
+		if !ok {
+			return nil, errors.New("malformed manifest line")
+		}
+		manifest[path] = sum
+	}
+	return manifest, sc.Err()
+}
+
+// Audit compares the regular files under root with the embedded manifest.
+// Paths in ignore, and everything below them, are skipped; symlinks are not
+// audited.
+func Audit(root string, ignore []string) (AuditReport, error) {
+	var report AuditReport
+	manifest, err := Manifest()
+	if err != nil {
+		return report, err
+	}
+	ignore = append(slices.Clone(DefaultAuditIgnores), ignore...)
+
+	seen := make(map[string]bool, len(manifest))
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		if ignored(rel, ignore) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		want, ok := manifest[rel]
+		if !ok {
+			report.Extra = append(report.Extra, rel)
+			return nil
+		}
+		seen[rel] = true
+		got, err := fileSHA256(path)
+		if err != nil {
+			return err
+		}
+		if got != want {
+			report.Modified = append(report.Modified, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+
+	for path := range manifest {
+		if !seen[path] && !ignored(path, ignore) {
+			report.Missing = append(report.Missing, path)
+		}
+	}
+	slices.Sort(report.Missing)
+	return report, nil
+}
+
+func ignored(rel string, ignore []string) bool {
+	for _, prefix := range ignore {
+		prefix = strings.Trim(filepath.ToSlash(prefix), "/")
+		if prefix == "" {
+			continue
+		}
+		if rel == prefix || strings.HasPrefix(rel, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
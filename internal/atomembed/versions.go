@@ -0,0 +1,191 @@
+package atomembed
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// A versions dir holds one extracted atom root per archive, named
+// atom-<hash prefix>, and a "current" symlink to the one being served.
+// A version chosen with Use is pinned so a restart with a newer embedded
+// archive does not switch away from it.
+const (
+	currentLink   = "current"
+	pinFile       = ".pinned"
+	previousFile  = ".previous"
+	versionPrefix = "atom-"
+)
+
+// Version is an extracted archive in a versions dir.
+type Version struct {
+	Name      string    `json:"name"`
+	Hash      string    `json:"hash"`
+	Extracted time.Time `json:"extracted"`
+	Current   bool      `json:"current"`
+	Pinned    bool      `json:"pinned"`
+}
+
+// VersionName is the directory name for the loaded archive.
+func VersionName() string {
+	return versionPrefix + ArchiveHash()[:12]
+}
+
+// CurrentPath is the symlink to serve from.
+func CurrentPath(base string) string {
+	return filepath.Join(base, currentLink)
+}
+
+// EnsureVersion extracts the loaded archive into its own directory under
+// base, points current at it unless another version is pinned, and prunes
+// all but keep previous versions. It returns the name current points to.
+func EnsureVersion(base string, keep int) (string, error) {
+	if err := os.MkdirAll(base, 0755); err != nil {
+		return "", err
+	}
+	name := VersionName()
+	dir := filepath.Join(base, name)
+	if _, err := EnsureExtracted(dir, true); err != nil {
+		return "", err
+	}
+
+	if pinned := readPin(base); pinned != "" && isVersion(base, pinned) {
+		name = pinned
+	}
+	if err := setCurrent(base, name); err != nil {
+		return "", err
+	}
+	return name, Prune(base, keep)
+}
+
+// Versions lists the versions under base, newest first.
+func Versions(base string) ([]Version, error) {
+	entries, err := os.ReadDir(base)
+	if err != nil {
+		return nil, err
+	}
+	current, _ := os.Readlink(CurrentPath(base))
+	pinned := readPin(base)
+
+	var versions []Version
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), versionPrefix) {
+			continue
+		}
+		marker, err := os.Stat(filepath.Join(base, entry.Name(), markerFile))
+		if err != nil {
+			continue
+		}
+		versions = append(versions, Version{
+			Name:      entry.Name(),
+			Hash:      InstalledHash(filepath.Join(base, entry.Name())),
+			Extracted: marker.ModTime().UTC(),
+			Current:   entry.Name() == filepath.Base(current),
+			Pinned:    entry.Name() == pinned,
+		})
+	}
+	slices.SortFunc(versions, func(a, b Version) int {
+		return b.Extracted.Compare(a.Extracted)
+	})
+	return versions, nil
+}
+
+// Use points current at name and pins it. The server must be restarted
+// to pick it up.
+func Use(base, name string) error {
+	if !isVersion(base, name) {
+		return fmt.Errorf("no version %q in %s", name, base)
+	}
+	if err := setCurrent(base, name); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(base, pinFile), []byte(name+"\n"), 0644)
+}
+
+// Rollback pins the version that was current before the last switch and
+// returns its name.
+func Rollback(base string) (string, error) {
+	name := readName(base, previousFile)
+	if name == "" || !isVersion(base, name) {
+		return "", errors.New("no earlier version to roll back to")
+	}
+	return name, Use(base, name)
+}
+
+// Unpin lets the next start switch to the loaded archive again.
+func Unpin(base string) error {
+	err := os.Remove(filepath.Join(base, pinFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Prune removes all but the newest keep versions besides the current,
+// pinned and rollback ones.
+func Prune(base string, keep int) error {
+	versions, err := Versions(base)
+	if err != nil {
+		return err
+	}
+	previous := readName(base, previousFile)
+	kept := 0
+	for _, v := range versions {
+		if v.Current || v.Pinned || v.Name == previous {
+			continue
+		}
+		if kept < keep {
+			kept++
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(base, v.Name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setCurrent repoints current at name, remembering the old target for
+// Rollback.
+func setCurrent(base, name string) error {
+	link := CurrentPath(base)
+	previous, err := os.Readlink(link)
+	if err == nil && previous == name {
+		return nil
+	}
+	tmp := link + ".tmp"
+	_ = os.Remove(tmp)
+	if err := os.Symlink(name, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, link); err != nil {
+		return err
+	}
+	if previous == "" {
+		return nil
+	}
+	return os.WriteFile(filepath.Join(base, previousFile), []byte(previous+"\n"), 0644)
+}
+
+func readPin(base string) string {
+	return readName(base, pinFile)
+}
+
+func readName(base, file string) string {
+	contents, err := os.ReadFile(filepath.Join(base, file))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(contents))
+}
+
+func isVersion(base, name string) bool {
+	if !strings.HasPrefix(name, versionPrefix) || strings.ContainsAny(name, `/\`) {
+		return false
+	}
+	return InstalledHash(filepath.Join(base, name)) != ""
+}
@@ -0,0 +1,68 @@
+package bootstrap
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const backupSuffix = ".bak."
+
+// backupFile copies target aside before it is replaced with contents,
+// keeping the newest a.backups generations. Nothing is written when target
+// does not exist or already holds contents.
+func (a *applier) backupFile(target string, contents []byte) error {
+	if a.backups <= 0 {
+		return nil
+	}
+	current, err := os.ReadFile(target)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(current, contents) {
+		return nil
+	}
+
+	backup := target + backupSuffix + time.Now().UTC().Format("20060102T150405.000000000Z")
+	if err := os.WriteFile(backup, current, 0600); err != nil {
+		return err
+	}
+	a.summary.Backups = append(a.summary.Backups, backup)
+	return pruneBackups(target, a.backups)
+}
+
+func pruneBackups(target string, keep int) error {
+	matches, err := filepath.Glob(globEscape(target) + backupSuffix + "*")
+	if err != nil {
+		return err
+	}
+	if len(matches) <= keep {
+		return nil
+	}
+	// Timestamps sort lexically, oldest first.
+	sort.Strings(matches)
+	for _, old := range matches[:len(matches)-keep] {
+		if err := os.Remove(old); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func globEscape(path string) string {
+	var buf bytes.Buffer
+	for _, r := range path {
+		switch r {
+		case '*', '?', '[', '\\':
+			buf.WriteByte('\\')
+		}
+		buf.WriteRune(r)
+	}
+	return buf.String()
+}
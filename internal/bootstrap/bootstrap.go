@@ -1,15 +1,22 @@
 package bootstrap
 
 import (
+	"context"
 	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"io"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/artefactual-labs/valence/internal/secrets"
 )
 
 type Config struct {
@@ -25,11 +32,172 @@ type Config struct {
 	MySQLUsername     string
 	MySQLPassword     string
 	DebugIP           string
-}
+
+	// MySQLEncoding defaults to the DSN charset, then utf8mb4.
+	MySQLEncoding  string
+	MySQLSSLCA     string
+	MySQLSSLCert   string
+	MySQLSSLKey    string
+	MySQLSSLVerify bool
+
+	ElasticsearchUsername    string
+	ElasticsearchPassword    string
+	ElasticsearchAPIKey      string
+	ElasticsearchCAFile      string
+	ElasticsearchTLSInsecure bool
+	// ElasticsearchIndex names AtoM's index, which also prefixes its
+	// per-type indices; sites sharing a cluster need distinct names.
+	ElasticsearchIndex string
+
+	// Session settings for the AtoM storage factory. SessionCookieSecure
+	// defaults to !DevelopmentMode; SameSite is also applied via php.ini
+	// because symfony's session storage predates the attribute.
+	SessionName           string
+	SessionStorageClass   string
+	SessionCookieSecure   bool
+	SessionCookieSameSite string
+	SessionCookieLifetime int
+
+	// DefaultCulture, Cultures and Timezone are merged into settings.yml when
+	// set; Timezone also becomes PHP's date.timezone.
+	DefaultCulture string
+	Cultures       []string
+	Timezone       string
+
+	// Theme is the theme plugin enabled at startup; empty keeps the theme
+	// stored in the database.
+	Theme string
+
+	// CSPDirectives replaces AtoM's default Content-Security-Policy and
+	// CSPOverrides replaces or adds single directives by name.
+	CSPDirectives string
+	CSPOverrides  map[string]string
+	CSPReportOnly bool
+
+	// CacheEngine selects the AtoM cache and session backend: memcache
+	// (default) or redis.
+	CacheEngine     string
+	RedisHost       string
+	RedisPassword   string
+	RedisDatabase   int
+	RedisCacheClass string
+
+	// Worker settings written to gearman.yml for the AtoM job worker that
+	// shares this data dir. WorkerJobs replaces the "general" worker type's
+	// job list.
+	WorkerJobs        []string
+	WorkerMemoryLimit string
+	WorkerJobTimeout  time.Duration
+	WorkerMaxJobs     int
+
+	// SMTP settings for AtoM's mailer; unset SMTPHost leaves the mailer
+	// untouched. SMTPEncryption is empty, "tls" or "ssl".
+	SMTPHost       string
+	SMTPPort       int
+	SMTPUsername   string
+	SMTPPassword   string
+	SMTPEncryption string
+	SMTPFrom       string
+
+	// OverridesDir mirrors the data dir layout; its files are layered over
+	// the generated config after every run.
+	OverridesDir string
+
+	// DataUID and DataGID own the writable data dirs (cache, log, uploads,
+	// downloads); -1 leaves ownership alone. DataDirMode is their mode.
+	DataUID     int
+	DataGID     int
+	DataDirMode os.FileMode
+
+	// UploadsDir, when set, is where the data dir's uploads dir links to,
+	// e.g. a volume kept apart from the rest of the data dir.
+	UploadsDir string
+
+	// TemplatesDir holds operator overrides for the embedded templates.
+	TemplatesDir string
+
+	// BackupGenerations is how many backups of each overwritten file to keep;
+	// zero disables backups.
+	BackupGenerations int
+}
+
+const (
+	CacheEngineMemcache = "memcache"
+	CacheEngineRedis    = "redis"
+)
 
 type Summary struct {
-	Written []string
-	Skipped []string
+	GeneratedAt time.Time `json:"generated_at"`
+	DryRun      bool      `json:"dry_run"`
+
+	Written []string `json:"written"`
+	Skipped []string `json:"skipped"`
+	Backups []string `json:"backups"`
+
+	// Overrides lists files touched by the overrides dir and Conflicts the
+	// generated files or YAML keys they replaced.
+	Overrides []string `json:"overrides"`
+	Conflicts []string `json:"conflicts"`
+
+	// Files records why each file was written or skipped, in order.
+	Files []FileRecord `json:"files"`
+
+	// Changes describes each file Apply would write in dry-run mode.
+	Changes []FileChange `json:"changes,omitempty"`
+}
+
+type FileChange struct {
+	Path   string `json:"path"`
+	Action string `json:"action"` // create, overwrite or unchanged
+	Diff   string `json:"diff"`
+}
+
+// FileRecord is one file Apply touched or left alone. SHA256 is the final
+// content hash (or symlink target hash), empty in dry-run mode.
+type FileRecord struct {
+	Path   string `json:"path"`
+	Action string `json:"action"` // written, skipped or override
+	Reason string `json:"reason"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// Reasons recorded in FileRecord.
+const (
+	ReasonRegenerated = "regenerated"    // rebuilt from env on every run
+	ReasonMissing     = "missing"        // created because it did not exist
+	ReasonMerged      = "env-merged"     // env settings merged into an existing file
+	ReasonExists      = "exists"         // operator-owned file left as is
+	ReasonUnchanged   = "unchanged"      // already up to date
+	ReasonOverride    = "override"       // layered from the overrides dir
+	ReasonSymlink     = "symlink-target" // symlink pointed somewhere else
+)
+
+type Option func(*applier)
+
+// DryRun makes Apply report what it would write, with unified diffs against
+// existing content, without touching disk.
+func DryRun(a *applier) {
+	a.dryRun = true
+}
+
+type applier struct {
+	summary Summary
+	dryRun  bool
+	backups int
+
+	// staged holds every write until commit; see stage.go.
+	staged      []stagedFile
+	stagedIndex map[string]int
+}
+
+func (a *applier) written(path, reason string) {
+	a.summary.Written = append(a.summary.Written, path)
+	a.summary.Files = append(a.summary.Files, FileRecord{Path: path, Action: "written", Reason: reason})
+}
+
+func (a *applier) skipped(path, reason string) {
+	a.summary.Skipped = append(a.summary.Skipped, path)
+	a.summary.Files = append(a.summary.Files, FileRecord{Path: path, Action: "skipped", Reason: reason})
 }
 
 func (c Config) dataDir() string {
@@ -39,6 +207,29 @@ func (c Config) dataDir() string {
 	return c.AtomDir
 }
 
+// ElasticsearchNodes splits ElasticsearchHost, which may list several
+// comma-separated nodes of one cluster.
+func (c Config) ElasticsearchNodes() []string {
+	return splitList(c.ElasticsearchHost)
+}
+
+// ElasticsearchTLSConfig returns the client TLS settings for https nodes.
+func (c Config) ElasticsearchTLSConfig() (*tls.Config, error) {
+	cfg := &tls.Config{InsecureSkipVerify: c.ElasticsearchTLSInsecure}
+	if c.ElasticsearchCAFile == "" {
+		return cfg, nil
+	}
+	pem, err := os.ReadFile(c.ElasticsearchCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("read elasticsearch ca file: %w", err)
+	}
+	cfg.RootCAs = x509.NewCertPool()
+	if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", c.ElasticsearchCAFile)
+	}
+	return cfg, nil
+}
+
 func (c Config) appConfigDir() string {
 	return filepath.Join(c.dataDir(), "apps/qubit/config")
 }
@@ -56,17 +247,75 @@ func (c Config) sourceProjectConfigDir() string {
 }
 
 func LoadConfigFromEnv(atomDir string) (Config, error) {
+	return LoadConfig(context.Background(), atomDir, secrets.Env)
+}
+
+// LoadConfig reads the bootstrap configuration from the environment,
+// resolving MySQL credentials through provider.
+func LoadConfig(ctx context.Context, atomDir string, provider secrets.Provider) (Config, error) {
+	creds, err := secrets.Resolve(ctx, provider, "ATOM_MYSQL_DSN", "ATOM_MYSQL_USERNAME", "ATOM_MYSQL_PASSWORD", "ATOM_MYSQL_SSL_KEY",
+		"ATOM_REDIS_PASSWORD", "ATOM_ELASTICSEARCH_PASSWORD", "ATOM_ELASTICSEARCH_API_KEY", "ATOM_SMTP_PASSWORD")
+	if err != nil {
+		return Config{}, fmt.Errorf("resolve secrets from %s: %w", provider.Name(), err)
+	}
+
+	devMode := envBool("ATOM_DEVELOPMENT_MODE", false)
 	cfg := Config{
-		AtomDir:           atomDir,
-		AtomDataDir:       envOrDefault("ATOM_DATA_DIR", ""),
-		DevelopmentMode:   envBool("ATOM_DEVELOPMENT_MODE", false),
-		ElasticsearchHost: mustEnv("ATOM_ELASTICSEARCH_HOST"),
-		MemcachedHost:     mustEnv("ATOM_MEMCACHED_HOST"),
-		GearmandHost:      mustEnv("ATOM_GEARMAND_HOST"),
-		MySQLDSN:          mustEnv("ATOM_MYSQL_DSN"),
-		MySQLUsername:     mustEnv("ATOM_MYSQL_USERNAME"),
-		MySQLPassword:     mustEnv("ATOM_MYSQL_PASSWORD"),
-		DebugIP:           envOrDefault("ATOM_DEBUG_IP", ""),
+		AtomDir:                  atomDir,
+		AtomDataDir:              envOrDefault("ATOM_DATA_DIR", ""),
+		DevelopmentMode:          devMode,
+		ElasticsearchHost:        envOrDefault("ATOM_ELASTICSEARCH_HOSTS", mustEnv("ATOM_ELASTICSEARCH_HOST")),
+		ElasticsearchUsername:    mustEnv("ATOM_ELASTICSEARCH_USERNAME"),
+		ElasticsearchPassword:    creds["ATOM_ELASTICSEARCH_PASSWORD"],
+		ElasticsearchAPIKey:      creds["ATOM_ELASTICSEARCH_API_KEY"],
+		ElasticsearchCAFile:      envOrDefault("ATOM_ELASTICSEARCH_CA_FILE", ""),
+		ElasticsearchTLSInsecure: envBool("ATOM_ELASTICSEARCH_TLS_INSECURE", false),
+		ElasticsearchIndex:       mustEnv("ATOM_ELASTICSEARCH_INDEX"),
+		SessionName:              envOrDefault("ATOM_SESSION_NAME", "symfony"),
+		SessionStorageClass:      envOrDefault("ATOM_SESSION_STORAGE_CLASS", "QubitCacheSessionStorage"),
+		SessionCookieSecure:      envBool("ATOM_SESSION_COOKIE_SECURE", !devMode),
+		SessionCookieSameSite:    sameSite(mustEnv("ATOM_SESSION_COOKIE_SAMESITE")),
+		SessionCookieLifetime:    envInt("ATOM_SESSION_COOKIE_LIFETIME", 0),
+		DefaultCulture:           mustEnv("ATOM_DEFAULT_CULTURE"),
+		Cultures:                 splitList(mustEnv("ATOM_CULTURES")),
+		Timezone:                 mustEnv("ATOM_TIMEZONE"),
+		Theme:                    mustEnv("ATOM_THEME"),
+		CSPDirectives:            mustEnv("ATOM_CSP_DIRECTIVES"),
+		CSPOverrides:             cspDirectivesFromEnv(),
+		CSPReportOnly:            envBool("ATOM_CSP_REPORT_ONLY", false),
+		CacheEngine:              strings.ToLower(envOrDefault("ATOM_CACHE_ENGINE", CacheEngineMemcache)),
+		MemcachedHost:            mustEnv("ATOM_MEMCACHED_HOST"),
+		RedisHost:                mustEnv("ATOM_REDIS_HOST"),
+		RedisPassword:            creds["ATOM_REDIS_PASSWORD"],
+		RedisDatabase:            envInt("ATOM_REDIS_DATABASE", 0),
+		RedisCacheClass:          envOrDefault("ATOM_REDIS_CACHE_CLASS", "sfRedisCache"),
+		GearmandHost:             mustEnv("ATOM_GEARMAND_HOST"),
+		MySQLDSN:                 creds["ATOM_MYSQL_DSN"],
+		MySQLUsername:            creds["ATOM_MYSQL_USERNAME"],
+		MySQLPassword:            creds["ATOM_MYSQL_PASSWORD"],
+		MySQLEncoding:            envOrDefault("ATOM_MYSQL_ENCODING", ""),
+		MySQLSSLCA:               envOrDefault("ATOM_MYSQL_SSL_CA", ""),
+		MySQLSSLCert:             envOrDefault("ATOM_MYSQL_SSL_CERT", ""),
+		MySQLSSLKey:              creds["ATOM_MYSQL_SSL_KEY"],
+		MySQLSSLVerify:           envBool("ATOM_MYSQL_SSL_VERIFY", true),
+		DebugIP:                  envOrDefault("ATOM_DEBUG_IP", ""),
+		WorkerJobs:               splitList(mustEnv("ATOM_WORKER_JOBS")),
+		WorkerMemoryLimit:        mustEnv("ATOM_WORKER_MEMORY_LIMIT"),
+		WorkerJobTimeout:         envDuration("ATOM_WORKER_JOB_TIMEOUT", 0),
+		WorkerMaxJobs:            envInt("ATOM_WORKER_MAX_JOBS", 0),
+		SMTPHost:                 mustEnv("ATOM_SMTP_HOST"),
+		SMTPPort:                 envInt("ATOM_SMTP_PORT", 25),
+		SMTPUsername:             mustEnv("ATOM_SMTP_USERNAME"),
+		SMTPPassword:             creds["ATOM_SMTP_PASSWORD"],
+		SMTPEncryption:           strings.ToLower(mustEnv("ATOM_SMTP_ENCRYPTION")),
+		SMTPFrom:                 mustEnv("ATOM_SMTP_FROM"),
+		OverridesDir:             envOrDefault("ATOM_CONFIG_OVERRIDES_DIR", ""),
+		TemplatesDir:             envOrDefault("ATOM_BOOTSTRAP_TEMPLATES_DIR", ""),
+		DataUID:                  envInt("ATOM_DATA_UID", -1),
+		DataGID:                  envInt("ATOM_DATA_GID", -1),
+		DataDirMode:              envFileMode("ATOM_DATA_DIR_MODE", 0775),
+		UploadsDir:               mustEnv("ATOM_UPLOADS_DIR"),
+		BackupGenerations:        envInt("ATOM_BOOTSTRAP_BACKUPS", 5),
 	}
 
 	if err := cfg.validate(); err != nil {
@@ -76,13 +325,27 @@ func LoadConfigFromEnv(atomDir string) (Config, error) {
 	return cfg, nil
 }
 
+var esIndexName = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+
 func (c Config) validate() error {
 	var missing []string
 	if c.ElasticsearchHost == "" {
 		missing = append(missing, "ATOM_ELASTICSEARCH_HOST")
 	}
-	if c.MemcachedHost == "" {
-		missing = append(missing, "ATOM_MEMCACHED_HOST")
+	if c.ElasticsearchUsername != "" && c.ElasticsearchPassword == "" {
+		missing = append(missing, "ATOM_ELASTICSEARCH_PASSWORD")
+	}
+	switch c.CacheEngine {
+	case CacheEngineMemcache:
+		if c.MemcachedHost == "" {
+			missing = append(missing, "ATOM_MEMCACHED_HOST")
+		}
+	case CacheEngineRedis:
+		if c.RedisHost == "" {
+			missing = append(missing, "ATOM_REDIS_HOST")
+		}
+	default:
+		return fmt.Errorf("unsupported ATOM_CACHE_ENGINE %q (want %s or %s)", c.CacheEngine, CacheEngineMemcache, CacheEngineRedis)
 	}
 	if c.GearmandHost == "" {
 		missing = append(missing, "ATOM_GEARMAND_HOST")
@@ -99,90 +362,152 @@ func (c Config) validate() error {
 	if len(missing) > 0 {
 		return fmt.Errorf("missing required environment variables: %s", strings.Join(missing, ", "))
 	}
+	if _, err := ParseMySQLDSN(c.MySQLDSN); err != nil {
+		return err
+	}
+	if _, err := c.cspDirectives(); err != nil {
+		return err
+	}
+	switch c.SessionCookieSameSite {
+	case "", "Lax", "Strict":
+	case "None":
+		if !c.SessionCookieSecure {
+			return fmt.Errorf("ATOM_SESSION_COOKIE_SAMESITE=None requires ATOM_SESSION_COOKIE_SECURE=true")
+		}
+	default:
+		return fmt.Errorf("unsupported ATOM_SESSION_COOKIE_SAMESITE %q (want Lax, Strict or None)", c.SessionCookieSameSite)
+	}
+	if c.SessionCookieLifetime < 0 {
+		return fmt.Errorf("ATOM_SESSION_COOKIE_LIFETIME must not be negative")
+	}
+	if c.DefaultCulture != "" && len(c.Cultures) > 0 && !slices.Contains(c.Cultures, c.DefaultCulture) {
+		return fmt.Errorf("ATOM_DEFAULT_CULTURE %q is not listed in ATOM_CULTURES", c.DefaultCulture)
+	}
+	if c.DataDirMode&^os.ModePerm != 0 || c.DataDirMode&0700 != 0700 {
+		return fmt.Errorf("ATOM_DATA_DIR_MODE %o must be a permission mode that lets the owner write", c.DataDirMode)
+	}
+	if c.ElasticsearchIndex != "" && !esIndexName.MatchString(c.ElasticsearchIndex) {
+		return fmt.Errorf("ATOM_ELASTICSEARCH_INDEX %q is not a valid index name (lowercase letters, digits, -, _ and .)", c.ElasticsearchIndex)
+	}
+	if c.UploadsDir != "" && !filepath.IsAbs(c.UploadsDir) {
+		return fmt.Errorf("ATOM_UPLOADS_DIR %q must be an absolute path", c.UploadsDir)
+	}
+	if err := c.validateTheme(); err != nil {
+		return err
+	}
+	if err := c.validateWorker(); err != nil {
+		return err
+	}
+	if err := c.validateSMTP(); err != nil {
+		return err
+	}
+	if (c.MySQLSSLCert == "") != (c.MySQLSSLKey == "") {
+		return fmt.Errorf("ATOM_MYSQL_SSL_CERT and ATOM_MYSQL_SSL_KEY must be set together")
+	}
 	return nil
 }
 
-func Apply(cfg Config) (Summary, error) {
-	var summary Summary
+// Apply generates the AtoM config set under the data dir. Files are staged
+// and only swapped into place once every step has succeeded.
+func Apply(cfg Config, opts ...Option) (Summary, error) {
+	a := &applier{backups: cfg.BackupGenerations}
+	for _, opt := range opts {
+		opt(a)
+	}
 
-	if err := ensureDir(cfg.appConfigDir()); err != nil {
-		return summary, err
+	if err := a.ensureDir(cfg.appConfigDir()); err != nil {
+		return a.summary, err
 	}
-	if err := ensureDir(cfg.projectConfigDir()); err != nil {
-		return summary, err
+	if err := a.ensureDir(cfg.projectConfigDir()); err != nil {
+		return a.summary, err
 	}
-	if err := syncConfigDir(&summary, cfg); err != nil {
-		return summary, err
+	if err := syncConfigDir(a, cfg); err != nil {
+		return a.summary, err
 	}
 
 	// /apps/qubit/config/settings.yml
-	if err := writeSettingsYML(&summary, cfg); err != nil {
-		return summary, err
+	if err := writeSettingsYML(a, cfg); err != nil {
+		return a.summary, err
 	}
 
 	// /config/propel.ini (always overwrite)
-	if err := overwriteFromTemplate(&summary,
+	if err := overwriteFromTemplate(a,
 		filepath.Join(cfg.projectConfigDir(), "propel.ini"),
 		filepath.Join(cfg.sourceProjectConfigDir(), "propel.ini.tmpl"),
 	); err != nil {
-		return summary, err
+		return a.summary, err
 	}
 
 	// /config/databases.yml (always overwrite)
-	if err := overwriteFile(&summary, filepath.Join(cfg.projectConfigDir(), "databases.yml"), buildDatabasesYML(cfg)); err != nil {
-		return summary, err
+	if err := overwriteFromRender(a, cfg, filepath.Join(cfg.projectConfigDir(), "databases.yml")); err != nil {
+		return a.summary, err
 	}
 
 	// /config/appChallenge.yml
-	if err := copyIfMissing(&summary,
+	if err := copyIfMissing(a,
 		filepath.Join(cfg.projectConfigDir(), "appChallenge.yml"),
 		filepath.Join(cfg.sourceProjectConfigDir(), "appChallenge.yml.tmpl"),
 	); err != nil {
-		return summary, err
+		return a.summary, err
 	}
 
 	// /config/ProjectConfiguration.class.php (shim for data dir)
-	if err := writeProjectConfigurationShim(&summary, cfg); err != nil {
-		return summary, err
+	if err := writeProjectConfigurationShim(a, cfg); err != nil {
+		return a.summary, err
 	}
 
 	// /apps/qubit/config/gearman.yml (always overwrite)
-	gearmanYML := fmt.Sprintf("all:\n  servers:\n    default: %s\n", cfg.GearmandHost)
-	if err := overwriteFile(&summary, filepath.Join(cfg.appConfigDir(), "gearman.yml"), gearmanYML); err != nil {
-		return summary, err
+	if err := overwriteFromRender(a, cfg, filepath.Join(cfg.appConfigDir(), "gearman.yml")); err != nil {
+		return a.summary, err
 	}
 
 	// /apps/qubit/config/app.yml
-	if err := writeAppYMLIfMissing(&summary, cfg); err != nil {
-		return summary, err
+	if err := writeAppYMLIfMissing(a, cfg); err != nil {
+		return a.summary, err
 	}
 
 	// /apps/qubit/config/factories.yml
-	if err := writeFactoriesYMLIfMissing(&summary, cfg); err != nil {
-		return summary, err
+	if err := writeFactoriesYMLIfMissing(a, cfg); err != nil {
+		return a.summary, err
 	}
 
 	// /config/search.yml (always overwrite)
-	searchYML := buildSearchYML(cfg)
-	if err := overwriteFile(&summary, filepath.Join(cfg.projectConfigDir(), "search.yml"), searchYML); err != nil {
-		return summary, err
+	if err := overwriteFromRender(a, cfg, filepath.Join(cfg.projectConfigDir(), "search.yml")); err != nil {
+		return a.summary, err
 	}
 
 	// /config/config.php (always overwrite)
-	if err := overwriteFile(&summary, filepath.Join(cfg.projectConfigDir(), "config.php"), buildConfigPHP(cfg)); err != nil {
-		return summary, err
+	if err := overwriteFromRender(a, cfg, filepath.Join(cfg.projectConfigDir(), "config.php")); err != nil {
+		return a.summary, err
 	}
 
 	// php ini (conf.d drop-in)
 	// sf symlink
-	if err := ensureSFSymlink(&summary, cfg); err != nil {
-		return summary, err
+	if err := ensureSFSymlink(a, cfg); err != nil {
+		return a.summary, err
+	}
+
+	// Site-specific overrides (layered last)
+	if err := applyOverrides(a, cfg); err != nil {
+		return a.summary, err
 	}
 
-	return summary, nil
+	// Nothing above touched the config files; swap them in together.
+	if !a.dryRun {
+		if err := a.commit(); err != nil {
+			return a.summary, err
+		}
+		if err := prepareDataDirs(cfg); err != nil {
+			return a.summary, err
+		}
+	}
+	if err := a.finish(cfg); err != nil {
+		return a.summary, err
+	}
+	return a.summary, nil
 }
 
-func writeSettingsYML(summary *Summary, cfg Config) error {
+func writeSettingsYML(a *applier, cfg Config) error {
 	target := filepath.Join(cfg.appConfigDir(), "settings.yml")
 	source := target
 	if !exists(target) {
@@ -199,54 +524,113 @@ func writeSettingsYML(summary *Summary, cfg Config) error {
 	updated := string(content)
 	updated = strings.ReplaceAll(updated, "change_me", secret)
 	updated = strings.ReplaceAll(updated, "no_script_name:         false", "no_script_name:         true")
-	return overwriteFile(summary, target, updated)
+	if cfg.DefaultCulture != "" || len(cfg.Cultures) > 0 || cfg.Timezone != "" {
+		if updated, err = mergeFragments(cfg, updated, "settings.i18n.yml"); err != nil {
+			return fmt.Errorf("%s: %w", target, err)
+		}
+	}
+	// Re-marshalling drops the operator's comments, so an existing file is
+	// only rewritten when the merge changes what it says.
+	if source == target {
+		if equal, err := yamlEqual(content, []byte(updated)); err == nil && equal {
+			a.skipped(target, ReasonUnchanged)
+			return nil
+		}
+	}
+	return overwriteFile(a, target, updated)
 }
 
-func writeAppYMLIfMissing(summary *Summary, cfg Config) error {
+func writeAppYMLIfMissing(a *applier, cfg Config) error {
 	target := filepath.Join(cfg.appConfigDir(), "app.yml")
-	if exists(target) {
-		summary.Skipped = append(summary.Skipped, target)
-		return nil
+	var fragments []string
+	if cfg.SMTPHost != "" {
+		fragments = append(fragments, "app.mailer.yml")
 	}
-	host, port := splitHostPort(cfg.MemcachedHost, 11211)
-	appYML := fmt.Sprintf("all:\n  upload_limit: -1\n  download_timeout: 10\n  cache_engine: sfMemcacheCache\n  cache_engine_param:\n    host: %s\n    port: %d\n    prefix: atom\n    storeCacheInfo: true\n    persistent: true\n  read_only: false\n  htmlpurifier_enabled: false\n  csp:\n    response_header: Content-Security-Policy\n    directives: >\n      default-src 'self';\n      font-src 'self' https://fonts.gstatic.com;\n      form-action 'self';\n      img-src 'self' https://*.googleapis.com https://*.gstatic.com *.google.com  *.googleusercontent.com data: https://www.gravatar.com/avatar/ https://*.google-analytics.com https://*.googletagmanager.com blob:;\n      script-src 'self' https://*.googletagmanager.com 'nonce' https://*.googleapis.com https://*.gstatic.com *.google.com https://*.ggpht.com *.googleusercontent.com blob:;\n      style-src 'self' 'nonce' https://fonts.googleapis.com;\n      worker-src 'self' blob:;\n      connect-src 'self' https://*.google-analytics.com https://*.analytics.google.com https://*.googletagmanager.com https://*.googleapis.com *.google.com https://*.gstatic.com  data: blob:;\n      frame-ancestors 'self';\n\n", host, port)
-	return writeFile(summary, target, appYML)
+	return renderIfMissing(a, cfg, target, fragments...)
 }
 
-func writeFactoriesYMLIfMissing(summary *Summary, cfg Config) error {
+func writeFactoriesYMLIfMissing(a *applier, cfg Config) error {
 	target := filepath.Join(cfg.appConfigDir(), "factories.yml")
-	if exists(target) {
-		summary.Skipped = append(summary.Skipped, target)
-		return nil
-	}
-	host, port := splitHostPort(cfg.MemcachedHost, 11211)
-	secureCookie := "true"
-	if cfg.DevelopmentMode {
-		secureCookie = "false"
+	var fragments []string
+	if cfg.SMTPHost != "" {
+		fragments = append(fragments, "factories.mailer.yml")
+	}
+	return renderIfMissing(a, cfg, target, fragments...)
+}
+
+// renderIfMissing renders target from its template when it does not exist.
+// Fragments are deep-merged into the file either way, so env-driven settings
+// still reach config the operator has edited.
+func renderIfMissing(a *applier, cfg Config, target string, fragments ...string) error {
+	var current []byte
+	reason := ReasonMerged
+	if a.exists(target) {
+		if len(fragments) == 0 {
+			a.skipped(target, ReasonExists)
+			return nil
+		}
+		var err error
+		if current, err = a.readFile(target); err != nil {
+			return err
+		}
+	} else {
+		reason = ReasonMissing
+		rendered, err := renderTemplate(cfg, filepath.Base(target))
+		if err != nil {
+			return err
+		}
+		current = []byte(rendered)
 	}
 
-	factories := fmt.Sprintf("prod:\n  storage:\n    class: QubitCacheSessionStorage\n    param:\n      session_name: symfony\n      session_cookie_httponly: true\n      session_cookie_secure: %s\n      cache:\n        class: sfMemcacheCache\n        param:\n          host: %s\n          port: %d\n          prefix: atom\n          storeCacheInfo: true\n          persistent: true\n\n\n", secureCookie, host, port)
-	factories += fmt.Sprintf("dev:\n  storage:\n    class: QubitCacheSessionStorage\n    param:\n      session_name: symfony\n      session_cookie_httponly: true\n      session_cookie_secure: %s\n      cache:\n        class: sfMemcacheCache\n        param:\n          host: %s\n          port: %d\n          prefix: atom\n          storeCacheInfo: true\n          persistent: true\n\n", secureCookie, host, port)
-	return writeFile(summary, target, factories)
-}
-
-func buildDatabasesYML(cfg Config) string {
-	return fmt.Sprintf("dev:\n  propel:\n    param:\n      classname: PropelPDO\n      debug:\n        realmemoryusage: true\n        details:\n          time: { enabled: true }\n          slow: { enabled: true, threshold: 0.1 }\n          mem: { enabled: true }\n          mempeak: { enabled: true }\n          memdelta: { enabled: true }\n\ntest:\n  propel:\n    param:\n      classname: PropelPDO\n\nall:\n  propel:\n    class: sfPropelDatabase\n    param:\n      classname: PropelPDO\n      dsn: %s\n      username: %s\n      password: %s\n      encoding: utf8mb4\n      persistent: true\n      pooling: true\n", cfg.MySQLDSN, cfg.MySQLUsername, cfg.MySQLPassword)
+	merged, err := mergeFragments(cfg, string(current), fragments...)
+	if err != nil {
+		return fmt.Errorf("%s: %w", target, err)
+	}
+	if reason == ReasonMerged {
+		if equal, err := yamlEqual(current, []byte(merged)); err != nil || equal {
+			a.skipped(target, ReasonUnchanged)
+			return err
+		}
+	}
+	if err := writeFile(a, target, merged); err != nil {
+		return err
+	}
+	a.written(target, reason)
+	return nil
 }
 
-func buildSearchYML(cfg Config) string {
-	host, port := splitHostPort(cfg.ElasticsearchHost, 9200)
-	return fmt.Sprintf("all:\n  server:\n    host: %s\n    port: %d\n\n", host, port)
+// mergeFragments deep-merges the rendered fragment templates into contents.
+func mergeFragments(cfg Config, contents string, fragments ...string) (string, error) {
+	if len(fragments) == 0 {
+		return contents, nil
+	}
+	for _, name := range fragments {
+		fragment, err := renderTemplate(cfg, name)
+		if err != nil {
+			return "", err
+		}
+		if contents, _, err = mergeYAML([]byte(contents), []byte(fragment)); err != nil {
+			return "", fmt.Errorf("merge %s: %w", name, err)
+		}
+	}
+	return contents, nil
 }
 
-func buildConfigPHP(cfg Config) string {
-	return fmt.Sprintf("<?php\n\nreturn [\n    'all' => [\n        'propel' => [\n            'class' => 'sfPropelDatabase',\n            'param' => [\n                'encoding' => 'utf8mb4',\n                'persistent' => true,\n                'pooling' => true,\n                'dsn' => '%s',\n                'username' => '%s',\n                'password' => '%s',\n            ],\n        ],\n    ],\n    'dev' => [\n        'propel' => [\n            'param' => [\n                'classname' => 'PropelPDO',\n                'debug' => [\n                    'realmemoryusage' => true,\n                    'details' => [\n                        'time' => [\n                            'enabled' => true,\n                        ],\n                        'slow' => [\n                            'enabled' => true,\n                            'threshold' => 0.1,\n                        ],\n                        'mem' => [\n                            'enabled' => true,\n                        ],\n                        'mempeak' => [\n                            'enabled' => true,\n                        ],\n                        'memdelta' => [\n                            'enabled' => true,\n                        ],\n                    ],\n                ],\n            ],\n        ],\n    ],\n    'test' => [\n        'propel' => [\n            'param' => [\n                'classname' => 'PropelPDO',\n            ],\n        ],\n    ],\n];\n", cfg.MySQLDSN, cfg.MySQLUsername, cfg.MySQLPassword)
+// overwriteFromRender renders the template named after target's base name
+// and writes the result to target.
+func overwriteFromRender(a *applier, cfg Config, target string) error {
+	contents, err := renderTemplate(cfg, filepath.Base(target))
+	if err != nil {
+		return err
+	}
+	return overwriteFile(a, target, contents)
 }
 
-func ensureSFSymlink(summary *Summary, cfg Config) error {
+func ensureSFSymlink(a *applier, cfg Config) error {
 	target := filepath.Join(cfg.AtomDir, "vendor/symfony/data/web/sf")
 	link := filepath.Join(cfg.AtomDir, "sf")
 
+	reason := ReasonSymlink
 	if fi, err := os.Lstat(link); err == nil {
 		if fi.Mode()&os.ModeSymlink == 0 {
 			return fmt.Errorf("expected %s to be symlink", link)
@@ -256,32 +640,35 @@ func ensureSFSymlink(summary *Summary, cfg Config) error {
 			return err
 		}
 		if current == target {
-			summary.Skipped = append(summary.Skipped, link)
+			a.skipped(link, ReasonUnchanged)
 			return nil
 		}
-		if err := os.Remove(link); err != nil {
-			return err
+		if a.dryRun {
+			a.change(link, "overwrite", fmt.Sprintf("-> %s\n+> %s\n", current, target))
 		}
 	} else if !errors.Is(err, os.ErrNotExist) {
 		return err
+	} else {
+		reason = ReasonMissing
+		if a.dryRun {
+			a.change(link, "create", fmt.Sprintf("+> %s\n", target))
+		}
 	}
 
-	if err := os.Symlink(target, link); err != nil {
-		return err
-	}
-	summary.Written = append(summary.Written, link)
+	a.stageSymlink(link, target)
+	a.written(link, reason)
 	return nil
 }
 
-func overwriteFromTemplate(summary *Summary, target, tmpl string) error {
-	if err := copyFile(tmpl, target); err != nil {
+func overwriteFromTemplate(a *applier, target, tmpl string) error {
+	if err := a.copyFile(tmpl, target); err != nil {
 		return err
 	}
-	summary.Written = append(summary.Written, target)
+	a.written(target, ReasonRegenerated)
 	return nil
 }
 
-func writeProjectConfigurationShim(summary *Summary, cfg Config) error {
+func writeProjectConfigurationShim(a *applier, cfg Config) error {
 	if cfg.dataDir() == cfg.AtomDir {
 		return nil
 	}
@@ -289,10 +676,10 @@ func writeProjectConfigurationShim(summary *Summary, cfg Config) error {
 	target := filepath.Join(cfg.projectConfigDir(), "ProjectConfiguration.class.php")
 	source := filepath.Join(cfg.AtomDir, "config", "ProjectConfiguration.class.php")
 	contents := fmt.Sprintf("<?php\n// Auto-generated by Valence; delegate to the app's config.\nrequire_once '%s';\n", phpPathEscape(source))
-	return overwriteFile(summary, target, contents)
+	return overwriteFile(a, target, contents)
 }
 
-func syncConfigDir(summary *Summary, cfg Config) error {
+func syncConfigDir(a *applier, cfg Config) error {
 	if cfg.dataDir() == cfg.AtomDir {
 		return nil
 	}
@@ -325,67 +712,93 @@ func syncConfigDir(summary *Summary, cfg Config) error {
 
 		target := filepath.Join(targetRoot, rel)
 		if entry.IsDir() {
-			return ensureDir(target)
+			return a.ensureDir(target)
 		}
-		if exists(target) {
+		if a.exists(target) {
 			return nil
 		}
-		if err := copyFile(path, target); err != nil {
+		if err := a.copyFile(path, target); err != nil {
 			return err
 		}
-		summary.Written = append(summary.Written, target)
+		a.written(target, ReasonMissing)
 		return nil
 	})
 }
 
-func copyIfMissing(summary *Summary, target, tmpl string) error {
-	if exists(target) {
-		summary.Skipped = append(summary.Skipped, target)
+func copyIfMissing(a *applier, target, tmpl string) error {
+	if a.exists(target) {
+		a.skipped(target, ReasonExists)
 		return nil
 	}
-	if err := copyFile(tmpl, target); err != nil {
+	if err := a.copyFile(tmpl, target); err != nil {
 		return err
 	}
-	summary.Written = append(summary.Written, target)
+	a.written(target, ReasonMissing)
 	return nil
 }
 
-func overwriteFile(summary *Summary, target, contents string) error {
-	if err := writeFile(summary, target, contents); err != nil {
+// overwriteFile writes contents to target, or records it as skipped when
+// it already holds them.
+func overwriteFile(a *applier, target, contents string) error {
+	if current, err := a.readFile(target); err == nil && string(current) == contents {
+		if a.dryRun {
+			a.change(target, "unchanged", "")
+		}
+		a.skipped(target, ReasonUnchanged)
+		return nil
+	}
+	if err := writeFile(a, target, contents); err != nil {
 		return err
 	}
-	summary.Written = append(summary.Written, target)
+	a.written(target, ReasonRegenerated)
 	return nil
 }
 
-func writeFile(summary *Summary, target, contents string) error {
-	if err := ensureDir(filepath.Dir(target)); err != nil {
-		return err
+// writeFile stages contents for target; in dry-run mode it also records the
+// diff against what is on disk.
+func writeFile(a *applier, target, contents string) error {
+	if a.dryRun {
+		if err := a.diffFile(target, contents); err != nil {
+			return err
+		}
 	}
-	return os.WriteFile(target, []byte(contents), 0644)
+	a.stage(target, []byte(contents))
+	return nil
 }
 
-func copyFile(src, dest string) error {
-	in, err := os.Open(src)
+func (a *applier) copyFile(src, dest string) error {
+	contents, err := os.ReadFile(src)
 	if err != nil {
 		return err
 	}
-	defer in.Close()
+	return writeFile(a, dest, string(contents))
+}
 
-	if err := ensureDir(filepath.Dir(dest)); err != nil {
-		return err
+func (a *applier) ensureDir(path string) error {
+	if a.dryRun {
+		return nil
 	}
+	return ensureDir(path)
+}
 
-	out, err := os.Create(dest)
-	if err != nil {
+// diffFile records how writing contents to target would change it.
+func (a *applier) diffFile(target, contents string) error {
+	current, err := os.ReadFile(target)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		a.change(target, "create", unifiedDiff("/dev/null", target, "", contents))
+	case err != nil:
 		return err
+	case string(current) == contents:
+		a.change(target, "unchanged", "")
+	default:
+		a.change(target, "overwrite", unifiedDiff(target, target, string(current), contents))
 	}
-	defer out.Close()
+	return nil
+}
 
-	if _, err := io.Copy(out, in); err != nil {
-		return err
-	}
-	return out.Sync()
+func (a *applier) change(path, action, diff string) {
+	a.summary.Changes = append(a.summary.Changes, FileChange{Path: path, Action: action, Diff: diff})
 }
 
 func ensureDir(path string) error {
@@ -410,6 +823,14 @@ func phpPathEscape(value string) string {
 	return strings.ReplaceAll(value, "'", "\\'")
 }
 
+// splitScheme separates an optional "scheme://" prefix from value.
+func splitScheme(value, defaultScheme string) (string, string) {
+	if scheme, rest, ok := strings.Cut(value, "://"); ok {
+		return strings.ToLower(scheme), strings.TrimSuffix(rest, "/")
+	}
+	return defaultScheme, value
+}
+
 func splitHostPort(value string, defaultPort int) (string, int) {
 	if value == "" {
 		return "", defaultPort
@@ -432,6 +853,49 @@ func envOrDefault(key, def string) string {
 	return def
 }
 
+func envInt(key string, def int) int {
+	val := strings.TrimSpace(os.Getenv(key))
+	if val == "" {
+		return def
+	}
+	parsed, err := strconv.Atoi(val)
+	if err != nil {
+		return def
+	}
+	return parsed
+}
+
+// splitList splits a comma-separated env value, dropping empty entries.
+func splitList(val string) []string {
+	var items []string
+	for _, item := range strings.Split(val, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// sameSite canonicalises a SameSite value ("none" -> "None").
+func sameSite(val string) string {
+	if val == "" {
+		return ""
+	}
+	return strings.ToUpper(val[:1]) + strings.ToLower(val[1:])
+}
+
+func envDuration(key string, def time.Duration) time.Duration {
+	val := strings.TrimSpace(os.Getenv(key))
+	if val == "" {
+		return def
+	}
+	parsed, err := time.ParseDuration(val)
+	if err != nil {
+		return def
+	}
+	return parsed
+}
+
 func mustEnv(key string) string {
 	return strings.TrimSpace(os.Getenv(key))
 }
@@ -0,0 +1,94 @@
+package bootstrap
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+)
+
+const cspEnvPrefix = "ATOM_CSP_"
+
+type cspDirective struct {
+	Name  string
+	Value string
+}
+
+// defaultCSPDirectives is the policy AtoM ships in app.yml.
+var defaultCSPDirectives = []cspDirective{
+	{"default-src", "'self'"},
+	{"font-src", "'self' https://fonts.gstatic.com"},
+	{"form-action", "'self'"},
+	{"img-src", "'self' https://*.googleapis.com https://*.gstatic.com *.google.com  *.googleusercontent.com data: https://www.gravatar.com/avatar/ https://*.google-analytics.com https://*.googletagmanager.com blob:"},
+	{"script-src", "'self' https://*.googletagmanager.com 'nonce' https://*.googleapis.com https://*.gstatic.com *.google.com https://*.ggpht.com *.googleusercontent.com blob:"},
+	{"style-src", "'self' 'nonce' https://fonts.googleapis.com"},
+	{"worker-src", "'self' blob:"},
+	{"connect-src", "'self' https://*.google-analytics.com https://*.analytics.google.com https://*.googletagmanager.com https://*.googleapis.com *.google.com https://*.gstatic.com  data: blob:"},
+	{"frame-ancestors", "'self'"},
+}
+
+// cspDirectivesFromEnv reads per-directive overrides such as
+// ATOM_CSP_SCRIPT_SRC="'self' https://matomo.example.org".
+func cspDirectivesFromEnv() map[string]string {
+	overrides := map[string]string{}
+	for _, kv := range os.Environ() {
+		key, value, _ := strings.Cut(kv, "=")
+		name, ok := strings.CutPrefix(key, cspEnvPrefix)
+		if !ok || name == "" || name == "DIRECTIVES" || name == "REPORT_ONLY" {
+			continue
+		}
+		name = strings.ToLower(strings.ReplaceAll(name, "_", "-"))
+		overrides[name] = strings.TrimSpace(value)
+	}
+	return overrides
+}
+
+// cspDirectives returns the policy written to app.yml: ATOM_CSP_DIRECTIVES
+// replaces the default list and ATOM_CSP_<NAME> variables replace or add
+// single directives.
+func (c Config) cspDirectives() ([]cspDirective, error) {
+	directives := defaultCSPDirectives
+	if c.CSPDirectives != "" {
+		parsed, err := parseCSP(c.CSPDirectives)
+		if err != nil {
+			return nil, err
+		}
+		directives = parsed
+	}
+
+	merged := make([]cspDirective, 0, len(directives)+len(c.CSPOverrides))
+	seen := map[string]bool{}
+	for _, d := range directives {
+		if value, ok := c.CSPOverrides[d.Name]; ok {
+			d.Value = value
+		}
+		seen[d.Name] = true
+		merged = append(merged, d)
+	}
+	for _, name := range slices.Sorted(maps.Keys(c.CSPOverrides)) {
+		if !seen[name] {
+			merged = append(merged, cspDirective{name, c.CSPOverrides[name]})
+		}
+	}
+	return merged, nil
+}
+
+func parseCSP(policy string) ([]cspDirective, error) {
+	var directives []cspDirective
+	for _, part := range strings.Split(policy, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(part, " ")
+		if strings.ContainsAny(name, "'\"") {
+			return nil, fmt.Errorf("ATOM_CSP_DIRECTIVES: invalid directive %q", part)
+		}
+		directives = append(directives, cspDirective{strings.ToLower(name), strings.TrimSpace(value)})
+	}
+	if len(directives) == 0 {
+		return nil, fmt.Errorf("ATOM_CSP_DIRECTIVES is empty")
+	}
+	return directives, nil
+}
@@ -0,0 +1,115 @@
+package bootstrap
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// writableDirs are the data dir subdirectories PHP writes to at runtime.
+var writableDirs = []string{"cache", "log", "uploads", "downloads"}
+
+// prepareDataDirs creates the writable data dirs with cfg.DataDirMode and,
+// when DataUID/DataGID are set, hands them (recursively, unless a dir has
+// that owner already) to that owner so PHP threads can write derivatives
+// after a root-owned extraction.
+func prepareDataDirs(cfg Config) error {
+	for _, name := range writableDirs {
+		dir := filepath.Join(cfg.dataDir(), name)
+		if name == "uploads" && cfg.UploadsDir != "" {
+			if err := linkUploadsDir(dir, cfg.UploadsDir); err != nil {
+				return err
+			}
+			dir = cfg.UploadsDir
+		}
+		if err := os.MkdirAll(dir, cfg.DataDirMode); err != nil {
+			return err
+		}
+		if err := os.Chmod(dir, cfg.DataDirMode); err != nil {
+			return err
+		}
+		if cfg.DataUID < 0 && cfg.DataGID < 0 {
+			continue
+		}
+		if err := chownTree(dir, cfg.DataUID, cfg.DataGID); err != nil {
+			return fmt.Errorf("chown %s: %w", dir, err)
+		}
+	}
+	return nil
+}
+
+// linkUploadsDir makes link a symlink to target. An empty directory at link
+// is replaced; one holding files is left for the operator to move.
+func linkUploadsDir(link, target string) error {
+	fi, err := os.Lstat(link)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return err
+	case fi.Mode()&os.ModeSymlink != 0:
+		if current, err := os.Readlink(link); err == nil && current == target {
+			return nil
+		}
+		if err := os.Remove(link); err != nil {
+			return err
+		}
+	case fi.IsDir():
+		if err := os.Remove(link); err != nil {
+			return fmt.Errorf("%s holds uploads; move them to ATOM_UPLOADS_DIR %s first: %w", link, target, err)
+		}
+	default:
+		return fmt.Errorf("expected %s to be a directory or symlink", link)
+	}
+	if err := os.MkdirAll(filepath.Dir(link), 0755); err != nil {
+		return err
+	}
+	return os.Symlink(target, link)
+}
+
+// chownTree sets the owner of every entry under root that differs; -1
+// leaves that id unchanged. A root that already has the owner was handed
+// over on an earlier boot, and what PHP wrote since is its own, so the
+// tree, uploads included, is only walked when the root's owner differs.
+func chownTree(root string, uid, gid int) error {
+	info, err := os.Stat(root)
+	if err != nil {
+		return err
+	}
+	if ownedBy(info, uid, gid) {
+		return nil
+	}
+	return filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if ownedBy(info, uid, gid) {
+			return nil
+		}
+		return os.Lchown(path, uid, gid)
+	})
+}
+
+func ownedBy(info fs.FileInfo, uid, gid int) bool {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && (uid < 0 || int(stat.Uid) == uid) && (gid < 0 || int(stat.Gid) == gid)
+}
+
+func envFileMode(key string, def os.FileMode) os.FileMode {
+	val := mustEnv(key)
+	if val == "" {
+		return def
+	}
+	parsed, err := strconv.ParseUint(val, 8, 32)
+	if err != nil {
+		return def
+	}
+	return os.FileMode(parsed)
+}
@@ -0,0 +1,30 @@
+package bootstrap
+
+import (
+	"fmt"
+	"net/mail"
+)
+
+func (c Config) validateSMTP() error {
+	if c.SMTPHost == "" {
+		return nil
+	}
+	if c.SMTPPort <= 0 || c.SMTPPort > 65535 {
+		return fmt.Errorf("ATOM_SMTP_PORT: invalid port %d", c.SMTPPort)
+	}
+	switch c.SMTPEncryption {
+	case "", "tls", "ssl":
+	default:
+		return fmt.Errorf("unsupported ATOM_SMTP_ENCRYPTION %q (want tls or ssl)", c.SMTPEncryption)
+	}
+	if c.SMTPUsername != "" && c.SMTPPassword == "" {
+		return fmt.Errorf("ATOM_SMTP_USERNAME is set but ATOM_SMTP_PASSWORD is empty")
+	}
+	if c.SMTPFrom == "" {
+		return fmt.Errorf("ATOM_SMTP_FROM is required when ATOM_SMTP_HOST is set")
+	}
+	if _, err := mail.ParseAddress(c.SMTPFrom); err != nil {
+		return fmt.Errorf("ATOM_SMTP_FROM: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package bootstrap
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const dsnExample = "mysql:host=percona;port=3306;dbname=atom;charset=utf8mb4"
+
+// MySQLDSN is a parsed PDO MySQL DSN.
+type MySQLDSN struct {
+	Host       string
+	Port       int
+	UnixSocket string
+	DBName     string
+	Charset    string
+}
+
+// Network returns the dial network and address of the server.
+func (d MySQLDSN) Network() (string, string) {
+	if d.UnixSocket != "" {
+		return "unix", d.UnixSocket
+	}
+	return "tcp", net.JoinHostPort(d.Host, strconv.Itoa(d.Port))
+}
+
+// ParseMySQLDSN parses and validates a PDO MySQL DSN such as
+// "mysql:host=db;port=3306;dbname=atom" or "mysql:unix_socket=/run/mysqld/mysqld.sock;dbname=atom".
+func ParseMySQLDSN(dsn string) (MySQLDSN, error) {
+	parsed := MySQLDSN{Port: 3306}
+	if dsn == "" {
+		return parsed, fmt.Errorf("ATOM_MYSQL_DSN is empty (expected e.g. %s)", dsnExample)
+	}
+	rest, ok := strings.CutPrefix(dsn, "mysql:")
+	if !ok {
+		return parsed, fmt.Errorf("ATOM_MYSQL_DSN must start with \"mysql:\" (expected e.g. %s)", dsnExample)
+	}
+
+	for _, part := range strings.Split(rest, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return parsed, fmt.Errorf("ATOM_MYSQL_DSN: %q is not a key=value pair", part)
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+		switch key {
+		case "host":
+			parsed.Host = value
+		case "port":
+			port, err := strconv.Atoi(value)
+			if err != nil || port <= 0 || port > 65535 {
+				return parsed, fmt.Errorf("ATOM_MYSQL_DSN: invalid port %q", value)
+			}
+			parsed.Port = port
+		case "unix_socket":
+			parsed.UnixSocket = value
+		case "dbname":
+			parsed.DBName = value
+		case "charset":
+			parsed.Charset = value
+		default:
+			return parsed, fmt.Errorf("ATOM_MYSQL_DSN: unknown key %q (supported: host, port, dbname, unix_socket, charset); TLS is set with ATOM_MYSQL_SSL_*", key)
+		}
+	}
+
+	if parsed.Host == "" && parsed.UnixSocket == "" {
+		return parsed, fmt.Errorf("ATOM_MYSQL_DSN needs host= or unix_socket= (expected e.g. %s)", dsnExample)
+	}
+	if parsed.DBName == "" {
+		return parsed, fmt.Errorf("ATOM_MYSQL_DSN needs dbname= (expected e.g. %s)", dsnExample)
+	}
+	return parsed, nil
+}
+
+// mysqlOption is a PDO driver option passed to Propel by constant name.
+type mysqlOption struct {
+	Name    string
+	Value   string
+	Literal bool // render Value unquoted (booleans)
+}
+
+func (c Config) mysqlEncoding() string {
+	if c.MySQLEncoding != "" {
+		return c.MySQLEncoding
+	}
+	if dsn, err := ParseMySQLDSN(c.MySQLDSN); err == nil && dsn.Charset != "" {
+		return dsn.Charset
+	}
+	return "utf8mb4"
+}
+
+func (c Config) mysqlOptions() []mysqlOption {
+	var opts []mysqlOption
+	if c.MySQLSSLCA != "" {
+		opts = append(opts, mysqlOption{Name: "MYSQL_ATTR_SSL_CA", Value: c.MySQLSSLCA})
+	}
+	if c.MySQLSSLCert != "" {
+		opts = append(opts, mysqlOption{Name: "MYSQL_ATTR_SSL_CERT", Value: c.MySQLSSLCert})
+	}
+	if c.MySQLSSLKey != "" {
+		opts = append(opts, mysqlOption{Name: "MYSQL_ATTR_SSL_KEY", Value: c.MySQLSSLKey})
+	}
+	if c.MySQLSSLCA != "" || c.MySQLSSLCert != "" {
+		opts = append(opts, mysqlOption{Name: "MYSQL_ATTR_SSL_VERIFY_SERVER_CERT", Value: strconv.FormatBool(c.MySQLSSLVerify), Literal: true})
+	}
+	return opts
+}
+
+// MySQLTLSConfig returns the client TLS settings from ATOM_MYSQL_SSL_*, or
+// nil when TLS is not configured.
+func (c Config) MySQLTLSConfig(serverName string) (*tls.Config, error) {
+	if c.MySQLSSLCA == "" && c.MySQLSSLCert == "" {
+		return nil, nil
+	}
+	cfg := &tls.Config{ServerName: serverName, InsecureSkipVerify: !c.MySQLSSLVerify}
+	if c.MySQLSSLCA != "" {
+		pem, err := os.ReadFile(c.MySQLSSLCA)
+		if err != nil {
+			return nil, fmt.Errorf("read mysql ca file: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.MySQLSSLCA)
+		}
+	}
+	if c.MySQLSSLCert != "" {
+		cert, err := tls.LoadX509KeyPair(c.MySQLSSLCert, c.MySQLSSLKey)
+		if err != nil {
+			return nil, fmt.Errorf("load mysql client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
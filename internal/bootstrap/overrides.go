@@ -0,0 +1,150 @@
+package bootstrap
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"go.yaml.in/yaml/v2"
+)
+
+// applyOverrides layers the files under cfg.OverridesDir onto the data dir.
+// YAML files are deep-merged into the generated file; anything else replaces
+// it. Values or files that displace what bootstrap generated are reported as
+// conflicts.
+func applyOverrides(a *applier, cfg Config) error {
+	if cfg.OverridesDir == "" {
+		return nil
+	}
+	root := cfg.OverridesDir
+	if info, err := os.Stat(root); err != nil || !info.IsDir() {
+		return fmt.Errorf("overrides dir not found at %s", root)
+	}
+
+	// Files bootstrap found already up to date are its own all the same.
+	generated := make(map[string]bool, len(a.summary.Files))
+	for _, f := range a.summary.Files {
+		if f.Action == "written" || f.Reason == ReasonUnchanged {
+			generated[f.Path] = true
+		}
+	}
+
+	return filepath.WalkDir(root, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(cfg.dataDir(), rel)
+
+		override, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		contents := string(override)
+
+		current, err := a.readFile(target)
+		switch {
+		case os.IsNotExist(err):
+		case err != nil:
+			return err
+		case isYAML(rel):
+			merged, conflicts, err := mergeYAML(current, override)
+			if err != nil {
+				return fmt.Errorf("merge override %s: %w", rel, err)
+			}
+			for _, key := range conflicts {
+				a.conflict(fmt.Sprintf("%s: %s", target, key))
+			}
+			contents = merged
+		case generated[target] && string(current) != contents:
+			a.conflict(target)
+		}
+
+		if err := writeFile(a, target, contents); err != nil {
+			return err
+		}
+		a.summary.Overrides = append(a.summary.Overrides, target)
+		a.summary.Files = append(a.summary.Files, FileRecord{Path: target, Action: "override", Reason: ReasonOverride})
+		return nil
+	})
+}
+
+func (a *applier) conflict(desc string) {
+	a.summary.Conflicts = append(a.summary.Conflicts, desc)
+}
+
+func isYAML(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".yml" || ext == ".yaml"
+}
+
+// mergeYAML deep-merges override into base and returns the dotted key paths
+// whose existing values were replaced.
+func mergeYAML(base, override []byte) (string, []string, error) {
+	var baseDoc, overrideDoc yaml.MapSlice
+	if err := yaml.Unmarshal(base, &baseDoc); err != nil {
+		return "", nil, err
+	}
+	if err := yaml.Unmarshal(override, &overrideDoc); err != nil {
+		return "", nil, err
+	}
+
+	var conflicts []string
+	merged := mergeMapSlice(baseDoc, overrideDoc, "", &conflicts)
+	out, err := yaml.Marshal(merged)
+	if err != nil {
+		return "", nil, err
+	}
+	return string(out), conflicts, nil
+}
+
+// yamlEqual reports whether a and b decode to the same document, ignoring
+// formatting and comments.
+func yamlEqual(a, b []byte) (bool, error) {
+	var docA, docB yaml.MapSlice
+	if err := yaml.Unmarshal(a, &docA); err != nil {
+		return false, err
+	}
+	if err := yaml.Unmarshal(b, &docB); err != nil {
+		return false, err
+	}
+	return reflect.DeepEqual(docA, docB), nil
+}
+
+func mergeMapSlice(base, override yaml.MapSlice, prefix string, conflicts *[]string) yaml.MapSlice {
+	merged := append(yaml.MapSlice{}, base...)
+	for _, item := range override {
+		key := prefix + fmt.Sprint(item.Key)
+		idx := -1
+		for i := range merged {
+			if fmt.Sprint(merged[i].Key) == fmt.Sprint(item.Key) {
+				idx = i
+				break
+			}
+		}
+		if idx < 0 {
+			merged = append(merged, item)
+			continue
+		}
+
+		baseMap, baseIsMap := merged[idx].Value.(yaml.MapSlice)
+		overrideMap, overrideIsMap := item.Value.(yaml.MapSlice)
+		if baseIsMap && overrideIsMap {
+			merged[idx].Value = mergeMapSlice(baseMap, overrideMap, key+".", conflicts)
+			continue
+		}
+		if !reflect.DeepEqual(merged[idx].Value, item.Value) {
+			*conflicts = append(*conflicts, key)
+		}
+		merged[idx].Value = item.Value
+	}
+	return merged
+}
@@ -0,0 +1,180 @@
+package bootstrap
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// stagedFile is a pending write held until Apply commits. Link is set for
+// symlinks, Contents otherwise.
+type stagedFile struct {
+	target   string
+	contents []byte
+	link     string
+
+	tmp      string // staged copy next to target, renamed over it on commit
+	existed  bool
+	previous []byte
+	prevLink string
+}
+
+// stage queues contents for target; a later stage of the same target wins.
+func (a *applier) stage(target string, contents []byte) {
+	a.queue(stagedFile{target: target, contents: contents})
+}
+
+func (a *applier) stageSymlink(link, target string) {
+	a.queue(stagedFile{target: link, link: target})
+}
+
+func (a *applier) queue(f stagedFile) {
+	if a.stagedIndex == nil {
+		a.stagedIndex = make(map[string]int)
+	}
+	if i, ok := a.stagedIndex[f.target]; ok {
+		a.staged[i] = f
+		return
+	}
+	a.stagedIndex[f.target] = len(a.staged)
+	a.staged = append(a.staged, f)
+}
+
+// readFile returns the staged contents of path, falling back to disk.
+func (a *applier) readFile(path string) ([]byte, error) {
+	if i, ok := a.stagedIndex[path]; ok && a.staged[i].link == "" {
+		return a.staged[i].contents, nil
+	}
+	return os.ReadFile(path)
+}
+
+// exists reports whether path is staged or is a regular file on disk.
+func (a *applier) exists(path string) bool {
+	if _, ok := a.stagedIndex[path]; ok {
+		return true
+	}
+	return exists(path)
+}
+
+// commit writes every staged file to a temporary sibling, then renames each
+// over its target. Renames are atomic per file; if any fails, the targets
+// already swapped are restored to their previous contents, so a failed run
+// leaves the config set as it was.
+func (a *applier) commit() (err error) {
+	defer func() {
+		for i := range a.staged {
+			if a.staged[i].tmp != "" {
+				_ = os.Remove(a.staged[i].tmp)
+			}
+		}
+	}()
+
+	for i := range a.staged {
+		if err := a.prepare(&a.staged[i]); err != nil {
+			return err
+		}
+	}
+	for _, f := range a.staged {
+		if f.link == "" {
+			if err := a.backupFile(f.target, f.contents); err != nil {
+				return err
+			}
+		}
+	}
+
+	for i := range a.staged {
+		if err := os.Rename(a.staged[i].tmp, a.staged[i].target); err != nil {
+			return errors.Join(fmt.Errorf("commit %s: %w", a.staged[i].target, err), a.rollback(a.staged[:i]))
+		}
+		a.staged[i].tmp = ""
+	}
+	a.staged, a.stagedIndex = nil, nil
+	return nil
+}
+
+// prepare records what f replaces and writes its temporary sibling.
+func (a *applier) prepare(f *stagedFile) error {
+	if err := ensureDir(filepath.Dir(f.target)); err != nil {
+		return err
+	}
+
+	info, err := os.Lstat(f.target)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return err
+	case info.Mode()&os.ModeSymlink != 0:
+		f.existed = true
+		if f.prevLink, err = os.Readlink(f.target); err != nil {
+			return err
+		}
+	default:
+		f.existed = true
+		if f.previous, err = os.ReadFile(f.target); err != nil {
+			return err
+		}
+	}
+
+	f.tmp, err = writeSibling(f.target, f.contents, f.link)
+	return err
+}
+
+// rollback restores the previous state of targets that were already swapped.
+func (a *applier) rollback(done []stagedFile) error {
+	var errs []error
+	for i := len(done) - 1; i >= 0; i-- {
+		f := done[i]
+		if !f.existed {
+			if err := os.Remove(f.target); err != nil && !errors.Is(err, os.ErrNotExist) {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		tmp, err := writeSibling(f.target, f.previous, f.prevLink)
+		if err == nil {
+			err = os.Rename(tmp, f.target)
+		}
+		if err != nil {
+			_ = os.Remove(tmp)
+			errs = append(errs, fmt.Errorf("restore %s: %w", f.target, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// writeSibling writes contents (or a symlink to link) to a temporary file in
+// target's directory, so the rename onto target stays on one filesystem.
+func writeSibling(target string, contents []byte, link string) (string, error) {
+	dir, base := filepath.Split(target)
+	if link != "" {
+		tmp := filepath.Join(dir, "."+base+".valence-"+randomSuffix())
+		return tmp, os.Symlink(link, tmp)
+	}
+
+	out, err := os.CreateTemp(dir, "."+base+".valence-*")
+	if err != nil {
+		return "", err
+	}
+	tmp := out.Name()
+	if _, err := out.Write(contents); err != nil {
+		out.Close()
+		return tmp, err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return tmp, err
+	}
+	if err := out.Close(); err != nil {
+		return tmp, err
+	}
+	return tmp, os.Chmod(tmp, 0644)
+}
+
+func randomSuffix() string {
+	suffix, err := randomHex(6)
+	if err != nil {
+		return "tmp"
+	}
+	return suffix
+}
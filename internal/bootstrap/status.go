@@ -0,0 +1,88 @@
+package bootstrap
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+)
+
+// Status compares the config on disk with the last run's summary and with
+// what Apply would generate now, to surface drift.
+type Status struct {
+	CheckedAt time.Time `json:"checked_at"`
+	InSync    bool      `json:"in_sync"`
+
+	// Summary is the last run's, nil when none was recorded.
+	Summary *Summary `json:"summary"`
+
+	// Drifted lists the files Apply would create or overwrite now. Diffs
+	// are left out, since generated files hold credentials.
+	Drifted []FileChange `json:"drifted"`
+
+	// Modified lists the files whose contents changed since the last run
+	// recorded their hash, including operator-owned ones Apply skips.
+	Modified []string `json:"modified"`
+}
+
+// CheckStatus dry-runs Apply for cfg and checks the recorded hashes. It
+// does not touch disk.
+func CheckStatus(cfg Config) (Status, error) {
+	status := Status{CheckedAt: time.Now().UTC(), Drifted: []FileChange{}, Modified: []string{}}
+
+	data, err := os.ReadFile(cfg.SummaryPath())
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return status, err
+	default:
+		var summary Summary
+		if err := json.Unmarshal(data, &summary); err != nil {
+			return status, err
+		}
+		status.Summary = &summary
+	}
+
+	if status.Summary != nil {
+		// A file can be recorded twice, e.g. written then overridden; the
+		// last record holds its final hash.
+		recorded := map[string]string{}
+		var order []string
+		for _, file := range status.Summary.Files {
+			if _, ok := recorded[file.Path]; !ok {
+				order = append(order, file.Path)
+			}
+			recorded[file.Path] = file.SHA256
+		}
+		for _, path := range order {
+			sum, err := hashPath(path)
+			if err != nil {
+				return status, err
+			}
+			if sum != recorded[path] {
+				status.Modified = append(status.Modified, path)
+			}
+		}
+	}
+
+	planned, err := Apply(cfg, DryRun)
+	if err != nil {
+		return status, err
+	}
+	last := map[string]string{}
+	var order []string
+	for _, change := range planned.Changes {
+		if _, ok := last[change.Path]; !ok {
+			order = append(order, change.Path)
+		}
+		last[change.Path] = change.Action
+	}
+	for _, path := range order {
+		if last[path] != "unchanged" {
+			status.Drifted = append(status.Drifted, FileChange{Path: path, Action: last[path]})
+		}
+	}
+
+	status.InSync = status.Summary != nil && len(status.Drifted) == 0 && len(status.Modified) == 0
+	return status, nil
+}
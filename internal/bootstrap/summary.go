@@ -0,0 +1,67 @@
+package bootstrap
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const summaryFile = "bootstrap-summary.json"
+
+// SummaryPath is where Apply records the summary of its last run.
+func (c Config) SummaryPath() string {
+	return filepath.Join(c.dataDir(), summaryFile)
+}
+
+// finish stamps the summary, hashes the final state of each recorded file
+// and, unless dry-running, writes it as JSON to the data dir.
+func (a *applier) finish(cfg Config) error {
+	a.summary.GeneratedAt = time.Now().UTC()
+	a.summary.DryRun = a.dryRun
+	if a.dryRun {
+		return nil
+	}
+
+	for i := range a.summary.Files {
+		sum, err := hashPath(a.summary.Files[i].Path)
+		if err != nil {
+			return err
+		}
+		a.summary.Files[i].SHA256 = sum
+	}
+
+	data, err := json.MarshalIndent(a.summary, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(cfg.SummaryPath(), append(data, '\n'), 0644)
+}
+
+// hashPath returns the SHA-256 of a file's contents, or of a symlink's
+// target, and "" when the path no longer exists.
+func hashPath(path string) (string, error) {
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	var contents []byte
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(path)
+		if err != nil {
+			return "", err
+		}
+		contents = []byte(target)
+	} else if contents, err = os.ReadFile(path); err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(contents)
+	return hex.EncodeToString(sum[:]), nil
+}
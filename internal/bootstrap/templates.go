@@ -0,0 +1,140 @@
+package bootstrap
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+//go:embed templates/*.tmpl
+var embeddedTemplates embed.FS
+
+var templateFuncs = template.FuncMap{
+	"php":  phpPathEscape,
+	"yaml": yamlScalar,
+}
+
+// templateData is passed to the bootstrap templates. Config fields are
+// available directly, e.g. {{ .MySQLDSN }}.
+type templateData struct {
+	Config
+
+	MemcachedHostname     string
+	MemcachedPort         int
+	CacheClass            string
+	CacheHostname         string
+	CachePort             int
+	ElasticsearchHostname string
+	ElasticsearchPort     int
+	ElasticsearchNodes    []templateNode
+	MySQLCharset          string
+	MySQLOptions          []mysqlOption
+	CSPHeader             string
+	CSPDirectives         []cspDirective
+	WorkerTuning          bool
+	WorkerJobTimeoutSecs  int
+}
+
+type templateNode struct {
+	Scheme string
+	Host   string
+	Port   int
+}
+
+func newTemplateData(cfg Config) (templateData, error) {
+	data := templateData{
+		Config:       cfg,
+		MySQLCharset: cfg.mysqlEncoding(),
+		MySQLOptions: cfg.mysqlOptions(),
+		CSPHeader:    "Content-Security-Policy",
+		WorkerTuning: cfg.hasWorkerTuning(),
+	}
+	data.WorkerJobTimeoutSecs = int(cfg.WorkerJobTimeout.Seconds())
+	if cfg.CSPReportOnly {
+		data.CSPHeader = "Content-Security-Policy-Report-Only"
+	}
+	var err error
+	if data.CSPDirectives, err = cfg.cspDirectives(); err != nil {
+		return data, err
+	}
+	data.MemcachedHostname, data.MemcachedPort = splitHostPort(cfg.MemcachedHost, 11211)
+	switch cfg.CacheEngine {
+	case CacheEngineRedis:
+		data.CacheClass = cfg.RedisCacheClass
+		data.CacheHostname, data.CachePort = splitHostPort(cfg.RedisHost, 6379)
+	default:
+		data.CacheClass = "sfMemcacheCache"
+		data.CacheHostname, data.CachePort = data.MemcachedHostname, data.MemcachedPort
+	}
+	for _, node := range cfg.ElasticsearchNodes() {
+		scheme, hostport := splitScheme(node, "http")
+		host, port := splitHostPort(hostport, 9200)
+		data.ElasticsearchNodes = append(data.ElasticsearchNodes, templateNode{Scheme: scheme, Host: host, Port: port})
+	}
+	if len(data.ElasticsearchNodes) > 0 {
+		data.ElasticsearchHostname = data.ElasticsearchNodes[0].Host
+		data.ElasticsearchPort = data.ElasticsearchNodes[0].Port
+	}
+	return data, nil
+}
+
+// renderTemplate renders name (e.g. "app.yml") from cfg.TemplatesDir when an
+// override exists there, falling back to the embedded template.
+func renderTemplate(cfg Config, name string) (string, error) {
+	file := name + ".tmpl"
+	var (
+		source []byte
+		err    error
+	)
+	if cfg.TemplatesDir != "" {
+		source, err = os.ReadFile(filepath.Join(cfg.TemplatesDir, file))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+	}
+	if source == nil {
+		source, err = embeddedTemplates.ReadFile("templates/" + file)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	data, err := newTemplateData(cfg)
+	if err != nil {
+		return "", err
+	}
+	tmpl, err := template.New(file).Funcs(templateFuncs).Option("missingkey=error").Parse(string(source))
+	if err != nil {
+		return "", fmt.Errorf("parse template %s: %w", file, err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("render template %s: %w", file, err)
+	}
+	return buf.String(), nil
+}
+
+// yamlScalar returns value as a YAML scalar, single-quoting it only when a
+// plain scalar would be misread.
+func yamlScalar(value string) string {
+	needsQuotes := value == "" ||
+		strings.TrimSpace(value) != value ||
+		strings.ContainsAny(value[:1], "-?:,[]{}#&*!|>'\"%@`") ||
+		strings.ContainsAny(value, "\n\t") ||
+		strings.Contains(value, ": ") ||
+		strings.Contains(value, " #") ||
+		strings.HasSuffix(value, ":")
+	switch strings.ToLower(value) {
+	case "~", "null", "true", "false", "yes", "no", "on", "off":
+		needsQuotes = true
+	}
+	if !needsQuotes {
+		return value
+	}
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
@@ -0,0 +1,30 @@
+package bootstrap
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+var themeSummary = regexp.MustCompile(`\$summary\s*=\s*['"][^'"]*[Tt]heme`)
+
+// validateTheme checks that c.Theme names a theme plugin in the atom root.
+// AtoM marks themes by mentioning "theme" in the plugin's $summary.
+func (c Config) validateTheme() error {
+	if c.Theme == "" {
+		return nil
+	}
+	if filepath.Base(c.Theme) != c.Theme {
+		return fmt.Errorf("ATOM_THEME %q is not a plugin name", c.Theme)
+	}
+	class := filepath.Join(c.AtomDir, "plugins", c.Theme, "config", c.Theme+"Configuration.class.php")
+	source, err := os.ReadFile(class)
+	if err != nil {
+		return fmt.Errorf("ATOM_THEME %q not found in %s", c.Theme, filepath.Join(c.AtomDir, "plugins"))
+	}
+	if !themeSummary.Match(source) {
+		return fmt.Errorf("ATOM_THEME %q is a plugin but not a theme", c.Theme)
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package bootstrap
+
+import (
+	"fmt"
+	"regexp"
+)
+
+var phpMemoryLimit = regexp.MustCompile(`^(-1|[0-9]+[KMGkmg]?)$`)
+
+func (c Config) validateWorker() error {
+	if c.WorkerMemoryLimit != "" && !phpMemoryLimit.MatchString(c.WorkerMemoryLimit) {
+		return fmt.Errorf("ATOM_WORKER_MEMORY_LIMIT %q is not a PHP memory size (e.g. 512M or -1)", c.WorkerMemoryLimit)
+	}
+	if c.WorkerJobTimeout < 0 {
+		return fmt.Errorf("ATOM_WORKER_JOB_TIMEOUT must not be negative")
+	}
+	if c.WorkerMaxJobs < 0 {
+		return fmt.Errorf("ATOM_WORKER_MAX_JOBS must not be negative")
+	}
+	return nil
+}
+
+// hasWorkerTuning reports whether any ATOM_WORKER_* limit is set.
+func (c Config) hasWorkerTuning() bool {
+	return c.WorkerMemoryLimit != "" || c.WorkerJobTimeout > 0 || c.WorkerMaxJobs > 0
+}
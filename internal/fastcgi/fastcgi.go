@@ -0,0 +1,212 @@
+// Package fastcgi is a FastCGI client for the responder role, enough for
+// Valence to hand PHP requests to an external PHP-FPM pool. It sends one
+// request per connection, as PHP-FPM handles them by default, and turns
+// the CGI response into an HTTP one.
+package fastcgi
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+const (
+	version1 = 1
+
+	typeBeginRequest = 1
+	typeEndRequest   = 3
+	typeParams       = 4
+	typeStdin        = 5
+	typeStdout       = 6
+	typeStderr       = 7
+
+	roleResponder = 1
+	requestID     = 1
+
+	maxContent = 65535
+)
+
+// Do sends a responder request with params and body on conn, which it
+// does not close, and writes the response to w. Output on the
+// application's stderr goes to stderr. Once the response headers are
+// written an error only cuts the body short, so callers can tell from w
+// whether to answer with an error themselves.
+func Do(conn io.ReadWriter, params map[string]string, body io.Reader, w http.ResponseWriter, stderr io.Writer) error {
+	out := bufio.NewWriterSize(conn, 8<<10)
+	begin := []byte{0, roleResponder, 0, 0, 0, 0, 0, 0}
+	if err := writeRecord(out, typeBeginRequest, begin); err != nil {
+		return err
+	}
+	if err := writeStream(out, typeParams, encodeParams(params)); err != nil {
+		return err
+	}
+	if err := out.Flush(); err != nil {
+		return err
+	}
+
+	// Send the body while the response is read, so a script answering
+	// before it has read everything does not deadlock.
+	sent := make(chan error, 1)
+	go func() {
+		buf := make([]byte, maxContent)
+		for body != nil {
+			n, err := body.Read(buf)
+			if n > 0 {
+				if werr := writeRecord(out, typeStdin, buf[:n]); werr != nil {
+					sent <- werr
+					return
+				}
+			}
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				sent <- fmt.Errorf("read request body: %w", err)
+				return
+			}
+		}
+		if err := writeRecord(out, typeStdin, nil); err != nil {
+			sent <- err
+			return
+		}
+		sent <- out.Flush()
+	}()
+
+	stdout, stdoutW := io.Pipe()
+	go func() {
+		stdoutW.CloseWithError(readRecords(conn, stdoutW, stderr))
+	}()
+	err := writeResponse(w, stdout)
+	// Drain what is left so the reader goroutine finishes.
+	_, _ = io.Copy(io.Discard, stdout)
+	if err == nil {
+		// The script may answer without reading all of the body; what
+		// is left of it no longer matters.
+		return nil
+	}
+	select {
+	case sendErr := <-sent:
+		if sendErr != nil {
+			return sendErr
+		}
+	default:
+	}
+	return err
+}
+
+// readRecords copies the application's stdout and stderr until it ends
+// the request.
+func readRecords(conn io.Reader, stdout, stderr io.Writer) error {
+	in := bufio.NewReaderSize(conn, 8<<10)
+	var header [8]byte
+	for {
+		if _, err := io.ReadFull(in, header[:]); err != nil {
+			return fmt.Errorf("read record: %w", err)
+		}
+		if header[0] != version1 {
+			return fmt.Errorf("unsupported fastcgi version %d", header[0])
+		}
+		length := int(binary.BigEndian.Uint16(header[4:6]))
+		padding := int(header[6])
+		content := make([]byte, length)
+		if _, err := io.ReadFull(in, content); err != nil {
+			return fmt.Errorf("read record: %w", err)
+		}
+		if _, err := in.Discard(padding); err != nil {
+			return fmt.Errorf("read record: %w", err)
+		}
+		switch header[1] {
+		case typeStdout:
+			if _, err := stdout.Write(content); err != nil {
+				return err
+			}
+		case typeStderr:
+			if stderr != nil {
+				_, _ = stderr.Write(content)
+			}
+		case typeEndRequest:
+			if len(content) >= 5 && content[4] != 0 {
+				return fmt.Errorf("fastcgi request ended with protocol status %d", content[4])
+			}
+			return nil
+		}
+	}
+}
+
+// writeResponse turns a CGI response into an HTTP one: headers, an
+// optional Status header, a blank line and the body.
+func writeResponse(w http.ResponseWriter, stdout io.Reader) error {
+	br := bufio.NewReader(stdout)
+	header, err := textproto.NewReader(br).ReadMIMEHeader()
+	if err != nil && !(errors.Is(err, io.EOF) && len(header) > 0) {
+		return fmt.Errorf("read response headers: %w", err)
+	}
+	status := http.StatusOK
+	if val := header.Get("Status"); val != "" {
+		code, _, _ := strings.Cut(val, " ")
+		if status, err = strconv.Atoi(code); err != nil || status < 100 || status > 999 {
+			return fmt.Errorf("invalid Status header %q", val)
+		}
+		header.Del("Status")
+	} else if header.Get("Location") != "" {
+		status = http.StatusFound
+	}
+	for key, vals := range header {
+		w.Header()[key] = vals
+	}
+	w.WriteHeader(status)
+	_, err = io.Copy(w, br)
+	return err
+}
+
+func writeRecord(w io.Writer, recType byte, content []byte) error {
+	padding := (8 - len(content)%8) % 8
+	header := [8]byte{version1, recType}
+	binary.BigEndian.PutUint16(header[2:4], requestID)
+	binary.BigEndian.PutUint16(header[4:6], uint16(len(content)))
+	header[6] = byte(padding)
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(content); err != nil {
+		return err
+	}
+	_, err := w.Write(make([]byte, padding))
+	return err
+}
+
+// writeStream writes data as records of recType and ends the stream.
+func writeStream(w io.Writer, recType byte, data []byte) error {
+	for len(data) > 0 {
+		n := min(len(data), maxContent)
+		if err := writeRecord(w, recType, data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return writeRecord(w, recType, nil)
+}
+
+func encodeParams(params map[string]string) []byte {
+	var buf []byte
+	appendLength := func(n int) {
+		if n < 128 {
+			buf = append(buf, byte(n))
+			return
+		}
+		buf = binary.BigEndian.AppendUint32(buf, uint32(n)|1<<31)
+	}
+	for name, value := range params {
+		appendLength(len(name))
+		appendLength(len(value))
+		buf = append(buf, name...)
+		buf = append(buf, value...)
+	}
+	return buf
+}
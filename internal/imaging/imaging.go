@@ -0,0 +1,130 @@
+// Package imaging scales images down for AtoM's reference and thumbnail
+// derivatives using only the standard library's decoders, so JPEG, PNG and
+// GIF masters no longer need PHP and ImageMagick. Other formats report
+// ErrUnsupported and are left to AtoM.
+package imaging
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif" // register decoder
+	"image/jpeg"
+	_ "image/png" // register decoder
+	"io"
+)
+
+var (
+	// ErrUnsupported is returned for formats the standard library cannot
+	// decode (TIFF, JPEG 2000, PDF...).
+	ErrUnsupported = errors.New("unsupported image format")
+	// ErrTooLarge is returned before decoding an image with more pixels
+	// than allowed, which would otherwise need the memory to match.
+	ErrTooLarge = errors.New("image too large")
+)
+
+// Decode reads an image of at most maxPixels pixels and returns it with its
+// format name.
+func Decode(r io.ReadSeeker, maxPixels int) (image.Image, string, error) {
+	cfg, format, err := image.DecodeConfig(r)
+	if errors.Is(err, image.ErrFormat) {
+		return nil, "", ErrUnsupported
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if cfg.Width*cfg.Height > maxPixels {
+		return nil, format, fmt.Errorf("%w: %dx%d", ErrTooLarge, cfg.Width, cfg.Height)
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, format, err
+	}
+	img, _, err := image.Decode(r)
+	return img, format, err
+}
+
+// Fit scales src down, keeping its aspect ratio, to fit within maxWidth by
+// maxHeight; a zero bound is ignored. Images are never scaled up.
+// Transparent areas are flattened onto white, since derivatives are JPEG.
+func Fit(src image.Image, maxWidth, maxHeight int) *image.RGBA {
+	b := src.Bounds()
+	width, height := b.Dx(), b.Dy()
+	scale := 1.0
+	if maxWidth > 0 && width > maxWidth {
+		scale = float64(maxWidth) / float64(width)
+	}
+	if maxHeight > 0 && height > maxHeight {
+		scale = min(scale, float64(maxHeight)/float64(height))
+	}
+	dstWidth := max(int(float64(width)*scale+0.5), 1)
+	dstHeight := max(int(float64(height)*scale+0.5), 1)
+
+	flat := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(flat, flat.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), src, b.Min, draw.Over)
+	if dstWidth == width && dstHeight == height {
+		return flat
+	}
+	return boxScale(flat, dstWidth, dstHeight)
+}
+
+// boxScale averages the source pixels each destination pixel covers,
+// horizontally then vertically, which is what downscaling by large factors
+// needs to avoid aliasing.
+func boxScale(src *image.RGBA, dstWidth, dstHeight int) *image.RGBA {
+	width, height := src.Rect.Dx(), src.Rect.Dy()
+
+	// Horizontal pass: one row of dstWidth averaged pixels per source row.
+	rows := make([]uint32, dstWidth*height*4)
+	for y := 0; y < height; y++ {
+		line := src.Pix[y*src.Stride:]
+		for x := 0; x < dstWidth; x++ {
+			x0, x1 := span(x, width, dstWidth)
+			var sum [4]uint32
+			for sx := x0; sx < x1; sx++ {
+				for c := 0; c < 4; c++ {
+					sum[c] += uint32(line[sx*4+c])
+				}
+			}
+			out := rows[(y*dstWidth+x)*4:]
+			for c := 0; c < 4; c++ {
+				out[c] = sum[c] / uint32(x1-x0)
+			}
+		}
+	}
+
+	// Vertical pass.
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+	for y := 0; y < dstHeight; y++ {
+		y0, y1 := span(y, height, dstHeight)
+		for x := 0; x < dstWidth; x++ {
+			var sum [4]uint32
+			for sy := y0; sy < y1; sy++ {
+				in := rows[(sy*dstWidth+x)*4:]
+				for c := 0; c < 4; c++ {
+					sum[c] += in[c]
+				}
+			}
+			out := dst.Pix[y*dst.Stride+x*4:]
+			for c := 0; c < 4; c++ {
+				out[c] = uint8(sum[c] / uint32(y1-y0))
+			}
+		}
+	}
+	return dst
+}
+
+// span returns the source range [from, to) destination index i of n
+// covers in a source of size total; it is never empty.
+func span(i, total, n int) (int, int) {
+	from := i * total / n
+	to := max((i+1)*total/n, from+1)
+	return from, to
+}
+
+// EncodeJPEG writes img as a baseline JPEG.
+func EncodeJPEG(w io.Writer, img image.Image, quality int) error {
+	return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+}
@@ -0,0 +1,500 @@
+// Package memcached is an in-memory cache that speaks the memcached text
+// protocol, so that a single-box AtoM can keep its sessions and cache in
+// the valence process instead of a separate memcached. It implements the
+// storage, retrieval, delete, incr/decr, touch, flush_all, stats and
+// version commands that PHP's memcache and memcached extensions send, and
+// evicts the least recently used items once the data it holds reaches a
+// size limit. Nothing is persisted.
+package memcached
+
+import (
+	"bufio"
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxKeyLength = 250
+	// relativeExpiryLimit is memcached's cut-off: larger expiry times are
+	// Unix timestamps rather than seconds from now.
+	relativeExpiryLimit = 30 * 24 * 60 * 60
+)
+
+// Server is a memcached-compatible cache. The zero value is not usable;
+// call NewServer.
+type Server struct {
+	maxBytes int64
+	now      func() time.Time
+
+	mu      sync.Mutex
+	items   map[string]*list.Element
+	lru     *list.List // front is most recently used
+	bytes   int64
+	nextCAS uint64
+	stats   Stats
+
+	connMu sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+}
+
+// Stats counts what the cache has done since it started.
+type Stats struct {
+	Items     int64
+	Bytes     int64
+	Hits      uint64
+	Misses    uint64
+	Sets      uint64
+	Evictions uint64
+}
+
+type item struct {
+	key     string
+	flags   uint32
+	expires time.Time // zero for never
+	cas     uint64
+	value   []byte
+}
+
+func (it *item) size() int64 {
+	return int64(len(it.key) + len(it.value) + 48)
+}
+
+// NewServer returns a cache holding at most maxBytes of keys and values.
+func NewServer(maxBytes int64) *Server {
+	return &Server{
+		maxBytes: maxBytes,
+		now:      time.Now,
+		items:    map[string]*list.Element{},
+		lru:      list.New(),
+		conns:    map[net.Conn]struct{}{},
+	}
+}
+
+// Stats returns the cache's counters.
+func (s *Server) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.stats
+	st.Items = int64(len(s.items))
+	st.Bytes = s.bytes
+	return st
+}
+
+// Serve accepts connections on ln until Close is called.
+func (s *Server) Serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.connMu.Lock()
+			closed := s.closed
+			s.connMu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		s.connMu.Lock()
+		if s.closed {
+			s.connMu.Unlock()
+			_ = conn.Close()
+			return nil
+		}
+		s.conns[conn] = struct{}{}
+		s.connMu.Unlock()
+		go func() {
+			s.serveConn(conn)
+			s.connMu.Lock()
+			delete(s.conns, conn)
+			s.connMu.Unlock()
+			_ = conn.Close()
+		}()
+	}
+}
+
+// Close closes the open connections and makes Serve return once its
+// listener is closed.
+func (s *Server) Close() {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	s.closed = true
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			fmt.Fprint(w, "ERROR\r\n")
+		} else if quit := s.command(fields, r, w); quit {
+			_ = w.Flush()
+			return
+		}
+		// Flush once a pipelined batch has been answered.
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+var errBadFormat = errors.New("bad command line format")
+
+// command runs one command and reports whether the connection should be
+// closed.
+func (s *Server) command(fields []string, r *bufio.Reader, w *bufio.Writer) bool {
+	name, args := strings.ToLower(fields[0]), fields[1:]
+	var err error
+	switch name {
+	case "get", "gets":
+		err = s.get(w, args, name == "gets", nil)
+	case "gat", "gats":
+		if len(args) < 2 {
+			err = errBadFormat
+			break
+		}
+		var expires time.Time
+		if expires, err = s.expiry(args[0]); err == nil {
+			err = s.get(w, args[1:], name == "gats", &expires)
+		}
+	case "set", "add", "replace", "append", "prepend", "cas":
+		return s.store(w, r, name, args)
+	case "delete":
+		err = s.delete(w, args)
+	case "incr", "decr":
+		err = s.incr(w, args, name == "incr")
+	case "touch":
+		err = s.touch(w, args)
+	case "flush_all":
+		err = s.flushAll(w, args)
+	case "stats":
+		s.writeStats(w)
+	case "version":
+		fmt.Fprint(w, "VERSION 1.6.0-valence\r\n")
+	case "verbosity":
+		if !noreply(args) {
+			fmt.Fprint(w, "OK\r\n")
+		}
+	case "quit":
+		return true
+	default:
+		fmt.Fprint(w, "ERROR\r\n")
+	}
+	if err != nil {
+		fmt.Fprintf(w, "CLIENT_ERROR %v\r\n", err)
+	}
+	return false
+}
+
+func noreply(args []string) bool {
+	return len(args) > 0 && args[len(args)-1] == "noreply"
+}
+
+// expiry turns a memcached expiry time into a deadline; zero means never.
+func (s *Server) expiry(arg string) (time.Time, error) {
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return time.Time{}, errBadFormat
+	}
+	switch {
+	case n == 0:
+		return time.Time{}, nil
+	case n < 0:
+		return s.now().Add(-time.Second), nil
+	case n > relativeExpiryLimit:
+		return time.Unix(n, 0), nil
+	}
+	return s.now().Add(time.Duration(n) * time.Second), nil
+}
+
+// lookup returns the live item for key, dropping it if it has expired.
+// The caller holds s.mu.
+func (s *Server) lookup(key string) *item {
+	el, ok := s.items[key]
+	if !ok {
+		return nil
+	}
+	it := el.Value.(*item)
+	if !it.expires.IsZero() && !s.now().Before(it.expires) {
+		s.remove(el)
+		return nil
+	}
+	return it
+}
+
+func (s *Server) remove(el *list.Element) {
+	it := s.lru.Remove(el).(*item)
+	delete(s.items, it.key)
+	s.bytes -= it.size()
+}
+
+// put stores it, evicting the least recently used items to make room.
+// The caller holds s.mu.
+func (s *Server) put(it *item) {
+	if el, ok := s.items[it.key]; ok {
+		s.remove(el)
+	}
+	s.nextCAS++
+	it.cas = s.nextCAS
+	s.items[it.key] = s.lru.PushFront(it)
+	s.bytes += it.size()
+	for s.bytes > s.maxBytes && s.lru.Len() > 1 {
+		s.remove(s.lru.Back())
+		s.stats.Evictions++
+	}
+}
+
+// get answers get and gets, and gat and gats when touch is set.
+func (s *Server) get(w *bufio.Writer, keys []string, withCAS bool, touch *time.Time) error {
+	if len(keys) == 0 {
+		return errBadFormat
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range keys {
+		it := s.lookup(key)
+		if it == nil {
+			s.stats.Misses++
+			continue
+		}
+		s.stats.Hits++
+		s.lru.MoveToFront(s.items[key])
+		if touch != nil {
+			it.expires = *touch
+		}
+		if withCAS {
+			fmt.Fprintf(w, "VALUE %s %d %d %d\r\n", it.key, it.flags, len(it.value), it.cas)
+		} else {
+			fmt.Fprintf(w, "VALUE %s %d %d\r\n", it.key, it.flags, len(it.value))
+		}
+		w.Write(it.value)
+		w.WriteString("\r\n")
+	}
+	w.WriteString("END\r\n")
+	return nil
+}
+
+// store handles the storage commands:
+// <cmd> <key> <flags> <exptime> <bytes> [<cas unique>] [noreply].
+func (s *Server) store(w *bufio.Writer, r *bufio.Reader, name string, args []string) bool {
+	want := 4
+	if name == "cas" {
+		want = 5
+	}
+	if len(args) < want {
+		fmt.Fprint(w, "ERROR\r\n")
+		return false
+	}
+	size, err := strconv.Atoi(args[3])
+	if err != nil || size < 0 {
+		fmt.Fprint(w, "CLIENT_ERROR bad data chunk\r\n")
+		return true
+	}
+	if int64(size) > s.maxBytes {
+		// Not worth reading; the connection cannot be resynchronised.
+		fmt.Fprint(w, "SERVER_ERROR object too large for cache\r\n")
+		return true
+	}
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return true
+	}
+	if string(data[size:]) != "\r\n" {
+		fmt.Fprint(w, "CLIENT_ERROR bad data chunk\r\n")
+		return false
+	}
+	data = data[:size]
+	quiet := noreply(args[want:])
+	reply := func(msg string) {
+		if !quiet {
+			fmt.Fprintf(w, "%s\r\n", msg)
+		}
+	}
+
+	key := args[0]
+	flags, err := strconv.ParseUint(args[1], 10, 32)
+	if err != nil || len(key) > maxKeyLength {
+		reply("CLIENT_ERROR bad command line format")
+		return false
+	}
+	expires, err := s.expiry(args[2])
+	if err != nil {
+		reply("CLIENT_ERROR bad command line format")
+		return false
+	}
+	if int64(size+len(key)) > s.maxBytes {
+		reply("SERVER_ERROR object too large for cache")
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.Sets++
+	existing := s.lookup(key)
+	switch name {
+	case "add":
+		if existing != nil {
+			reply("NOT_STORED")
+			return false
+		}
+	case "replace":
+		if existing == nil {
+			reply("NOT_STORED")
+			return false
+		}
+	case "append", "prepend":
+		if existing == nil {
+			reply("NOT_STORED")
+			return false
+		}
+		joined := make([]byte, 0, len(existing.value)+len(data))
+		if name == "append" {
+			joined = append(append(joined, existing.value...), data...)
+		} else {
+			joined = append(append(joined, data...), existing.value...)
+		}
+		data, flags, expires = joined, uint64(existing.flags), existing.expires
+	case "cas":
+		unique, err := strconv.ParseUint(args[4], 10, 64)
+		if err != nil {
+			reply("CLIENT_ERROR bad command line format")
+			return false
+		}
+		if existing == nil {
+			reply("NOT_FOUND")
+			return false
+		}
+		if existing.cas != unique {
+			reply("EXISTS")
+			return false
+		}
+	}
+	s.put(&item{key: key, flags: uint32(flags), expires: expires, value: data})
+	reply("STORED")
+	return false
+}
+
+func (s *Server) delete(w *bufio.Writer, args []string) error {
+	if len(args) == 0 {
+		return errBadFormat
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msg := "NOT_FOUND"
+	if s.lookup(args[0]) != nil {
+		s.remove(s.items[args[0]])
+		msg = "DELETED"
+	}
+	if !noreply(args[1:]) {
+		fmt.Fprintf(w, "%s\r\n", msg)
+	}
+	return nil
+}
+
+func (s *Server) incr(w *bufio.Writer, args []string, up bool) error {
+	if len(args) < 2 {
+		return errBadFormat
+	}
+	delta, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return errors.New("invalid numeric delta argument")
+	}
+	quiet := noreply(args[2:])
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	it := s.lookup(args[0])
+	if it == nil {
+		if !quiet {
+			fmt.Fprint(w, "NOT_FOUND\r\n")
+		}
+		return nil
+	}
+	current, err := strconv.ParseUint(strings.TrimSpace(string(it.value)), 10, 64)
+	if err != nil {
+		return errors.New("cannot increment or decrement non-numeric value")
+	}
+	switch {
+	case up:
+		current += delta
+	case delta > current:
+		current = 0
+	default:
+		current -= delta
+	}
+	value := strconv.FormatUint(current, 10)
+	s.put(&item{key: it.key, flags: it.flags, expires: it.expires, value: []byte(value)})
+	if !quiet {
+		fmt.Fprintf(w, "%s\r\n", value)
+	}
+	return nil
+}
+
+func (s *Server) touch(w *bufio.Writer, args []string) error {
+	if len(args) < 2 {
+		return errBadFormat
+	}
+	expires, err := s.expiry(args[1])
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msg := "NOT_FOUND"
+	if it := s.lookup(args[0]); it != nil {
+		it.expires = expires
+		msg = "TOUCHED"
+	}
+	if !noreply(args[2:]) {
+		fmt.Fprintf(w, "%s\r\n", msg)
+	}
+	return nil
+}
+
+// flushAll empties the cache. A delay, which memcached honours by
+// expiring items later, empties it now.
+func (s *Server) flushAll(w *bufio.Writer, args []string) error {
+	s.mu.Lock()
+	s.items = map[string]*list.Element{}
+	s.lru.Init()
+	s.bytes = 0
+	s.mu.Unlock()
+	if !noreply(args) {
+		fmt.Fprint(w, "OK\r\n")
+	}
+	return nil
+}
+
+func (s *Server) writeStats(w *bufio.Writer) {
+	st := s.Stats()
+	for _, stat := range []struct {
+		name  string
+		value any
+	}{
+		{"curr_items", st.Items},
+		{"bytes", st.Bytes},
+		{"limit_maxbytes", s.maxBytes},
+		{"get_hits", st.Hits},
+		{"get_misses", st.Misses},
+		{"cmd_set", st.Sets},
+		{"evictions", st.Evictions},
+	} {
+		fmt.Fprintf(w, "STAT %s %v\r\n", stat.name, stat.value)
+	}
+	fmt.Fprint(w, "END\r\n")
+}
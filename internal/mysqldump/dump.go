@@ -0,0 +1,173 @@
+// Package mysqldump writes and replays SQL dumps in the format mysqldump
+// produces, over a mysqlwire.Conn, so a site can be backed up and restored
+// without MySQL client tools.
+package mysqldump
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/artefactual-labs/valence/internal/mysqlwire"
+)
+
+// maxInsertSize bounds one extended INSERT, well under the default
+// max_allowed_packet.
+const maxInsertSize = 1 << 20
+
+// Dump writes the schema and rows of every base table in the connection's
+// database to w. It reads inside a consistent-snapshot transaction, so the
+// dump of InnoDB tables is consistent without locking them.
+func Dump(conn *mysqlwire.Conn, database string, w io.Writer) error {
+	bw := bufio.NewWriterSize(w, 64<<10)
+	fmt.Fprintf(bw, "-- Valence dump of database %s\n-- %s\n\n", quoteName(database), time.Now().UTC().Format(time.RFC3339))
+	bw.WriteString("/*!40101 SET NAMES utf8mb4 */;\n")
+	bw.WriteString("/*!40103 SET TIME_ZONE='+00:00' */;\n")
+	bw.WriteString("/*!40014 SET UNIQUE_CHECKS=0 */;\n")
+	bw.WriteString("/*!40014 SET FOREIGN_KEY_CHECKS=0 */;\n")
+	bw.WriteString("/*!40101 SET SQL_MODE='NO_AUTO_VALUE_ON_ZERO' */;\n\n")
+
+	for _, stmt := range []string{
+		"SET NAMES utf8mb4",
+		"SET TIME_ZONE='+00:00'",
+		"SET SESSION TRANSACTION ISOLATION LEVEL REPEATABLE READ",
+		"START TRANSACTION /*!40100 WITH CONSISTENT SNAPSHOT */",
+	} {
+		if err := conn.Exec(stmt); err != nil {
+			return fmt.Errorf("%s: %w", stmt, err)
+		}
+	}
+	defer conn.Exec("ROLLBACK")
+
+	tables, err := baseTables(conn)
+	if err != nil {
+		return err
+	}
+	for _, table := range tables {
+		if err := dumpTable(conn, bw, table); err != nil {
+			return fmt.Errorf("dump %s: %w", table, err)
+		}
+	}
+
+	bw.WriteString("/*!40014 SET FOREIGN_KEY_CHECKS=1 */;\n")
+	bw.WriteString("/*!40014 SET UNIQUE_CHECKS=1 */;\n")
+	bw.WriteString("\n-- Dump completed\n")
+	return bw.Flush()
+}
+
+func baseTables(conn *mysqlwire.Conn) ([]string, error) {
+	rows, err := conn.Query("SHOW FULL TABLES")
+	if err != nil {
+		return nil, err
+	}
+	var tables []string
+	for rows.Next() {
+		values := rows.Values()
+		if len(values) >= 2 && string(values[1]) == "BASE TABLE" {
+			tables = append(tables, string(values[0]))
+		}
+	}
+	return tables, rows.Close()
+}
+
+func dumpTable(conn *mysqlwire.Conn, w *bufio.Writer, table string) error {
+	rows, err := conn.Query("SHOW CREATE TABLE " + quoteName(table))
+	if err != nil {
+		return err
+	}
+	var create string
+	for rows.Next() {
+		if values := rows.Values(); len(values) >= 2 {
+			create = string(values[1])
+		}
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "--\n-- Table structure for table %s\n--\n\n", quoteName(table))
+	fmt.Fprintf(w, "DROP TABLE IF EXISTS %s;\n%s;\n\n", quoteName(table), create)
+
+	rows, err = conn.Query("SELECT * FROM " + quoteName(table))
+	if err != nil {
+		return err
+	}
+	columns := rows.Columns()
+	insert := "INSERT INTO " + quoteName(table) + " VALUES "
+	var stmt strings.Builder
+	for rows.Next() {
+		if stmt.Len() == 0 {
+			stmt.WriteString(insert)
+		} else {
+			stmt.WriteByte(',')
+		}
+		stmt.WriteByte('(')
+		for i, value := range rows.Values() {
+			if i > 0 {
+				stmt.WriteByte(',')
+			}
+			writeValue(&stmt, columns[i], value)
+		}
+		stmt.WriteByte(')')
+		if stmt.Len() >= maxInsertSize {
+			stmt.WriteString(";\n")
+			if _, err := w.WriteString(stmt.String()); err != nil {
+				_ = rows.Close()
+				return err
+			}
+			stmt.Reset()
+		}
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+	if stmt.Len() > 0 {
+		stmt.WriteString(";\n")
+		w.WriteString(stmt.String())
+	}
+	_, err = w.WriteString("\n")
+	return err
+}
+
+func writeValue(b *strings.Builder, col mysqlwire.Column, value []byte) {
+	switch {
+	case value == nil:
+		b.WriteString("NULL")
+	case col.Numeric():
+		b.Write(value)
+	case col.Binary():
+		if len(value) == 0 {
+			b.WriteString("''")
+			return
+		}
+		b.WriteString("0x")
+		b.WriteString(hex.EncodeToString(value))
+	default:
+		b.WriteByte('\'')
+		for _, c := range value {
+			switch c {
+			case 0:
+				b.WriteString(`\0`)
+			case '\n':
+				b.WriteString(`\n`)
+			case '\r':
+				b.WriteString(`\r`)
+			case 0x1a:
+				b.WriteString(`\Z`)
+			case '\\', '\'', '"':
+				b.WriteByte('\\')
+				b.WriteByte(c)
+			default:
+				b.WriteByte(c)
+			}
+		}
+		b.WriteByte('\'')
+	}
+}
+
+func quoteName(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
@@ -0,0 +1,160 @@
+package mysqldump
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/artefactual-labs/valence/internal/mysqlwire"
+)
+
+// Load runs the statements of a SQL dump read from r and returns how many
+// it ran. Statements end with ";" outside quotes and comments; "--" and
+// "#" comments are dropped, /* */ comments (including /*! */ conditional
+// ones) are passed to the server. Dumps that change the DELIMITER (stored
+// routines and triggers) are not supported.
+func Load(conn *mysqlwire.Conn, r io.Reader) (int, error) {
+	sc := newStatementScanner(r)
+	n := 0
+	for sc.Scan() {
+		if err := conn.Exec(sc.Statement()); err != nil {
+			return n, fmt.Errorf("statement %d (line %d): %w", n+1, sc.line, err)
+		}
+		n++
+	}
+	return n, sc.Err()
+}
+
+type statementScanner struct {
+	r    *bufio.Reader
+	stmt strings.Builder
+	err  error
+	// line is where the current statement started.
+	line    int
+	curLine int
+}
+
+func newStatementScanner(r io.Reader) *statementScanner {
+	return &statementScanner{r: bufio.NewReaderSize(r, 64<<10), curLine: 1}
+}
+
+func (s *statementScanner) Statement() string {
+	return strings.TrimSpace(s.stmt.String())
+}
+
+func (s *statementScanner) Err() error {
+	return s.err
+}
+
+// Scan reads the next non-empty statement, without its terminating ";".
+func (s *statementScanner) Scan() bool {
+	s.stmt.Reset()
+	s.line = s.curLine
+	var quote byte // ', " or ` while inside a quoted string
+	for {
+		c, err := s.r.ReadByte()
+		if errors.Is(err, io.EOF) {
+			if quote != 0 {
+				s.err = fmt.Errorf("unterminated %c quote in statement at line %d", quote, s.line)
+				return false
+			}
+			return strings.TrimSpace(s.stmt.String()) != ""
+		}
+		if err != nil {
+			s.err = err
+			return false
+		}
+		if c == '\n' {
+			s.curLine++
+		}
+
+		if quote != 0 {
+			s.stmt.WriteByte(c)
+			switch {
+			case c == '\\' && quote != '`':
+				next, err := s.r.ReadByte()
+				if err != nil {
+					continue
+				}
+				if next == '\n' {
+					s.curLine++
+				}
+				s.stmt.WriteByte(next)
+			case c == quote:
+				quote = 0
+			}
+			continue
+		}
+
+		switch c {
+		case '\'', '"', '`':
+			quote = c
+			s.stmt.WriteByte(c)
+		case ';':
+			if strings.TrimSpace(s.stmt.String()) == "" {
+				s.stmt.Reset()
+				s.line = s.curLine
+				continue
+			}
+			return true
+		case '#':
+			s.skipLine()
+		case '-':
+			// "--" starts a comment only when followed by whitespace.
+			if next, _ := s.r.Peek(2); len(next) >= 1 && next[0] == '-' && (len(next) == 1 || strings.IndexByte(" \t\r\n", next[1]) >= 0) {
+				s.skipLine()
+				continue
+			}
+			s.stmt.WriteByte(c)
+		case '/':
+			s.stmt.WriteByte(c)
+			if next, _ := s.r.Peek(1); len(next) == 1 && next[0] == '*' {
+				if !s.copyComment() {
+					return false
+				}
+			}
+		case 'D', 'd':
+			if strings.TrimSpace(s.stmt.String()) == "" {
+				if word, _ := s.r.Peek(8); strings.EqualFold(string(c)+string(word), "DELIMITER") {
+					s.err = fmt.Errorf("line %d: DELIMITER is not supported", s.curLine)
+					return false
+				}
+			}
+			s.stmt.WriteByte(c)
+		default:
+			s.stmt.WriteByte(c)
+		}
+	}
+}
+
+// skipLine drops the rest of a comment line.
+func (s *statementScanner) skipLine() {
+	if _, err := s.r.ReadString('\n'); err == nil {
+		s.curLine++
+	}
+	s.stmt.WriteByte('\n')
+}
+
+// copyComment copies a /* */ comment whose "/" was already written.
+func (s *statementScanner) copyComment() bool {
+	open, _ := s.r.ReadByte()
+	s.stmt.WriteByte(open)
+	var prev byte
+	for {
+		c, err := s.r.ReadByte()
+		if err != nil {
+			s.err = fmt.Errorf("unterminated comment in statement at line %d", s.line)
+			return false
+		}
+		if c == '\n' {
+			s.curLine++
+		}
+		s.stmt.WriteByte(c)
+		if prev == '*' && c == '/' {
+			return true
+		}
+		prev = c
+	}
+}
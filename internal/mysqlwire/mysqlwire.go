@@ -0,0 +1,374 @@
+// Package mysqlwire is a small MySQL client speaking just enough of the
+// client/server protocol to authenticate (with mysql_native_password or
+// caching_sha2_password, optionally over TLS) and run plain text-protocol
+// queries, without pulling in a full driver. Ping checks that a server
+// accepts a login before PHP starts; Conn runs the few tasks Valence does
+// against the database itself, such as API keys and dumps.
+package mysqlwire
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+const (
+	clientLongPassword     = 0x00000001
+	clientConnectWithDB    = 0x00000008
+	clientProtocol41       = 0x00000200
+	clientSSL              = 0x00000800
+	clientTransactions     = 0x00002000
+	clientSecureConnection = 0x00008000
+	clientPluginAuth       = 0x00080000
+
+	charsetUTF8MB4 = 45
+	maxPacketSize  = 1 << 24
+
+	comQuit = 0x01
+)
+
+// Options describe the login to attempt.
+type Options struct {
+	User     string
+	Password string
+	DBName   string
+	// TLS, when set, upgrades the connection before authenticating.
+	TLS *tls.Config
+}
+
+// Error is an error packet returned by the server.
+type Error struct {
+	Code    uint16
+	State   string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("mysql error %d (%s): %s", e.Code, e.State, e.Message)
+}
+
+// Permanent reports whether retrying cannot help: bad credentials or a
+// missing database.
+func (e *Error) Permanent() bool {
+	switch e.Code {
+	case 1044, 1045, 1049, 1251:
+		return true
+	}
+	return false
+}
+
+// Ping authenticates on conn, which must be freshly connected, and quits.
+func Ping(conn net.Conn, opts Options) error {
+	c := &client{conn: conn}
+	if err := c.login(opts); err != nil {
+		return err
+	}
+	c.seq = 0
+	return c.writePacket([]byte{comQuit})
+}
+
+type client struct {
+	conn net.Conn
+	seq  byte
+	tls  bool
+}
+
+func (c *client) login(opts Options) error {
+	greeting, err := c.readPacket()
+	if err != nil {
+		return fmt.Errorf("read handshake: %w", err)
+	}
+	if len(greeting) > 0 && greeting[0] == 0xff {
+		return parseError(greeting)
+	}
+	hs, err := parseHandshake(greeting)
+	if err != nil {
+		return err
+	}
+
+	caps := uint32(clientLongPassword | clientProtocol41 | clientSecureConnection |
+		clientTransactions | clientPluginAuth)
+	if opts.DBName != "" {
+		caps |= clientConnectWithDB
+	}
+	if opts.TLS != nil {
+		if hs.caps&clientSSL == 0 {
+			return errors.New("server does not support TLS")
+		}
+		caps |= clientSSL
+		if err := c.writePacket(handshakePrefix(caps)); err != nil {
+			return err
+		}
+		tlsConn := tls.Client(c.conn, opts.TLS)
+		if err := tlsConn.Handshake(); err != nil {
+			return fmt.Errorf("tls handshake: %w", err)
+		}
+		c.conn = tlsConn
+		c.tls = true
+	}
+
+	plugin := hs.plugin
+	authData, err := scramble(plugin, opts.Password, hs.scramble)
+	if err != nil {
+		return err
+	}
+	resp := handshakePrefix(caps)
+	resp = append(resp, opts.User...)
+	resp = append(resp, 0)
+	resp = append(resp, byte(len(authData)))
+	resp = append(resp, authData...)
+	if opts.DBName != "" {
+		resp = append(resp, opts.DBName...)
+		resp = append(resp, 0)
+	}
+	resp = append(resp, plugin...)
+	resp = append(resp, 0)
+	if err := c.writePacket(resp); err != nil {
+		return err
+	}
+
+	seed := hs.scramble
+	for {
+		pkt, err := c.readPacket()
+		if err != nil {
+			return fmt.Errorf("read auth response: %w", err)
+		}
+		if len(pkt) == 0 {
+			return errors.New("empty auth response")
+		}
+		switch pkt[0] {
+		case 0x00:
+			return nil
+		case 0xff:
+			return parseError(pkt)
+		case 0xfe:
+			// Auth switch: plugin name, then the new seed.
+			name, rest, _ := bytes.Cut(pkt[1:], []byte{0})
+			plugin = string(name)
+			seed = bytes.TrimSuffix(rest, []byte{0})
+			authData, err := scramble(plugin, opts.Password, seed)
+			if err != nil {
+				return err
+			}
+			if err := c.writePacket(authData); err != nil {
+				return err
+			}
+		case 0x01:
+			if err := c.cachingSHA2More(pkt[1:], opts.Password, seed); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unexpected auth packet 0x%02x", pkt[0])
+		}
+	}
+}
+
+// cachingSHA2More answers caching_sha2_password's extra round trips.
+func (c *client) cachingSHA2More(data []byte, password string, seed []byte) error {
+	if len(data) == 0 {
+		return errors.New("empty auth data")
+	}
+	switch data[0] {
+	case 0x03: // fast auth succeeded; OK packet follows
+		return nil
+	case 0x04: // full auth
+		if c.tls {
+			return c.writePacket(append([]byte(password), 0))
+		}
+		if err := c.writePacket([]byte{0x02}); err != nil {
+			return err
+		}
+		pkt, err := c.readPacket()
+		if err != nil {
+			return err
+		}
+		if len(pkt) == 0 || pkt[0] != 0x01 {
+			if len(pkt) > 0 && pkt[0] == 0xff {
+				return parseError(pkt)
+			}
+			return errors.New("server did not send its public key")
+		}
+		enc, err := encryptPassword(pkt[1:], password, seed)
+		if err != nil {
+			return err
+		}
+		return c.writePacket(enc)
+	default:
+		return fmt.Errorf("unexpected caching_sha2_password state 0x%02x", data[0])
+	}
+}
+
+type handshake struct {
+	caps     uint32
+	scramble []byte
+	plugin   string
+}
+
+func parseHandshake(pkt []byte) (handshake, error) {
+	var hs handshake
+	if len(pkt) == 0 || pkt[0] != 10 {
+		return hs, errors.New("unsupported handshake protocol")
+	}
+	_, rest, ok := bytes.Cut(pkt[1:], []byte{0}) // server version
+	if !ok || len(rest) < 4+8+1+2 {
+		return hs, errors.New("short handshake")
+	}
+	rest = rest[4:] // connection id
+	hs.scramble = append(hs.scramble, rest[:8]...)
+	rest = rest[9:]
+	hs.caps = uint32(binary.LittleEndian.Uint16(rest))
+	rest = rest[2:]
+	if len(rest) < 1+2+2+1+10 {
+		return hs, nil
+	}
+	rest = rest[3:] // charset, status
+	hs.caps |= uint32(binary.LittleEndian.Uint16(rest)) << 16
+	authLen := int(rest[2])
+	rest = rest[13:]
+	if hs.caps&clientSecureConnection != 0 {
+		n := max(13, authLen-8)
+		if len(rest) < n {
+			return hs, errors.New("short handshake scramble")
+		}
+		hs.scramble = append(hs.scramble, bytes.TrimSuffix(rest[:n], []byte{0})...)
+		rest = rest[n:]
+	}
+	if hs.caps&clientPluginAuth != 0 {
+		name, _, _ := bytes.Cut(rest, []byte{0})
+		hs.plugin = string(name)
+	}
+	if hs.plugin == "" {
+		hs.plugin = "mysql_native_password"
+	}
+	return hs, nil
+}
+
+func handshakePrefix(caps uint32) []byte {
+	buf := make([]byte, 32)
+	binary.LittleEndian.PutUint32(buf, caps)
+	binary.LittleEndian.PutUint32(buf[4:], maxPacketSize)
+	buf[8] = charsetUTF8MB4
+	return buf
+}
+
+func scramble(plugin, password string, seed []byte) ([]byte, error) {
+	if password == "" {
+		return nil, nil
+	}
+	switch plugin {
+	case "mysql_native_password":
+		// SHA1(password) XOR SHA1(seed + SHA1(SHA1(password)))
+		h1 := sha1.Sum([]byte(password))
+		h2 := sha1.Sum(h1[:])
+		h := sha1.New()
+		h.Write(seed)
+		h.Write(h2[:])
+		return xor(h1[:], h.Sum(nil)), nil
+	case "caching_sha2_password":
+		// SHA256(password) XOR SHA256(SHA256(SHA256(password)) + seed)
+		h1 := sha256.Sum256([]byte(password))
+		h2 := sha256.Sum256(h1[:])
+		h := sha256.New()
+		h.Write(h2[:])
+		h.Write(seed)
+		return xor(h1[:], h.Sum(nil)), nil
+	default:
+		return nil, fmt.Errorf("unsupported auth plugin %q", plugin)
+	}
+}
+
+func encryptPassword(keyPEM []byte, password string, seed []byte) ([]byte, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("invalid server public key")
+	}
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := parsed.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("server public key is not RSA")
+	}
+	plain := append([]byte(password), 0)
+	for i := range plain {
+		plain[i] ^= seed[i%len(seed)]
+	}
+	return rsa.EncryptOAEP(sha1.New(), rand.Reader, pub, plain, nil)
+}
+
+func xor(a, b []byte) []byte {
+	out := make([]byte, len(a))
+	for i := range a {
+		out[i] = a[i] ^ b[i]
+	}
+	return out
+}
+
+func parseError(pkt []byte) error {
+	e := &Error{}
+	if len(pkt) >= 3 {
+		e.Code = binary.LittleEndian.Uint16(pkt[1:3])
+	}
+	rest := pkt[min(3, len(pkt)):]
+	if len(rest) >= 6 && rest[0] == '#' {
+		e.State = string(rest[1:6])
+		rest = rest[6:]
+	}
+	e.Message = string(rest)
+	return e
+}
+
+// readPacket reads one logical packet, joining the 16MB chunks a large
+// payload is split into.
+func (c *client) readPacket() ([]byte, error) {
+	var pkt []byte
+	for {
+		var header [4]byte
+		if _, err := io.ReadFull(c.conn, header[:]); err != nil {
+			return nil, err
+		}
+		size := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+		c.seq = header[3] + 1
+		start := len(pkt)
+		pkt = append(pkt, make([]byte, size)...)
+		if _, err := io.ReadFull(c.conn, pkt[start:]); err != nil {
+			return nil, err
+		}
+		if size < maxPacketSize-1 {
+			return pkt, nil
+		}
+	}
+}
+
+func (c *client) writePacket(payload []byte) error {
+	for {
+		size := min(len(payload), maxPacketSize-1)
+		pkt := make([]byte, 4+size)
+		pkt[0] = byte(size)
+		pkt[1] = byte(size >> 8)
+		pkt[2] = byte(size >> 16)
+		pkt[3] = c.seq
+		copy(pkt[4:], payload[:size])
+		c.seq++
+		if _, err := c.conn.Write(pkt); err != nil {
+			return err
+		}
+		payload = payload[size:]
+		// A payload of exactly a multiple of the chunk size ends with an
+		// empty packet.
+		if size < maxPacketSize-1 {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package mysqlwire
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+const comQuery = 0x03
+
+// Column types that hold numbers, written unquoted in SQL.
+const (
+	typeDecimal    = 0x00
+	typeTiny       = 0x01
+	typeShort      = 0x02
+	typeLong       = 0x03
+	typeFloat      = 0x04
+	typeDouble     = 0x05
+	typeLongLong   = 0x08
+	typeInt24      = 0x09
+	typeYear       = 0x0d
+	typeBit        = 0x10
+	typeNewDecimal = 0xf6
+
+	charsetBinary = 63
+)
+
+// Conn is an authenticated connection that runs text-protocol queries one
+// at a time. It is not safe for concurrent use.
+type Conn struct {
+	c *client
+}
+
+// Connect authenticates on conn, which must be freshly connected.
+func Connect(conn net.Conn, opts Options) (*Conn, error) {
+	c := &client{conn: conn}
+	if err := c.login(opts); err != nil {
+		return nil, err
+	}
+	return &Conn{c: c}, nil
+}
+
+// Close quits and closes the connection.
+func (c *Conn) Close() error {
+	c.c.seq = 0
+	err := c.c.writePacket([]byte{comQuit})
+	return errors.Join(err, c.c.conn.Close())
+}
+
+// Exec runs a statement, discarding any rows it returns.
+func (c *Conn) Exec(query string) error {
+	rows, err := c.Query(query)
+	if err != nil {
+		return err
+	}
+	return rows.Close()
+}
+
+// Query runs a statement. The returned Rows must be closed before the
+// next query.
+func (c *Conn) Query(query string) (*Rows, error) {
+	c.c.seq = 0
+	if err := c.c.writePacket(append([]byte{comQuery}, query...)); err != nil {
+		return nil, err
+	}
+	pkt, err := c.c.readPacket()
+	if err != nil {
+		return nil, err
+	}
+	if len(pkt) == 0 {
+		return nil, errors.New("empty query response")
+	}
+	switch pkt[0] {
+	case 0x00:
+		return &Rows{done: true}, nil
+	case 0xff:
+		return nil, parseError(pkt)
+	case 0xfb:
+		return nil, errors.New("LOAD DATA LOCAL INFILE is not supported")
+	}
+
+	count, _, ok := lenencInt(pkt)
+	if !ok {
+		return nil, errors.New("malformed column count")
+	}
+	rows := &Rows{c: c.c, columns: make([]Column, count)}
+	for i := range rows.columns {
+		pkt, err := c.c.readPacket()
+		if err != nil {
+			return nil, err
+		}
+		if rows.columns[i], err = parseColumn(pkt); err != nil {
+			return nil, err
+		}
+	}
+	// Without CLIENT_DEPRECATE_EOF the definitions end with an EOF packet.
+	if pkt, err := c.c.readPacket(); err != nil {
+		return nil, err
+	} else if !isEOF(pkt) {
+		return nil, errors.New("missing end of column definitions")
+	}
+	return rows, nil
+}
+
+// Column describes a result column.
+type Column struct {
+	Name    string
+	Type    byte
+	Charset uint16
+}
+
+// Numeric reports whether the column's values are numbers.
+func (col Column) Numeric() bool {
+	switch col.Type {
+	case typeDecimal, typeTiny, typeShort, typeLong, typeFloat, typeDouble,
+		typeLongLong, typeInt24, typeYear, typeNewDecimal:
+		return true
+	}
+	return false
+}
+
+// Binary reports whether the column holds bytes rather than text.
+func (col Column) Binary() bool {
+	return col.Type == typeBit || (col.Charset == charsetBinary && !col.Numeric())
+}
+
+// Rows iterates over a result set.
+type Rows struct {
+	c       *client
+	columns []Column
+	values  [][]byte
+	err     error
+	done    bool
+}
+
+func (r *Rows) Columns() []Column {
+	return r.columns
+}
+
+// Next advances to the next row, returning false at the end or on error.
+func (r *Rows) Next() bool {
+	if r.done {
+		return false
+	}
+	pkt, err := r.c.readPacket()
+	if err != nil {
+		r.err, r.done = err, true
+		return false
+	}
+	switch {
+	case isEOF(pkt):
+		r.done = true
+		return false
+	case len(pkt) > 0 && pkt[0] == 0xff:
+		r.err, r.done = parseError(pkt), true
+		return false
+	}
+
+	r.values = make([][]byte, len(r.columns))
+	rest := pkt
+	for i := range r.values {
+		if len(rest) > 0 && rest[0] == 0xfb {
+			rest = rest[1:]
+			continue
+		}
+		n, size, ok := lenencInt(rest)
+		if !ok || uint64(len(rest)-size) < n {
+			r.err, r.done = errors.New("malformed row"), true
+			return false
+		}
+		r.values[i] = rest[size : size+int(n)]
+		rest = rest[size+int(n):]
+	}
+	return true
+}
+
+// Values returns the current row; NULL values are nil.
+func (r *Rows) Values() [][]byte {
+	return r.values
+}
+
+func (r *Rows) Err() error {
+	return r.err
+}
+
+// Close reads any remaining rows so the connection can be reused.
+func (r *Rows) Close() error {
+	for r.Next() {
+	}
+	return r.err
+}
+
+func parseColumn(pkt []byte) (Column, error) {
+	var col Column
+	rest := pkt
+	var fields [6][]byte // catalog, schema, table, org_table, name, org_name
+	for i := range fields {
+		n, size, ok := lenencInt(rest)
+		if !ok || uint64(len(rest)-size) < n {
+			return col, errors.New("malformed column definition")
+		}
+		fields[i] = rest[size : size+int(n)]
+		rest = rest[size+int(n):]
+	}
+	// Fixed-length fields: length marker, charset, column length, type.
+	if len(rest) < 1+2+4+1 {
+		return col, errors.New("short column definition")
+	}
+	col.Name = string(fields[4])
+	col.Charset = binary.LittleEndian.Uint16(rest[1:3])
+	col.Type = rest[7]
+	return col, nil
+}
+
+func isEOF(pkt []byte) bool {
+	return len(pkt) > 0 && len(pkt) < 9 && pkt[0] == 0xfe
+}
+
+// lenencInt decodes a length-encoded integer, returning it and the number
+// of bytes it took.
+func lenencInt(b []byte) (uint64, int, bool) {
+	if len(b) == 0 {
+		return 0, 0, false
+	}
+	switch b[0] {
+	case 0xfc:
+		if len(b) < 3 {
+			return 0, 0, false
+		}
+		return uint64(binary.LittleEndian.Uint16(b[1:])), 3, true
+	case 0xfd:
+		if len(b) < 4 {
+			return 0, 0, false
+		}
+		return uint64(b[1]) | uint64(b[2])<<8 | uint64(b[3])<<16, 4, true
+	case 0xfe:
+		if len(b) < 9 {
+			return 0, 0, false
+		}
+		return binary.LittleEndian.Uint64(b[1:]), 9, true
+	case 0xfb, 0xff:
+		return 0, 0, false
+	default:
+		return uint64(b[0]), 1, true
+	}
+}
@@ -0,0 +1,484 @@
+// Package routexpr compiles the boolean expressions of valence's route
+// rules, which match a request on its method, host, path, headers, query
+// and client address. The language is small on purpose:
+//
+//	method == "POST" && hasPrefix(path, "/api/")
+//	header("User-Agent") =~ `(?i)badbot` || !cidr(client_ip, "10.0.0.0/8", "192.168.0.0/16")
+//	query("format") in ["xml", "ead"]
+//
+// Values are strings or booleans. The variables are method, host (without
+// the port), path and client_ip; header(name), query(name) and lower(s)
+// return strings, and hasPrefix(s, prefix), hasSuffix(s, suffix),
+// contains(s, sub) and cidr(ip, prefix...) booleans. Strings compare with
+// == and !=, match a regular expression with =~ and !~, and test
+// membership in a list with in; booleans combine with &&, || and !, and
+// parentheses group. Strings are double-quoted with Go escapes, or
+// back-quoted raw. Regular expressions, lists and CIDR prefixes must be
+// literals, so that everything is checked and compiled up front and an
+// expression that compiles cannot fail on a request.
+package routexpr
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Request is what an expression sees of a request.
+type Request struct {
+	Method   string
+	Host     string
+	Path     string
+	ClientIP string
+	Header   http.Header
+	Query    url.Values
+}
+
+// Program is a compiled expression.
+type Program struct {
+	src  string
+	eval func(*Request) bool
+}
+
+// Compile parses and checks src, which must be a boolean expression.
+func Compile(src string) (*Program, error) {
+	tokens, err := tokenize(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	n, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %s at offset %d", tok, tok.pos)
+	}
+	if n.typ != typeBool {
+		return nil, fmt.Errorf("expression is a string, not a condition")
+	}
+	return &Program{src: src, eval: n.b}, nil
+}
+
+// Match evaluates the expression against r.
+func (p *Program) Match(r *Request) bool {
+	return p.eval(r)
+}
+
+func (p *Program) String() string {
+	return p.src
+}
+
+type valueType int
+
+const (
+	typeString valueType = iota
+	typeBool
+)
+
+func (t valueType) String() string {
+	if t == typeBool {
+		return "boolean"
+	}
+	return "string"
+}
+
+// node is a compiled subexpression: s for strings, b for booleans. lit is
+// set for string literals, which regular expressions, lists and prefixes
+// must be.
+type node struct {
+	typ valueType
+	s   func(*Request) string
+	b   func(*Request) bool
+	lit *string
+}
+
+func stringNode(fn func(*Request) string) node { return node{typ: typeString, s: fn} }
+func boolNode(fn func(*Request) bool) node     { return node{typ: typeBool, b: fn} }
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokString
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string // the operator or identifier, or the unquoted string
+	pos  int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of expression"
+	case tokString:
+		return strconv.Quote(t.text)
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+var operators = []string{"==", "!=", "=~", "!~", "&&", "||", "!", "(", ")", "[", "]", ","}
+
+func tokenize(src string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"' || c == '`':
+			end := strings.IndexByte(src[i+1:], c)
+			// Skip escaped quotes in double-quoted strings.
+			for c == '"' && end >= 0 && escaped(src[i+1:i+1+end]) {
+				next := strings.IndexByte(src[i+2+end:], c)
+				if next < 0 {
+					end = -1
+					break
+				}
+				end += next + 1
+			}
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string at offset %d", i)
+			}
+			text, err := strconv.Unquote(src[i : i+end+2])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string at offset %d: %w", i, err)
+			}
+			tokens = append(tokens, token{tokString, text, i})
+			i += end + 2
+		case c == '_' || unicode.IsLetter(rune(c)):
+			j := i + 1
+			for j < len(src) && (src[j] == '_' || unicode.IsLetter(rune(src[j])) || unicode.IsDigit(rune(src[j]))) {
+				j++
+			}
+			tokens = append(tokens, token{tokIdent, src[i:j], i})
+			i = j
+		default:
+			op := ""
+			for _, candidate := range operators {
+				if strings.HasPrefix(src[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected %q at offset %d", c, i)
+			}
+			tokens = append(tokens, token{tokOp, op, i})
+			i += len(op)
+		}
+	}
+	return append(tokens, token{tokEOF, "", len(src)}), nil
+}
+
+// escaped reports whether s ends in an odd number of backslashes.
+func escaped(s string) bool {
+	n := len(s) - len(strings.TrimRight(s, `\`))
+	return n%2 == 1
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// accept consumes the operator or keyword text if it comes next.
+func (p *parser) accept(text string) bool {
+	if tok := p.peek(); (tok.kind == tokOp || tok.kind == tokIdent) && tok.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(text string) error {
+	if !p.accept(text) {
+		tok := p.peek()
+		return fmt.Errorf("expected %q, got %s at offset %d", text, tok, tok.pos)
+	}
+	return nil
+}
+
+func (p *parser) expr() (node, error) {
+	left, err := p.and()
+	if err != nil {
+		return node{}, err
+	}
+	for p.accept("||") {
+		right, err := p.and()
+		if err != nil {
+			return node{}, err
+		}
+		if err := wantBool("||", left, right); err != nil {
+			return node{}, err
+		}
+		l, r := left.b, right.b
+		left = boolNode(func(req *Request) bool { return l(req) || r(req) })
+	}
+	return left, nil
+}
+
+func (p *parser) and() (node, error) {
+	left, err := p.unary()
+	if err != nil {
+		return node{}, err
+	}
+	for p.accept("&&") {
+		right, err := p.unary()
+		if err != nil {
+			return node{}, err
+		}
+		if err := wantBool("&&", left, right); err != nil {
+			return node{}, err
+		}
+		l, r := left.b, right.b
+		left = boolNode(func(req *Request) bool { return l(req) && r(req) })
+	}
+	return left, nil
+}
+
+func (p *parser) unary() (node, error) {
+	if p.accept("!") {
+		n, err := p.unary()
+		if err != nil {
+			return node{}, err
+		}
+		if err := wantBool("!", n); err != nil {
+			return node{}, err
+		}
+		return boolNode(func(req *Request) bool { return !n.b(req) }), nil
+	}
+	return p.comparison()
+}
+
+func (p *parser) comparison() (node, error) {
+	left, err := p.operand()
+	if err != nil {
+		return node{}, err
+	}
+	tok := p.peek()
+	switch {
+	case tok.kind == tokOp && (tok.text == "==" || tok.text == "!="):
+		p.next()
+		right, err := p.operand()
+		if err != nil {
+			return node{}, err
+		}
+		if left.typ != right.typ {
+			return node{}, fmt.Errorf("%s compares a %s with a %s", tok.text, left.typ, right.typ)
+		}
+		equal := func(req *Request) bool { return left.s(req) == right.s(req) }
+		if left.typ == typeBool {
+			equal = func(req *Request) bool { return left.b(req) == right.b(req) }
+		}
+		if tok.text == "!=" {
+			return boolNode(func(req *Request) bool { return !equal(req) }), nil
+		}
+		return boolNode(equal), nil
+	case tok.kind == tokOp && (tok.text == "=~" || tok.text == "!~"):
+		p.next()
+		right, err := p.operand()
+		if err != nil {
+			return node{}, err
+		}
+		if left.typ != typeString || right.lit == nil {
+			return node{}, fmt.Errorf("%s needs a string on the left and a literal regular expression on the right", tok.text)
+		}
+		re, err := regexp.Compile(*right.lit)
+		if err != nil {
+			return node{}, err
+		}
+		want := tok.text == "=~"
+		return boolNode(func(req *Request) bool { return re.MatchString(left.s(req)) == want }), nil
+	case tok.kind == tokIdent && tok.text == "in":
+		p.next()
+		list, err := p.list()
+		if err != nil {
+			return node{}, err
+		}
+		if left.typ != typeString {
+			return node{}, fmt.Errorf("in needs a string on the left")
+		}
+		return boolNode(func(req *Request) bool { return slices.Contains(list, left.s(req)) }), nil
+	}
+	return left, nil
+}
+
+func (p *parser) list() ([]string, error) {
+	if err := p.expect("["); err != nil {
+		return nil, err
+	}
+	var list []string
+	for !p.accept("]") {
+		if len(list) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		tok := p.next()
+		if tok.kind != tokString {
+			return nil, fmt.Errorf("lists hold string literals, got %s at offset %d", tok, tok.pos)
+		}
+		list = append(list, tok.text)
+	}
+	return list, nil
+}
+
+func (p *parser) operand() (node, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokString:
+		text := tok.text
+		n := stringNode(func(*Request) string { return text })
+		n.lit = &text
+		return n, nil
+	case tokIdent:
+		if p.peek().kind == tokOp && p.peek().text == "(" {
+			return p.call(tok)
+		}
+		return variable(tok)
+	case tokOp:
+		if tok.text == "(" {
+			n, err := p.expr()
+			if err != nil {
+				return node{}, err
+			}
+			return n, p.expect(")")
+		}
+	}
+	return node{}, fmt.Errorf("unexpected %s at offset %d", tok, tok.pos)
+}
+
+func variable(tok token) (node, error) {
+	switch tok.text {
+	case "method":
+		return stringNode(func(r *Request) string { return r.Method }), nil
+	case "host":
+		return stringNode(func(r *Request) string { return r.Host }), nil
+	case "path":
+		return stringNode(func(r *Request) string { return r.Path }), nil
+	case "client_ip":
+		return stringNode(func(r *Request) string { return r.ClientIP }), nil
+	case "true", "false":
+		value := tok.text == "true"
+		return boolNode(func(*Request) bool { return value }), nil
+	}
+	return node{}, fmt.Errorf("unknown variable %q at offset %d", tok.text, tok.pos)
+}
+
+func (p *parser) call(name token) (node, error) {
+	p.next() // (
+	var args []node
+	for !p.accept(")") {
+		if len(args) > 0 {
+			if err := p.expect(","); err != nil {
+				return node{}, err
+			}
+		}
+		arg, err := p.expr()
+		if err != nil {
+			return node{}, err
+		}
+		args = append(args, arg)
+	}
+	arity := func(n int) error {
+		if len(args) != n {
+			return fmt.Errorf("%s takes %d arguments, got %d", name.text, n, len(args))
+		}
+		return wantString(name.text, args...)
+	}
+	switch name.text {
+	case "header":
+		if err := arity(1); err != nil {
+			return node{}, err
+		}
+		return stringNode(func(r *Request) string { return r.Header.Get(args[0].s(r)) }), nil
+	case "query":
+		if err := arity(1); err != nil {
+			return node{}, err
+		}
+		return stringNode(func(r *Request) string { return r.Query.Get(args[0].s(r)) }), nil
+	case "lower":
+		if err := arity(1); err != nil {
+			return node{}, err
+		}
+		return stringNode(func(r *Request) string { return strings.ToLower(args[0].s(r)) }), nil
+	case "hasPrefix", "hasSuffix", "contains":
+		if err := arity(2); err != nil {
+			return node{}, err
+		}
+		test := map[string]func(string, string) bool{
+			"hasPrefix": strings.HasPrefix,
+			"hasSuffix": strings.HasSuffix,
+			"contains":  strings.Contains,
+		}[name.text]
+		return boolNode(func(r *Request) bool { return test(args[0].s(r), args[1].s(r)) }), nil
+	case "cidr":
+		if len(args) < 2 {
+			return node{}, fmt.Errorf("cidr takes an address and one or more prefixes")
+		}
+		if err := wantString("cidr", args...); err != nil {
+			return node{}, err
+		}
+		var prefixes []netip.Prefix
+		for _, arg := range args[1:] {
+			if arg.lit == nil {
+				return node{}, fmt.Errorf("cidr prefixes must be string literals")
+			}
+			prefix, err := netip.ParsePrefix(*arg.lit)
+			if err != nil {
+				return node{}, err
+			}
+			prefixes = append(prefixes, prefix.Masked())
+		}
+		return boolNode(func(r *Request) bool {
+			addr, err := netip.ParseAddr(args[0].s(r))
+			if err != nil {
+				return false
+			}
+			addr = addr.Unmap()
+			return slices.ContainsFunc(prefixes, func(p netip.Prefix) bool { return p.Contains(addr) })
+		}), nil
+	}
+	return node{}, fmt.Errorf("unknown function %q at offset %d", name.text, name.pos)
+}
+
+func wantBool(op string, nodes ...node) error {
+	for _, n := range nodes {
+		if n.typ != typeBool {
+			return fmt.Errorf("%s needs conditions, got a string", op)
+		}
+	}
+	return nil
+}
+
+func wantString(op string, nodes ...node) error {
+	for _, n := range nodes {
+		if n.typ != typeString {
+			return fmt.Errorf("%s needs strings, got a condition", op)
+		}
+	}
+	return nil
+}
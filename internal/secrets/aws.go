@@ -0,0 +1,119 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/artefactual-labs/valence/internal/awssig"
+)
+
+// awsProvider reads fields from a JSON SecretString stored in AWS Secrets
+// Manager, signing requests with static credentials from the environment.
+type awsProvider struct {
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	secretID     string
+	endpoint     string
+	client       *http.Client
+}
+
+func newAWSFromEnv() (Provider, error) {
+	region := envFirst("AWS_REGION", "AWS_DEFAULT_REGION")
+	if region == "" {
+		return nil, fmt.Errorf("AWS_REGION is required")
+	}
+	accessKey, err := FromEnv("AWS_ACCESS_KEY_ID")
+	if err != nil {
+		return nil, err
+	}
+	secretKey, err := FromEnv("AWS_SECRET_ACCESS_KEY")
+	if err != nil {
+		return nil, err
+	}
+	if accessKey == "" || secretKey == "" {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are required")
+	}
+	sessionToken, err := FromEnv("AWS_SESSION_TOKEN")
+	if err != nil {
+		return nil, err
+	}
+	secretID := strings.TrimSpace(os.Getenv("VALENCE_AWS_SECRET_ID"))
+	if secretID == "" {
+		return nil, fmt.Errorf("VALENCE_AWS_SECRET_ID is required")
+	}
+	return &awsProvider{
+		region:       region,
+		accessKey:    accessKey,
+		secretKey:    secretKey,
+		sessionToken: sessionToken,
+		secretID:     secretID,
+		endpoint:     fmt.Sprintf("secretsmanager.%s.amazonaws.com", region),
+		client:       &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (p *awsProvider) Name() string { return "aws" }
+
+func (p *awsProvider) Lookup(ctx context.Context, key string) (string, error) {
+	payload, err := json.Marshal(map[string]string{"SecretId": p.secretID})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://"+p.endpoint+"/", bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	p.sign(req, payload, time.Now().UTC())
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", fmt.Errorf("secrets manager returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var body struct {
+		SecretString string `json:"SecretString"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("decode secrets manager response: %w", err)
+	}
+	var fields map[string]string
+	if err := json.Unmarshal([]byte(body.SecretString), &fields); err != nil {
+		return "", fmt.Errorf("secret %s is not a JSON object of strings", p.secretID)
+	}
+	val, ok := fields[key]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return val, nil
+}
+
+// sign adds AWS Signature Version 4 headers to req.
+func (p *awsProvider) sign(req *http.Request, payload []byte, now time.Time) {
+	creds := awssig.Credentials{AccessKey: p.accessKey, SecretKey: p.secretKey, SessionToken: p.sessionToken}
+	awssig.Sign(req, creds, p.region, "secretsmanager", awssig.PayloadHash(payload), now)
+}
+
+func envFirst(keys ...string) string {
+	for _, key := range keys {
+		if val := strings.TrimSpace(os.Getenv(key)); val != "" {
+			return val
+		}
+	}
+	return ""
+}
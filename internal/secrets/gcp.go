@@ -0,0 +1,103 @@
+package secrets
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const gcpMetadataTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+// gcpProvider reads one Google Secret Manager secret per key, authenticating
+// with the instance service account from the metadata server. ATOM_MYSQL_PASSWORD
+// maps to the secret "<prefix>atom-mysql-password".
+type gcpProvider struct {
+	project string
+	prefix  string
+	client  *http.Client
+}
+
+func newGCPFromEnv() (Provider, error) {
+	project := envFirst("VALENCE_GCP_PROJECT", "GOOGLE_CLOUD_PROJECT")
+	if project == "" {
+		return nil, fmt.Errorf("VALENCE_GCP_PROJECT is required")
+	}
+	return &gcpProvider{
+		project: project,
+		prefix:  strings.TrimSpace(os.Getenv("VALENCE_GCP_SECRET_PREFIX")),
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (p *gcpProvider) Name() string { return "gcp" }
+
+func (p *gcpProvider) Lookup(ctx context.Context, key string) (string, error) {
+	token, err := p.accessToken(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	name := p.prefix + strings.ToLower(strings.ReplaceAll(key, "_", "-"))
+	endpoint := fmt.Sprintf("https://secretmanager.googleapis.com/v1/projects/%s/secrets/%s/versions/latest:access", p.project, name)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return "", ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("secret manager returned %s for %s", resp.Status, name)
+	}
+
+	var body struct {
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("decode secret manager response: %w", err)
+	}
+	data, err := base64.StdEncoding.DecodeString(body.Payload.Data)
+	if err != nil {
+		return "", fmt.Errorf("decode secret %s: %w", name, err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func (p *gcpProvider) accessToken(ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, gcpMetadataTokenURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("metadata server: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata server returned %s", resp.Status)
+	}
+
+	var body struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("decode metadata token: %w", err)
+	}
+	return body.AccessToken, nil
+}
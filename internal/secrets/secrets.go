@@ -0,0 +1,101 @@
+package secrets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ErrNotFound is returned by a Provider that does not hold a value for key.
+var ErrNotFound = errors.New("secret not found")
+
+// Provider resolves secrets such as MySQL credentials and the internal API
+// token by their environment variable name.
+type Provider interface {
+	Name() string
+	Lookup(ctx context.Context, key string) (string, error)
+}
+
+// Env resolves secrets from the environment and *_FILE variables.
+var Env Provider = envProvider{}
+
+type envProvider struct{}
+
+func (envProvider) Name() string { return "env" }
+
+func (envProvider) Lookup(_ context.Context, key string) (string, error) {
+	return FromEnv(key)
+}
+
+// FromEnv returns the value of the environment variable key or, when it is
+// unset, the contents of the file named by key+"_FILE" (Docker/Kubernetes
+// secrets). Setting both is reported as an error.
+func FromEnv(key string) (string, error) {
+	val := strings.TrimSpace(os.Getenv(key))
+	file := strings.TrimSpace(os.Getenv(key + "_FILE"))
+	if file == "" {
+		return val, nil
+	}
+	if val != "" {
+		return "", fmt.Errorf("both %s and %s_FILE are set", key, key)
+	}
+	contents, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("read %s_FILE: %w", key, err)
+	}
+	return strings.TrimSpace(string(contents)), nil
+}
+
+// NewFromEnv returns the provider selected by VALENCE_SECRETS_PROVIDER
+// (env, vault, aws or gcp). Keys a remote provider does not hold fall back
+// to the environment.
+func NewFromEnv() (Provider, error) {
+	kind := strings.ToLower(strings.TrimSpace(os.Getenv("VALENCE_SECRETS_PROVIDER")))
+	var (
+		p   Provider
+		err error
+	)
+	switch kind {
+	case "", "env":
+		return Env, nil
+	case "vault":
+		p, err = newVaultFromEnv()
+	case "aws":
+		p, err = newAWSFromEnv()
+	case "gcp":
+		p, err = newGCPFromEnv()
+	default:
+		return nil, fmt.Errorf("unknown VALENCE_SECRETS_PROVIDER %q", kind)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s secrets provider: %w", kind, err)
+	}
+	return withEnvFallback{p}, nil
+}
+
+type withEnvFallback struct {
+	Provider
+}
+
+func (p withEnvFallback) Lookup(ctx context.Context, key string) (string, error) {
+	val, err := p.Provider.Lookup(ctx, key)
+	if errors.Is(err, ErrNotFound) {
+		return FromEnv(key)
+	}
+	return val, err
+}
+
+// Resolve looks up each key and returns the values by key.
+func Resolve(ctx context.Context, p Provider, keys ...string) (map[string]string, error) {
+	values := make(map[string]string, len(keys))
+	for _, key := range keys {
+		val, err := p.Lookup(ctx, key)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		values[key] = val
+	}
+	return values, nil
+}
@@ -0,0 +1,96 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// vaultProvider reads fields from a single Vault KV secret. Both KV v1 and
+// v2 mounts are supported; for v2 the path must include "data/", e.g.
+// "secret/data/atom".
+type vaultProvider struct {
+	addr      string
+	token     string
+	namespace string
+	path      string
+	client    *http.Client
+}
+
+func newVaultFromEnv() (Provider, error) {
+	addr := strings.TrimRight(strings.TrimSpace(os.Getenv("VAULT_ADDR")), "/")
+	if addr == "" {
+		return nil, fmt.Errorf("VAULT_ADDR is required")
+	}
+	token, err := FromEnv("VAULT_TOKEN")
+	if err != nil {
+		return nil, err
+	}
+	if token == "" {
+		return nil, fmt.Errorf("VAULT_TOKEN is required")
+	}
+	path := strings.Trim(strings.TrimSpace(os.Getenv("VALENCE_VAULT_SECRET_PATH")), "/")
+	if path == "" {
+		return nil, fmt.Errorf("VALENCE_VAULT_SECRET_PATH is required")
+	}
+	return &vaultProvider{
+		addr:      addr,
+		token:     token,
+		namespace: strings.TrimSpace(os.Getenv("VAULT_NAMESPACE")),
+		path:      path,
+		client:    &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (p *vaultProvider) Name() string { return "vault" }
+
+func (p *vaultProvider) Lookup(ctx context.Context, key string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.addr+"/v1/"+p.path, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", p.token)
+	if p.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", p.namespace)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return "", ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault returned %s for %s", resp.Status, p.path)
+	}
+
+	var body struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("decode vault response: %w", err)
+	}
+	fields := body.Data
+	if nested, ok := body.Data["data"]; ok {
+		// KV v2 wraps the fields in data.data.
+		fields = nil
+		if err := json.Unmarshal(nested, &fields); err != nil {
+			return "", fmt.Errorf("decode vault response: %w", err)
+		}
+	}
+	raw, ok := fields[key]
+	if !ok {
+		return "", ErrNotFound
+	}
+	var val string
+	if err := json.Unmarshal(raw, &val); err != nil {
+		return "", fmt.Errorf("vault field %s is not a string", key)
+	}
+	return val, nil
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/artefactual-labs/valence/internal/secrets"
+)
+
+// provisionAdminScript creates the superuser unless an account with the
+// same username or email exists, so restarts never touch existing users.
+const provisionAdminScript = `
+$stmt = Propel::getConnection()->prepare('SELECT COUNT(*) FROM user WHERE username = ? OR email = ?');
+$stmt->execute([$username, $email]);
+if (0 < $stmt->fetchColumn()) {
+  exit(0);
+}
+if (0 != $status = $runTask(['tools:add-superuser', '--email='.$email, '--password='.$password, $username])) {
+  exit($status);
+}
+echo "created administrator $username\n";
+`
+
+type adminAccount struct {
+	username string
+	email    string
+	password string
+}
+
+// adminFromEnv reads ATOM_ADMIN_*; ok is false when provisioning is not
+// configured.
+func adminFromEnv(ctx context.Context, provider secrets.Provider) (adminAccount, bool, error) {
+	account := adminAccount{
+		username: envOrDefault("ATOM_ADMIN_USERNAME", ""),
+		email:    envOrDefault("ATOM_ADMIN_EMAIL", ""),
+	}
+	password, err := provider.Lookup(ctx, "ATOM_ADMIN_PASSWORD")
+	if err != nil && !errors.Is(err, secrets.ErrNotFound) {
+		return account, false, err
+	}
+	account.password = password
+
+	if account.username == "" && account.email == "" && account.password == "" {
+		return account, false, nil
+	}
+	if account.username == "" || account.email == "" || account.password == "" {
+		return account, false, fmt.Errorf("ATOM_ADMIN_USERNAME, ATOM_ADMIN_EMAIL and ATOM_ADMIN_PASSWORD must be set together")
+	}
+	return account, true, nil
+}
+
+func provisionAdmin(root string, account adminAccount) error {
+	logInfof("ensuring administrator %s exists", account.username)
+	code := fmt.Sprintf("$username = '%s';\n$email = '%s';\n$password = '%s';\n%s",
+		phpEscape(account.username), phpEscape(account.email), phpEscape(account.password), provisionAdminScript)
+	return runAtomScript(root, code)
+}
@@ -0,0 +1,488 @@
+package server
+
+import (
+	"cmp"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/artefactual-labs/valence/internal/bootstrap"
+	"github.com/artefactual-labs/valence/internal/mysqlwire"
+	"go.etcd.io/bbolt"
+)
+
+// API keys give each team or integration its own credential for the
+// internal API, limited to the scopes it needs, where
+// ATOM_VALENCE_INTERNAL_TOKEN is one credential with full access. With
+// VALENCE_API_KEYS=true, keys are read from the valence_api_key table of
+// the primary site's AtoM database, or the state database with
+// VALENCE_STATE_STORE=local, which only hold their SHA-256 hash; valence
+// api-key create|list|revoke manages them. A key is sent like the token,
+// as "Authorization: Bearer vk_<id>_<secret>".
+
+// apiScopes are the scopes a key can hold; "*" holds them all.
+var apiScopes = []string{
+	"status:read",     // health, status and inventory endpoints
+	"audit:read",      // /v/audit
+	"storage:read",    // storage locations and signed download URLs
+	"storage:write",   // task file uploads and upload URLs
+	"tasks:run",       // /v/tasks
+	"cache:clear",     // /v/cache/clear
+	"derivatives:run", // /v/derivatives
+	"admin",           // draining, switching and reloading atom versions
+}
+
+// requiredScope returns the scope a request to the internal API needs.
+func requiredScope(r *http.Request) string {
+	p := r.URL.Path
+	read := r.Method == http.MethodGet || r.Method == http.MethodHead
+	switch {
+	case p == "/v/audit":
+		return "audit:read"
+	case p == "/v/signed-urls", strings.HasPrefix(p, "/v/storage/"):
+		return "storage:read"
+	case p == "/v/uploads", p == "/v/tasks/files":
+		return "storage:write"
+	case p == "/v/tasks", strings.HasPrefix(p, "/v/tasks/"):
+		return "tasks:run"
+	case strings.HasPrefix(p, "/v/cache/clear"):
+		return "cache:clear"
+	case p == "/v/derivatives":
+		return "derivatives:run"
+	case p == "/v/debug/capture":
+		// Captures hold request and response bodies.
+		return "admin"
+	case !read && (p == "/v/drain" || strings.HasPrefix(p, "/v/atom/")):
+		return "admin"
+	default:
+		return "status:read"
+	}
+}
+
+var apiKeyNameRe = regexp.MustCompile(`^[A-Za-z0-9 ._@-]{1,100}$`)
+
+// apiKeyRe matches a key as handed out, capturing its id and its secret.
+var (
+	apiKeyRe   = regexp.MustCompile(`^vk_([0-9a-f]{16})_([A-Za-z0-9_-]{43})$`)
+	apiKeyIDRe = regexp.MustCompile(`^[0-9a-f]{16}$`)
+)
+
+type apiKey struct {
+	ID        string
+	Name      string
+	Scopes    []string
+	CreatedAt string
+	RevokedAt string
+	hash      string
+}
+
+func (k apiKey) allows(scope string) bool {
+	return slices.Contains(k.Scopes, "*") || slices.Contains(k.Scopes, scope)
+}
+
+const apiKeyTableSQL = "CREATE TABLE IF NOT EXISTS valence_api_key (" +
+	"id CHAR(16) NOT NULL PRIMARY KEY, " +
+	"name VARCHAR(100) NOT NULL, " +
+	"secret_sha256 CHAR(64) NOT NULL, " +
+	"scopes VARCHAR(1024) NOT NULL, " +
+	"created_at DATETIME NOT NULL, " +
+	"revoked_at DATETIME NULL" +
+	") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4"
+
+// readAPIKeys lists the keys in the table, which may not exist yet.
+func readAPIKeys(conn *mysqlwire.Conn) ([]apiKey, error) {
+	rows, err := conn.Query("SELECT id, name, secret_sha256, scopes, created_at, COALESCE(revoked_at, '') " +
+		"FROM valence_api_key ORDER BY created_at, id")
+	var mysqlErr *mysqlwire.Error
+	if errors.As(err, &mysqlErr) && mysqlErr.Code == 1146 { // no such table
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var keys []apiKey
+	for rows.Next() {
+		v := rows.Values()
+		keys = append(keys, apiKey{
+			ID:        string(v[0]),
+			Name:      string(v[1]),
+			hash:      string(v[2]),
+			Scopes:    strings.Split(string(v[3]), ","),
+			CreatedAt: string(v[4]),
+			RevokedAt: string(v[5]),
+		})
+	}
+	return keys, rows.Close()
+}
+
+// apiKeyBackend is where the keys are kept.
+type apiKeyBackend interface {
+	list() ([]apiKey, error)
+	// add stores a new key, with its hash, created now.
+	add(key apiKey) error
+	revoke(id string) error
+	String() string
+}
+
+// apiKeyBackendFromEnv picks the backend VALENCE_STATE_STORE names; dial
+// connects to the AtoM database.
+func apiKeyBackendFromEnv(dial func() (*mysqlwire.Conn, error)) (apiKeyBackend, error) {
+	path, err := stateDBFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if path != "" {
+		return localAPIKeys{path: path}, nil
+	}
+	return mysqlAPIKeys{dial: dial}, nil
+}
+
+type mysqlAPIKeys struct {
+	dial func() (*mysqlwire.Conn, error)
+}
+
+func (m mysqlAPIKeys) String() string { return "valence_api_key" }
+
+func (m mysqlAPIKeys) list() ([]apiKey, error) {
+	conn, err := m.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return readAPIKeys(conn)
+}
+
+func (m mysqlAPIKeys) add(key apiKey) error {
+	conn, err := m.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.Exec(apiKeyTableSQL); err != nil {
+		return fmt.Errorf("create valence_api_key: %w", err)
+	}
+	return conn.Exec(fmt.Sprintf("INSERT INTO valence_api_key (id, name, secret_sha256, scopes, created_at) VALUES (%s, %s, %s, %s, UTC_TIMESTAMP())",
+		sqlString(key.ID), sqlString(key.Name), sqlString(key.hash), sqlString(strings.Join(key.Scopes, ","))))
+}
+
+func (m mysqlAPIKeys) revoke(id string) error {
+	conn, err := m.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	keys, err := readAPIKeys(conn)
+	if err != nil {
+		return err
+	}
+	if !slices.ContainsFunc(keys, func(k apiKey) bool { return k.ID == id }) {
+		return fmt.Errorf("no api key %s", id)
+	}
+	return conn.Exec("UPDATE valence_api_key SET revoked_at = UTC_TIMESTAMP() WHERE revoked_at IS NULL AND id = " + sqlString(id))
+}
+
+// localAPIKeys keeps the keys in the state database, by id.
+type localAPIKeys struct {
+	path string
+}
+
+// storedAPIKey is a key as the state database holds it.
+type storedAPIKey struct {
+	Name      string   `json:"name"`
+	Scopes    []string `json:"scopes"`
+	Hash      string   `json:"secret_sha256"`
+	CreatedAt string   `json:"created_at"`
+	RevokedAt string   `json:"revoked_at,omitempty"`
+}
+
+func (l localAPIKeys) String() string { return l.path }
+
+func (l localAPIKeys) list() ([]apiKey, error) {
+	var keys []apiKey
+	err := stateView(l.path, func(tx *bbolt.Tx) error {
+		b := tx.Bucket(stateAPIKeysBucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(id, data []byte) error {
+			var stored storedAPIKey
+			if err := json.Unmarshal(data, &stored); err != nil {
+				return fmt.Errorf("api key %s: %w", id, err)
+			}
+			keys = append(keys, apiKey{
+				ID:        string(id),
+				Name:      stored.Name,
+				Scopes:    stored.Scopes,
+				CreatedAt: stored.CreatedAt,
+				RevokedAt: stored.RevokedAt,
+				hash:      stored.Hash,
+			})
+			return nil
+		})
+	})
+	slices.SortFunc(keys, func(a, b apiKey) int {
+		return cmp.Or(strings.Compare(a.CreatedAt, b.CreatedAt), strings.Compare(a.ID, b.ID))
+	})
+	return keys, err
+}
+
+func (l localAPIKeys) add(key apiKey) error {
+	data, err := json.Marshal(storedAPIKey{
+		Name:      key.Name,
+		Scopes:    key.Scopes,
+		Hash:      key.hash,
+		CreatedAt: time.Now().UTC().Format(time.DateTime),
+	})
+	if err != nil {
+		return err
+	}
+	return stateUpdate(l.path, func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(stateAPIKeysBucket)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key.ID), data)
+	})
+}
+
+func (l localAPIKeys) revoke(id string) error {
+	return stateUpdate(l.path, func(tx *bbolt.Tx) error {
+		b := tx.Bucket(stateAPIKeysBucket)
+		var data []byte
+		if b != nil {
+			data = b.Get([]byte(id))
+		}
+		if data == nil {
+			return fmt.Errorf("no api key %s", id)
+		}
+		var stored storedAPIKey
+		if err := json.Unmarshal(data, &stored); err != nil {
+			return err
+		}
+		if stored.RevokedAt != "" {
+			return nil
+		}
+		stored.RevokedAt = time.Now().UTC().Format(time.DateTime)
+		data, err := json.Marshal(stored)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(id), data)
+	})
+}
+
+// apiKeyStore caches the keys, reading them again once they are older
+// than refresh, so a revoked key stops working within that time.
+type apiKeyStore struct {
+	backend apiKeyBackend
+	refresh time.Duration
+
+	mu       sync.Mutex
+	keys     map[string]apiKey
+	loadedAt time.Time
+}
+
+// apiKeys is set by serve when VALENCE_API_KEYS is on.
+var apiKeys *apiKeyStore
+
+func apiKeyStoreFromEnv(cfg bootstrap.Config) (*apiKeyStore, error) {
+	if !envBool("VALENCE_API_KEYS", false) {
+		return nil, nil
+	}
+	backend, err := apiKeyBackendFromEnv(func() (*mysqlwire.Conn, error) {
+		conn, _, err := dialMySQL(cfg, 2*time.Second)
+		return conn, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &apiKeyStore{backend: backend, refresh: envDuration("VALENCE_API_KEYS_REFRESH", 30*time.Second)}, nil
+}
+
+// verify returns the unrevoked key bearer is.
+func (s *apiKeyStore) verify(bearer string) (apiKey, bool) {
+	m := apiKeyRe.FindStringSubmatch(bearer)
+	if m == nil {
+		return apiKey{}, false
+	}
+	s.mu.Lock()
+	if time.Since(s.loadedAt) >= s.refresh {
+		if err := s.load(); err != nil {
+			// Keep the keys read last; with none read, nothing verifies.
+			logWarnf("api keys: %v", err)
+		}
+	}
+	key, ok := s.keys[m[1]]
+	s.mu.Unlock()
+	if !ok || key.RevokedAt != "" {
+		return apiKey{}, false
+	}
+	sum := sha256.Sum256([]byte(m[2]))
+	if subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(key.hash)) != 1 {
+		return apiKey{}, false
+	}
+	return key, true
+}
+
+func (s *apiKeyStore) load() error {
+	// Back off as after a successful read, so a database outage does not
+	// cost every request a connection attempt.
+	s.loadedAt = time.Now()
+	list, err := s.backend.list()
+	if err != nil {
+		return err
+	}
+	keys := make(map[string]apiKey, len(list))
+	for _, key := range list {
+		keys[key.ID] = key
+	}
+	s.keys = keys
+	return nil
+}
+
+// bearerAPIKey returns the key r authenticates with, if any.
+func bearerAPIKey(r *http.Request) (apiKey, bool) {
+	if apiKeys == nil {
+		return apiKey{}, false
+	}
+	bearer, ok := strings.CutPrefix(strings.TrimSpace(r.Header.Get("Authorization")), "Bearer ")
+	if !ok {
+		return apiKey{}, false
+	}
+	return apiKeys.verify(bearer)
+}
+
+// internalAPIConfigured reports whether the internal API requires
+// credentials, which the endpoints that change state insist on.
+func internalAPIConfigured() bool {
+	return internalAPIToken() != "" || apiKeys != nil
+}
+
+// sqlString quotes s as a MySQL string literal.
+func sqlString(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`, "\x00", `\0`).Replace(s) + "'"
+}
+
+// cliAPIKeyBackend returns where the api-key commands find the keys.
+func cliAPIKeyBackend() (apiKeyBackend, error) {
+	return apiKeyBackendFromEnv(func() (*mysqlwire.Conn, error) {
+		conn, _, _, err := connectDB()
+		return conn, err
+	})
+}
+
+// apiKeyCommand manages API keys.
+func apiKeyCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: valence api-key create|list|revoke [flags]")
+	}
+	switch args[0] {
+	case "create":
+		return apiKeyCreateCommand(args[1:])
+	case "list":
+		return apiKeyListCommand(args[1:])
+	case "revoke":
+		return apiKeyRevokeCommand(args[1:])
+	default:
+		return fmt.Errorf("unknown api-key subcommand %q", args[0])
+	}
+}
+
+func apiKeyCreateCommand(args []string) error {
+	fs := flag.NewFlagSet("api-key create", flag.ContinueOnError)
+	name := fs.String("name", "", "who or what the key is for")
+	scopeList := fs.String("scopes", "", "comma-separated scopes: "+strings.Join(apiScopes, ", ")+", or *")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if !apiKeyNameRe.MatchString(*name) {
+		return errors.New("-name is required: letters, digits, spaces and ._@- only, up to 100")
+	}
+	scopes := commaList(*scopeList)
+	if len(scopes) == 0 {
+		return errors.New("-scopes is required")
+	}
+	for _, scope := range scopes {
+		if scope != "*" && !slices.Contains(apiScopes, scope) {
+			return fmt.Errorf("unknown scope %q (want %s or *)", scope, strings.Join(apiScopes, ", "))
+		}
+	}
+
+	backend, err := cliAPIKeyBackend()
+	if err != nil {
+		return err
+	}
+
+	id := make([]byte, 8)
+	secret := make([]byte, 32)
+	_, _ = rand.Read(id)
+	_, _ = rand.Read(secret)
+	encoded := base64.RawURLEncoding.EncodeToString(secret)
+	sum := sha256.Sum256([]byte(encoded))
+	key := apiKey{ID: hex.EncodeToString(id), Name: *name, Scopes: scopes, hash: hex.EncodeToString(sum[:])}
+	if err := backend.add(key); err != nil {
+		return err
+	}
+	logInfof("created api key %s for %s with scopes %s; it is shown only once", key.ID, key.Name, strings.Join(scopes, ","))
+	fmt.Printf("vk_%s_%s\n", key.ID, encoded)
+	return nil
+}
+
+func apiKeyListCommand(args []string) error {
+	fs := flag.NewFlagSet("api-key list", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	backend, err := cliAPIKeyBackend()
+	if err != nil {
+		return err
+	}
+	keys, err := backend.list()
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tSCOPES\tCREATED (UTC)\tREVOKED (UTC)")
+	for _, key := range keys {
+		revoked := key.RevokedAt
+		if revoked == "" {
+			revoked = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", key.ID, key.Name, strings.Join(key.Scopes, ","), key.CreatedAt, revoked)
+	}
+	return tw.Flush()
+}
+
+func apiKeyRevokeCommand(args []string) error {
+	fs := flag.NewFlagSet("api-key revoke", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	id := fs.Arg(0)
+	if !apiKeyIDRe.MatchString(id) {
+		return errors.New("usage: valence api-key revoke <id>")
+	}
+	backend, err := cliAPIKeyBackend()
+	if err != nil {
+		return err
+	}
+	if err := backend.revoke(id); err != nil {
+		return err
+	}
+	logInfof("revoked api key %s; running servers stop accepting it within VALENCE_API_KEYS_REFRESH", id)
+	return nil
+}
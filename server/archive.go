@@ -0,0 +1,125 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/artefactual-labs/valence/internal/atomembed"
+	"github.com/artefactual-labs/valence/internal/awssig"
+	"github.com/artefactual-labs/valence/internal/secrets"
+)
+
+// useRemoteArchive downloads the archive at url in place of the embedded
+// one, and the vendor layer at VALENCE_ATOM_VENDOR_ARCHIVE_URL if set. It
+// reports true, without downloading, when root is set and already holds
+// the archive pinned by VALENCE_ATOM_ARCHIVE_SHA256.
+func useRemoteArchive(ctx context.Context, url, root string) (bool, error) {
+	sha := strings.TrimSpace(os.Getenv("VALENCE_ATOM_ARCHIVE_SHA256"))
+	if root != "" && sha != "" && strings.EqualFold(atomembed.InstalledHash(root), sha) {
+		logInfof("atom root %s already holds archive %s", root, sha)
+		return true, nil
+	}
+
+	data, err := fetchArchive(ctx, url, sha, strings.TrimSpace(os.Getenv("VALENCE_ATOM_ARCHIVE_SIGNATURE_URL")))
+	if err != nil {
+		return false, err
+	}
+	atomembed.UseArchive(data)
+
+	if vendorURL := strings.TrimSpace(os.Getenv("VALENCE_ATOM_VENDOR_ARCHIVE_URL")); vendorURL != "" {
+		vendorSHA := strings.TrimSpace(os.Getenv("VALENCE_ATOM_VENDOR_ARCHIVE_SHA256"))
+		vendor, err := fetchArchive(ctx, vendorURL, vendorSHA, "")
+		if err != nil {
+			return false, fmt.Errorf("vendor layer: %w", err)
+		}
+		atomembed.UseVendorArchive(vendor)
+	}
+	logInfof("using remote atom archive %s", atomembed.ArchiveHash())
+	return false, nil
+}
+
+// fetchArchive downloads and verifies one archive layer. Layers with a
+// checksum are cached in VALENCE_ATOM_ARCHIVE_CACHE_DIR when it is set.
+func fetchArchive(ctx context.Context, url, sha, signatureURL string) ([]byte, error) {
+	opts := atomembed.FetchOptions{
+		URL:          url,
+		SHA256:       sha,
+		SignatureURL: signatureURL,
+		AWSRegion:    envOrDefault("AWS_REGION", os.Getenv("AWS_DEFAULT_REGION")),
+		S3Endpoint:   strings.TrimSpace(os.Getenv("AWS_ENDPOINT_URL_S3")),
+		CacheDir:     strings.TrimSpace(os.Getenv("VALENCE_ATOM_ARCHIVE_CACHE_DIR")),
+	}
+
+	publicKey, err := secrets.FromEnv("VALENCE_ATOM_ARCHIVE_PUBLIC_KEY")
+	if err != nil {
+		return nil, err
+	}
+	if publicKey != "" {
+		if opts.PublicKey, err = atomembed.ParsePublicKey(publicKey); err != nil {
+			return nil, err
+		}
+	}
+	if strings.HasPrefix(url, "s3://") {
+		if opts.AWS, err = awsCredentialsFromEnv(); err != nil {
+			return nil, err
+		}
+	}
+
+	logInfof("downloading atom archive from %s", url)
+	return atomembed.Fetch(ctx, opts)
+}
+
+func awsCredentialsFromEnv() (awssig.Credentials, error) {
+	var creds awssig.Credentials
+	var err error
+	if creds.AccessKey, err = secrets.FromEnv("AWS_ACCESS_KEY_ID"); err != nil {
+		return creds, err
+	}
+	if creds.SecretKey, err = secrets.FromEnv("AWS_SECRET_ACCESS_KEY"); err != nil {
+		return creds, err
+	}
+	creds.SessionToken, err = secrets.FromEnv("AWS_SESSION_TOKEN")
+	return creds, err
+}
+
+// extractOwnershipFromEnv applies VALENCE_EXTRACT_OWNER ("uid[:gid]") and
+// VALENCE_EXTRACT_UMASK (octal) to archive extraction, for containers
+// that drop privileges after extracting as root. The owner defaults to
+// VALENCE_USER.
+func extractOwnershipFromEnv() error {
+	uid, gid := -1, -1
+	runAs, err := runAsUserFromEnv()
+	if err != nil {
+		return err
+	}
+	if runAs != nil {
+		uid, gid = runAs.uid, runAs.gid
+	}
+	if owner := strings.TrimSpace(os.Getenv("VALENCE_EXTRACT_OWNER")); owner != "" {
+		u, g, hasGID := strings.Cut(owner, ":")
+		gid = -1
+		if uid, err = strconv.Atoi(u); err != nil || uid < 0 {
+			return fmt.Errorf("invalid VALENCE_EXTRACT_OWNER %q (want uid[:gid])", owner)
+		}
+		if hasGID {
+			if gid, err = strconv.Atoi(g); err != nil || gid < 0 {
+				return fmt.Errorf("invalid VALENCE_EXTRACT_OWNER %q (want uid[:gid])", owner)
+			}
+		}
+	}
+
+	var umask *os.FileMode
+	if val := strings.TrimSpace(os.Getenv("VALENCE_EXTRACT_UMASK")); val != "" {
+		parsed, err := strconv.ParseUint(val, 8, 32)
+		if err != nil || parsed > 0777 {
+			return fmt.Errorf("invalid VALENCE_EXTRACT_UMASK %q (want octal, e.g. 022)", val)
+		}
+		mask := os.FileMode(parsed)
+		umask = &mask
+	}
+	atomembed.SetOwnership(uid, gid, umask)
+	return nil
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/artefactual-labs/valence/internal/secrets"
+)
+
+// aipPathRe matches /aips/<uuid> (the whole package) and
+// /aips/<uuid>/<relative path> (one file inside it).
+var aipPathRe = regexp.MustCompile(`^/aips/([0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12})(/.+)?$`)
+
+// storageService streams AIP and DIP contents from an Archivematica Storage
+// Service, so digital objects stored there need not be copied into the
+// uploads dir. Requests reach it through signed URLs for /aips/..., which
+// keeps AtoM in charge of who may download what.
+type storageService struct {
+	baseURL *url.URL
+	user    string
+	apiKey  string
+	client  *http.Client
+}
+
+// storageServiceFromEnv configures the Storage Service from
+// ARCHIVEMATICA_SS_URL, ARCHIVEMATICA_SS_USER and ARCHIVEMATICA_SS_API_KEY;
+// it returns nil when no URL is set.
+func storageServiceFromEnv(ctx context.Context, provider secrets.Provider) (*storageService, error) {
+	raw := strings.TrimSpace(os.Getenv("ARCHIVEMATICA_SS_URL"))
+	if raw == "" {
+		return nil, nil
+	}
+	base, err := url.Parse(strings.TrimSuffix(raw, "/"))
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		return nil, fmt.Errorf("ARCHIVEMATICA_SS_URL %q is not an http(s) URL", raw)
+	}
+	user := strings.TrimSpace(os.Getenv("ARCHIVEMATICA_SS_USER"))
+	apiKey, err := provider.Lookup(ctx, "ARCHIVEMATICA_SS_API_KEY")
+	if err != nil {
+		return nil, fmt.Errorf("ARCHIVEMATICA_SS_API_KEY: %w", err)
+	}
+	if user == "" || apiKey == "" {
+		return nil, errors.New("ARCHIVEMATICA_SS_URL needs ARCHIVEMATICA_SS_USER and ARCHIVEMATICA_SS_API_KEY")
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// Extracting a file from a compressed AIP happens before the first
+	// byte, so allow for it; the body itself is not time limited.
+	transport.ResponseHeaderTimeout = envDuration("ARCHIVEMATICA_SS_TIMEOUT", 2*time.Minute)
+	return &storageService{
+		baseURL: base,
+		user:    user,
+		apiKey:  apiKey,
+		client:  &http.Client{Transport: transport},
+	}, nil
+}
+
+// fileURL is the Storage Service URL for uuid, or for relPath inside it.
+func (ss *storageService) fileURL(uuid, relPath string) string {
+	u := *ss.baseURL
+	if relPath == "" {
+		u.Path += "/api/v2/file/" + uuid + "/download/"
+		return u.String()
+	}
+	u.Path += "/api/v2/file/" + uuid + "/extract_file/"
+	u.RawQuery = url.Values{"relative_path_to_file": {relPath}}.Encode()
+	return u.String()
+}
+
+// serve streams /aips/<uuid>[/<relative path>] from the Storage Service.
+// Range requests are passed through.
+func (ss *storageService) serve(w http.ResponseWriter, r *http.Request, aipPath string) {
+	m := aipPathRe.FindStringSubmatch(aipPath)
+	if m == nil {
+		http.NotFound(w, r)
+		return
+	}
+	uuid := strings.ToLower(m[1])
+	// The Storage Service expects the path inside the package, which
+	// starts with the package's directory name.
+	relPath := strings.TrimPrefix(m[2], "/")
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, ss.fileURL(uuid, relPath), nil)
+	if err != nil {
+		http.Error(w, "storage service request error", http.StatusBadGateway)
+		return
+	}
+	req.Header.Set("Authorization", "ApiKey "+ss.user+":"+ss.apiKey)
+	if rng := r.Header.Get("Range"); rng != "" {
+		req.Header.Set("Range", rng)
+	}
+	resp, err := ss.client.Do(req)
+	if err != nil {
+		logWarnf("storage service %s: %v", aipPath, err)
+		http.Error(w, "storage service unavailable", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent:
+	case http.StatusNotFound:
+		http.NotFound(w, r)
+		return
+	case http.StatusRequestedRangeNotSatisfiable:
+		http.Error(w, http.StatusText(resp.StatusCode), resp.StatusCode)
+		return
+	default:
+		logWarnf("storage service %s: unexpected status %s", aipPath, resp.Status)
+		http.Error(w, "storage service error", http.StatusBadGateway)
+		return
+	}
+	for _, header := range []string{"Content-Type", "Content-Length", "Content-Range", "Content-Disposition", "Accept-Ranges", "Last-Modified", "ETag"} {
+		if value := resp.Header.Get(header); value != "" {
+			w.Header().Set(header, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(w, resp.Body); err != nil && r.Context().Err() == nil {
+		logWarnf("storage service %s: stream: %v", aipPath, err)
+	}
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// embeddedAssets stand in for files a fresh atom root may lack, so a new
+// install does not answer every browser's favicon and robots.txt request
+// with a 404, and back valence's own error pages. The atom root (or data
+// dir) wins when it has the file.
+//
+//go:embed assets
+var embeddedAssets embed.FS
+
+// valenceAssetPrefix serves the assets valence's own pages link to. It
+// is answered even in maintenance, when those pages are shown.
+const valenceAssetPrefix = "/_valence/"
+
+// fallbackAssets maps public paths to the embedded file served when the
+// atom root has none.
+var fallbackAssets = map[string]string{
+	"/favicon.ico": "assets/favicon.ico",
+	"/robots.txt":  "assets/robots.txt",
+}
+
+// embeddedAssetPath returns the embedded file for a /_valence/ path.
+func embeddedAssetPath(reqPath string) (string, bool) {
+	name, ok := strings.CutPrefix(reqPath, valenceAssetPrefix)
+	if !ok || name == "" || strings.Contains(name, "/") {
+		return "", false
+	}
+	name = "assets/" + name
+	if _, err := fs.Stat(embeddedAssets, name); err != nil {
+		return "", false
+	}
+	return name, true
+}
+
+// embeddedAssetDecision serves an embedded file. They change with the
+// binary, so they are cached for a day rather than forever.
+func embeddedAssetDecision(label, name string) routeDecision {
+	return routeDecision{
+		label:  label,
+		source: "embedded",
+		handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "public, max-age=86400")
+			w.Header().Set("Expires", time.Now().Add(24*time.Hour).UTC().Format(http.TimeFormat))
+			http.ServeFileFS(w, r, embeddedAssets, name)
+		}),
+	}
+}
@@ -0,0 +1,375 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// VALENCE_AUDIT_LOG_FILE records every request to the internal API under
+// /v/, authorized or not, as one JSON line: who made it, what it asked for
+// and how it was answered. It rotates like the other log files, and
+// GET /v/audit searches the current file. With VALENCE_STATE_STORE=local
+// the entries also go to the state database, which GET /v/audit searches
+// instead, so history survives rotation; entries older than
+// VALENCE_AUDIT_KEEP_AGE (default 90 days, 0 for ever) are dropped from it.
+
+type auditEntry struct {
+	Time       time.Time         `json:"time"`
+	Identity   string            `json:"identity"`
+	Client     string            `json:"client"`
+	Host       string            `json:"host"`
+	Method     string            `json:"method"`
+	Endpoint   string            `json:"endpoint"`
+	Query      map[string]string `json:"query,omitempty"`
+	Body       json.RawMessage   `json:"body,omitempty"`
+	Status     int               `json:"status"`
+	Bytes      int64             `json:"bytes"`
+	DurationMS int64             `json:"duration_ms"`
+}
+
+// auditBodyKept bounds the JSON request body kept per entry; larger
+// bodies are left out.
+const auditBodyKept = 16 << 10
+
+type auditLog struct {
+	file *rotatingFile
+	// state is the state database entries are also kept in, if any.
+	state   string
+	keepAge time.Duration
+}
+
+func auditLogFromEnv(rot logRotation) (*auditLog, error) {
+	path := strings.TrimSpace(os.Getenv("VALENCE_AUDIT_LOG_FILE"))
+	if path == "" {
+		return nil, nil
+	}
+	state, err := stateDBFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	file, err := openRotatingFile(path, rot)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{file: file, state: state, keepAge: envDuration("VALENCE_AUDIT_KEEP_AGE", 90*24*time.Hour)}, nil
+}
+
+func (a *auditLog) Close() error {
+	return a.file.Close()
+}
+
+func (a *auditLog) record(entry auditEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		logWarnf("audit: encode entry: %v", err)
+		return
+	}
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		logErrorf("audit: write %s: %v", a.file.path, err)
+	}
+	if a.state != "" {
+		if err := a.recordState(entry.Time, line); err != nil {
+			logErrorf("audit: %v", err)
+		}
+	}
+}
+
+// recordState adds an entry to the state database, keyed by its time and a
+// sequence number so the keys sort as the entries were made, and drops the
+// entries past keepAge.
+func (a *auditLog) recordState(at time.Time, line []byte) error {
+	return stateUpdate(a.state, func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(stateAuditBucket)
+		if err != nil {
+			return err
+		}
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 16)
+		binary.BigEndian.PutUint64(key, uint64(at.UnixNano()))
+		binary.BigEndian.PutUint64(key[8:], seq)
+		if err := b.Put(key, line); err != nil {
+			return err
+		}
+		if a.keepAge <= 0 {
+			return nil
+		}
+		cutoff := uint64(at.Add(-a.keepAge).UnixNano())
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k) < cutoff; k, _ = c.Next() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// auditIdentity names who made r: the internal API token, by fingerprint
+// so rotations can be told apart, an API key, a signed URL, or nobody.
+func auditIdentity(r *http.Request) string {
+	token := internalAPIToken()
+	if key, ok := bearerAPIKey(r); ok {
+		return "key:" + key.ID + " (" + key.Name + ")"
+	}
+	switch {
+	case !internalAPIConfigured():
+		return "unauthenticated (no token configured)"
+	case token != "" && strings.TrimSpace(r.Header.Get("Authorization")) == "Bearer "+token:
+		sum := sha256.Sum256([]byte(token))
+		return "token:" + hex.EncodeToString(sum[:6])
+	case r.URL.Query().Has("signature"):
+		return "signed-url"
+	default:
+		return "anonymous"
+	}
+}
+
+// auditSecretKey reports whether a query parameter or JSON field holds a
+// credential, which the audit log leaves out.
+func auditSecretKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, word := range []string{"password", "secret", "token", "signature"} {
+		if strings.Contains(key, word) {
+			return true
+		}
+	}
+	return key == "key" || strings.HasSuffix(key, "_key") || strings.HasSuffix(key, "-key")
+}
+
+// redactAudit replaces the values of credential fields, at any depth.
+func redactAudit(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for key, val := range v {
+			if auditSecretKey(key) {
+				v[key] = "[redacted]"
+			} else {
+				v[key] = redactAudit(val)
+			}
+		}
+	case []any:
+		for i, val := range v {
+			v[i] = redactAudit(val)
+		}
+	}
+	return v
+}
+
+// bodyCapture keeps the first limit bytes a handler reads.
+type bodyCapture struct {
+	io.ReadCloser
+	limit     int
+	buf       bytes.Buffer
+	truncated bool
+}
+
+func (c *bodyCapture) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	if room := max(c.limit-c.buf.Len(), 0); n > room {
+		c.buf.Write(p[:room])
+		c.truncated = true
+	} else {
+		c.buf.Write(p[:n])
+	}
+	return n, err
+}
+
+// withAudit records the requests under /v/ to audit; a nil audit leaves
+// next as it is.
+func withAudit(audit *auditLog, next http.Handler) http.Handler {
+	if audit == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/v/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		entry := auditEntry{
+			Time:     start.UTC(),
+			Identity: auditIdentity(r),
+			Host:     r.Host,
+			Method:   r.Method,
+			Endpoint: r.URL.Path,
+		}
+		entry.Client, _, _ = net.SplitHostPort(r.RemoteAddr)
+		if entry.Client == "" {
+			entry.Client = r.RemoteAddr
+		}
+		for key, vals := range r.URL.Query() {
+			if entry.Query == nil {
+				entry.Query = map[string]string{}
+			}
+			entry.Query[key] = strings.Join(vals, ",")
+			if auditSecretKey(key) {
+				entry.Query[key] = "[redacted]"
+			}
+		}
+		var body *bodyCapture
+		if r.Body != nil && strings.Contains(r.Header.Get("Content-Type"), "json") {
+			body = &bodyCapture{ReadCloser: r.Body, limit: auditBodyKept}
+			r.Body = body
+		}
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		entry.Status = recorder.status
+		entry.Bytes = recorder.bytes
+		entry.DurationMS = time.Since(start).Milliseconds()
+		if body != nil && !body.truncated {
+			var v any
+			if json.Unmarshal(body.buf.Bytes(), &v) == nil {
+				entry.Body, _ = json.Marshal(redactAudit(v))
+			}
+		}
+		audit.record(entry)
+	})
+}
+
+// matches reports whether entry passes the /v/audit filters.
+func (entry auditEntry) matches(since time.Time, endpoint, identity string) bool {
+	switch {
+	case entry.Time.Before(since):
+	case endpoint != "" && !strings.HasPrefix(entry.Endpoint, endpoint):
+	case identity != "" && entry.Identity != identity:
+	default:
+		return true
+	}
+	return false
+}
+
+// search returns the entries matching the filters, newest first, at most
+// limit of them: from the state database if there is one, or else the
+// current file.
+func (a *auditLog) search(since time.Time, endpoint, identity string, limit int) ([]auditEntry, error) {
+	if a.state != "" {
+		return a.searchState(since, endpoint, identity, limit)
+	}
+	f, err := os.Open(a.file.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var kept []auditEntry // a window of the last limit matches
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		var entry auditEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+			continue
+		}
+		if entry.matches(since, endpoint, identity) {
+			kept = append(kept, entry)
+			if len(kept) > limit {
+				kept = kept[1:]
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	entries := make([]auditEntry, 0, len(kept))
+	for i := len(kept) - 1; i >= 0; i-- {
+		entries = append(entries, kept[i])
+	}
+	return entries, nil
+}
+
+// searchState walks the state database back from the newest entry.
+func (a *auditLog) searchState(since time.Time, endpoint, identity string, limit int) ([]auditEntry, error) {
+	entries := []auditEntry{}
+	err := stateView(a.state, func(tx *bbolt.Tx) error {
+		b := tx.Bucket(stateAuditBucket)
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.Last(); k != nil && len(entries) < limit; k, v = c.Prev() {
+			var entry auditEntry
+			if json.Unmarshal(v, &entry) != nil {
+				continue
+			}
+			if entry.Time.Before(since) {
+				break
+			}
+			if entry.matches(since, endpoint, identity) {
+				entries = append(entries, entry)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("audit entries: %w", err)
+	}
+	return entries, nil
+}
+
+// auditHandler serves GET /v/audit, filtered by ?since= (RFC 3339),
+// ?endpoint= (a path prefix), ?identity= and ?limit= (default 100, at
+// most 1000). Without a state database, rotated files are left to the log
+// tooling.
+func auditHandler(audit *auditLog) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !authorizeInternalAPI(w, r) {
+			return
+		}
+		if audit == nil {
+			http.Error(w, "VALENCE_AUDIT_LOG_FILE is not configured", http.StatusNotFound)
+			return
+		}
+
+		query := r.URL.Query()
+		var since time.Time
+		if val := query.Get("since"); val != "" {
+			var err error
+			if since, err = time.Parse(time.RFC3339, val); err != nil {
+				http.Error(w, "since must be an RFC 3339 time", http.StatusBadRequest)
+				return
+			}
+		}
+		limit := 100
+		if val := query.Get("limit"); val != "" {
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 1 {
+				http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+				return
+			}
+			limit = min(n, 1000)
+		}
+		entries, err := audit.search(since, query.Get("endpoint"), query.Get("identity"), limit)
+		if err != nil {
+			logWarnf("audit: search: %v", err)
+			http.Error(w, "read audit log", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		_ = json.NewEncoder(w).Encode(map[string]any{"entries": entries})
+	}
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+)
+
+// VALENCE_AUTH_LOG_FILE gets one line per failed authentication or
+// blocked request, for fail2ban or CrowdSec to ban the client:
+//
+//	2026-01-02T15:04:05Z authfail kind=atom_login client=192.0.2.7 host="atom.example.org" path="/user/login" status=200
+//
+// kind is internal_api (a missing or wrong token or API key), atom_login
+// (AtoM answered a login POST with the form again rather than a redirect)
+// or blocked (a deny rule, a bad signed URL or login throttling). client
+// is the peer, or the address a VALENCE_TRUSTED_PROXIES proxy forwarded
+// for. A fail2ban filter matches it with
+//
+//	failregex = authfail kind=\S+ client=<HOST>
+type authFailureLog struct {
+	file    *rotatingFile
+	trusted []netip.Prefix
+}
+
+// authFailures is set by serve when VALENCE_AUTH_LOG_FILE is.
+var authFailures *authFailureLog
+
+func authFailureLogFromEnv(rot logRotation) (*authFailureLog, error) {
+	path := strings.TrimSpace(os.Getenv("VALENCE_AUTH_LOG_FILE"))
+	if path == "" {
+		return nil, nil
+	}
+	trusted, err := trustedProxiesFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	file, err := openRotatingFile(path, rot)
+	if err != nil {
+		return nil, err
+	}
+	return &authFailureLog{file: file, trusted: trusted}, nil
+}
+
+func (l *authFailureLog) Close() error {
+	return l.file.Close()
+}
+
+// record logs a failure of kind for r; a nil log does nothing.
+func (l *authFailureLog) record(r *http.Request, kind string, status int) {
+	if l == nil {
+		return
+	}
+	line := fmt.Sprintf("%s authfail kind=%s client=%s host=%q path=%q status=%d\n",
+		time.Now().UTC().Format(time.RFC3339), kind, forwardedClientIP(r, l.trusted), r.Host, r.URL.Path, status)
+	if _, err := l.file.Write([]byte(line)); err != nil {
+		logErrorf("auth log: write %s: %v", l.file.path, err)
+	}
+}
+
+// observe records the failures a routed AtoM request shows.
+func (l *authFailureLog) observe(r *http.Request, label, reqPath string, status int) {
+	switch {
+	case l == nil:
+	case strings.HasPrefix(label, "deny_"), label == "signed_denied", label == "login_rate_limited":
+		l.record(r, "blocked", status)
+	case r.Method == http.MethodPost && reqPath == "/user/login" && status == http.StatusOK:
+		// AtoM redirects after a successful login.
+		l.record(r, "atom_login", status)
+	}
+}
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bytes served count per routing decision in valence_route_bytes_total.
+// To tell the public UI, OAI harvesters and bulk downloaders apart,
+// VALENCE_BANDWIDTH_PREFIXES lists path prefixes counted in
+// valence_path_prefix_bytes_total (the longest that matches; "other" for
+// none), and VALENCE_BANDWIDTH_CLIENTS=ip or token counts bytes per client,
+// by address or, with token, by API key or internal token when the request
+// carries one. Clients are too many for metrics, so every
+// VALENCE_BANDWIDTH_SUMMARY_INTERVAL (default 1h) the log gets the totals
+// since the last summary and the VALENCE_BANDWIDTH_TOP_CLIENTS (default 10)
+// busiest clients:
+//
+//	bandwidth: summary period=1h0m0s requests=5120 bytes=734003200
+//	bandwidth: route site=atom route=front_controller requests=4100 bytes=52428800
+//	bandwidth: prefix site=atom prefix=/downloads requests=12 bytes=629145600
+//	bandwidth: client client=192.0.2.7 requests=12 bytes=629145600
+type bandwidthMeter struct {
+	prefixes   []string // longest first
+	clients    string   // "", ip or token
+	trusted    []netip.Prefix
+	interval   time.Duration
+	topClients int
+
+	mu      sync.Mutex
+	since   time.Time
+	total   bandwidthUsage
+	routes  map[bandwidthKey]*bandwidthUsage
+	paths   map[bandwidthKey]*bandwidthUsage
+	byPeer  map[string]*bandwidthUsage
+	dropped bandwidthUsage // clients past bandwidthMaxClients
+}
+
+// bandwidthMaxClients bounds the clients kept between summaries.
+const bandwidthMaxClients = 10000
+
+type bandwidthKey struct {
+	site string
+	name string
+}
+
+type bandwidthUsage struct {
+	requests int64
+	bytes    int64
+}
+
+func (u *bandwidthUsage) add(bytes int64) {
+	u.requests++
+	u.bytes += bytes
+}
+
+// bandwidth is set by serve when any VALENCE_BANDWIDTH_* setting is.
+var bandwidth *bandwidthMeter
+
+func bandwidthFromEnv() (*bandwidthMeter, error) {
+	prefixes := commaList(os.Getenv("VALENCE_BANDWIDTH_PREFIXES"))
+	clients := strings.ToLower(strings.TrimSpace(os.Getenv("VALENCE_BANDWIDTH_CLIENTS")))
+	interval := strings.TrimSpace(os.Getenv("VALENCE_BANDWIDTH_SUMMARY_INTERVAL"))
+	if len(prefixes) == 0 && clients == "" && interval == "" {
+		return nil, nil
+	}
+	switch clients {
+	case "", "ip", "token":
+	default:
+		return nil, fmt.Errorf("invalid VALENCE_BANDWIDTH_CLIENTS %q (want ip or token)", clients)
+	}
+	for _, prefix := range prefixes {
+		if !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("VALENCE_BANDWIDTH_PREFIXES: %q does not start with /", prefix)
+		}
+	}
+	// The longest prefix wins.
+	slices.SortFunc(prefixes, func(a, b string) int { return len(b) - len(a) })
+	m := &bandwidthMeter{
+		prefixes:   prefixes,
+		clients:    clients,
+		interval:   envDuration("VALENCE_BANDWIDTH_SUMMARY_INTERVAL", time.Hour),
+		topClients: max(envInt("VALENCE_BANDWIDTH_TOP_CLIENTS", 10), 0),
+	}
+	if m.interval <= 0 {
+		return nil, fmt.Errorf("VALENCE_BANDWIDTH_SUMMARY_INTERVAL must be positive")
+	}
+	var err error
+	if m.trusted, err = trustedProxiesFromEnv(); err != nil {
+		return nil, err
+	}
+	m.reset(time.Now())
+	return m, nil
+}
+
+// reset starts a new summary period. The caller holds m.mu, or has the
+// meter to itself.
+func (m *bandwidthMeter) reset(now time.Time) {
+	m.since = now
+	m.total = bandwidthUsage{}
+	m.routes = map[bandwidthKey]*bandwidthUsage{}
+	m.paths = map[bandwidthKey]*bandwidthUsage{}
+	m.byPeer = map[string]*bandwidthUsage{}
+	m.dropped = bandwidthUsage{}
+}
+
+// prefixFor returns the configured prefix reqPath falls under.
+func (m *bandwidthMeter) prefixFor(reqPath string) string {
+	for _, prefix := range m.prefixes {
+		if strings.HasPrefix(reqPath, prefix) {
+			return prefix
+		}
+	}
+	return "other"
+}
+
+// client names who r is for VALENCE_BANDWIDTH_CLIENTS.
+func (m *bandwidthMeter) client(r *http.Request) string {
+	if m.clients == "token" {
+		if id := auditIdentity(r); strings.HasPrefix(id, "key:") || strings.HasPrefix(id, "token:") {
+			return id
+		}
+	}
+	return forwardedClientIP(r, m.trusted)
+}
+
+// record counts the bytes of a routed request; a nil meter does nothing.
+func (m *bandwidthMeter) record(r *http.Request, site, decision, reqPath string, bytes int64) {
+	if m == nil {
+		return
+	}
+	var prefix, client string
+	if len(m.prefixes) > 0 {
+		prefix = m.prefixFor(reqPath)
+		pathPrefixBytes.WithLabelValues(site, prefix).Add(float64(bytes))
+	}
+	if m.clients != "" {
+		client = m.client(r)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.total.add(bytes)
+	usage(m.routes, bandwidthKey{site, decision}).add(bytes)
+	if prefix != "" {
+		usage(m.paths, bandwidthKey{site, prefix}).add(bytes)
+	}
+	if client != "" {
+		if _, ok := m.byPeer[client]; !ok && len(m.byPeer) >= bandwidthMaxClients {
+			m.dropped.add(bytes)
+			return
+		}
+		usage(m.byPeer, client).add(bytes)
+	}
+}
+
+func usage[K comparable](counts map[K]*bandwidthUsage, key K) *bandwidthUsage {
+	u, ok := counts[key]
+	if !ok {
+		u = &bandwidthUsage{}
+		counts[key] = u
+	}
+	return u
+}
+
+// run logs a summary every interval until ctx is done.
+func (m *bandwidthMeter) run(ctx context.Context) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			m.summarize(now)
+		}
+	}
+}
+
+// summarize logs the usage since the last summary and starts over.
+func (m *bandwidthMeter) summarize(now time.Time) {
+	m.mu.Lock()
+	since, total, routes, paths, peers, dropped := m.since, m.total, m.routes, m.paths, m.byPeer, m.dropped
+	m.reset(now)
+	m.mu.Unlock()
+
+	logInfof("bandwidth: summary period=%s requests=%d bytes=%d", now.Sub(since).Round(time.Second), total.requests, total.bytes)
+	for _, e := range byBytes(routes) {
+		logInfof("bandwidth: route site=%s route=%s requests=%d bytes=%d", e.key.site, e.key.name, e.usage.requests, e.usage.bytes)
+	}
+	for _, e := range byBytes(paths) {
+		logInfof("bandwidth: prefix site=%s prefix=%s requests=%d bytes=%d", e.key.site, e.key.name, e.usage.requests, e.usage.bytes)
+	}
+	top := byBytes(peers)
+	for _, e := range top[:min(len(top), m.topClients)] {
+		logInfof("bandwidth: client client=%s requests=%d bytes=%d", e.key, e.usage.requests, e.usage.bytes)
+	}
+	if dropped.requests > 0 {
+		logWarnf("bandwidth: %d requests (%d bytes) from clients past the first %d were not counted per client", dropped.requests, dropped.bytes, bandwidthMaxClients)
+	}
+}
+
+type bandwidthEntry[K comparable] struct {
+	key   K
+	usage bandwidthUsage
+}
+
+// byBytes returns counts, most bytes first.
+func byBytes[K comparable](counts map[K]*bandwidthUsage) []bandwidthEntry[K] {
+	entries := make([]bandwidthEntry[K], 0, len(counts))
+	for key, u := range counts {
+		entries = append(entries, bandwidthEntry[K]{key, *u})
+	}
+	slices.SortFunc(entries, func(a, b bandwidthEntry[K]) int {
+		return cmp.Compare(b.usage.bytes, a.usage.bytes)
+	})
+	return entries
+}
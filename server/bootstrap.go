@@ -0,0 +1,80 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+
+	"github.com/artefactual-labs/valence/internal/bootstrap"
+	"github.com/artefactual-labs/valence/internal/secrets"
+)
+
+// bootstrapSummaryHandler serves the JSON summary of the last bootstrap run.
+func bootstrapSummaryHandler(path string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if !authorizeInternalAPI(w, r) {
+			return
+		}
+
+		data, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			http.Error(w, "no bootstrap summary", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "read bootstrap summary", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		_, _ = w.Write(data)
+	}
+}
+
+// bootstrapStatusHandler serves GET /v/bootstrap/status: the last run's
+// summary and whether the site's config on disk still matches it and what
+// bootstrap would generate from the current env and secrets.
+func bootstrapStatusHandler(s *site, root func() string, provider secrets.Provider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if !authorizeInternalAPI(w, r) {
+			return
+		}
+
+		// Loading the config reads the site's env, which site startup and
+		// atom reloads also borrow.
+		var status bootstrap.Status
+		siteStartMu.Lock()
+		err := withSiteEnv(s.env, func() error {
+			cfg, err := bootstrap.LoadConfig(r.Context(), root(), provider)
+			if err != nil {
+				return err
+			}
+			status, err = bootstrap.CheckStatus(cfg)
+			return err
+		})
+		siteStartMu.Unlock()
+		if err != nil {
+			logWarnf("bootstrap status: %v", err)
+			http.Error(w, "check bootstrap status", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		_ = json.NewEncoder(w).Encode(status)
+	}
+}
@@ -0,0 +1,265 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/artefactual-labs/valence/internal/bootstrap"
+	"github.com/artefactual-labs/valence/internal/secrets"
+)
+
+// cacheClearCommand runs symfony cc against the atom root without starting
+// the server, for cron jobs and post-deploy hooks. With --flush it also
+// empties the memcached or Redis cache AtoM is configured to use.
+func cacheClearCommand(args []string) error {
+	fs := flag.NewFlagSet("cache:clear", flag.ContinueOnError)
+	flush := fs.Bool("flush", false, "also flush the memcached or Redis cache")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	root, err := atomRootFromEnv()
+	if err != nil {
+		return err
+	}
+	root = realAtomRoot(root)
+	if info, err := os.Stat(root); err != nil || !info.IsDir() {
+		return fmt.Errorf("atom root not found at %s", root)
+	}
+
+	if *flush {
+		provider, err := secrets.NewFromEnv()
+		if err != nil {
+			return fmt.Errorf("secrets provider: %w", err)
+		}
+		cfg, err := bootstrap.LoadConfig(context.Background(), root, provider)
+		if err != nil {
+			return fmt.Errorf("bootstrap config error: %w", err)
+		}
+		if err := flushCache(cfg); err != nil {
+			return fmt.Errorf("flush cache: %w", err)
+		}
+	}
+	return runSymfonyCacheClear(root)
+}
+
+// flushCache empties the configured cache backend: flush_all on
+// memcached, FLUSHDB on the configured Redis database.
+func flushCache(cfg bootstrap.Config) error {
+	ep, err := cacheEndpoint(cfg)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialTimeout("tcp", ep.addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	if cfg.CacheEngine != bootstrap.CacheEngineRedis {
+		logInfof("flushing memcached at %s", ep.addr)
+		if _, err := conn.Write([]byte("flush_all\r\n")); err != nil {
+			return err
+		}
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if strings.TrimSpace(line) != "OK" {
+			return fmt.Errorf("unexpected reply %q", strings.TrimSpace(line))
+		}
+		return nil
+	}
+
+	logInfof("flushing redis database %d at %s", cfg.RedisDatabase, ep.addr)
+	br := bufio.NewReader(conn)
+	if cfg.RedisPassword != "" {
+		if err := redisCommand(conn, br, "AUTH", cfg.RedisPassword); err != nil {
+			return err
+		}
+	}
+	if err := redisCommand(conn, br, "SELECT", strconv.Itoa(cfg.RedisDatabase)); err != nil {
+		return err
+	}
+	return redisCommand(conn, br, "FLUSHDB")
+}
+
+// cacheClearer runs cache clears requested through POST /v/cache/clear in
+// the background: symfony cc for every ready site and, unless the body
+// says {"flush": false}, a flush of each site's cache backend. A request
+// made while a clear is running gets that clear's job. The last few jobs
+// can be polled at GET /v/cache/clear/<id>.
+type cacheClearer struct {
+	sites []*site
+	tasks *scheduler
+	root  func() string
+
+	mu      sync.Mutex
+	jobs    []*cacheClearJob // oldest first
+	running *cacheClearJob
+}
+
+// cacheClearJobsKept bounds the jobs kept for polling.
+const cacheClearJobsKept = 20
+
+type cacheClearJob struct {
+	ID         string     `json:"id"`
+	Status     string     `json:"status"` // running, done or failed
+	Flush      bool       `json:"flush"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+func newCacheClearer(sites []*site, tasks *scheduler, root func() string) *cacheClearer {
+	return &cacheClearer{sites: sites, tasks: tasks, root: root}
+}
+
+// start starts a job, or returns the running one.
+func (c *cacheClearer) start(flush bool) cacheClearJob {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.running != nil {
+		return *c.running
+	}
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	job := &cacheClearJob{ID: hex.EncodeToString(id), Status: "running", Flush: flush, StartedAt: time.Now().UTC()}
+	c.running = job
+	c.jobs = append(c.jobs, job)
+	if len(c.jobs) > cacheClearJobsKept {
+		c.jobs = c.jobs[len(c.jobs)-cacheClearJobsKept:]
+	}
+	go c.run(job)
+	return *job
+}
+
+func (c *cacheClearer) run(job *cacheClearJob) {
+	logInfof("cache clear %s started (flush=%t)", job.ID, job.Flush)
+	err := c.clear(job.Flush)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now().UTC()
+	job.FinishedAt = &now
+	job.Status = "done"
+	if err != nil {
+		job.Status = "failed"
+		job.Error = err.Error()
+		logErrorf("cache clear %s failed: %v", job.ID, err)
+	} else {
+		logInfof("cache clear %s done in %s", job.ID, now.Sub(job.StartedAt).Round(time.Millisecond))
+	}
+	c.running = nil
+}
+
+// clear runs symfony cc for each ready site, with its env, after flushing
+// its cache backend so pages are not rebuilt from stale entries.
+func (c *cacheClearer) clear(flush bool) error {
+	// Symfony runs from the process's working directory and environment,
+	// which scheduled tasks and site startup also borrow.
+	c.tasks.runMu.Lock()
+	defer c.tasks.runMu.Unlock()
+	siteStartMu.Lock()
+	defer siteStartMu.Unlock()
+
+	root := c.root()
+	var errs []error
+	for _, s := range c.sites {
+		if !s.ready.Load() {
+			continue
+		}
+		err := withSiteEnv(s.env, func() error {
+			if flush {
+				if err := flushCache(s.bootstrap); err != nil {
+					return fmt.Errorf("flush cache: %w", err)
+				}
+			}
+			return runSymfonyCacheClear(root)
+		})
+		if err != nil {
+			if s.name != "" {
+				err = fmt.Errorf("site %s: %w", s.name, err)
+			}
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (c *cacheClearer) job(id string) (cacheClearJob, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, job := range c.jobs {
+		if job.ID == id {
+			return *job, true
+		}
+	}
+	return cacheClearJob{}, false
+}
+
+// cacheClearHandler serves POST /v/cache/clear, answering 202 with the
+// job, and GET /v/cache/clear/<id>.
+func cacheClearHandler(c *cacheClearer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorizeInternalAPI(w, r) {
+			return
+		}
+
+		id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/v/cache/clear"), "/")
+		var job cacheClearJob
+		code := http.StatusOK
+		switch {
+		case id == "" && r.Method == http.MethodPost:
+			if !internalAPIConfigured() {
+				http.Error(w, "internal api token not configured", http.StatusForbidden)
+				return
+			}
+			body := struct {
+				Flush *bool `json:"flush"`
+			}{}
+			if r.ContentLength != 0 {
+				if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4<<10)).Decode(&body); err != nil {
+					http.Error(w, "invalid json", http.StatusBadRequest)
+					return
+				}
+			}
+			flush := body.Flush == nil || *body.Flush
+			job = c.start(flush)
+			code = http.StatusAccepted
+			w.Header().Set("Location", "/v/cache/clear/"+job.ID)
+		case id == "":
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		case r.Method != http.MethodGet:
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		default:
+			var ok bool
+			if job, ok = c.job(id); !ok {
+				http.NotFound(w, r)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(code)
+		_ = json.NewEncoder(w).Encode(job)
+	}
+}
@@ -0,0 +1,533 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Capture mode records whole request/response pairs of the requests PHP
+// handles, to diagnose front controller problems that only show in
+// production. It needs VALENCE_CAPTURE_DIR and is off until switched on,
+// with VALENCE_CAPTURE=true at startup or at runtime through
+// POST /v/debug/capture:
+//
+//	{"enabled": true, "path": "^/informationobject", "sample": 10, "max": 200, "duration": "30m"}
+//
+// path is a regexp the request path must match, sample keeps one request
+// in that many, and capture switches itself off after max requests
+// (default 1000) or once duration has passed. GET /v/debug/capture shows
+// the settings and what was captured. VALENCE_CAPTURE_FORMAT=jsonl (the
+// default) appends one HAR entry per line to capture-<date>.jsonl; har
+// writes each request to a HAR file of its own, which browser developer
+// tools open. Cookies, Authorization and credential-looking query and form
+// fields are redacted; up to VALENCE_CAPTURE_BODY_LIMIT (default 64K) of
+// each text body is kept, multipart and binary bodies only by size.
+type captureRecorder struct {
+	dir       string
+	format    string
+	bodyLimit int
+
+	mu       sync.Mutex
+	settings captureSettings
+	seen     uint64
+	captured int
+	lastErr  string
+	file     *os.File
+	fileDate string
+
+	enabled atomic.Bool
+}
+
+type captureSettings struct {
+	Enabled bool       `json:"enabled"`
+	Path    string     `json:"path,omitempty"`
+	Sample  int        `json:"sample"`
+	Max     int        `json:"max"`
+	Until   *time.Time `json:"until,omitempty"`
+	pathRe  *regexp.Regexp
+}
+
+// captures is set by serve when VALENCE_CAPTURE_DIR is.
+var captures *captureRecorder
+
+func captureRecorderFromEnv() (*captureRecorder, error) {
+	dir := strings.TrimSpace(os.Getenv("VALENCE_CAPTURE_DIR"))
+	if dir == "" {
+		return nil, nil
+	}
+	c := &captureRecorder{
+		dir:       dir,
+		format:    strings.ToLower(envOrDefault("VALENCE_CAPTURE_FORMAT", "jsonl")),
+		bodyLimit: 64 << 10,
+	}
+	if c.format != "jsonl" && c.format != "har" {
+		return nil, fmt.Errorf("invalid VALENCE_CAPTURE_FORMAT %q (want jsonl or har)", c.format)
+	}
+	if val := strings.TrimSpace(os.Getenv("VALENCE_CAPTURE_BODY_LIMIT")); val != "" {
+		limit, err := parseByteSize(val)
+		if err != nil {
+			return nil, fmt.Errorf("VALENCE_CAPTURE_BODY_LIMIT: %w", err)
+		}
+		c.bodyLimit = int(limit)
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	settings := captureSettings{
+		Enabled: envBool("VALENCE_CAPTURE", false),
+		Path:    strings.TrimSpace(os.Getenv("VALENCE_CAPTURE_PATH")),
+		Sample:  envInt("VALENCE_CAPTURE_SAMPLE", 1),
+		Max:     envInt("VALENCE_CAPTURE_MAX", 1000),
+	}
+	if err := c.configure(settings); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// configure replaces the settings and starts counting afresh.
+func (c *captureRecorder) configure(settings captureSettings) error {
+	if settings.Path != "" {
+		re, err := regexp.Compile(settings.Path)
+		if err != nil {
+			return fmt.Errorf("path: %w", err)
+		}
+		settings.pathRe = re
+	}
+	settings.Sample = max(settings.Sample, 1)
+	if settings.Max <= 0 {
+		settings.Max = 1000
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	was := c.settings.Enabled
+	c.settings = settings
+	c.seen = 0
+	c.captured = 0
+	c.enabled.Store(settings.Enabled)
+	if settings.Enabled {
+		logWarnf("capture: recording requests to %s (path %q, 1 in %d, at most %d)", c.dir, settings.Path, settings.Sample, settings.Max)
+	} else if was {
+		logInfof("capture: off")
+	}
+	return nil
+}
+
+// want reports whether a request for reqPath is to be captured, counting
+// it if so.
+func (c *captureRecorder) want(reqPath string) bool {
+	if c == nil || !c.enabled.Load() {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := &c.settings
+	if !s.Enabled {
+		return false
+	}
+	if (s.Until != nil && time.Now().After(*s.Until)) || c.captured >= s.Max {
+		s.Enabled = false
+		c.enabled.Store(false)
+		logInfof("capture: off after %d requests", c.captured)
+		return false
+	}
+	if s.pathRe != nil && !s.pathRe.MatchString(reqPath) {
+		return false
+	}
+	c.seen++
+	if (c.seen-1)%uint64(s.Sample) != 0 {
+		return false
+	}
+	c.captured++
+	return true
+}
+
+// captureResponse records what a handler writes, keeping up to limit
+// bytes of the body.
+type captureResponse struct {
+	http.ResponseWriter
+	limit     int
+	status    int
+	header    http.Header
+	size      int64
+	body      bytes.Buffer
+	truncated bool
+}
+
+func (w *captureResponse) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+		w.header = w.ResponseWriter.Header().Clone()
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *captureResponse) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.size += int64(n)
+	if room := max(w.limit-w.body.Len(), 0); n > room {
+		w.body.Write(p[:room])
+		w.truncated = true
+	} else {
+		w.body.Write(p[:n])
+	}
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *captureResponse) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// withCapture captures the requests next, PHP, handles for site.
+func withCapture(site string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := captures
+		if !c.want(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		var reqBody *bodyCapture
+		if r.Body != nil && r.Body != http.NoBody {
+			reqBody = &bodyCapture{ReadCloser: r.Body, limit: c.bodyLimit}
+			r.Body = reqBody
+		}
+		resp := &captureResponse{ResponseWriter: w, limit: c.bodyLimit}
+		start := time.Now()
+		next.ServeHTTP(resp, r)
+		c.record(harEntryFor(site, r, reqBody, resp, start, time.Since(start)))
+	})
+}
+
+// HAR 1.2, as much of it as a server sees.
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         struct {
+		Send    float64 `json:"send"`
+		Wait    float64 `json:"wait"`
+		Receive float64 `json:"receive"`
+	} `json:"timings"`
+	Site string `json:"_site,omitempty"`
+}
+
+// captureRedactedHeaders carry credentials.
+var captureRedactedHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+}
+
+func harHeaders(h http.Header) []harNameValue {
+	headers := []harNameValue{}
+	for name, vals := range h {
+		for _, val := range vals {
+			if captureRedactedHeaders[name] {
+				val = "[redacted]"
+			}
+			headers = append(headers, harNameValue{Name: name, Value: val})
+		}
+	}
+	return headers
+}
+
+// harQuery lists values, redacting the credential-looking ones.
+func harQuery(values url.Values) []harNameValue {
+	query := []harNameValue{}
+	for name, vals := range values {
+		for _, val := range vals {
+			if auditSecretKey(name) {
+				val = "[redacted]"
+			}
+			query = append(query, harNameValue{Name: name, Value: val})
+		}
+	}
+	return query
+}
+
+func harEntryFor(site string, r *http.Request, reqBody *bodyCapture, resp *captureResponse, start time.Time, elapsed time.Duration) harEntry {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	redacted := url.Values{}
+	for _, nv := range harQuery(r.URL.Query()) {
+		redacted.Add(nv.Name, nv.Value)
+	}
+	u := url.URL{Scheme: scheme, Host: r.Host, Path: r.URL.Path, RawQuery: redacted.Encode()}
+
+	e := harEntry{StartedDateTime: start.UTC(), Time: float64(elapsed.Microseconds()) / 1000, Site: site}
+	e.Timings.Wait = e.Time
+	e.Request = harRequest{
+		Method:      r.Method,
+		URL:         u.String(),
+		HTTPVersion: r.Proto,
+		Cookies:     []harNameValue{},
+		Headers:     harHeaders(r.Header),
+		QueryString: harQuery(r.URL.Query()),
+		HeadersSize: -1,
+		BodySize:    r.ContentLength,
+	}
+	if reqBody != nil {
+		e.Request.PostData = captureRequestBody(r.Header.Get("Content-Type"), reqBody)
+	}
+
+	status := resp.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	header := resp.header
+	if header == nil {
+		header = resp.Header()
+	}
+	e.Response = harResponse{
+		Status:      status,
+		StatusText:  http.StatusText(status),
+		HTTPVersion: r.Proto,
+		Cookies:     []harNameValue{},
+		Headers:     harHeaders(header),
+		RedirectURL: header.Get("Location"),
+		HeadersSize: -1,
+		BodySize:    resp.size,
+		Content:     harContent{Size: resp.size, MimeType: header.Get("Content-Type")},
+	}
+	switch {
+	case header.Get("Content-Encoding") != "":
+		e.Response.Content.Comment = "encoded body not kept"
+	case !captureTextType(e.Response.Content.MimeType):
+		e.Response.Content.Comment = "binary body not kept"
+	default:
+		e.Response.Content.Text = strings.ToValidUTF8(resp.body.String(), "�")
+		if resp.truncated {
+			e.Response.Content.Comment = "truncated"
+		}
+	}
+	return e
+}
+
+// captureRequestBody keeps a request body, with form and JSON credentials
+// redacted.
+func captureRequestBody(contentType string, body *bodyCapture) *harPostData {
+	data := &harPostData{MimeType: contentType}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case body.truncated:
+		data.Comment = "body over the capture limit not kept"
+	case mediaType == "application/x-www-form-urlencoded":
+		values, err := url.ParseQuery(body.buf.String())
+		if err != nil {
+			data.Comment = "unparsable form not kept"
+			break
+		}
+		redacted := url.Values{}
+		for _, nv := range harQuery(values) {
+			redacted.Add(nv.Name, nv.Value)
+		}
+		data.Text = redacted.Encode()
+	case strings.Contains(mediaType, "json"):
+		var v any
+		if json.Unmarshal(body.buf.Bytes(), &v) != nil {
+			data.Comment = "invalid json not kept"
+			break
+		}
+		text, _ := json.Marshal(redactAudit(v))
+		data.Text = string(text)
+	case captureTextType(mediaType):
+		data.Text = strings.ToValidUTF8(body.buf.String(), "�")
+	default:
+		data.Comment = "binary or multipart body not kept"
+	}
+	return data
+}
+
+func captureTextType(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return strings.HasPrefix(mediaType, "text/") || strings.Contains(mediaType, "json") ||
+		strings.Contains(mediaType, "xml") || strings.Contains(mediaType, "javascript")
+}
+
+// record writes an entry in the configured format.
+func (c *captureRecorder) record(e harEntry) {
+	var err error
+	if c.format == "har" {
+		err = c.writeHAR(e)
+	} else {
+		err = c.appendJSONL(e)
+	}
+	if err != nil {
+		c.mu.Lock()
+		c.lastErr = err.Error()
+		c.mu.Unlock()
+		logErrorf("capture: %v", err)
+	}
+}
+
+func (c *captureRecorder) writeHAR(e harEntry) error {
+	doc := map[string]any{"log": map[string]any{
+		"version": "1.2",
+		"creator": map[string]string{"name": "valence", "version": version},
+		"entries": []harEntry{e},
+	}}
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("capture-%s-%s.har", e.StartedDateTime.Format("20060102T150405.000000"), newTaskID()[:8])
+	return os.WriteFile(filepath.Join(c.dir, name), data, 0o600)
+}
+
+func (c *captureRecorder) appendJSONL(e harEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	date := e.StartedDateTime.Format(time.DateOnly)
+	if c.file == nil || c.fileDate != date {
+		if c.file != nil {
+			_ = c.file.Close()
+		}
+		c.file, err = os.OpenFile(filepath.Join(c.dir, "capture-"+date+".jsonl"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			c.file = nil
+			return err
+		}
+		c.fileDate = date
+	}
+	_, err = c.file.Write(append(data, '\n'))
+	return err
+}
+
+type captureStatus struct {
+	captureSettings
+	Dir      string `json:"dir"`
+	Format   string `json:"format"`
+	Captured int    `json:"captured"`
+	LastErr  string `json:"last_error,omitempty"`
+}
+
+type captureRequest struct {
+	Enabled  bool   `json:"enabled"`
+	Path     string `json:"path"`
+	Sample   int    `json:"sample"`
+	Max      int    `json:"max"`
+	Duration string `json:"duration"`
+}
+
+// captureHandler serves GET and POST /v/debug/capture.
+func captureHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizeInternalAPI(w, r) {
+		return
+	}
+	c := captures
+	if c == nil {
+		http.Error(w, "capture not configured (VALENCE_CAPTURE_DIR)", http.StatusNotFound)
+		return
+	}
+	if r.Method == http.MethodPost {
+		if !internalAPIConfigured() {
+			http.Error(w, "internal api token not configured", http.StatusForbidden)
+			return
+		}
+		var req captureRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			http.Error(w, "invalid json: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		settings := captureSettings{Enabled: req.Enabled, Path: req.Path, Sample: req.Sample, Max: req.Max}
+		if req.Duration != "" {
+			d, err := time.ParseDuration(req.Duration)
+			if err != nil || d <= 0 {
+				http.Error(w, "invalid duration", http.StatusBadRequest)
+				return
+			}
+			until := time.Now().Add(d).UTC()
+			settings.Until = &until
+		}
+		if err := c.configure(settings); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	c.mu.Lock()
+	status := captureStatus{
+		captureSettings: c.settings,
+		Dir:             c.dir,
+		Format:          c.format,
+		Captured:        c.captured,
+		LastErr:         c.lastErr,
+	}
+	c.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/artefactual-labs/valence/internal/bootstrap"
+	"github.com/artefactual-labs/valence/internal/secrets"
+)
+
+func runCommand(name string, args []string) error {
+	switch name {
+	case "serve":
+		return serve()
+	case "bootstrap":
+		return bootstrapCommand(args)
+	case "verify":
+		return verifyCommand(args)
+	case "atom":
+		return atomCommand(args)
+	case "version":
+		return versionCommand(args)
+	case "cache:clear":
+		return cacheClearCommand(args)
+	case "search:populate":
+		return searchPopulateCommand(args)
+	case "db":
+		return dbCommand(args)
+	case "api-key":
+		return apiKeyCommand(args)
+	case "digitalobject:derivatives":
+		return derivativesCommand(args)
+	default:
+		return fmt.Errorf("unknown command %q", name)
+	}
+}
+
+func bootstrapCommand(args []string) error {
+	fs := flag.NewFlagSet("bootstrap", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "report changes and diffs without writing files")
+	asJSON := fs.Bool("json", false, "print the summary as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	root, err := atomRootFromEnv()
+	if err != nil {
+		return err
+	}
+	if !*dryRun {
+		if err := ensureAtomRoot(root); err != nil {
+			return err
+		}
+	}
+	root = realAtomRoot(root)
+	if info, err := os.Stat(root); err != nil || !info.IsDir() {
+		return fmt.Errorf("atom root not found at %s", root)
+	}
+
+	provider, err := secrets.NewFromEnv()
+	if err != nil {
+		return fmt.Errorf("secrets provider: %w", err)
+	}
+	cfg, err := bootstrap.LoadConfig(context.Background(), root, provider)
+	if err != nil {
+		return fmt.Errorf("bootstrap config error: %w", err)
+	}
+
+	var opts []bootstrap.Option
+	if *dryRun {
+		opts = append(opts, bootstrap.DryRun)
+	}
+	summary, err := bootstrap.Apply(cfg, opts...)
+	if err != nil {
+		return fmt.Errorf("bootstrap error: %w", err)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(summary)
+	}
+	for _, conflict := range summary.Conflicts {
+		fmt.Printf("override replaced generated config: %s\n", conflict)
+	}
+	if !*dryRun {
+		fmt.Printf("bootstrap complete: wrote=%d skipped=%d backups=%d overrides=%d\n", len(summary.Written), len(summary.Skipped), len(summary.Backups), len(summary.Overrides))
+		return nil
+	}
+	for _, change := range summary.Changes {
+		fmt.Printf("%-9s %s\n", change.Action, change.Path)
+	}
+	for _, path := range summary.Skipped {
+		fmt.Printf("%-9s %s\n", "skip", path)
+	}
+	for _, change := range summary.Changes {
+		if change.Diff != "" {
+			fmt.Printf("\n%s", change.Diff)
+		}
+	}
+	return nil
+}
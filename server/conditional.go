@@ -0,0 +1,193 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// conditionalGET answers repeat requests for unchanged front controller
+// pages with 304. A successful HTML page gets a weak ETag hashed from its
+// body unless AtoM sent an ETag or Last-Modified, which are honored
+// instead. The page is held until it is complete, so pages larger than
+// VALENCE_ETAG_MAX_SIZE (512K) stream untagged. Behind the page cache a
+// 304 costs no render at all. AtoM's session handling marks every page
+// no-store, which would keep browsers from ever revalidating, so for
+// visitors without loginCookie that becomes "private, no-cache". Set
+// VALENCE_CONDITIONAL_GET=false to turn it off.
+type conditionalGET struct {
+	maxSize     int
+	loginCookie string
+}
+
+// conditionalGETFromEnv returns nil when conditional GETs are turned off.
+func conditionalGETFromEnv() (*conditionalGET, error) {
+	if !envBool("VALENCE_CONDITIONAL_GET", true) {
+		return nil, nil
+	}
+	c := &conditionalGET{maxSize: 512 << 10, loginCookie: "atom_authenticated"}
+	if val := strings.TrimSpace(os.Getenv("VALENCE_ETAG_MAX_SIZE")); val != "" {
+		size, err := parseByteSize(val)
+		if err != nil {
+			return nil, fmt.Errorf("VALENCE_ETAG_MAX_SIZE: %w", err)
+		}
+		c.maxSize = int(size)
+	}
+	return c, nil
+}
+
+func (c *conditionalGET) handler(site string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			next.ServeHTTP(w, r)
+			return
+		}
+		_, err := r.Cookie(c.loginCookie)
+		ew := &etagWriter{ResponseWriter: w, r: r, c: c, site: site, anonymous: err != nil}
+		next.ServeHTTP(ew, r)
+		ew.finish()
+	})
+}
+
+// etagWriter holds a page back to tag it, and drops the body of pages
+// answered 304.
+type etagWriter struct {
+	http.ResponseWriter
+	r         *http.Request
+	c         *conditionalGET
+	site      string
+	anonymous bool
+
+	status      int
+	buffering   bool
+	notModified bool
+	buf         bytes.Buffer
+}
+
+func (ew *etagWriter) WriteHeader(code int) {
+	if ew.status != 0 {
+		return
+	}
+	ew.status = code
+	header := ew.Header()
+	if code != http.StatusOK {
+		ew.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if header.Get("ETag") != "" || header.Get("Last-Modified") != "" {
+		ew.revalidatable()
+		ew.writeStatus()
+		return
+	}
+	if strings.HasPrefix(header.Get("Content-Type"), "text/html") && header.Get("Content-Encoding") == "" {
+		ew.buffering = true
+		return
+	}
+	ew.ResponseWriter.WriteHeader(code)
+}
+
+func (ew *etagWriter) Write(p []byte) (int, error) {
+	if ew.status == 0 {
+		ew.WriteHeader(http.StatusOK)
+	}
+	switch {
+	case ew.notModified:
+		return len(p), nil
+	case !ew.buffering:
+		return ew.ResponseWriter.Write(p)
+	case ew.buf.Len()+len(p) <= ew.c.maxSize:
+		return ew.buf.Write(p)
+	}
+	// Too large to tag: send what was held and stream the rest.
+	ew.buffering = false
+	ew.ResponseWriter.WriteHeader(ew.status)
+	if _, err := ew.buf.WriteTo(ew.ResponseWriter); err != nil {
+		return 0, err
+	}
+	return ew.ResponseWriter.Write(p)
+}
+
+// Flush is held back while the page is buffered; it is sent whole.
+func (ew *etagWriter) Flush() {
+	if ew.buffering || ew.notModified {
+		return
+	}
+	_ = http.NewResponseController(ew.ResponseWriter).Flush()
+}
+
+func (ew *etagWriter) Unwrap() http.ResponseWriter {
+	return ew.ResponseWriter
+}
+
+// finish tags and sends a buffered page once the handler is done.
+func (ew *etagWriter) finish() {
+	if !ew.buffering {
+		return
+	}
+	sum := sha256.Sum256(ew.buf.Bytes())
+	ew.Header().Set("ETag", `W/"`+hex.EncodeToString(sum[:16])+`"`)
+	ew.revalidatable()
+	ew.writeStatus()
+	if !ew.notModified {
+		ew.Header().Set("Content-Length", strconv.Itoa(ew.buf.Len()))
+		_, _ = ew.buf.WriteTo(ew.ResponseWriter)
+	}
+}
+
+// writeStatus sends 304 when the request's validators match the page's,
+// and 200 otherwise.
+func (ew *etagWriter) writeStatus() {
+	if !notModified(ew.r, ew.Header()) {
+		ew.ResponseWriter.WriteHeader(http.StatusOK)
+		return
+	}
+	ew.notModified = true
+	ew.buffering = false
+	ew.Header().Del("Content-Length")
+	notModifiedTotal.WithLabelValues(ew.site).Inc()
+	ew.ResponseWriter.WriteHeader(http.StatusNotModified)
+}
+
+// revalidatable lets browsers keep anonymous visitors' pages and ask
+// whether they changed, rather than never keeping them.
+func (ew *etagWriter) revalidatable() {
+	header := ew.Header()
+	if ew.anonymous && strings.Contains(header.Get("Cache-Control"), "no-store") {
+		header.Set("Cache-Control", "private, no-cache")
+		header.Del("Pragma")
+		header.Del("Expires")
+	}
+}
+
+// notModified evaluates If-None-Match, or failing that If-Modified-Since,
+// against the response header (RFC 9110, section 13.2.2).
+func notModified(r *http.Request, header http.Header) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	modified, err := http.ParseTime(header.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+	return !modified.Truncate(time.Second).After(ims)
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/artefactual-labs/valence/internal/bootstrap"
+	"github.com/artefactual-labs/valence/internal/mysqldump"
+	"github.com/artefactual-labs/valence/internal/mysqlwire"
+	"github.com/artefactual-labs/valence/internal/secrets"
+)
+
+// dbCommand dumps the AtoM database to SQL or loads a dump back, using the
+// configured DSN. Files ending in .gz are compressed; "-" or no file means
+// stdout or stdin.
+func dbCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: valence db dump|load [flags] [file]")
+	}
+	switch args[0] {
+	case "dump":
+		return dbDumpCommand(args[1:])
+	case "load":
+		return dbLoadCommand(args[1:])
+	default:
+		return fmt.Errorf("unknown db subcommand %q", args[0])
+	}
+}
+
+func dbDumpCommand(args []string) error {
+	fs := flag.NewFlagSet("db dump", flag.ContinueOnError)
+	maintenance := fs.Bool("maintenance", false, "keep the site in maintenance mode while dumping")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	conn, dbName, flagPath, err := connectDB()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if *maintenance {
+		leave, err := enterMaintenance(flagPath)
+		if err != nil {
+			return fmt.Errorf("maintenance mode: %w", err)
+		}
+		defer leave()
+	}
+
+	out, closeOut, err := openDumpOutput(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	if err := mysqldump.Dump(conn, dbName, out); err != nil {
+		_ = closeOut()
+		return err
+	}
+	if err := closeOut(); err != nil {
+		return err
+	}
+	logInfof("dumped database %s in %s", dbName, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+func dbLoadCommand(args []string) error {
+	fs := flag.NewFlagSet("db load", flag.ContinueOnError)
+	noMaintenance := fs.Bool("no-maintenance", false, "do not put the site in maintenance mode while loading")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	in, closeIn, err := openDumpInput(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer closeIn()
+
+	conn, dbName, flagPath, err := connectDB()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if !*noMaintenance {
+		leave, err := enterMaintenance(flagPath)
+		if err != nil {
+			return fmt.Errorf("maintenance mode: %w", err)
+		}
+		defer leave()
+	}
+
+	start := time.Now()
+	n, err := mysqldump.Load(conn, in)
+	if err != nil {
+		return err
+	}
+	logInfof("loaded %d statements into %s in %s; run valence cache:clear --flush and valence search:populate", n, dbName, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// connectDB logs in with the bootstrap config and returns the connection,
+// the database name and the maintenance flag path.
+func connectDB() (*mysqlwire.Conn, string, string, error) {
+	root, err := atomRootFromEnv()
+	if err != nil {
+		return nil, "", "", err
+	}
+	root = realAtomRoot(root)
+	provider, err := secrets.NewFromEnv()
+	if err != nil {
+		return nil, "", "", fmt.Errorf("secrets provider: %w", err)
+	}
+	cfg, err := bootstrap.LoadConfig(context.Background(), root, provider)
+	if err != nil {
+		return nil, "", "", fmt.Errorf("bootstrap config error: %w", err)
+	}
+	conn, dbName, err := dialMySQL(cfg, 10*time.Second)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	dataDir := strings.TrimSpace(os.Getenv("ATOM_DATA_DIR"))
+	if dataDir != "" {
+		if dataDir, err = filepath.Abs(dataDir); err != nil {
+			_ = conn.Close()
+			return nil, "", "", err
+		}
+	}
+	return conn, dbName, maintenanceFlagPath(root, dataDir), nil
+}
+
+// dialMySQL opens an authenticated connection to the configured database
+// and returns it with the database name.
+func dialMySQL(cfg bootstrap.Config, timeout time.Duration) (*mysqlwire.Conn, string, error) {
+	dsn, err := bootstrap.ParseMySQLDSN(cfg.MySQLDSN)
+	if err != nil {
+		return nil, "", err
+	}
+	tlsConfig, err := cfg.MySQLTLSConfig(dsn.Host)
+	if err != nil {
+		return nil, "", err
+	}
+
+	network, addr := dsn.Network()
+	nc, err := net.DialTimeout(network, addr, timeout)
+	if err != nil {
+		return nil, "", err
+	}
+	conn, err := mysqlwire.Connect(nc, mysqlwire.Options{
+		User:     cfg.MySQLUsername,
+		Password: cfg.MySQLPassword,
+		DBName:   dsn.DBName,
+		TLS:      tlsConfig,
+	})
+	if err != nil {
+		_ = nc.Close()
+		return nil, "", err
+	}
+	return conn, dsn.DBName, nil
+}
+
+func openDumpOutput(path string) (io.Writer, func() error, error) {
+	if path == "" || path == "-" {
+		return os.Stdout, func() error { return nil }, nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !strings.HasSuffix(path, ".gz") {
+		return f, f.Close, nil
+	}
+	gz := gzip.NewWriter(f)
+	return gz, func() error {
+		return errors.Join(gz.Close(), f.Close())
+	}, nil
+}
+
+func openDumpInput(path string) (io.Reader, func(), error) {
+	if path == "" || path == "-" {
+		return os.Stdin, func() {}, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !strings.HasSuffix(path, ".gz") {
+		return f, func() { _ = f.Close() }, nil
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		_ = f.Close()
+		return nil, nil, err
+	}
+	return gz, func() { _ = gz.Close(); _ = f.Close() }, nil
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"unicode"
+)
+
+// denyPatterns block paths on top of the built-in rules (/private/, upload
+// conf dirs, files on disk PHP would not serve), from VALENCE_DENY_PATHS:
+// patterns separated by commas or spaces, where * matches within one path
+// segment.
+//
+//   - /plugins/*/data/ ends in a slash and blocks that directory and
+//     everything under it.
+//   - /backup/dump.sql starts with a slash and blocks that exact path.
+//   - *.sql has no slash and blocks any file whose name matches it.
+//
+// Matching requests are answered 403, like the built-in deny rules.
+type denyPatterns []denyPattern
+
+type denyPattern struct {
+	raw string
+	// segments is set for patterns anchored at the root, base for file
+	// name patterns.
+	segments []string
+	dir      bool
+	base     string
+}
+
+func denyPatternsFromEnv() (denyPatterns, error) {
+	var patterns denyPatterns
+	fields := strings.FieldsFunc(os.Getenv("VALENCE_DENY_PATHS"), func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+	for _, raw := range fields {
+		p := denyPattern{raw: raw}
+		switch {
+		case strings.HasPrefix(raw, "/"):
+			p.dir = strings.HasSuffix(raw, "/")
+			p.segments = strings.Split(strings.Trim(raw, "/"), "/")
+			for _, segment := range p.segments {
+				if _, err := path.Match(segment, ""); err != nil || segment == "" {
+					return nil, fmt.Errorf("VALENCE_DENY_PATHS: invalid pattern %q", raw)
+				}
+			}
+		case strings.Contains(raw, "/"):
+			return nil, fmt.Errorf("VALENCE_DENY_PATHS: %q must start with / or be a file name pattern", raw)
+		default:
+			if _, err := path.Match(raw, ""); err != nil {
+				return nil, fmt.Errorf("VALENCE_DENY_PATHS: invalid pattern %q", raw)
+			}
+			p.base = raw
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+// match returns the pattern that blocks reqPath, a cleaned request path.
+func (d denyPatterns) match(reqPath string) (string, bool) {
+	if len(d) == 0 {
+		return "", false
+	}
+	segments := strings.Split(strings.TrimPrefix(reqPath, "/"), "/")
+	for _, p := range d {
+		if p.base != "" {
+			if ok, _ := path.Match(p.base, segments[len(segments)-1]); ok {
+				return p.raw, true
+			}
+			continue
+		}
+		if len(segments) < len(p.segments) || (!p.dir && len(segments) != len(p.segments)) {
+			continue
+		}
+		matched := true
+		for i, segment := range p.segments {
+			if ok, _ := path.Match(segment, segments[i]); !ok {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return p.raw, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDenyPatternsMatch(t *testing.T) {
+	t.Setenv("VALENCE_DENY_PATHS", "/plugins/*/data/, /backup/dump.sql *.sql")
+	patterns, err := denyPatternsFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path    string
+		pattern string
+	}{
+		{"/plugins/arFoo/data/", "/plugins/*/data/"},
+		{"/plugins/arFoo/data/schema.yml", "/plugins/*/data/"},
+		{"/plugins/arFoo/lib/data.php", ""},
+		{"/plugins/data/schema.yml", ""},
+		{"/backup/dump.sql", "/backup/dump.sql"},
+		{"/backup/dump.sql.gz", ""},
+		{"/backup/dump.sql/more", ""},
+		{"/backup/other.sql", "*.sql"},
+		{"/data/atom.sql", "*.sql"},
+		{"/index.php", ""},
+	}
+	for _, tt := range tests {
+		pattern, ok := patterns.match(tt.path)
+		if pattern != tt.pattern || ok != (tt.pattern != "") {
+			t.Errorf("match(%q) = %q, %v; want %q", tt.path, pattern, ok, tt.pattern)
+		}
+	}
+}
+
+func TestDenyPatternsFromEnvInvalid(t *testing.T) {
+	for _, val := range []string{"backup/dump.sql", "/backup//dump.sql", "[.sql", "/backup/[/"} {
+		t.Setenv("VALENCE_DENY_PATHS", val)
+		if _, err := denyPatternsFromEnv(); err == nil {
+			t.Errorf("denyPatternsFromEnv accepted %q", val)
+		}
+	}
+}
+
+func TestDecideRouteDeny(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"index.php", "config/databases.yml", "backup/dump.sql", "plugins/arFoo/data/schema.yml"} {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("VALENCE_DENY_PATHS", "/plugins/*/data/ *.sql")
+	patterns, err := denyPatternsFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newAtomHandler(config{
+		phpRoot:         root,
+		frontController: filepath.Join(root, "index.php"),
+		denyPaths:       patterns,
+	}, "", nil, nil, nil)
+
+	tests := []struct {
+		path  string
+		label string
+	}{
+		{"/private/secret", "deny_private"},
+		{"/uploads/r/repo/conf/settings.yml", "deny_uploads_conf"},
+		{"/uploads/r/repo/image.jpg", "uploads_front_controller"},
+		{"/config/databases.yml", "deny_direct_file"},
+		{"/backup/dump.sql", "deny_configured"},
+		{"/missing.sql", "deny_configured"},
+		{"/plugins/arFoo/data/schema.yml", "deny_configured"},
+		{"/plugins/arFoo/data/", "deny_configured"},
+		{"/index.php", "php_entry"},
+		{"/informationobject/browse", "front_controller"},
+	}
+	for _, tt := range tests {
+		if got := h.decideRoute(httptest.NewRequest(http.MethodGet, tt.path, nil), tt.path).label; got != tt.label {
+			t.Errorf("decideRoute(%q) = %s; want %s", tt.path, got, tt.label)
+		}
+	}
+}
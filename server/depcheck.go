@@ -0,0 +1,217 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/artefactual-labs/valence/internal/bootstrap"
+)
+
+// checkError is a readiness failure; permanent ones stop the wait.
+type checkError struct {
+	msg       string
+	permanent bool
+}
+
+func (e *checkError) Error() string   { return e.msg }
+func (e *checkError) Permanent() bool { return e.permanent }
+
+// elasticsearchCheck waits for _cluster/health to reach
+// VALENCE_WAIT_ES_STATUS (yellow by default) and, when VALENCE_WAIT_ES_INDEX
+// is set, for that index to exist.
+func elasticsearchCheck(cfg bootstrap.Config, host string) func(net.Conn) error {
+	status := strings.ToLower(envOrDefault("VALENCE_WAIT_ES_STATUS", "yellow"))
+	index := envOrDefault("VALENCE_WAIT_ES_INDEX", "")
+	if status != "green" && status != "yellow" {
+		logWarnf("invalid VALENCE_WAIT_ES_STATUS %q; using yellow", status)
+		status = "yellow"
+	}
+
+	return func(conn net.Conn) error {
+		br := bufio.NewReader(conn)
+		resp, err := esGet(conn, br, cfg, host, "/_cluster/health?wait_for_status="+url.QueryEscape(status)+"&timeout=1s")
+		if err != nil {
+			return err
+		}
+		var health struct {
+			Status string `json:"status"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&health)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("decode cluster health: %w", err)
+		}
+		if !esStatusAtLeast(health.Status, status) {
+			return fmt.Errorf("cluster status %s, want %s", health.Status, status)
+		}
+
+		if index == "" {
+			return nil
+		}
+		resp, err = esGet(conn, br, cfg, host, "/"+url.PathEscape(index))
+		if err != nil {
+			if resp != nil && resp.StatusCode == http.StatusNotFound {
+				return fmt.Errorf("index %s does not exist yet", index)
+			}
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+}
+
+func esGet(conn net.Conn, br *bufio.Reader, cfg bootstrap.Config, host, path string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, "http://"+host+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case cfg.ElasticsearchAPIKey != "":
+		req.Header.Set("Authorization", "ApiKey "+cfg.ElasticsearchAPIKey)
+	case cfg.ElasticsearchUsername != "":
+		req.SetBasicAuth(cfg.ElasticsearchUsername, cfg.ElasticsearchPassword)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		resp.Body.Close()
+		return resp, &checkError{msg: fmt.Sprintf("GET %s: %s (check credentials)", path, resp.Status), permanent: true}
+	case resp.StatusCode != http.StatusOK:
+		resp.Body.Close()
+		return resp, fmt.Errorf("GET %s: %s", path, resp.Status)
+	}
+	return resp, nil
+}
+
+func esStatusAtLeast(got, want string) bool {
+	rank := map[string]int{"red": 0, "yellow": 1, "green": 2}
+	g, ok := rank[got]
+	return ok && g >= rank[want]
+}
+
+// memcachedCheck sends "version" over the text protocol.
+func memcachedCheck(conn net.Conn) error {
+	if _, err := conn.Write([]byte("version\r\n")); err != nil {
+		return err
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "VERSION ") {
+		return fmt.Errorf("unexpected reply %q", strings.TrimSpace(line))
+	}
+	return nil
+}
+
+// redisCheck authenticates when a password is set, then sends PING.
+func redisCheck(password string) func(net.Conn) error {
+	return func(conn net.Conn) error {
+		br := bufio.NewReader(conn)
+		if password != "" {
+			if err := redisCommand(conn, br, "AUTH", password); err != nil {
+				if strings.Contains(err.Error(), "WRONGPASS") || strings.Contains(err.Error(), "invalid password") {
+					return &checkError{msg: err.Error(), permanent: true}
+				}
+				return err
+			}
+		}
+		return redisCommand(conn, br, "PING")
+	}
+}
+
+func redisCommand(conn net.Conn, br *bufio.Reader, args ...string) error {
+	var cmd strings.Builder
+	fmt.Fprintf(&cmd, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&cmd, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := conn.Write([]byte(cmd.String())); err != nil {
+		return err
+	}
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	line = strings.TrimSpace(line)
+	if strings.HasPrefix(line, "-") {
+		return fmt.Errorf("redis %s: %s", args[0], line[1:])
+	}
+	return nil
+}
+
+// gearmanFunction is one line of gearmand's admin "status" reply.
+type gearmanFunction struct {
+	Name    string `json:"name"`
+	Queued  int    `json:"queued"`
+	Running int    `json:"running"`
+	Workers int    `json:"workers"`
+}
+
+// gearmanCheck queries gearmand's admin status; with requireWorker it also
+// needs at least one registered worker, since jobs otherwise queue forever.
+// When workers is non-nil it receives the worker count.
+func gearmanCheck(requireWorker bool, workers *int) func(net.Conn) error {
+	return func(conn net.Conn) error {
+		functions, err := gearmanStatus(conn)
+		if err != nil {
+			return err
+		}
+		n := gearmanWorkers(functions)
+		if workers != nil {
+			*workers = n
+		}
+		if requireWorker && n == 0 {
+			return fmt.Errorf("no workers registered")
+		}
+		return nil
+	}
+}
+
+func gearmanStatus(conn net.Conn) ([]gearmanFunction, error) {
+	if _, err := conn.Write([]byte("status\n")); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	var functions []gearmanFunction
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "." {
+			return functions, nil
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("unexpected status line %q", line)
+		}
+		fn := gearmanFunction{Name: fields[0]}
+		fn.Queued, _ = strconv.Atoi(fields[1])
+		fn.Running, _ = strconv.Atoi(fields[2])
+		fn.Workers, _ = strconv.Atoi(fields[3])
+		functions = append(functions, fn)
+	}
+}
+
+// gearmanWorkers is the most workers registered for any one function.
+func gearmanWorkers(functions []gearmanFunction) int {
+	workers := 0
+	for _, fn := range functions {
+		workers = max(workers, fn.Workers)
+	}
+	return workers
+}
@@ -0,0 +1,282 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"github.com/artefactual-labs/valence/internal/imaging"
+)
+
+// AtoM's digital object usage terms (QubitTerm::*_ID) for derivatives.
+const (
+	usageReference = 141
+	usageThumbnail = 142
+)
+
+// derivativeSpec is one derivative AtoM keeps next to a master, named
+// <master basename>_<usage id>.jpg.
+type derivativeSpec struct {
+	usage     string
+	usageID   int
+	maxWidth  int
+	maxHeight int
+}
+
+func derivativeSpecs() []derivativeSpec {
+	return []derivativeSpec{
+		{
+			usage:     "reference",
+			usageID:   usageReference,
+			maxWidth:  envInt("VALENCE_DERIVATIVE_REFERENCE_WIDTH", 480),
+			maxHeight: envInt("VALENCE_DERIVATIVE_REFERENCE_HEIGHT", 480),
+		},
+		{
+			usage:     "thumbnail",
+			usageID:   usageThumbnail,
+			maxWidth:  envInt("VALENCE_DERIVATIVE_THUMBNAIL_WIDTH", 100),
+			maxHeight: envInt("VALENCE_DERIVATIVE_THUMBNAIL_HEIGHT", 100),
+		},
+	}
+}
+
+// derivative describes a written file with what AtoM records for it, so
+// the caller can register it without reading it back.
+type derivative struct {
+	Usage    string `json:"usage"`
+	UsageID  int    `json:"usage_id"`
+	Path     string `json:"path"`
+	Name     string `json:"name"`
+	MimeType string `json:"mime_type"`
+	ByteSize int64  `json:"byte_size"`
+	Checksum string `json:"checksum"` // sha256, as AtoM computes it
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+}
+
+// derivativeSlots bounds concurrent generation; decoding a large master
+// takes memory in proportion to its pixels.
+var derivativeSlots = make(chan struct{}, max(envInt("VALENCE_DERIVATIVE_CONCURRENCY", runtime.GOMAXPROCS(0)), 1))
+
+// The other derivative settings are read once too, as jobs run while sites
+// borrow the process environment.
+var (
+	derivativeSizes     = derivativeSpecs()
+	derivativeMaxPixels = envInt("VALENCE_DERIVATIVE_MAX_PIXELS", 50_000_000)
+	derivativeQuality   = envInt("VALENCE_DERIVATIVE_QUALITY", 85)
+)
+
+// generateDerivatives writes the reference and thumbnail images for the
+// master at masterPath beside it. Existing ones are kept unless force is
+// set.
+func generateDerivatives(masterPath string, force bool) ([]derivative, error) {
+	derivativeSlots <- struct{}{}
+	defer func() { <-derivativeSlots }()
+
+	master, err := os.Open(masterPath)
+	if err != nil {
+		return nil, err
+	}
+	defer master.Close()
+	info, err := master.Stat()
+	if err != nil {
+		return nil, err
+	}
+	img, _, err := imaging.Decode(master, derivativeMaxPixels)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Dir(masterPath)
+	base := strings.TrimSuffix(filepath.Base(masterPath), filepath.Ext(masterPath))
+	var out []derivative
+	for _, spec := range derivativeSizes {
+		name := fmt.Sprintf("%s_%d.jpg", base, spec.usageID)
+		target := filepath.Join(dir, name)
+		if !force {
+			if _, err := os.Stat(target); err == nil {
+				continue
+			}
+		}
+		d, err := writeDerivative(target, imaging.Fit(img, spec.maxWidth, spec.maxHeight), info)
+		if err != nil {
+			return out, fmt.Errorf("%s: %w", name, err)
+		}
+		d.Usage, d.UsageID, d.Name = spec.usage, spec.usageID, name
+		out = append(out, d)
+	}
+	return out, nil
+}
+
+// writeDerivative encodes img to a temp file in path's dir and renames it
+// into place, so AtoM never serves a partial image. The file gets the
+// master's owner so PHP can replace it later.
+func writeDerivative(path string, img *image.RGBA, owner os.FileInfo) (derivative, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".derivative-*")
+	if err != nil {
+		return derivative{}, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	counter := &countingWriter{}
+	if err := imaging.EncodeJPEG(io.MultiWriter(tmp, hash, counter), img, derivativeQuality); err != nil {
+		return derivative{}, err
+	}
+	if err := tmp.Chmod(0o644); err != nil {
+		return derivative{}, err
+	}
+	if stat, ok := owner.Sys().(*syscall.Stat_t); ok && os.Geteuid() == 0 {
+		if err := tmp.Chown(int(stat.Uid), int(stat.Gid)); err != nil {
+			return derivative{}, err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return derivative{}, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return derivative{}, err
+	}
+	return derivative{
+		Path:     path,
+		MimeType: "image/jpeg",
+		ByteSize: counter.n,
+		Checksum: hex.EncodeToString(hash.Sum(nil)),
+		Width:    img.Rect.Dx(),
+		Height:   img.Rect.Dy(),
+	}, nil
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+type derivativesRequest struct {
+	// Master is the master's URL path, /uploads/r/...
+	Master string `json:"master"`
+	Force  bool   `json:"force,omitempty"`
+}
+
+// derivativesHandler generates derivatives for a master of the site the
+// request's Host names and reports them for AtoM to record. Formats it
+// cannot read answer 415, for the caller to fall back to ImageMagick.
+func derivativesHandler(router *siteRouter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !authorizeInternalAPI(w, r) {
+			return
+		}
+		if !internalAPIConfigured() {
+			http.Error(w, "internal api token not configured", http.StatusForbidden)
+			return
+		}
+		s := router.siteFor(r.Host)
+		if s == nil {
+			http.Error(w, "unknown site", http.StatusNotFound)
+			return
+		}
+
+		var req derivativesRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+		reqPath := cleanPath(req.Master)
+		if reqPath != req.Master || !uploadsAssetRe.MatchString(reqPath) || uploadsConfRe.MatchString(reqPath) {
+			http.Error(w, "master must be a file under /uploads/r/", http.StatusBadRequest)
+			return
+		}
+		h := s.handler.Load()
+		if h == nil {
+			http.Error(w, "site unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		dataDir := h.atomDataDir
+		if dataDir == "" {
+			dataDir = h.phpRoot
+		}
+		masterPath := filepath.Join(dataDir, filepath.FromSlash(strings.TrimPrefix(reqPath, "/")))
+
+		written, err := generateDerivatives(masterPath, req.Force)
+		switch {
+		case err == nil:
+		case errors.Is(err, os.ErrNotExist):
+			http.Error(w, "master not found", http.StatusNotFound)
+			return
+		case errors.Is(err, imaging.ErrUnsupported):
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+			return
+		case errors.Is(err, imaging.ErrTooLarge):
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		default:
+			logErrorf("derivatives for %s: %v", reqPath, err)
+			http.Error(w, "derivative generation failed", http.StatusInternalServerError)
+			return
+		}
+		for i := range written {
+			written[i].Path = path.Join(path.Dir(reqPath), written[i].Name)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		_ = json.NewEncoder(w).Encode(map[string][]derivative{"derivatives": written})
+	}
+}
+
+// derivativesCommand generates derivatives for master files on disk, for
+// backfills and for regenerating after the size settings change. Masters
+// in formats it cannot read are skipped with a message.
+func derivativesCommand(args []string) error {
+	fs := flag.NewFlagSet("digitalobject:derivatives", flag.ContinueOnError)
+	force := fs.Bool("force", false, "replace existing derivatives")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errors.New("usage: valence digitalobject:derivatives [--force] <master>...")
+	}
+
+	failed := 0
+	for _, masterPath := range fs.Args() {
+		written, err := generateDerivatives(masterPath, *force)
+		switch {
+		case errors.Is(err, imaging.ErrUnsupported):
+			logInfof("%s: skipped, %v", masterPath, err)
+			continue
+		case err != nil:
+			logErrorf("%s: %v", masterPath, err)
+			failed++
+			continue
+		}
+		for _, d := range written {
+			fmt.Printf("%s %s %dx%d %d bytes\n", d.Usage, d.Path, d.Width, d.Height, d.ByteSize)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d masters failed", failed, fs.NArg())
+	}
+	return nil
+}
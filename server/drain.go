@@ -0,0 +1,119 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// phpInFlight counts requests currently inside the PHP runtime.
+var phpInFlight atomic.Int64
+
+// drainer takes the server out of rotation before it stops: readiness goes
+// false, then it keeps serving for VALENCE_DRAIN_DELAY so load balancers
+// notice, and waits for in-flight PHP requests for up to
+// VALENCE_DRAIN_GRACE before done is closed and the listener shuts down.
+type drainer struct {
+	delay time.Duration
+	grace time.Duration
+
+	once      sync.Once
+	startedAt atomic.Pointer[time.Time]
+	done      chan struct{}
+}
+
+type drainStatus struct {
+	Draining  bool       `json:"draining"`
+	StartedAt *time.Time `json:"started_at,omitempty"`
+	InFlight  int64      `json:"in_flight"`
+}
+
+func newDrainer() *drainer {
+	return &drainer{
+		delay: envDuration("VALENCE_DRAIN_DELAY", 5*time.Second),
+		grace: envDuration("VALENCE_DRAIN_GRACE", 30*time.Second),
+		done:  make(chan struct{}),
+	}
+}
+
+func (d *drainer) draining() bool {
+	return d.startedAt.Load() != nil
+}
+
+// start begins draining; later calls are no-ops.
+func (d *drainer) start() {
+	d.once.Do(func() {
+		now := time.Now().UTC()
+		d.startedAt.Store(&now)
+		logInfof("draining: readiness is false, waiting up to %s for in-flight PHP requests", d.delay+d.grace)
+		go d.wait()
+	})
+}
+
+func (d *drainer) wait() {
+	defer close(d.done)
+	time.Sleep(d.delay)
+	deadline := time.Now().Add(d.grace)
+	for phpInFlight.Load() > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if n := phpInFlight.Load(); n > 0 {
+		logWarnf("draining: grace period over with %d PHP requests in flight", n)
+		return
+	}
+	logInfof("draining: no PHP requests in flight")
+}
+
+func (d *drainer) status() drainStatus {
+	return drainStatus{
+		Draining:  d.draining(),
+		StartedAt: d.startedAt.Load(),
+		InFlight:  phpInFlight.Load(),
+	}
+}
+
+// readinessHandler answers 503 once draining starts, unlike /health which
+// stays up for liveness probes until the process exits.
+func readinessHandler(d *drainer) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		status, code := "ok", http.StatusOK
+		if d.draining() {
+			status, code = "draining", http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(code)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": status})
+	}
+}
+
+// drainHandler starts draining on POST and reports progress on GET. Once
+// the drain finishes the server shuts down.
+func drainHandler(d *drainer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !authorizeInternalAPI(w, r) {
+			return
+		}
+
+		code := http.StatusOK
+		if r.Method == http.MethodPost {
+			if !internalAPIConfigured() {
+				http.Error(w, "internal api token not configured", http.StatusForbidden)
+				return
+			}
+			d.start()
+			code = http.StatusAccepted
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(code)
+		_ = json.NewEncoder(w).Encode(d.status())
+	}
+}
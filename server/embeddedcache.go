@@ -0,0 +1,80 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/artefactual-labs/valence/internal/bootstrap"
+	"github.com/artefactual-labs/valence/internal/memcached"
+)
+
+// VALENCE_EMBEDDED_CACHE runs a memcached-compatible cache inside valence,
+// so a single-box install needs no memcached of its own. auto, the
+// default, uses it when ATOM_MEMCACHED_HOST is unset and AtoM caches in
+// memcache; on uses it whatever ATOM_MEMCACHED_HOST says; off never does.
+// It listens on VALENCE_EMBEDDED_CACHE_ADDR (default 127.0.0.1:11211),
+// which must be a loopback address as memcached has no authentication,
+// and holds up to VALENCE_EMBEDDED_CACHE_SIZE (default 64M). Its contents,
+// sessions included, do not survive a restart.
+//
+// ATOM_MEMCACHED_HOST is pointed at the cache for every command, so the
+// generated AtoM config, the dependency checks and cache:clear -flush all
+// reach the cache of the running server.
+func embeddedCacheFromEnv() (string, error) {
+	mode := strings.ToLower(envOrDefault("VALENCE_EMBEDDED_CACHE", "auto"))
+	switch mode {
+	case "off":
+		return "", nil
+	case "auto":
+		engine := strings.ToLower(envOrDefault("ATOM_CACHE_ENGINE", bootstrap.CacheEngineMemcache))
+		if engine != bootstrap.CacheEngineMemcache || strings.TrimSpace(os.Getenv("ATOM_MEMCACHED_HOST")) != "" {
+			return "", nil
+		}
+	case "on":
+	default:
+		return "", fmt.Errorf("invalid VALENCE_EMBEDDED_CACHE %q (want auto, on or off)", mode)
+	}
+	addr := envOrDefault("VALENCE_EMBEDDED_CACHE_ADDR", "127.0.0.1:11211")
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("VALENCE_EMBEDDED_CACHE_ADDR: %w", err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return "", fmt.Errorf("VALENCE_EMBEDDED_CACHE_ADDR %q is not a loopback address", addr)
+	}
+	// Settle the choice for processes valence starts, which see
+	// ATOM_MEMCACHED_HOST set.
+	os.Setenv("VALENCE_EMBEDDED_CACHE", "on")
+	os.Setenv("ATOM_MEMCACHED_HOST", addr)
+	return addr, nil
+}
+
+// startEmbeddedCache serves the embedded cache, if it is in use, until
+// valence exits.
+func startEmbeddedCache() error {
+	addr, err := embeddedCacheFromEnv()
+	if err != nil || addr == "" {
+		return err
+	}
+	size := int64(64 << 20)
+	if val := strings.TrimSpace(os.Getenv("VALENCE_EMBEDDED_CACHE_SIZE")); val != "" {
+		if size, err = parseByteSize(val); err != nil {
+			return fmt.Errorf("VALENCE_EMBEDDED_CACHE_SIZE: %w", err)
+		}
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("listen: %w", err)
+	}
+	cache := memcached.NewServer(size)
+	embeddedCacheStats = cache.Stats
+	go func() {
+		if err := cache.Serve(ln); err != nil {
+			logErrorf("embedded cache stopped: %v", err)
+		}
+	}()
+	logInfof("embedded cache listening on %s (%d MiB)", addr, size>>20)
+	return nil
+}
@@ -0,0 +1,340 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/artefactual-labs/valence/internal/atomembed"
+)
+
+// errorReporter forwards panics, 5xx responses, PHP fatal errors and
+// bootstrap failures to Sentry or a compatible service such as GlitchTip,
+// configured with VALENCE_SENTRY_DSN. Events carry the embedded AtoM
+// version as their release. They are sent in the background; when the
+// queue is full new events are dropped rather than slowing requests down.
+type errorReporter struct {
+	endpoint    string
+	auth        string
+	release     string
+	environment string
+	serverName  string
+	report5xx   bool
+	client      *http.Client
+	queue       chan []byte
+	pending     sync.WaitGroup
+}
+
+// reporter is nil unless VALENCE_SENTRY_DSN is set.
+var reporter *errorReporter
+
+func errorReporterFromEnv() (*errorReporter, error) {
+	dsn := strings.TrimSpace(os.Getenv("VALENCE_SENTRY_DSN"))
+	if dsn == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(dsn)
+	if err != nil || u.User == nil || u.User.Username() == "" || u.Host == "" {
+		return nil, errors.New("VALENCE_SENTRY_DSN must look like https://<key>@<host>/<project>")
+	}
+	dir, project := path.Split(strings.TrimSuffix(u.Path, "/"))
+	if project == "" {
+		return nil, errors.New("VALENCE_SENTRY_DSN has no project id")
+	}
+	endpoint := url.URL{Scheme: u.Scheme, Host: u.Host, Path: path.Join(dir, "api", project, "envelope") + "/"}
+
+	release := atomembed.AtomVersion()
+	if release == "" {
+		release = atomembed.VersionName()
+	}
+	serverName, _ := os.Hostname()
+	r := &errorReporter{
+		endpoint:    endpoint.String(),
+		auth:        fmt.Sprintf("Sentry sentry_version=7, sentry_client=valence/%s, sentry_key=%s", version, u.User.Username()),
+		release:     "atom@" + release,
+		environment: envOrDefault("VALENCE_SENTRY_ENVIRONMENT", valenceEnvironment()),
+		serverName:  serverName,
+		report5xx:   envBool("VALENCE_SENTRY_REPORT_5XX", true),
+		client:      &http.Client{Timeout: envDuration("VALENCE_SENTRY_TIMEOUT", 5*time.Second)},
+		queue:       make(chan []byte, 100),
+	}
+	go r.run()
+	return r, nil
+}
+
+func (r *errorReporter) run() {
+	for envelope := range r.queue {
+		r.send(envelope)
+		r.pending.Done()
+	}
+}
+
+func (r *errorReporter) send(envelope []byte) {
+	req, err := http.NewRequest(http.MethodPost, r.endpoint, bytes.NewReader(envelope))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-sentry-envelope")
+	req.Header.Set("X-Sentry-Auth", r.auth)
+	resp, err := r.client.Do(req)
+	if err != nil {
+		logWarnf("sentry: %v", err)
+		return
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		logWarnf("sentry: unexpected status %s", resp.Status)
+	}
+}
+
+// flush waits at most timeout for the queued events to be sent, for use
+// on the way out of the process.
+func (r *errorReporter) flush(timeout time.Duration) {
+	if r == nil {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		r.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+	}
+}
+
+// sentryEvent is the subset of the Sentry event payload valence fills in.
+type sentryEvent struct {
+	EventID     string            `json:"event_id"`
+	Timestamp   time.Time         `json:"timestamp"`
+	Platform    string            `json:"platform"`
+	Level       string            `json:"level"`
+	Logger      string            `json:"logger"`
+	Release     string            `json:"release"`
+	Environment string            `json:"environment"`
+	ServerName  string            `json:"server_name,omitempty"`
+	Exception   *sentryExceptions `json:"exception,omitempty"`
+	Request     *sentryRequest    `json:"request,omitempty"`
+	Tags        map[string]string `json:"tags"`
+	Extra       map[string]any    `json:"extra,omitempty"`
+}
+
+type sentryExceptions struct {
+	Values []sentryException `json:"values"`
+}
+
+type sentryException struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type sentryRequest struct {
+	URL         string            `json:"url"`
+	Method      string            `json:"method"`
+	QueryString string            `json:"query_string,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Env         map[string]string `json:"env,omitempty"`
+}
+
+// reportedHeaders are the request headers sent with an event; cookies and
+// credentials never are.
+var reportedHeaders = []string{"User-Agent", "Referer", "Accept", "Accept-Language", "Content-Type", "Content-Length", "X-Forwarded-For", "X-Forwarded-Proto", "X-Request-Id"}
+
+// report queues an event. kind says where it came from (panic, http_5xx,
+// php_fatal or bootstrap) and req, when set, adds the request.
+func (r *errorReporter) report(kind, level, errType, msg string, req *http.Request, extra map[string]any) {
+	if r == nil {
+		return
+	}
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+	event := sentryEvent{
+		EventID:     hex.EncodeToString(id),
+		Timestamp:   time.Now().UTC(),
+		Platform:    "go",
+		Level:       level,
+		Logger:      "valence",
+		Release:     r.release,
+		Environment: r.environment,
+		ServerName:  r.serverName,
+		Exception:   &sentryExceptions{Values: []sentryException{{Type: errType, Value: msg}}},
+		Tags:        map[string]string{"kind": kind, "valence_version": version},
+		Extra:       extra,
+	}
+	if req != nil {
+		scheme := "http"
+		if req.TLS != nil {
+			scheme = "https"
+		}
+		headers := map[string]string{}
+		for _, name := range reportedHeaders {
+			if val := req.Header.Get(name); val != "" {
+				headers[name] = val
+			}
+		}
+		event.Request = &sentryRequest{
+			URL:         scheme + "://" + req.Host + req.URL.Path,
+			Method:      req.Method,
+			QueryString: req.URL.RawQuery,
+			Headers:     headers,
+			Env:         map[string]string{"REMOTE_ADDR": req.RemoteAddr},
+		}
+		event.Tags["host"] = normalizeHost(req.Host)
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	var envelope bytes.Buffer
+	fmt.Fprintf(&envelope, `{"event_id":%q,"sent_at":%q}`+"\n", event.EventID, event.Timestamp.Format(time.RFC3339))
+	fmt.Fprintf(&envelope, `{"type":"event","length":%d}`+"\n", len(payload))
+	envelope.Write(payload)
+	envelope.WriteByte('\n')
+
+	r.pending.Add(1)
+	select {
+	case r.queue <- envelope.Bytes():
+	default:
+		r.pending.Done()
+		logWarnf("sentry: queue full, dropping %s event", kind)
+	}
+}
+
+// reportState lets handlers deeper in the chain attach what they know
+// about a failing request, such as a PHP fatal error, to the one event
+// withErrorReporting sends for it.
+type reportState struct {
+	phpFatal string
+}
+
+type reportStateKey struct{}
+
+func requestReportState(r *http.Request) *reportState {
+	state, _ := r.Context().Value(reportStateKey{}).(*reportState)
+	return state
+}
+
+// withErrorReporting reports panics and 5xx responses. A panic is answered
+// with a 500 when nothing was written yet.
+func withErrorReporting(next http.Handler) http.Handler {
+	if reporter == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state := &reportState{}
+		r = r.WithContext(context.WithValue(r.Context(), reportStateKey{}, state))
+		recorder := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			if p := recover(); p != nil {
+				if p == http.ErrAbortHandler {
+					panic(p)
+				}
+				reporter.report("panic", "fatal", "panic", fmt.Sprint(p), r, map[string]any{"stack": string(debug.Stack())})
+				if recorder.status == 0 {
+					http.Error(recorder, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				}
+				return
+			}
+			switch {
+			case state.phpFatal != "":
+				reporter.report("php_fatal", "fatal", "PHP Fatal error", state.phpFatal, r, map[string]any{"status": recorder.status})
+			case recorder.status >= 500 && reporter.report5xx:
+				msg := fmt.Sprintf("%d %s %s", recorder.status, r.Method, r.URL.Path)
+				reporter.report("http_5xx", "error", http.StatusText(recorder.status), msg, r, nil)
+			}
+		}()
+		next.ServeHTTP(recorder, r)
+	})
+}
+
+// phpFatalHeader carries a PHP fatal error from the shutdown function in
+// phpFatalScript to the front controller handler, which strips it.
+const phpFatalHeader = "X-Valence-Php-Fatal"
+
+const phpFatalScript = `<?php
+register_shutdown_function(function () {
+    $e = error_get_last();
+    if ($e === null || !($e['type'] & (E_ERROR | E_PARSE | E_CORE_ERROR | E_COMPILE_ERROR | E_USER_ERROR | E_RECOVERABLE_ERROR))) {
+        return;
+    }
+    if (!headers_sent()) {
+        header('` + phpFatalHeader + `: ' . rawurlencode(sprintf('%s in %s:%d', $e['message'], $e['file'], $e['line'])));
+    }
+});
+`
+
+// writePHPFatalScript writes the script PHP prepends to every request so
+// fatal errors reach the reporter and /v/php/status, and returns its path.
+// The file gets a fresh name so no other user or valence instance on the
+// host can plant or replace it.
+func writePHPFatalScript() (string, error) {
+	tmp, err := os.CreateTemp("", "valence-fatal-handler-*.php")
+	if err != nil {
+		return "", err
+	}
+	defer tmp.Close()
+	if _, err := tmp.WriteString(phpFatalScript); err != nil {
+		return "", err
+	}
+	if err := tmp.Sync(); err != nil {
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// phpFatalRecorder takes the PHP fatal error header off the response
+// before it goes out, keeping the error in fatal.
+type phpFatalRecorder struct {
+	http.ResponseWriter
+	fatal       string
+	wroteHeader bool
+}
+
+func (w *phpFatalRecorder) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if val := w.Header().Get(phpFatalHeader); val != "" {
+			w.Header().Del(phpFatalHeader)
+			if msg, err := url.QueryUnescape(val); err == nil {
+				val = msg
+			}
+			w.fatal = val
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *phpFatalRecorder) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// ReadFrom keeps http.ServeFile's sendfile path through the wrapper.
+func (w *phpFatalRecorder) ReadFrom(src io.Reader) (int64, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return io.Copy(w.ResponseWriter, src)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *phpFatalRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/artefactual-labs/valence/internal/bootstrap"
+)
+
+type dependencyHealth struct {
+	Status  string `json:"status"`
+	Error   string `json:"error,omitempty"`
+	Workers *int   `json:"workers,omitempty"`
+}
+
+type deepHealth struct {
+	Status       string                      `json:"status"`
+	CheckedAt    time.Time                   `json:"checked_at"`
+	Dependencies map[string]dependencyHealth `json:"dependencies"`
+}
+
+// deepHealthHandler reports dependency state, 503 when any is down. With
+// background monitoring on it serves the monitor's last result; otherwise it
+// checks every dependency per request, so unlike /health it is not meant for
+// liveness probes.
+func deepHealthHandler(monitor *dependencyMonitor) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		report, err := monitor.report()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		status := http.StatusOK
+		if report.Status != "ok" {
+			status = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(report)
+	}
+}
+
+// probeDependencies checks each dependency once.
+func probeDependencies(cfg bootstrap.Config, skip map[string]bool) (deepHealth, error) {
+	report := deepHealth{Status: "ok", CheckedAt: time.Now().UTC(), Dependencies: map[string]dependencyHealth{}}
+	deps, err := dependencies(cfg)
+	if err != nil {
+		return report, err
+	}
+	for _, dep := range deps {
+		if skip[dep.name] {
+			report.Dependencies[dep.name] = dependencyHealth{Status: "skipped"}
+			continue
+		}
+		var workers *int
+		if dep.name == "gearmand" {
+			workers = new(int)
+			for i := range dep.endpoints {
+				dep.endpoints[i].check = gearmanCheck(requireGearmanWorker(), workers)
+			}
+		}
+		health := dependencyHealth{Status: "ok", Workers: workers}
+		if err := checkDependency(dep); err != nil {
+			health.Status = "down"
+			health.Error = err.Error()
+			report.Status = "degraded"
+		}
+		report.Dependencies[dep.name] = health
+	}
+	return report, nil
+}
+
+// checkDependency tries each endpoint once and returns the last error.
+func checkDependency(dep dependency) error {
+	err := errors.New("no address configured")
+	for _, ep := range dep.endpoints {
+		if err = dialEndpoint(ep); err == nil {
+			return nil
+		}
+	}
+	return err
+}
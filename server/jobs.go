@@ -0,0 +1,156 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/artefactual-labs/valence/internal/bootstrap"
+)
+
+// AtoM's job status terms (QubitTerm::JOB_STATUS_*_ID).
+const (
+	jobStatusInProgress = 183
+	jobStatusCompleted  = 184
+	jobStatusError      = 185
+)
+
+// jobsReport combines AtoM's job table with gearmand's queue. AtoM marks a
+// job in progress as soon as it is queued, so pending and running come from
+// gearmand, and the oldest in-progress job's age is what grows when no
+// worker is picking jobs up.
+type jobsReport struct {
+	CheckedAt time.Time `json:"checked_at"`
+	// Pending and Running are gearmand jobs waiting for or held by a
+	// worker, across all functions.
+	Pending int `json:"pending"`
+	Running int `json:"running"`
+	// InProgress, Completed and Failed count the job table by status.
+	InProgress int `json:"in_progress"`
+	Completed  int `json:"completed"`
+	Failed     int `json:"failed"`
+	// OldestPendingAge is how long the oldest in-progress job has waited.
+	OldestPendingAge float64           `json:"oldest_pending_age_seconds"`
+	Functions        []gearmanFunction `json:"functions"`
+	Errors           map[string]string `json:"errors,omitempty"`
+}
+
+// collectJobs reads both sources; one failing is reported in Errors rather
+// than hiding the other.
+func collectJobs(cfg bootstrap.Config) jobsReport {
+	report := jobsReport{CheckedAt: time.Now().UTC(), Functions: []gearmanFunction{}}
+	if err := report.readJobTable(cfg); err != nil {
+		report.addError("mysql", err)
+	}
+	if err := report.readGearmanQueue(cfg); err != nil {
+		report.addError("gearmand", err)
+	}
+	return report
+}
+
+func (r *jobsReport) addError(source string, err error) {
+	if r.Errors == nil {
+		r.Errors = map[string]string{}
+	}
+	r.Errors[source] = err.Error()
+}
+
+func (r *jobsReport) readJobTable(cfg bootstrap.Config) error {
+	conn, _, err := dialMySQL(cfg, 2*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	rows, err := conn.Query("SELECT j.status_id, COUNT(*), TIMESTAMPDIFF(SECOND, MIN(o.created_at), NOW()) " +
+		"FROM job j JOIN object o ON o.id = j.id GROUP BY j.status_id")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		values := rows.Values()
+		status, _ := strconv.Atoi(string(values[0]))
+		count, _ := strconv.Atoi(string(values[1]))
+		switch status {
+		case jobStatusInProgress:
+			r.InProgress = count
+			if age, err := strconv.ParseFloat(string(values[2]), 64); err == nil {
+				r.OldestPendingAge = max(age, 0)
+			}
+		case jobStatusCompleted:
+			r.Completed = count
+		case jobStatusError:
+			r.Failed = count
+		}
+	}
+	return rows.Close()
+}
+
+func (r *jobsReport) readGearmanQueue(cfg bootstrap.Config) error {
+	addr, err := hostPort(cfg.GearmandHost, 4730)
+	if err != nil {
+		return fmt.Errorf("parse gearmand host: %w", err)
+	}
+	conn, err := net.DialTimeout("tcp", addr, 2*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		return err
+	}
+	functions, err := gearmanStatus(conn)
+	if err != nil {
+		return err
+	}
+	for _, fn := range functions {
+		// gearmand's total includes the jobs workers hold.
+		r.Pending += max(fn.Queued-fn.Running, 0)
+		r.Running += fn.Running
+		r.Functions = append(r.Functions, fn)
+	}
+	return nil
+}
+
+func (r jobsReport) setMetrics(site string) {
+	if r.Errors["mysql"] == "" {
+		jobsByStatus.WithLabelValues(site, "in_progress").Set(float64(r.InProgress))
+		jobsByStatus.WithLabelValues(site, "completed").Set(float64(r.Completed))
+		jobsByStatus.WithLabelValues(site, "failed").Set(float64(r.Failed))
+		jobsOldestPendingAge.WithLabelValues(site).Set(r.OldestPendingAge)
+	}
+	if r.Errors["gearmand"] == "" {
+		gearmandJobs.WithLabelValues(site, "pending").Set(float64(r.Pending))
+		gearmandJobs.WithLabelValues(site, "running").Set(float64(r.Running))
+	}
+}
+
+// jobsHandler reports job queue state, refreshing the job metrics too.
+// It answers 503 when either source could not be read.
+func jobsHandler(site string, cfg bootstrap.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !authorizeInternalAPI(w, r) {
+			return
+		}
+
+		report := collectJobs(cfg)
+		report.setMetrics(site)
+
+		status := http.StatusOK
+		if len(report.Errors) > 0 {
+			status = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(report)
+	}
+}
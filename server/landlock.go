@@ -0,0 +1,90 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// VALENCE_LANDLOCK=best-effort or require confines valence and the PHP it
+// runs to the files it needs with Linux Landlock, so code execution in
+// AtoM cannot read the rest of the host: the atom root, data dirs, temp
+// dir and log dirs are writable; system dirs (/usr, /lib, /etc, /proc,
+// ...), the files named by *_FILE variables and PHP's extension dir are
+// readable; nothing else is reachable. VALENCE_LANDLOCK_READ and
+// VALENCE_LANDLOCK_WRITE add paths. best-effort carries on unconfined on
+// kernels without Landlock, require refuses to start.
+const landlockActiveEnv = "VALENCE_LANDLOCK_ACTIVE"
+
+var errLandlockUnsupported = errors.New("landlock is not supported by this kernel")
+
+type landlockRule struct {
+	path  string
+	write bool
+}
+
+// sandboxFromEnv applies VALENCE_LANDLOCK. Applying it re-executes valence,
+// so on success it does not return.
+func sandboxFromEnv(cfg config, sites []*site) error {
+	mode := strings.ToLower(envOrDefault("VALENCE_LANDLOCK", "off"))
+	switch mode {
+	case "off":
+		return nil
+	case "best-effort", "require":
+	default:
+		return fmt.Errorf("invalid VALENCE_LANDLOCK %q (want off, best-effort or require)", mode)
+	}
+	if os.Getenv(landlockActiveEnv) == "1" {
+		logInfof("landlock: filesystem access is restricted")
+		return nil
+	}
+	err := applyLandlock(landlockRules(cfg, sites))
+	if errors.Is(err, errLandlockUnsupported) && mode == "best-effort" {
+		logWarnf("landlock: %v; running unconfined", err)
+		return nil
+	}
+	return fmt.Errorf("landlock: %w", err)
+}
+
+// landlockRules lists the paths valence and AtoM use.
+func landlockRules(cfg config, sites []*site) []landlockRule {
+	var rules []landlockRule
+	read := func(paths ...string) {
+		for _, path := range paths {
+			rules = append(rules, landlockRule{path: path})
+		}
+	}
+	write := func(paths ...string) {
+		for _, path := range paths {
+			rules = append(rules, landlockRule{path: path, write: true})
+		}
+	}
+
+	read("/usr", "/lib", "/lib64", "/bin", "/sbin", "/etc", "/proc", "/sys", "/run")
+	if exe, err := os.Executable(); err == nil {
+		read(filepath.Dir(exe))
+	}
+	read(os.Getenv("PHP_EXTENSION_DIR"), os.Getenv("VALENCE_TLS_CERT_DIR"), os.Getenv("VALENCE_WELL_KNOWN_DIR"))
+	for _, kv := range os.Environ() {
+		key, value, _ := strings.Cut(kv, "=")
+		if strings.HasSuffix(key, "_FILE") && filepath.IsAbs(value) {
+			read(value)
+		}
+	}
+	read(commaList(os.Getenv("VALENCE_LANDLOCK_READ"))...)
+
+	write("/dev", os.TempDir(), cfg.phpRoot, atomVersionsDir())
+	for _, s := range sites {
+		write(s.cfg.phpRoot, s.cfg.atomDataDir)
+	}
+	for _, key := range []string{"VALENCE_LOG_FILE", "VALENCE_ACCESS_LOG_FILE", "VALENCE_AUDIT_LOG_FILE", "VALENCE_AUTH_LOG_FILE", "VALENCE_STATE_DB"} {
+		if path := strings.TrimSpace(os.Getenv(key)); path != "" {
+			write(filepath.Dir(path))
+		}
+	}
+	write(os.Getenv("VALENCE_TLS_ACME_CACHE_DIR"), os.Getenv("VALENCE_ATOM_ARCHIVE_CACHE_DIR"), os.Getenv("VALENCE_CAPTURE_DIR"))
+	write(commaList(os.Getenv("VALENCE_LANDLOCK_WRITE"))...)
+	return rules
+}
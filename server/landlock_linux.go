@@ -0,0 +1,122 @@
+//go:build linux
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	landlockReadAccess = unix.LANDLOCK_ACCESS_FS_EXECUTE | unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_READ_DIR
+
+	// landlockFileAccess are the rights that apply to files rather than
+	// dirs; a rule for a file may hold no others.
+	landlockFileAccess = unix.LANDLOCK_ACCESS_FS_EXECUTE | unix.LANDLOCK_ACCESS_FS_WRITE_FILE |
+		unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_TRUNCATE | unix.LANDLOCK_ACCESS_FS_IOCTL_DEV
+)
+
+// landlockHandledAccess returns the rights the given Landlock ABI version
+// can restrict.
+func landlockHandledAccess(abi int) uint64 {
+	access := uint64(unix.LANDLOCK_ACCESS_FS_MAKE_SYM<<1 - 1) // ABI 1
+	if abi >= 2 {
+		access |= unix.LANDLOCK_ACCESS_FS_REFER
+	}
+	if abi >= 3 {
+		access |= unix.LANDLOCK_ACCESS_FS_TRUNCATE
+	}
+	if abi >= 5 {
+		access |= unix.LANDLOCK_ACCESS_FS_IOCTL_DEV
+	}
+	return access
+}
+
+// applyLandlock restricts the process to rules. Landlock restricts the
+// calling thread only, and Go cannot reach all of its threads once cgo is
+// in use, so valence restricts one locked thread and re-executes itself
+// from it: the new process, every thread it starts and the PHP it runs
+// inherit the restriction.
+func applyLandlock(rules []landlockRule) error {
+	abi, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, unix.LANDLOCK_CREATE_RULESET_VERSION)
+	if errno != 0 {
+		return fmt.Errorf("%w (%v)", errLandlockUnsupported, errno)
+	}
+	handled := landlockHandledAccess(int(abi))
+	attr := unix.LandlockRulesetAttr{Access_fs: handled}
+	fd, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return fmt.Errorf("create ruleset: %w", errno)
+	}
+	defer unix.Close(int(fd))
+
+	var allowed []string
+	for _, rule := range rules {
+		if rule.path == "" {
+			continue
+		}
+		access := uint64(landlockReadAccess)
+		if rule.write {
+			access = handled
+		}
+		ok, err := addLandlockRule(int(fd), rule.path, access&handled)
+		if err != nil {
+			return fmt.Errorf("allow %s: %w", rule.path, err)
+		}
+		if ok {
+			mode := "read"
+			if rule.write {
+				mode = "write"
+			}
+			allowed = append(allowed, rule.path+" ("+mode+")")
+		}
+	}
+	logInfof("landlock: ABI %d, allowing %s", abi, strings.Join(allowed, ", "))
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	// The thread restricts itself and then execs, so it must not be
+	// handed back to the scheduler in between.
+	runtime.LockOSThread()
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("no_new_privs: %w", err)
+	}
+	if _, _, errno := unix.Syscall(unix.SYS_LANDLOCK_RESTRICT_SELF, fd, 0, 0); errno != 0 {
+		return fmt.Errorf("restrict self: %w", errno)
+	}
+	return unix.Exec(exe, os.Args, append(os.Environ(), landlockActiveEnv+"=1"))
+}
+
+// addLandlockRule allows access beneath path, or to path alone when it is
+// a file. A path that does not exist is skipped.
+func addLandlockRule(rulesetFD int, path string, access uint64) (bool, error) {
+	fd, err := unix.Open(path, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if errors.Is(err, unix.ENOENT) || errors.Is(err, unix.ENOTDIR) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer unix.Close(fd)
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		return false, err
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFDIR {
+		access &= landlockFileAccess
+	}
+	attr := unix.LandlockPathBeneathAttr{Allowed_access: access, Parent_fd: int32(fd)}
+	_, _, errno := unix.Syscall6(unix.SYS_LANDLOCK_ADD_RULE, uintptr(rulesetFD), unix.LANDLOCK_RULE_PATH_BENEATH, uintptr(unsafe.Pointer(&attr)), 0, 0, 0)
+	if errno != 0 {
+		return false, errno
+	}
+	return true, nil
+}
@@ -0,0 +1,7 @@
+//go:build !linux
+
+package server
+
+func applyLandlock([]landlockRule) error {
+	return errLandlockUnsupported
+}
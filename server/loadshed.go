@@ -0,0 +1,181 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"runtime/metrics"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Load shedding keeps valence up when memory runs short, rather than
+// leaving the OOM killer to take the whole instance down. Every
+// VALENCE_SHED_INTERVAL (default 5s) valence samples the process RSS, PHP
+// included, and the Go heap; once either passes VALENCE_SHED_RSS or
+// VALENCE_SHED_HEAP, low-priority requests for PHP are answered 503 until
+// both fall back below 90% of their threshold. Low priority means a
+// crawler, by a User-Agent matching VALENCE_SHED_USER_AGENTS (a regular
+// expression, by default the usual bot, crawler and spider names), or a
+// heavy path under one of VALENCE_SHED_PATHS (default OAI-PMH and clipboard
+// exports). Everything else, health checks and static files included, is
+// served as usual.
+type loadShedder struct {
+	rss      int64
+	heap     int64
+	interval time.Duration
+	agents   *regexp.Regexp
+	paths    []string
+
+	shedding atomic.Bool
+}
+
+const (
+	defaultShedUserAgents = `(?i)bot|crawl|spider|slurp|archiver|facebookexternalhit`
+	defaultShedPaths      = "/;oai,/clipboard/export"
+
+	// shedRetryAfter is the Retry-After, in seconds, of a shed request.
+	shedRetryAfter = 120
+)
+
+// loadShed is set by serve when a VALENCE_SHED_RSS or VALENCE_SHED_HEAP
+// threshold is.
+var loadShed *loadShedder
+
+func loadShedderFromEnv() (*loadShedder, error) {
+	s := &loadShedder{
+		interval: envDuration("VALENCE_SHED_INTERVAL", 5*time.Second),
+		paths:    commaList(envOrDefault("VALENCE_SHED_PATHS", defaultShedPaths)),
+	}
+	for _, threshold := range []struct {
+		name string
+		dst  *int64
+	}{{"VALENCE_SHED_RSS", &s.rss}, {"VALENCE_SHED_HEAP", &s.heap}} {
+		val := strings.TrimSpace(os.Getenv(threshold.name))
+		if val == "" {
+			continue
+		}
+		size, err := parseByteSize(val)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", threshold.name, err)
+		}
+		*threshold.dst = size
+	}
+	if s.rss <= 0 && s.heap <= 0 {
+		return nil, nil
+	}
+	if s.interval <= 0 {
+		return nil, fmt.Errorf("VALENCE_SHED_INTERVAL must be positive")
+	}
+	var err error
+	if s.agents, err = regexp.Compile(envOrDefault("VALENCE_SHED_USER_AGENTS", defaultShedUserAgents)); err != nil {
+		return nil, fmt.Errorf("VALENCE_SHED_USER_AGENTS: %w", err)
+	}
+	for _, prefix := range s.paths {
+		if !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("VALENCE_SHED_PATHS: %q does not start with /", prefix)
+		}
+	}
+	return s, nil
+}
+
+// active reports whether requests are being shed; a nil shedder never
+// sheds.
+func (s *loadShedder) active() bool {
+	return s != nil && s.shedding.Load()
+}
+
+// sheds reports whether a request routed as label must be refused, and
+// why: crawler or path.
+func (s *loadShedder) sheds(r *http.Request, label, reqPath string) (string, bool) {
+	if !s.active() {
+		return "", false
+	}
+	switch label {
+	case "front_controller", "php_entry", "uploads_front_controller", "rule_php":
+	default:
+		return "", false
+	}
+	for _, prefix := range s.paths {
+		if strings.HasPrefix(reqPath, prefix) {
+			return "path", true
+		}
+	}
+	if ua := r.UserAgent(); ua != "" && s.agents.MatchString(ua) {
+		return "crawler", true
+	}
+	return "", false
+}
+
+// run samples memory every interval until ctx is done.
+func (s *loadShedder) run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		s.check()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check samples memory and starts or stops shedding.
+func (s *loadShedder) check() {
+	rss, heap := processRSS(), goHeapBytes()
+	over := func(used, limit int64, scale float64) bool {
+		return limit > 0 && float64(used) >= float64(limit)*scale
+	}
+	if !s.shedding.Load() {
+		if over(rss, s.rss, 1) || over(heap, s.heap, 1) {
+			s.shedding.Store(true)
+			logWarnf("memory pressure: shedding low-priority requests (rss=%d heap=%d)", rss, heap)
+		}
+		return
+	}
+	if !over(rss, s.rss, 0.9) && !over(heap, s.heap, 0.9) {
+		s.shedding.Store(false)
+		logInfof("memory pressure over: serving every request again (rss=%d heap=%d)", rss, heap)
+	}
+}
+
+// processRSS returns the resident set size of the process, or 0 where
+// /proc is not available.
+func processRSS() int64 {
+	data, err := os.ReadFile("/proc/self/statm")
+	if err != nil {
+		return 0
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 2 {
+		return 0
+	}
+	pages, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return pages * int64(os.Getpagesize())
+}
+
+// goHeapBytes returns the bytes held by live and not yet swept heap
+// objects.
+func goHeapBytes() int64 {
+	sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	return int64(sample[0].Value.Uint64())
+}
+
+// shedHandler answers a request refused under memory pressure.
+func shedHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Retry-After", strconv.Itoa(shedRetryAfter))
+	http.Error(w, "server busy, try again later", http.StatusServiceUnavailable)
+}
@@ -0,0 +1,244 @@
+package server
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// VALENCE_LOG_FILE and VALENCE_ACCESS_LOG_FILE send the application and
+// access logs to files, for installs without a log collector or logrotate.
+// A file is rotated once it reaches VALENCE_LOG_ROTATE_SIZE or has been open
+// for VALENCE_LOG_ROTATE_AGE; rotated files are gzipped, and only the newest
+// VALENCE_LOG_KEEP of them, none older than VALENCE_LOG_KEEP_AGE, are kept.
+
+const logRotationStamp = "20060102T150405.000"
+
+type logRotation struct {
+	maxSize  int64
+	maxAge   time.Duration
+	keep     int
+	keepAge  time.Duration
+	compress bool
+}
+
+func logRotationFromEnv() (logRotation, error) {
+	rot := logRotation{
+		maxSize:  100 << 20,
+		maxAge:   envDuration("VALENCE_LOG_ROTATE_AGE", 24*time.Hour),
+		keep:     max(envInt("VALENCE_LOG_KEEP", 7), 0),
+		keepAge:  envDuration("VALENCE_LOG_KEEP_AGE", 0),
+		compress: envBool("VALENCE_LOG_COMPRESS", true),
+	}
+	if val := strings.TrimSpace(os.Getenv("VALENCE_LOG_ROTATE_SIZE")); val != "" {
+		size, err := parseByteSize(val)
+		if err != nil {
+			return rot, fmt.Errorf("VALENCE_LOG_ROTATE_SIZE: %w", err)
+		}
+		rot.maxSize = size
+	}
+	return rot, nil
+}
+
+// rotatingFile is an append-only log file that rotates itself. The age
+// counts from when valence opened the file, so a restart starts it over.
+type rotatingFile struct {
+	path string
+	rot  logRotation
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+
+	// cleanup serializes compressing and pruning rotated files, which runs
+	// in the background so writers do not wait for gzip.
+	cleanup sync.Mutex
+}
+
+func openRotatingFile(path string, rot logRotation) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, rot: rot}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	// Finish what a previous process may have left half done.
+	go f.compressAndPrune()
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	f.file, f.size, f.opened = file, info.Size(), time.Now()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	tooBig := f.rot.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.rot.maxSize
+	tooOld := f.rot.maxAge > 0 && time.Since(f.opened) >= f.rot.maxAge
+	if tooBig || tooOld {
+		if err := f.rotate(); err != nil {
+			// Keep logging to the current file rather than losing lines.
+			fmt.Fprintf(os.Stderr, "valence: rotate %s: %v\n", f.path, err)
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+	renameErr := os.Rename(f.path, f.path+"."+time.Now().UTC().Format(logRotationStamp))
+	if err := f.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+	go f.compressAndPrune()
+	return nil
+}
+
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+// rotatedLog is a rotated file, named <path>.<stamp>[.gz].
+type rotatedLog struct {
+	path    string
+	rotated time.Time
+	gzipped bool
+}
+
+func (f *rotatingFile) rotatedFiles() ([]rotatedLog, error) {
+	matches, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	var logs []rotatedLog
+	for _, match := range matches {
+		stamp := strings.TrimPrefix(match, f.path+".")
+		stamp, gzipped := strings.CutSuffix(stamp, ".gz")
+		rotated, err := time.Parse(logRotationStamp, stamp)
+		if err != nil {
+			continue
+		}
+		logs = append(logs, rotatedLog{path: match, rotated: rotated, gzipped: gzipped})
+	}
+	slices.SortFunc(logs, func(a, b rotatedLog) int { return b.rotated.Compare(a.rotated) })
+	return logs, nil
+}
+
+func (f *rotatingFile) compressAndPrune() {
+	f.cleanup.Lock()
+	defer f.cleanup.Unlock()
+	logs, err := f.rotatedFiles()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "valence: list rotated logs for %s: %v\n", f.path, err)
+		return
+	}
+	for i, rotated := range logs {
+		expired := f.rot.keepAge > 0 && time.Since(rotated.rotated) > f.rot.keepAge
+		if i >= f.rot.keep || expired {
+			if err := os.Remove(rotated.path); err != nil && !os.IsNotExist(err) {
+				fmt.Fprintf(os.Stderr, "valence: remove %s: %v\n", rotated.path, err)
+			}
+			continue
+		}
+		if f.rot.compress && !rotated.gzipped {
+			if err := gzipFile(rotated.path); err != nil {
+				fmt.Fprintf(os.Stderr, "valence: compress %s: %v\n", rotated.path, err)
+			}
+		}
+	}
+}
+
+// gzipFile replaces path with path.gz.
+func gzipFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmp := path + ".gz.tmp"
+	dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o640)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	if closeErr := zw.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path+".gz")
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Remove(path)
+}
+
+// withAccessLog writes one line per request to w in the combined log
+// format, followed by the time taken in seconds.
+func withAccessLog(w io.Writer, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: rw, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		client, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			client = r.RemoteAddr
+		}
+		line := fmt.Sprintf("%s - - [%s] %q %d %d %q %q %.3f\n",
+			client,
+			start.Format("02/Jan/2006:15:04:05 -0700"),
+			r.Method+" "+r.RequestURI+" "+r.Proto,
+			recorder.status,
+			recorder.bytes,
+			r.Referer(),
+			r.UserAgent(),
+			time.Since(start).Seconds(),
+		)
+		_, _ = io.WriteString(w, line)
+	})
+}
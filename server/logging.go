@@ -0,0 +1,79 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// logLevel orders log lines by severity; VALENCE_LOG_LEVEL (debug, info,
+// warn or error, default info) drops those below it. Info lines carry no
+// prefix, the others are prefixed with their level.
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logThreshold = logLevelFromEnv()
+
+func logLevelFromEnv() logLevel {
+	switch val := strings.ToLower(strings.TrimSpace(os.Getenv("VALENCE_LOG_LEVEL"))); val {
+	case "debug":
+		return levelDebug
+	case "", "info":
+		return levelInfo
+	case "warn", "warning":
+		return levelWarn
+	case "error":
+		return levelError
+	default:
+		log.Printf("warn: invalid VALENCE_LOG_LEVEL %q; using info", val)
+		return levelInfo
+	}
+}
+
+func logEnabled(level logLevel) bool {
+	return level >= logThreshold
+}
+
+func logf(level logLevel, format string, args ...any) {
+	if !logEnabled(level) {
+		return
+	}
+	prefix := ""
+	switch level {
+	case levelDebug:
+		prefix = "debug: "
+	case levelWarn:
+		prefix = "warn: "
+	case levelError:
+		prefix = "error: "
+	}
+	_ = log.Output(3, prefix+fmt.Sprintf(format, args...))
+}
+
+func logDebugf(format string, args ...any) { logf(levelDebug, format, args...) }
+func logInfof(format string, args ...any)  { logf(levelInfo, format, args...) }
+func logWarnf(format string, args ...any)  { logf(levelWarn, format, args...) }
+func logErrorf(format string, args ...any) { logf(levelError, format, args...) }
+
+// logSampler lets one in every n lines of a high-volume kind through, as
+// set by its env variable (default 1, every line).
+type logSampler struct {
+	every uint64
+	seen  atomic.Uint64
+}
+
+func newLogSampler(key string) *logSampler {
+	return &logSampler{every: uint64(max(envInt(key, 1), 1))}
+}
+
+func (s *logSampler) sample() bool {
+	return (s.seen.Add(1)-1)%s.every == 0
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// loginLimiter throttles POSTs to AtoM's /user/login, which has no
+// throttling of its own. Each client address may try
+// VALENCE_LOGIN_RATE_LIMIT times (default 10) and each user name, read
+// from the form, VALENCE_LOGIN_USER_RATE_LIMIT times (default 5) per
+// VALENCE_LOGIN_RATE_WINDOW (default 1m); more attempts are answered 429
+// without reaching PHP. With VALENCE_LOGIN_LOCKOUT set, an address or user
+// name that fails VALENCE_LOGIN_LOCKOUT_FAILURES logins (default 10)
+// within that time is locked out for it. A successful login clears the
+// failures. Limits of 0 turn that limit off.
+type loginLimiter struct {
+	window    time.Duration
+	perIP     int
+	perUser   int
+	lockout   time.Duration
+	lockAfter int
+	trusted   []netip.Prefix
+
+	mu        sync.Mutex
+	attempts  map[loginKey][]time.Time
+	failures  map[loginKey][]time.Time
+	locked    map[loginKey]time.Time
+	lastPrune time.Time
+}
+
+// loginKey is a client address (kind ip) or user name (kind user) on a
+// site.
+type loginKey struct {
+	site, kind, value string
+}
+
+// loginFormMax bounds the login form read for the user name.
+const loginFormMax = 64 << 10
+
+func loginLimiterFromEnv() (*loginLimiter, error) {
+	l := &loginLimiter{
+		window:    envDuration("VALENCE_LOGIN_RATE_WINDOW", time.Minute),
+		perIP:     max(envInt("VALENCE_LOGIN_RATE_LIMIT", 10), 0),
+		perUser:   max(envInt("VALENCE_LOGIN_USER_RATE_LIMIT", 5), 0),
+		lockout:   envDuration("VALENCE_LOGIN_LOCKOUT", 0),
+		lockAfter: max(envInt("VALENCE_LOGIN_LOCKOUT_FAILURES", 10), 1),
+		attempts:  map[loginKey][]time.Time{},
+		failures:  map[loginKey][]time.Time{},
+		locked:    map[loginKey]time.Time{},
+	}
+	if l.perIP == 0 && l.perUser == 0 && l.lockout <= 0 {
+		return nil, nil
+	}
+	if l.window <= 0 {
+		return nil, fmt.Errorf("VALENCE_LOGIN_RATE_WINDOW must be positive")
+	}
+	var err error
+	if l.trusted, err = trustedProxiesFromEnv(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// loginAttempt is a login POST let through, whose outcome finish records.
+type loginAttempt struct {
+	limiter *loginLimiter
+	keys    []loginKey
+}
+
+// begin checks a request to reqPath against the limits. It returns ok
+// false, and how long to wait, when the request must be refused; attempt
+// is nil unless r is a login POST let through.
+func (l *loginLimiter) begin(site string, r *http.Request, reqPath string) (attempt *loginAttempt, wait time.Duration, ok bool) {
+	if l == nil || r.Method != http.MethodPost || reqPath != "/user/login" {
+		return nil, 0, true
+	}
+	keys := []loginKey{{site, "ip", forwardedClientIP(r, l.trusted)}}
+	if user := loginUser(r); user != "" {
+		keys = append(keys, loginKey{site, "user", user})
+	}
+
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.prune(now)
+	for _, key := range keys {
+		if until, locked := l.locked[key]; locked {
+			loginThrottledTotal.WithLabelValues(site, "lockout").Inc()
+			return nil, until.Sub(now), false
+		}
+	}
+	for _, key := range keys {
+		limit := l.perIP
+		if key.kind == "user" {
+			limit = l.perUser
+		}
+		if limit > 0 && len(l.attempts[key]) >= limit {
+			loginThrottledTotal.WithLabelValues(site, key.kind).Inc()
+			return nil, l.attempts[key][0].Add(l.window).Sub(now), false
+		}
+	}
+	for _, key := range keys {
+		l.attempts[key] = append(l.attempts[key], now)
+	}
+	return &loginAttempt{limiter: l, keys: keys}, 0, true
+}
+
+// finish records the outcome of the attempt from AtoM's answer: a
+// redirect after a successful login, the form again after a failed one.
+func (a *loginAttempt) finish(status int) {
+	if a == nil {
+		return
+	}
+	l := a.limiter
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch {
+	case status >= 300 && status < 400:
+		for _, key := range a.keys {
+			delete(l.failures, key)
+		}
+	case status == http.StatusOK && l.lockout > 0:
+		now := time.Now()
+		for _, key := range a.keys {
+			l.failures[key] = append(l.failures[key], now)
+			if len(l.failures[key]) >= l.lockAfter {
+				l.locked[key] = now.Add(l.lockout)
+				delete(l.failures, key)
+				logWarnf("login: locked out %s %s for %s after %d failed logins", key.kind, key.value, l.lockout, l.lockAfter)
+			}
+		}
+	}
+}
+
+// prune drops the attempts and failures that no longer count and the
+// lockouts that have ended, at most once a second.
+func (l *loginLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < time.Second {
+		return
+	}
+	l.lastPrune = now
+	dropBefore := func(times map[loginKey][]time.Time, cutoff time.Time) {
+		for key, ts := range times {
+			i := 0
+			for i < len(ts) && !ts[i].After(cutoff) {
+				i++
+			}
+			if i == len(ts) {
+				delete(times, key)
+			} else if i > 0 {
+				times[key] = ts[i:]
+			}
+		}
+	}
+	dropBefore(l.attempts, now.Add(-l.window))
+	dropBefore(l.failures, now.Add(-l.lockout))
+	for key, until := range l.locked {
+		if !now.Before(until) {
+			delete(l.locked, key)
+		}
+	}
+}
+
+// loginUser reads the user name from a login form, leaving the body for
+// PHP to read in full.
+func loginUser(r *http.Request) string {
+	if r.Body == nil || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		return ""
+	}
+	head, err := io.ReadAll(io.LimitReader(r.Body, loginFormMax))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(head), r.Body), r.Body}
+	if err != nil {
+		return ""
+	}
+	form, err := url.ParseQuery(string(head))
+	if err != nil {
+		return ""
+	}
+	for _, field := range []string{"email", "login[email]", "username"} {
+		if user := strings.ToLower(strings.TrimSpace(form.Get(field))); user != "" {
+			return user
+		}
+	}
+	return ""
+}
+
+// loginRateLimited answers a throttled login.
+func loginRateLimited(wait time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Retry-After", strconv.Itoa(max(int(wait.Round(time.Second).Seconds()), 1)))
+		http.Error(w, "too many login attempts, try again later", http.StatusTooManyRequests)
+	}
+}
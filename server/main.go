@@ -0,0 +1,1309 @@
+// Package server is the valence server and its commands, for the
+// valence command and for programs that build valence with hooks of their
+// own (see package hooks):
+//
+//	package main
+//
+//	import (
+//		"github.com/artefactual-labs/valence/server"
+//
+//		_ "example.org/valence-sso"
+//	)
+//
+//	func main() {
+//		server.Main()
+//	}
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/artefactual-labs/valence/hooks"
+	"github.com/artefactual-labs/valence/internal/atomembed"
+	"github.com/artefactual-labs/valence/internal/bootstrap"
+	"github.com/artefactual-labs/valence/internal/mysqlwire"
+	"github.com/artefactual-labs/valence/internal/secrets"
+)
+
+const defaultAddr = ":8080"
+
+type config struct {
+	addr            string
+	phpRoot         string
+	frontController string
+	atomDataDir     string
+	uploads         uploadLimits
+	pages           *pageCache
+	conditional     *conditionalGET
+	logins          *loginLimiter
+	phpBackend      *phpBackend
+	methods         routeMethods
+	timeouts        routeTimeouts
+	// The rest are per site, read from the site's env at startup:
+	// handlers must not read the environment, which site startup borrows.
+	denyPaths       denyPatterns
+	middleware      *routeMiddleware
+	routeRules      *routeRules
+	signedURLTTL    time.Duration
+	signedURLMaxTTL time.Duration
+}
+
+// Main runs valence with the process's arguments and environment, as the
+// valence command does, and exits if it fails.
+func Main() {
+	if err := run(os.Args[1:]); err != nil {
+		reporter.report("bootstrap", "fatal", "bootstrap", err.Error(), nil, nil)
+		reporter.flush(5 * time.Second)
+		log.Fatal(err)
+	}
+}
+
+func run(args []string) error {
+	if _, err := embeddedCacheFromEnv(); err != nil {
+		return fmt.Errorf("embedded cache: %w", err)
+	}
+	if len(args) == 0 {
+		return serve()
+	}
+	return runCommand(args[0], args[1:])
+}
+
+func serve() error {
+	rotation, err := logRotationFromEnv()
+	if err != nil {
+		return fmt.Errorf("log rotation: %w", err)
+	}
+	if path := strings.TrimSpace(os.Getenv("VALENCE_LOG_FILE")); path != "" {
+		logFile, err := openRotatingFile(path, rotation)
+		if err != nil {
+			return fmt.Errorf("log file: %w", err)
+		}
+		log.SetOutput(logFile)
+	}
+	reporter, err = errorReporterFromEnv()
+	if err != nil {
+		return fmt.Errorf("error reporting: %w", err)
+	}
+	if err := applyMemoryTuning(); err != nil {
+		return fmt.Errorf("memory tuning: %w", err)
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return fmt.Errorf("config error: %w", err)
+	}
+
+	provider, err := secrets.NewFromEnv()
+	if err != nil {
+		return fmt.Errorf("secrets provider: %w", err)
+	}
+	if err := loadInternalAPIToken(context.Background(), provider); err != nil {
+		return fmt.Errorf("internal api token: %w", err)
+	}
+	if err := loadSignedURLKey(context.Background(), provider); err != nil {
+		return fmt.Errorf("signed url key: %w", err)
+	}
+
+	cfg.uploads, err = uploadLimitsFromEnv()
+	if err != nil {
+		return fmt.Errorf("upload limits: %w", err)
+	}
+	cfg.pages, err = pageCacheFromEnv()
+	if err != nil {
+		return fmt.Errorf("page cache: %w", err)
+	}
+	cfg.conditional, err = conditionalGETFromEnv()
+	if err != nil {
+		return fmt.Errorf("conditional get: %w", err)
+	}
+	cfg.logins, err = loginLimiterFromEnv()
+	if err != nil {
+		return fmt.Errorf("login rate limit: %w", err)
+	}
+	cfg.phpBackend, err = phpBackendFromEnv()
+	if err != nil {
+		return fmt.Errorf("php backend: %w", err)
+	}
+	if cfg.phpBackend != nil {
+		logInfof("php requests go to %s", cfg.phpBackend)
+	}
+	cfg.methods, err = routeMethodsFromEnv()
+	if err != nil {
+		return fmt.Errorf("route methods: %w", err)
+	}
+	cfg.timeouts, err = routeTimeoutsFromEnv()
+	if err != nil {
+		return fmt.Errorf("route timeouts: %w", err)
+	}
+
+	sites, err := loadSites(cfg)
+	if err != nil {
+		return fmt.Errorf("sites: %w", err)
+	}
+	logSites(sites)
+	if err := sandboxFromEnv(cfg, sites); err != nil {
+		return err
+	}
+
+	// Bind while still root, then give root up before any site writes.
+	var listener net.Listener
+	runAs, err := runAsUserFromEnv()
+	if err != nil {
+		return err
+	}
+	if runAs != nil {
+		if listener, err = net.Listen("tcp", cfg.addr); err != nil {
+			return fmt.Errorf("http listen: %w", err)
+		}
+		var dirs []string
+		if path := strings.TrimSpace(os.Getenv("VALENCE_LOG_FILE")); path != "" {
+			if err := runAs.chown(path); err != nil {
+				return fmt.Errorf("log file: %w", err)
+			}
+			dirs = append(dirs, filepath.Dir(path))
+		}
+		if err := runAs.drop(); err != nil {
+			return err
+		}
+		for _, s := range sites {
+			dirs = append(dirs, writableDirs(s.cfg)...)
+		}
+		if failed := unwritableDirs(dirs); len(failed) > 0 {
+			return fmt.Errorf("not writable by VALENCE_USER %s: %s", runAs.spec, strings.Join(failed, ", "))
+		}
+	}
+	if err := startEmbeddedCache(); err != nil {
+		return fmt.Errorf("embedded cache: %w", err)
+	}
+	var primary *site
+	started := map[*site]bool{}
+	for _, s := range sites {
+		if err := s.start(provider); err != nil {
+			if s.name == "" {
+				return err
+			}
+			logErrorf("site %s failed to start: %v", s.name, err)
+			reporter.report("bootstrap", "error", "bootstrap", err.Error(), nil, map[string]any{"site": s.name})
+			continue
+		}
+		started[s] = true
+		if primary == nil {
+			primary = s
+		}
+	}
+	if primary == nil {
+		return errors.New("no site started")
+	}
+
+	if err := initPHPRuntime(primary.bootstrap, cfg.uploads); err != nil {
+		return fmt.Errorf("frankenphp init: %w", err)
+	}
+	defer shutdownPHPRuntime()
+
+	ctx := context.Background()
+	restarts := restartPolicyFromEnv()
+	if phpThreads.autoscaling() {
+		scaler, err := phpScalerFromEnv()
+		if err != nil {
+			return fmt.Errorf("php thread scaling: %w", err)
+		}
+		go supervise(ctx, "php thread scaler", restarts, func(ctx context.Context) error {
+			phpThreads.autoscale(ctx, scaler)
+			return nil
+		})
+	}
+	tasks, err := newScheduler(cfg.phpRoot, primary.bootstrap.Timezone, restarts)
+	if err != nil {
+		return fmt.Errorf("scheduler: %w", err)
+	}
+	// Secret rotation and scheduled tasks reload config and run symfony
+	// through the process environment, which only describes a single site.
+	if len(sites) == 1 {
+		go supervise(ctx, "secrets watcher", restarts, func(ctx context.Context) error {
+			watchSecrets(ctx, provider, primary.bootstrap)
+			return nil
+		})
+		tasks.run(ctx)
+	} else if len(tasks.tasks) > 0 {
+		return errors.New("scheduler: VALENCE_SCHEDULE_* is not supported with VALENCE_SITES_FILE")
+	}
+
+	for _, s := range sites {
+		if started[s] {
+			s.activate(ctx, restarts)
+		} else {
+			go s.retry(ctx, provider, restarts)
+		}
+	}
+	reloader := newAtomReloader(cfg.phpRoot, sites, provider, tasks)
+	go supervise(ctx, "atom reload signal", restarts, func(ctx context.Context) error {
+		reloader.watchSignals(ctx)
+		return nil
+	})
+
+	wellKnown, err := wellKnownFromEnv()
+	if err != nil {
+		return fmt.Errorf("well-known: %w", err)
+	}
+
+	if apiKeys, err = apiKeyStoreFromEnv(primary.bootstrap); err != nil {
+		return fmt.Errorf("api keys: %w", err)
+	}
+	if apiKeys != nil {
+		logInfof("internal api accepts api keys from %s", apiKeys.backend)
+	}
+	drain := newDrainer()
+	router := newSiteRouter(sites)
+	taskJobs, err := newTaskAPI(router, tasks, reloader.currentRoot)
+	if err != nil {
+		return fmt.Errorf("tasks: %w", err)
+	}
+	audit, err := auditLogFromEnv(rotation)
+	if err != nil {
+		return fmt.Errorf("audit log: %w", err)
+	}
+	if audit != nil {
+		defer audit.Close()
+	}
+	if authFailures, err = authFailureLogFromEnv(rotation); err != nil {
+		return fmt.Errorf("auth log: %w", err)
+	}
+	if authFailures != nil {
+		defer authFailures.Close()
+	}
+	if captures, err = captureRecorderFromEnv(); err != nil {
+		return fmt.Errorf("capture: %w", err)
+	}
+	if loadShed, err = loadShedderFromEnv(); err != nil {
+		return fmt.Errorf("load shedding: %w", err)
+	}
+	if loadShed != nil {
+		go supervise(ctx, "memory sampler", restarts, func(ctx context.Context) error {
+			loadShed.run(ctx)
+			return nil
+		})
+	}
+	if bandwidth, err = bandwidthFromEnv(); err != nil {
+		return fmt.Errorf("bandwidth: %w", err)
+	}
+	if bandwidth != nil {
+		go supervise(ctx, "bandwidth summary", restarts, func(ctx context.Context) error {
+			bandwidth.run(ctx)
+			return nil
+		})
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", healthHandler)
+	mux.HandleFunc("/health/ready", readinessHandler(drain))
+	mux.HandleFunc("/health/deep", deepHealthHandler(primary.monitor))
+	mux.Handle("/metrics", metricsHandler())
+	mux.Handle("/.well-known/", wellKnown)
+	mux.HandleFunc("/v/bootstrap/summary", bootstrapSummaryHandler(primary.bootstrap.SummaryPath()))
+	mux.HandleFunc("/v/bootstrap/status", bootstrapStatusHandler(primary, reloader.currentRoot, provider))
+	mux.HandleFunc("/v/php/status", phpStatusHandler)
+	mux.HandleFunc("/v/system/info", systemInfoHandler(reloader.currentRoot, sites))
+	mux.HandleFunc("/v/scheduler", schedulerHandler(tasks))
+	mux.HandleFunc("/v/jobs", jobsHandler(primary.name, primary.bootstrap))
+	mux.HandleFunc("/v/drain", drainHandler(drain))
+	cacheClear := cacheClearHandler(newCacheClearer(sites, tasks, reloader.currentRoot))
+	mux.HandleFunc("/v/cache/clear", cacheClear)
+	mux.HandleFunc("/v/cache/clear/", cacheClear)
+	mux.HandleFunc("/v/tasks", tasksHandler(taskJobs))
+	mux.HandleFunc("/v/tasks/", tasksHandler(taskJobs))
+	mux.HandleFunc("/v/uploads", uploadURLHandler(taskJobs))
+	mux.HandleFunc("/v/uploads/", uploadURLHandler(taskJobs))
+	mux.HandleFunc("/v/atom/versions", atomVersionsHandler)
+	mux.HandleFunc("/v/atom/versions/", atomVersionsHandler)
+	mux.HandleFunc("/v/atom/reload", atomReloadHandler(reloader))
+	mux.HandleFunc("/v/storage/locations", storageLocationsHandler)
+	mux.HandleFunc("/v/storage/locations/", storageLocationsHandler)
+	mux.HandleFunc("/v/signed-urls", signedURLHandler(router))
+	mux.HandleFunc("/v/derivatives", derivativesHandler(router))
+	mux.HandleFunc("/v/search/health", searchHealthHandler(router))
+	mux.HandleFunc("/v/audit", auditHandler(audit))
+	mux.HandleFunc("/v/debug/capture", captureHandler)
+	mux.Handle("/", router)
+
+	redirects, err := edgeRedirectsFromEnv(sites)
+	if err != nil {
+		return fmt.Errorf("redirects: %w", err)
+	}
+	if mw, phpEnv := hooks.Registered(); mw > 0 || phpEnv > 0 {
+		logInfof("hooks: %d middleware, %d php env", mw, phpEnv)
+	}
+	handler := redirects.wrap(withPermissionsPolicy(withAudit(audit, hooks.Wrap(mux))))
+	if noindexFromEnv() {
+		logInfof("%s environment: responses are marked noindex", valenceEnvironment())
+		handler = withNoindex(handler)
+	}
+	handler = withErrorReporting(withTraceRejected(handler))
+	if path := strings.TrimSpace(os.Getenv("VALENCE_ACCESS_LOG_FILE")); path != "" {
+		accessLog, err := openRotatingFile(path, rotation)
+		if err != nil {
+			return fmt.Errorf("access log: %w", err)
+		}
+		defer accessLog.Close()
+		handler = withAccessLog(accessLog, handler)
+	}
+
+	srv := &http.Server{
+		Addr:    cfg.addr,
+		Handler: handler,
+	}
+
+	var hosts []string
+	for _, s := range sites {
+		hosts = append(hosts, s.hosts...)
+		hosts = append(hosts, s.redirectHosts...)
+	}
+	tlsConfig, certs, err := tlsConfigFromEnv(hosts)
+	if err != nil {
+		return fmt.Errorf("tls: %w", err)
+	}
+	if tlsConfig != nil {
+		srv.TLSConfig = tlsConfig
+		go supervise(ctx, "tls certificate watcher", restarts, func(ctx context.Context) error {
+			certs.watch(ctx)
+			return nil
+		})
+	}
+
+	logInfof("valence listening on %s (tls=%t)", cfg.addr, tlsConfig != nil)
+	return serveWithShutdown(srv, listener, drain)
+}
+
+// startSite generates a site's config and gets its database ready to
+// serve: schema, purge, administrator, theme and symfony cache.
+func startSite(cfg config, provider secrets.Provider) (bootstrap.Config, error) {
+	bcfg, err := bootstrap.LoadConfig(context.Background(), cfg.phpRoot, provider)
+	if err != nil {
+		return bcfg, fmt.Errorf("bootstrap config error: %w", err)
+	}
+	admin, provisionAdminUser, err := adminFromEnv(context.Background(), provider)
+	if err != nil {
+		return bcfg, fmt.Errorf("admin config: %w", err)
+	}
+	summary, err := bootstrap.Apply(bcfg)
+	if err != nil {
+		return bcfg, fmt.Errorf("bootstrap error: %w", err)
+	}
+	logInfof("bootstrap complete: wrote=%d skipped=%d backups=%d overrides=%d", len(summary.Written), len(summary.Skipped), len(summary.Backups), len(summary.Overrides))
+	for _, conflict := range summary.Conflicts {
+		logInfof("bootstrap override replaced generated config: %s", conflict)
+	}
+	if err := verifyAtomRootOnStartup(cfg.phpRoot, cfg.atomDataDir); err != nil {
+		return bcfg, fmt.Errorf("atom verify: %w", err)
+	}
+
+	if err := waitForDependencies(bcfg); err != nil {
+		return bcfg, fmt.Errorf("dependency check failed: %w", err)
+	}
+
+	installed, err := checkSchema(cfg.phpRoot)
+	if err != nil {
+		return bcfg, fmt.Errorf("schema check failed: %w", err)
+	}
+
+	purge, err := purgeArgs(installed, admin, provisionAdminUser)
+	if err != nil {
+		return bcfg, fmt.Errorf("symfony purge: %w", err)
+	}
+	if purge != nil {
+		if err := runSymfonyPurge(cfg.phpRoot, purge); err != nil {
+			return bcfg, fmt.Errorf("symfony purge failed: %w", err)
+		}
+	}
+	if provisionAdminUser {
+		if err := provisionAdmin(cfg.phpRoot, admin); err != nil {
+			return bcfg, fmt.Errorf("provision admin: %w", err)
+		}
+	}
+	if bcfg.Theme != "" {
+		if err := runEnableTheme(cfg.phpRoot, bcfg.Theme); err != nil {
+			return bcfg, fmt.Errorf("enable theme: %w", err)
+		}
+	}
+	if err := runSymfonyCacheClear(cfg.phpRoot); err != nil {
+		return bcfg, fmt.Errorf("symfony cache clear failed: %w", err)
+	}
+	return bcfg, nil
+}
+
+// serveWithShutdown serves until SIGINT or SIGTERM, or until a drain
+// started through /v/drain finishes. With VALENCE_DRAIN_ON_SIGTERM a
+// signal drains first too. It serves TLS when srv.TLSConfig is set, on
+// ln when it is already bound.
+func serveWithShutdown(srv *http.Server, ln net.Listener, drain *drainer) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if ln == nil {
+		var err error
+		if ln, err = net.Listen("tcp", srv.Addr); err != nil {
+			return fmt.Errorf("http listen: %w", err)
+		}
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil {
+			errCh <- srv.ServeTLS(ln, "", "")
+			return
+		}
+		errCh <- srv.Serve(ln)
+	}()
+
+	select {
+	case err := <-errCh:
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			return fmt.Errorf("http listen: %w", err)
+		}
+		return nil
+	case <-ctx.Done():
+		if envBool("VALENCE_DRAIN_ON_SIGTERM", false) {
+			drain.start()
+			<-drain.done
+		}
+	case <-drain.done:
+	}
+
+	logInfof("shutdown requested, stopping server")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		logWarnf("http shutdown error: %v", err)
+		_ = srv.Close()
+	}
+
+	err := <-errCh
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("http listen: %w", err)
+	}
+	return nil
+}
+
+func loadConfig() (config, error) {
+	addr := envOrDefault("VALENCE_ADDR", defaultAddr)
+	absRoot, err := resolveAtomRoot()
+	if err != nil {
+		return config{}, err
+	}
+	atomDataDir := strings.TrimSpace(os.Getenv("ATOM_DATA_DIR"))
+	if atomDataDir != "" {
+		if abs, err := filepath.Abs(atomDataDir); err == nil {
+			atomDataDir = abs
+		}
+	}
+	frontController := filepath.Join(absRoot, "index.php")
+	if info, err := os.Stat(frontController); err != nil || info.IsDir() {
+		return config{}, fmt.Errorf("front controller not found at %s", frontController)
+	}
+
+	return config{
+		addr:            addr,
+		phpRoot:         absRoot,
+		frontController: frontController,
+		atomDataDir:     atomDataDir,
+	}, nil
+}
+
+func envOrDefault(key, def string) string {
+	if val := strings.TrimSpace(os.Getenv(key)); val != "" {
+		return val
+	}
+	return def
+}
+
+func envBool(key string, def bool) bool {
+	val := strings.TrimSpace(os.Getenv(key))
+	if val == "" {
+		return def
+	}
+	parsed, err := strconv.ParseBool(val)
+	if err != nil {
+		return def
+	}
+	return parsed
+}
+
+func envInt(key string, def int) int {
+	val := strings.TrimSpace(os.Getenv(key))
+	if val == "" {
+		return def
+	}
+	parsed, err := strconv.Atoi(val)
+	if err != nil {
+		return def
+	}
+	return parsed
+}
+
+func envFloat(key string, def float64) float64 {
+	val := strings.TrimSpace(os.Getenv(key))
+	if val == "" {
+		return def
+	}
+	parsed, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		return def
+	}
+	return parsed
+}
+
+func envDuration(key string, def time.Duration) time.Duration {
+	val := strings.TrimSpace(os.Getenv(key))
+	if val == "" {
+		return def
+	}
+	parsed, err := time.ParseDuration(val)
+	if err != nil {
+		return def
+	}
+	return parsed
+}
+
+func resolveAtomRoot() (string, error) {
+	abs, err := atomRootFromEnv()
+	if err != nil {
+		return "", err
+	}
+	if err := ensureAtomRoot(abs); err != nil {
+		return "", err
+	}
+	abs = realAtomRoot(abs)
+	if info, err := os.Stat(abs); err == nil && info.IsDir() {
+		return abs, nil
+	}
+	return "", fmt.Errorf("atom root not found at %s", abs)
+}
+
+func atomRootFromEnv() (string, error) {
+	if base := atomVersionsDir(); base != "" {
+		return atomembed.CurrentPath(base), nil
+	}
+	root := strings.TrimSpace(os.Getenv("VALENCE_ATOM_SRC_DIR"))
+	if root == "" {
+		return "", fmt.Errorf("VALENCE_ATOM_SRC_DIR is required")
+	}
+	return filepath.Abs(root)
+}
+
+// realAtomRoot resolves the versions dir's current symlink, so PHP and the
+// file walkers see a stable path for the life of the process.
+func realAtomRoot(path string) string {
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		return resolved
+	}
+	return path
+}
+
+func ensureAtomRoot(path string) error {
+	if err := extractOwnershipFromEnv(); err != nil {
+		return err
+	}
+	if url := strings.TrimSpace(os.Getenv("VALENCE_ATOM_ARCHIVE_URL")); url != "" {
+		current, err := useRemoteArchive(context.Background(), url, path)
+		if err != nil {
+			return fmt.Errorf("remote atom archive: %w", err)
+		}
+		if current {
+			return nil
+		}
+	}
+	if base := atomVersionsDir(); base != "" {
+		name, err := atomembed.EnsureVersion(base, envInt("VALENCE_ATOM_KEEP_VERSIONS", 2))
+		if err != nil {
+			return err
+		}
+		if name != atomembed.VersionName() {
+			logWarnf("atom version %s is pinned; loaded archive is %s", name, atomembed.VersionName())
+		}
+		logInfof("serving atom version %s from %s", name, base)
+		return nil
+	}
+	forceExtract := envBool("VALENCE_ATOM_FORCE_EXTRACT", false)
+	extracted, err := atomembed.EnsureExtracted(path, forceExtract)
+	if err != nil {
+		if errors.Is(err, atomembed.ErrAtomRootExists) {
+			logInfof("atom root exists at %s; skipping embedded extraction", path)
+			return nil
+		}
+		return err
+	}
+	if extracted {
+		logInfof("extracted embedded atom archive to %s", path)
+	}
+	return nil
+}
+
+// dependency is a backing service checked before serving and by the deep
+// health endpoint; it is up when any of its endpoints passes.
+type dependency struct {
+	name      string
+	endpoints []endpoint
+}
+
+func dependencies(cfg bootstrap.Config) ([]dependency, error) {
+	dsn, err := bootstrap.ParseMySQLDSN(cfg.MySQLDSN)
+	if err != nil {
+		return nil, err
+	}
+	network, mysqlAddr := dsn.Network()
+	mysqlTLS, err := cfg.MySQLTLSConfig(dsn.Host)
+	if err != nil {
+		return nil, err
+	}
+	esEndpoints, err := elasticsearchEndpoints(cfg)
+	if err != nil {
+		return nil, err
+	}
+	cache, err := cacheEndpoint(cfg)
+	if err != nil {
+		return nil, err
+	}
+	gearmanAddr, err := hostPort(cfg.GearmandHost, 4730)
+	if err != nil {
+		return nil, fmt.Errorf("parse gearmand host: %w", err)
+	}
+
+	mysql := endpoint{
+		network: network,
+		addr:    mysqlAddr,
+		check: func(conn net.Conn) error {
+			return mysqlwire.Ping(conn, mysqlwire.Options{
+				User:     cfg.MySQLUsername,
+				Password: cfg.MySQLPassword,
+				DBName:   dsn.DBName,
+				TLS:      mysqlTLS,
+			})
+		},
+	}
+	return []dependency{
+		{name: "mysql", endpoints: []endpoint{mysql}},
+		{name: "elasticsearch", endpoints: esEndpoints},
+		{name: cfg.CacheEngine, endpoints: []endpoint{cache}},
+		{name: "gearmand", endpoints: []endpoint{{
+			addr:  gearmanAddr,
+			check: gearmanCheck(requireGearmanWorker(), nil),
+		}}},
+	}, nil
+}
+
+func waitForDependencies(cfg bootstrap.Config) error {
+	deps, err := dependencies(cfg)
+	if err != nil {
+		return err
+	}
+	policy := waitPolicyFromEnv()
+	skip := skippedDependencies(deps)
+	for _, dep := range deps {
+		if skip[dep.name] {
+			logInfof("skipping wait for %s (VALENCE_WAIT_SKIP)", dep.name)
+			continue
+		}
+		if err := waitFor(dep.name, policy, dep.endpoints...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cacheEndpoint is the session/cache backend; PHP sessions fail obscurely
+// when it is missing.
+func cacheEndpoint(cfg bootstrap.Config) (endpoint, error) {
+	if cfg.CacheEngine == bootstrap.CacheEngineRedis {
+		addr, err := hostPort(cfg.RedisHost, 6379)
+		if err != nil {
+			return endpoint{}, fmt.Errorf("parse redis host: %w", err)
+		}
+		return endpoint{addr: addr, check: redisCheck(cfg.RedisPassword)}, nil
+	}
+	addr, err := hostPort(cfg.MemcachedHost, 11211)
+	if err != nil {
+		return endpoint{}, fmt.Errorf("parse memcached host: %w", err)
+	}
+	return endpoint{addr: addr, check: memcachedCheck}, nil
+}
+
+// skippedDependencies parses VALENCE_WAIT_SKIP, a comma-separated list of
+// dependency names, for deployments that run without search or jobs on
+// purpose. MySQL cannot be skipped: nothing works without it.
+func skippedDependencies(deps []dependency) map[string]bool {
+	known := make(map[string]bool, len(deps))
+	for _, dep := range deps {
+		known[dep.name] = true
+	}
+	skip := map[string]bool{}
+	for _, name := range strings.Split(os.Getenv("VALENCE_WAIT_SKIP"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		switch {
+		case name == "":
+		case name == "mysql":
+			logWarnf("VALENCE_WAIT_SKIP: mysql cannot be skipped")
+		case !known[name]:
+			logWarnf("VALENCE_WAIT_SKIP: unknown dependency %q", name)
+		default:
+			skip[name] = true
+		}
+	}
+	return skip
+}
+
+func requireGearmanWorker() bool {
+	return envBool("VALENCE_WAIT_GEARMAN_WORKER", false)
+}
+
+// endpoint is a dependency address; when tls is set the check also
+// completes a TLS handshake, and check, when set, runs a protocol-level
+// readiness check on the connection.
+type endpoint struct {
+	network string // defaults to tcp
+	addr    string
+	tls     *tls.Config
+	check   func(net.Conn) error
+}
+
+// permanentError is implemented by check errors that retrying cannot fix,
+// such as rejected credentials.
+type permanentError interface {
+	Permanent() bool
+}
+
+func elasticsearchEndpoints(cfg bootstrap.Config) ([]endpoint, error) {
+	var endpoints []endpoint
+	for _, node := range cfg.ElasticsearchNodes() {
+		addr, err := hostPort(node, 9200)
+		if err != nil {
+			return nil, fmt.Errorf("parse elasticsearch host: %w", err)
+		}
+		ep := endpoint{addr: addr, check: elasticsearchCheck(cfg, addr)}
+		if strings.HasPrefix(strings.ToLower(node), "https://") {
+			ep.tls, err = cfg.ElasticsearchTLSConfig()
+			if err != nil {
+				return nil, err
+			}
+			ep.tls.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+		endpoints = append(endpoints, ep)
+	}
+	return endpoints, nil
+}
+
+// retryLogEvery is VALENCE_LOG_RETRY_SAMPLE: waitFor logs the first and
+// every nth attempt. It is read once, as site retries wait while other
+// sites borrow the process environment.
+var retryLogEvery = max(envInt("VALENCE_LOG_RETRY_SAMPLE", 1), 1)
+
+// waitFor succeeds as soon as any of endpoints accepts a connection and
+// passes its check. A permanent check error stops the wait immediately, as
+// does running out of attempts or reaching the policy's deadline.
+func waitFor(name string, policy waitPolicy, endpoints ...endpoint) error {
+	if len(endpoints) == 0 {
+		return fmt.Errorf("%s: no address configured", name)
+	}
+	addrs := make([]string, 0, len(endpoints))
+	for _, ep := range endpoints {
+		addrs = append(addrs, ep.addr)
+	}
+	all := strings.Join(addrs, ",")
+	for i := 0; i < policy.attempts; i++ {
+		var lastErr error
+		for _, ep := range endpoints {
+			if err := dialEndpoint(ep); err != nil {
+				var perm permanentError
+				if errors.As(err, &perm) && perm.Permanent() {
+					return fmt.Errorf("%s at %s: %w", name, ep.addr, err)
+				}
+				lastErr = err
+				continue
+			}
+			logInfof("%s reachable at %s", name, ep.addr)
+			return nil
+		}
+		if i == policy.attempts-1 {
+			logWarnf("%s not ready at %s (attempt %d/%d): %v", name, all, i+1, policy.attempts, lastErr)
+			break
+		}
+		if i%retryLogEvery == 0 {
+			logInfof("%s not ready at %s (attempt %d/%d): %v", name, all, i+1, policy.attempts, lastErr)
+		}
+		delay, ok := policy.next(i)
+		if !ok {
+			return fmt.Errorf("%s not reachable at %s: startup deadline exceeded: %v", name, all, lastErr)
+		}
+		time.Sleep(delay)
+	}
+	return fmt.Errorf("%s not reachable at %s after %d attempts", name, all, policy.attempts)
+}
+
+func dialEndpoint(ep endpoint) error {
+	network := ep.network
+	if network == "" {
+		network = "tcp"
+	}
+	dialer := &net.Dialer{Timeout: 2 * time.Second}
+	var (
+		conn net.Conn
+		err  error
+	)
+	if ep.tls == nil {
+		conn, err = dialer.Dial(network, ep.addr)
+	} else {
+		conn, err = tls.DialWithDialer(dialer, network, ep.addr, ep.tls)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if ep.check == nil {
+		return nil
+	}
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		return err
+	}
+	return ep.check(conn)
+}
+
+func hostPort(value string, defaultPort int) (string, error) {
+	if value == "" {
+		return "", fmt.Errorf("empty host")
+	}
+	if strings.Contains(value, "://") {
+		u, err := url.Parse(value)
+		if err != nil {
+			return "", err
+		}
+		host := u.Hostname()
+		port := u.Port()
+		if port == "" {
+			port = strconv.Itoa(defaultPort)
+		}
+		return net.JoinHostPort(host, port), nil
+	}
+	parts := strings.Split(value, ":")
+	if len(parts) == 1 {
+		return net.JoinHostPort(parts[0], strconv.Itoa(defaultPort)), nil
+	}
+	return net.JoinHostPort(parts[0], parts[1]), nil
+}
+
+func healthHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"status": "ok",
+	})
+}
+
+func withPermissionsPolicy(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Allow legacy JS (e.g., YUI) to register unload handlers without browser warnings.
+		// We can tighten this later if we remove those dependencies.
+		w.Header().Set("Permissions-Policy", "unload=*")
+		next.ServeHTTP(w, r)
+	})
+}
+
+type atomHandler struct {
+	site            string
+	phpRoot         string
+	frontController string
+	fallback        http.Handler
+	atomDataDir     string
+	monitor         *dependencyMonitor
+	maintenanceFlag string
+	storage         *storageService
+	pages           *pageCache
+	conditional     *conditionalGET
+	logins          *loginLimiter
+	rewrites        *rewriteRules
+	denyPaths       denyPatterns
+	middleware      *routeMiddleware
+	routeRules      *routeRules
+	methods         routeMethods
+	timeouts        routeTimeouts
+	stats           *statCache
+}
+
+func newAtomHandler(cfg config, site string, monitor *dependencyMonitor, storage *storageService, rewrites *rewriteRules) *atomHandler {
+	fallback := &frontControllerHandler{
+		site:            site,
+		phpRoot:         cfg.phpRoot,
+		frontController: cfg.frontController,
+		dataDir:         cfg.atomDataDir,
+		uploads:         &uploadSpool{limits: cfg.uploads, site: site, dir: uploadSpoolDir(cfg)},
+	}
+	var php http.Handler = fallback
+	if cfg.phpBackend != nil {
+		php = cfg.phpBackend.handler(fallback)
+	}
+	php = withCapture(site, php)
+	h := &atomHandler{
+		site:            site,
+		phpRoot:         cfg.phpRoot,
+		frontController: cfg.frontController,
+		fallback:        php,
+		atomDataDir:     cfg.atomDataDir,
+		maintenanceFlag: maintenanceFlagPath(cfg.phpRoot, cfg.atomDataDir),
+		storage:         storage,
+		pages:           cfg.pages,
+		conditional:     cfg.conditional,
+		logins:          cfg.logins,
+		rewrites:        rewrites,
+		denyPaths:       cfg.denyPaths,
+		middleware:      cfg.middleware,
+		routeRules:      cfg.routeRules,
+		methods:         cfg.methods,
+		timeouts:        cfg.timeouts,
+		stats:           newStatCacheFromEnv(),
+	}
+	if envBool("VALENCE_MYSQL_BREAKER", true) {
+		h.monitor = monitor
+	}
+	return h
+}
+
+func (h *atomHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reqPath := cleanPath(r.URL.Path)
+	if reqPath != r.URL.Path {
+		clone := r.Clone(r.Context())
+		clone.URL.Path = reqPath
+		r = clone
+	}
+
+	r, reqPath, ok := h.applyRewriteRules(w, r, reqPath)
+	if !ok {
+		return
+	}
+
+	if rewritten := stripLegacyFrontController(reqPath); rewritten != "" {
+		clone := r.Clone(r.Context())
+		clone.URL.Path = rewritten
+		r = clone
+		reqPath = rewritten
+	}
+
+	if rewritten := rewriteStoragePath(reqPath); rewritten != "" {
+		clone := r.Clone(r.Context())
+		clone.URL.Path = rewritten
+		r = clone
+		reqPath = rewritten
+	}
+
+	r, reqPath, rule := h.routeRules.match(h.site, r, reqPath)
+
+	decision := routeDecision{label: "login_rate_limited"}
+	login, wait, ok := h.logins.begin(h.site, r, reqPath)
+	switch {
+	case ok && rule != nil:
+		decision = h.ruleDecision(rule, r, reqPath)
+	case ok:
+		decision = h.decideRoute(r, reqPath)
+	default:
+		decision.handler = loginRateLimited(wait)
+	}
+	if reason, shed := loadShed.sheds(r, decision.label, reqPath); shed {
+		shedTotal.WithLabelValues(h.site, reason).Inc()
+		decision = routeDecision{label: "shed_memory", handler: http.HandlerFunc(shedHandler)}
+	}
+	if allow, ok := h.methods.allows(decision.label, r.Method); !ok {
+		decision = routeDecision{label: "method_not_allowed", handler: methodNotAllowed(allow)}
+	}
+	decision.handler = h.middleware.wrap(h.site, decision.label, decision.handler)
+	decision.handler = h.timeouts.wrap(h.site, decision.label, reqPath, decision.handler)
+	recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	decision.handler.ServeHTTP(recorder, r)
+	if decision.source != "" {
+		servedBytes.WithLabelValues(h.site, decision.source).Add(float64(recorder.bytes))
+	}
+	logRouteDecision(r, h.site, decision.label, recorder.status, recorder.bytes)
+	login.finish(recorder.status)
+	authFailures.observe(r, decision.label, reqPath, recorder.status)
+	bandwidth.record(r, h.site, decision.label, reqPath, recorder.bytes)
+}
+
+// staticAssetPath returns the file serving requestPath and its source,
+// data_dir or atom_root.
+func (h *atomHandler) staticAssetPath(requestPath string) (string, string, bool) {
+	rel := strings.TrimPrefix(requestPath, "/")
+	type candidate struct{ path, source string }
+	candidates := []candidate{}
+	if h.atomDataDir != "" && downloadAssetRe.MatchString(requestPath) {
+		candidates = append(candidates, candidate{filepath.Join(h.atomDataDir, filepath.FromSlash(rel)), "data_dir"})
+	}
+	candidates = append(candidates, candidate{filepath.Join(h.phpRoot, filepath.FromSlash(rel)), "atom_root"})
+
+	for _, c := range candidates {
+		if h.isFile(c.path) {
+			return c.path, c.source, true
+		}
+	}
+	return "", "", false
+}
+
+func (h *atomHandler) existsOnDisk(requestPath string) bool {
+	rel := strings.TrimPrefix(requestPath, "/")
+	return h.isFile(filepath.Join(h.phpRoot, filepath.FromSlash(rel)))
+}
+
+// isFile looks path up through the stat cache, counting the stats it
+// makes by hit and miss.
+func (h *atomHandler) isFile(path string) bool {
+	isFile, stat := h.stats.isFile(path, time.Now())
+	if !stat {
+		statCacheHits.WithLabelValues(h.site).Inc()
+		return isFile
+	}
+	if isFile {
+		fileStats.WithLabelValues(h.site, "hit").Inc()
+	} else {
+		fileStats.WithLabelValues(h.site, "miss").Inc()
+	}
+	return isFile
+}
+
+func cleanPath(requestPath string) string {
+	clean := path.Clean("/" + requestPath)
+	if strings.Contains(clean, "..") {
+		return "/"
+	}
+	return clean
+}
+
+func matchesStatic(reqPath string) bool {
+	if staticAssetRe.MatchString(reqPath) {
+		return true
+	}
+	if downloadAssetRe.MatchString(reqPath) {
+		return true
+	}
+	return publicFileRe.MatchString(reqPath)
+}
+
+func stripLegacyFrontController(reqPath string) string {
+	if strings.HasPrefix(reqPath, "/index.php/") {
+		return "/" + strings.TrimPrefix(reqPath, "/index.php/")
+	}
+	if strings.HasPrefix(reqPath, "/qubit_dev.php/") {
+		return "/" + strings.TrimPrefix(reqPath, "/qubit_dev.php/")
+	}
+	if reqPath == "/index.php" || reqPath == "/qubit_dev.php" {
+		return "/"
+	}
+	return ""
+}
+
+func rewriteStoragePath(reqPath string) string {
+	if reqPath == "/storage/location/list" {
+		return "/storage/list"
+	}
+	return ""
+}
+
+type routeDecision struct {
+	label   string
+	handler http.Handler
+	// source names where a file served from disk came from, for
+	// valence_served_bytes_total.
+	source string
+}
+
+func (h *atomHandler) decideRoute(r *http.Request, reqPath string) routeDecision {
+	if decision, ok := h.denyDecision(reqPath); ok {
+		return decision
+	}
+
+	// Assets for valence's own pages, which must load during maintenance.
+	if name, ok := embeddedAssetPath(reqPath); ok {
+		return embeddedAssetDecision("valence_asset", name)
+	}
+
+	// Signed URLs are checked and served by valence alone.
+	if signedURLRe.MatchString(reqPath) {
+		return h.signedFileDecision(r, reqPath)
+	}
+
+	// Every PHP route needs the database; while it is down, answer from Go
+	// instead of holding a PHP thread for the full connect timeout.
+	if h.monitor != nil && h.monitor.mysqlUnavailable() && h.routesToPHP(reqPath) {
+		return routeDecision{label: "maintenance", handler: http.HandlerFunc(maintenanceHandler)}
+	}
+	// Likewise while valence db load is restoring it.
+	if inMaintenance(h.maintenanceFlag) && h.routesToPHP(reqPath) {
+		return routeDecision{label: "maintenance", handler: http.HandlerFunc(maintenanceHandler)}
+	}
+
+	// Explicit PHP entry points handled by PHP directly.
+	if phpEntryRe.MatchString(reqPath) {
+		return routeDecision{label: "php_entry", handler: h.fallback}
+	}
+
+	// Static assets served directly when they exist on disk.
+	if matchesStatic(reqPath) {
+		if assetPath, source, ok := h.staticAssetPath(reqPath); ok {
+			return routeDecision{
+				label:  "static",
+				source: source,
+				handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					setStaticHeaders(w)
+					http.ServeFile(w, r, assetPath)
+				}),
+			}
+		}
+		if name, ok := fallbackAssets[reqPath]; ok {
+			return embeddedAssetDecision("static_embedded", name)
+		}
+		return routeDecision{label: "static_missing", handler: http.NotFoundHandler()}
+	}
+
+	// Uploaded artifacts are routed through the front controller.
+	if uploadsAssetRe.MatchString(reqPath) {
+		return routeDecision{label: "uploads_front_controller", handler: h.fallback}
+	}
+
+	// try_files $uri /index.php?$args; if the file exists, forbid direct access.
+	if h.existsOnDisk(reqPath) {
+		return routeDecision{label: "deny_direct_file", handler: http.HandlerFunc(forbiddenHandler)}
+	}
+
+	// Default: legacy Symfony front controller, behind the page cache for
+	// anonymous visitors when it is enabled, and answering conditional GETs.
+	handler := h.fallback
+	caches := h.middleware.caches()
+	if h.pages != nil && caches {
+		handler = h.pages.handler(h.site, handler)
+	}
+	if h.conditional != nil && caches {
+		handler = h.conditional.handler(h.site, handler)
+	}
+	return routeDecision{label: "front_controller", handler: handler}
+}
+
+// denyDecision refuses the paths no route may serve.
+func (h *atomHandler) denyDecision(reqPath string) (routeDecision, bool) {
+	// Block internal paths.
+	if privatePathRe.MatchString(reqPath) {
+		return routeDecision{label: "deny_private", handler: http.NotFoundHandler()}, true
+	}
+
+	// Explicit deny-list for upload config directories.
+	if uploadsConfRe.MatchString(reqPath) {
+		return routeDecision{label: "deny_uploads_conf", handler: http.HandlerFunc(forbiddenHandler)}, true
+	}
+
+	// Site-specific deny-list from VALENCE_DENY_PATHS.
+	if _, ok := h.denyPaths.match(reqPath); ok {
+		return routeDecision{label: "deny_configured", handler: http.HandlerFunc(forbiddenHandler)}, true
+	}
+	return routeDecision{}, false
+}
+
+// routesToPHP reports whether decideRoute would hand reqPath to the front
+// controller.
+func (h *atomHandler) routesToPHP(reqPath string) bool {
+	switch {
+	case phpEntryRe.MatchString(reqPath), uploadsAssetRe.MatchString(reqPath):
+		return true
+	case matchesStatic(reqPath), signedURLRe.MatchString(reqPath):
+		return false
+	}
+	return !h.existsOnDisk(reqPath)
+}
+
+func setStaticHeaders(w http.ResponseWriter) {
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("Expires", time.Now().Add(365*24*time.Hour).UTC().Format(http.TimeFormat))
+}
+
+// routeLogSampler keeps one route line in VALENCE_LOG_ROUTES_SAMPLE.
+var routeLogSampler = newLogSampler("VALENCE_LOG_ROUTES_SAMPLE")
+
+// logRoutes is VALENCE_LOG_ROUTES, read once since sites borrow the
+// process environment while others serve.
+var logRoutes = strings.TrimSpace(os.Getenv("VALENCE_LOG_ROUTES")) != ""
+
+// logRouteDecision counts every decision and logs it at debug level, or at
+// info level when VALENCE_LOG_ROUTES is set.
+func logRouteDecision(r *http.Request, site, decision string, status int, bytes int64) {
+	routeDecisions.WithLabelValues(site, decision).Inc()
+	routeBytes.WithLabelValues(site, decision).Add(float64(bytes))
+	level := levelDebug
+	if logRoutes {
+		level = levelInfo
+	}
+	if !logEnabled(level) || !routeLogSampler.sample() {
+		return
+	}
+	if site != "" {
+		logf(level, "site=%s route=%s method=%s host=%s path=%s status=%d bytes=%d", site, decision, r.Method, r.Host, r.URL.Path, status, bytes)
+		return
+	}
+	logf(level, "route=%s method=%s path=%s status=%d bytes=%d", decision, r.Method, r.URL.Path, status, bytes)
+}
+
+func forbiddenHandler(w http.ResponseWriter, _ *http.Request) {
+	http.Error(w, "forbidden", http.StatusForbidden)
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.status = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(p)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// ReadFrom hands http.ServeFile's copy to the underlying writer, so large
+// files still go out with sendfile instead of through a userspace buffer.
+func (r *statusRecorder) ReadFrom(src io.Reader) (int64, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := io.Copy(r.ResponseWriter, src)
+	r.bytes += n
+	return n, err
+}
+
+var (
+	staticAssetRe   = regexp.MustCompile(`^/(css|dist|js|images|plugins|vendor)/.*\.(css|png|jpg|js|svg|ico|gif|pdf|woff|woff2|otf|ttf)$`)
+	downloadAssetRe = regexp.MustCompile(`^/(downloads)/.*\.(pdf|xml|html|csv|zip|rtf)$`)
+	publicFileRe    = regexp.MustCompile(`^/(ead\.dtd|favicon\.ico|robots\.txt|sitemap.*)$`)
+	uploadsConfRe   = regexp.MustCompile(`^/uploads/r/.*/conf/`)
+	uploadsAssetRe  = regexp.MustCompile(`^/uploads/r/.*$`)
+	privatePathRe   = regexp.MustCompile(`^/private/`)
+	phpEntryRe      = regexp.MustCompile(`^/(index|qubit_dev)\.php(/|$)`)
+)
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// readFromRecorder records whether a response body reached ReadFrom, where
+// the real writer uses sendfile.
+type readFromRecorder struct {
+	*httptest.ResponseRecorder
+	readFrom bool
+}
+
+func (r *readFromRecorder) ReadFrom(src io.Reader) (int64, error) {
+	r.readFrom = true
+	return io.Copy(r.ResponseRecorder, src)
+}
+
+func TestResponseWrappersReadFrom(t *testing.T) {
+	content := strings.Repeat("valence", 4096)
+	wrappers := map[string]func(http.ResponseWriter) http.ResponseWriter{
+		"statusRecorder": func(w http.ResponseWriter) http.ResponseWriter {
+			return &statusRecorder{ResponseWriter: w}
+		},
+		"headerWriter": func(w http.ResponseWriter) http.ResponseWriter {
+			return &headerWriter{ResponseWriter: w, set: map[string]string{"X-Test": "1"}}
+		},
+		"compressWriter": func(w http.ResponseWriter) http.ResponseWriter {
+			return &compressWriter{ResponseWriter: w, types: defaultCompressTypes, minSize: 1024, writers: &sync.Pool{}}
+		},
+		"timeoutWriter": func(w http.ResponseWriter) http.ResponseWriter {
+			return &timeoutWriter{w: w, header: w.Header().Clone(), deadline: time.Now().Add(time.Minute)}
+		},
+		"phpFatalRecorder": func(w http.ResponseWriter) http.ResponseWriter {
+			return &phpFatalRecorder{ResponseWriter: w}
+		},
+	}
+	for name, wrap := range wrappers {
+		t.Run(name, func(t *testing.T) {
+			rec := &readFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+			r := httptest.NewRequest(http.MethodGet, "/downloads/video.mp4", nil)
+			http.ServeContent(wrap(rec), r, "video.mp4", time.Time{}, strings.NewReader(content))
+			if !rec.readFrom {
+				t.Error("body did not reach the underlying ReadFrom")
+			}
+			if rec.Code != http.StatusOK || rec.Body.String() != content {
+				t.Errorf("got status %d and %d bytes; want 200 and %d", rec.Code, rec.Body.Len(), len(content))
+			}
+		})
+	}
+}
+
+func TestCompressWriterReadFromCompresses(t *testing.T) {
+	content := strings.Repeat("<p>valence</p>", 1024)
+	rec := &readFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+	writers := &sync.Pool{New: func() any { return gzip.NewWriter(io.Discard) }}
+	w := &compressWriter{ResponseWriter: rec, types: defaultCompressTypes, minSize: 1024, writers: writers}
+	r := httptest.NewRequest(http.MethodGet, "/page.html", nil)
+	http.ServeContent(w, r, "page.html", time.Time{}, strings.NewReader(content))
+	w.Close()
+
+	if rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Content-Encoding = %q; want gzip", rec.Header().Get("Content-Encoding"))
+	}
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != content {
+		t.Errorf("decompressed %d bytes; want %d", len(body), len(content))
+	}
+}
+
+// BenchmarkServeLargeFile serves a file over a real connection, straight
+// and through every wrapper a download passes, which should cost the same
+// when sendfile is kept.
+func BenchmarkServeLargeFile(b *testing.B) {
+	const size = 64 << 20
+	path := filepath.Join(b.TempDir(), "video.mp4")
+	if err := os.WriteFile(path, make([]byte, size), 0o644); err != nil {
+		b.Fatal(err)
+	}
+	serve := func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, path)
+	}
+	timeouts := routeTimeouts{byLabel: map[string]time.Duration{"static": time.Minute}}
+	handlers := map[string]http.Handler{
+		"direct": http.HandlerFunc(serve),
+		"wrapped": timeouts.wrap("", "static", "/downloads/video.mp4", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w = &statusRecorder{ResponseWriter: w}
+			w = &phpFatalRecorder{ResponseWriter: w}
+			w = &headerWriter{ResponseWriter: w, set: map[string]string{"X-Benchmark": "1"}}
+			w = &compressWriter{ResponseWriter: w, types: defaultCompressTypes, minSize: 1024, writers: &sync.Pool{}}
+			serve(w, r)
+		})),
+	}
+	for _, name := range []string{"direct", "wrapped"} {
+		b.Run(name, func(b *testing.B) {
+			srv := httptest.NewServer(handlers[name])
+			defer srv.Close()
+			b.SetBytes(size)
+			b.ResetTimer()
+			for range b.N {
+				resp, err := srv.Client().Get(srv.URL + "/downloads/video.mp4")
+				if err != nil {
+					b.Fatal(err)
+				}
+				n, err := io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				if err != nil || n != size {
+					b.Fatalf("read %d bytes: %v", n, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+const maintenanceRetryAfter = 30 // seconds
+
+var maintenancePage = []byte(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Temporarily unavailable</title>
+<link rel="icon" href="/favicon.ico">
+<link rel="stylesheet" href="/_valence/error.css">
+</head>
+<body>
+<main>
+<h1>Temporarily unavailable</h1>
+<p>The site is down for maintenance or cannot reach its database right now. Please try again in a moment.</p>
+</main>
+</body>
+</html>
+`)
+
+// maintenanceHandler answers PHP routes while the MySQL circuit breaker is
+// open or the site is in maintenance mode.
+func maintenanceHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Retry-After", strconv.Itoa(maintenanceRetryAfter))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	_, _ = w.Write(maintenancePage)
+}
+
+// maintenanceFile puts the site in maintenance mode while it exists, e.g.
+// during valence db load, so PHP does not see a half-restored database.
+const maintenanceFile = ".valence-maintenance"
+
+// maintenanceFlagPath keeps the flag in the data dir when there is one, so
+// every replica sharing it goes into maintenance together.
+func maintenanceFlagPath(root, dataDir string) string {
+	if dataDir != "" {
+		return filepath.Join(dataDir, maintenanceFile)
+	}
+	return filepath.Join(root, maintenanceFile)
+}
+
+func inMaintenance(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// enterMaintenance creates the flag and returns a func that removes it.
+// A flag that already existed is left in place.
+func enterMaintenance(path string) (func(), error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if errors.Is(err, os.ErrExist) {
+		return func() {}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	return func() { _ = os.Remove(path) }, nil
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"runtime/debug"
+	"runtime/metrics"
+	"strconv"
+	"strings"
+)
+
+// Memory tuning sets the Go collector for a process whose PHP threads share
+// its memory. VALENCE_GOGC is GOGC (a percentage, or off);
+// VALENCE_MEMORY_LIMIT is GOMEMLIMIT, a size or a percentage of the
+// container's memory limit, and must leave room below that limit for PHP,
+// whose memory the Go runtime neither counts nor collects. Turning GOGC off
+// needs a memory limit, or the heap would grow until the container is
+// killed. VALENCE_MEMORY_BALLAST allocates that much, never touched, so the
+// collector runs less often on a small heap; it counts against the memory
+// limit but, being untouched, not against RSS. GOGC and GOMEMLIMIT
+// themselves still work, and the VALENCE_ settings win over them.
+
+// memoryBallast keeps VALENCE_MEMORY_BALLAST alive.
+var memoryBallast []byte
+
+func applyMemoryTuning() error {
+	gcPercent, limit, ballast := 0, int64(0), int64(0)
+	setGC := false
+	if val := strings.ToLower(strings.TrimSpace(os.Getenv("VALENCE_GOGC"))); val != "" {
+		setGC = true
+		if val == "off" {
+			gcPercent = -1
+		} else if n, err := strconv.Atoi(val); err == nil && n > 0 {
+			gcPercent = n
+		} else {
+			return fmt.Errorf("invalid VALENCE_GOGC %q (want a positive percentage or off)", val)
+		}
+	}
+	container := containerMemoryLimit()
+	if val := strings.TrimSpace(os.Getenv("VALENCE_MEMORY_LIMIT")); val != "" {
+		if pct, ok := strings.CutSuffix(val, "%"); ok {
+			n, err := strconv.ParseFloat(strings.TrimSpace(pct), 64)
+			if err != nil || n <= 0 || n >= 100 {
+				return fmt.Errorf("invalid VALENCE_MEMORY_LIMIT %q (want a percentage below 100%%)", val)
+			}
+			if container <= 0 {
+				return errors.New("VALENCE_MEMORY_LIMIT is a percentage but the container has no memory limit")
+			}
+			limit = int64(float64(container) * n / 100)
+		} else {
+			var err error
+			if limit, err = parseByteSize(val); err != nil || limit <= 0 {
+				return fmt.Errorf("invalid VALENCE_MEMORY_LIMIT %q", val)
+			}
+		}
+		if container > 0 && limit >= container {
+			return fmt.Errorf("VALENCE_MEMORY_LIMIT %d is not below the container limit %d, leaving nothing for PHP", limit, container)
+		}
+	}
+	// A negative SetMemoryLimit reads the limit, which GOMEMLIMIT may set.
+	if gcPercent < 0 && limit <= 0 && debug.SetMemoryLimit(-1) == math.MaxInt64 {
+		return errors.New("VALENCE_GOGC=off needs VALENCE_MEMORY_LIMIT")
+	}
+	if val := strings.TrimSpace(os.Getenv("VALENCE_MEMORY_BALLAST")); val != "" {
+		var err error
+		if ballast, err = parseByteSize(val); err != nil || ballast <= 0 {
+			return fmt.Errorf("invalid VALENCE_MEMORY_BALLAST %q", val)
+		}
+		if limit > 0 && ballast >= limit/2 {
+			return fmt.Errorf("VALENCE_MEMORY_BALLAST %d takes half or more of VALENCE_MEMORY_LIMIT %d", ballast, limit)
+		}
+	}
+
+	if setGC {
+		debug.SetGCPercent(gcPercent)
+	}
+	if limit > 0 {
+		debug.SetMemoryLimit(limit)
+	}
+	if ballast > 0 {
+		memoryBallast = make([]byte, ballast)
+	}
+	if setGC || limit > 0 || ballast > 0 {
+		gogc, memLimit := goGCSettings()
+		logInfof("memory tuning: gogc=%d memory_limit=%d ballast=%d container_limit=%d", gogc, memLimit, ballast, container)
+	}
+	return nil
+}
+
+// goGCSettings returns the collector's GOGC, -1 for off, and memory limit
+// in force.
+func goGCSettings() (int64, int64) {
+	samples := []metrics.Sample{{Name: "/gc/gogc:percent"}, {Name: "/gc/gomemlimit:bytes"}}
+	metrics.Read(samples)
+	var values [2]int64
+	for i, s := range samples {
+		if s.Value.Kind() == metrics.KindUint64 {
+			values[i] = int64(min(s.Value.Uint64(), math.MaxInt64))
+		}
+	}
+	// GOGC=off reads as the largest value there is.
+	if values[0] == math.MaxInt64 {
+		values[0] = -1
+	}
+	return values[0], values[1]
+}
+
+// containerMemoryLimit returns the memory limit of the cgroup valence runs
+// in, or 0 for none.
+func containerMemoryLimit() int64 {
+	for _, path := range []string{
+		"/sys/fs/cgroup/memory.max",                   // cgroup v2
+		"/sys/fs/cgroup/memory/memory.limit_in_bytes", // cgroup v1
+	} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+		// "max", or v1's page-rounded MaxInt64, means no limit.
+		if err != nil || n <= 0 || n >= math.MaxInt64/2 {
+			return 0
+		}
+		return n
+	}
+	return 0
+}
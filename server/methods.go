@@ -0,0 +1,101 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+// routeMethodEnvPrefix sets the methods a route class accepts, e.g.
+// VALENCE_ROUTE_METHODS_FRONT_CONTROLLER="GET,POST". The class is the route
+// decision label in upper case; "*" accepts any method. GET implies HEAD.
+const routeMethodEnvPrefix = "VALENCE_ROUTE_METHODS_"
+
+// readMethods is what file-serving route classes accept.
+var readMethods = []string{http.MethodGet, http.MethodHead}
+
+// defaultRouteMethods restricts the classes that only ever read; those not
+// listed, such as front_controller, accept any method but TRACE and TRACK.
+var defaultRouteMethods = map[string][]string{
+	"static":                 readMethods,
+	"static_missing":         readMethods,
+	"static_embedded":        readMethods,
+	"valence_asset":          readMethods,
+	"signed":                 readMethods,
+	"signed_storage_service": readMethods,
+}
+
+// routeMethods maps route decision labels to the methods they accept.
+type routeMethods map[string][]string
+
+func routeMethodsFromEnv() (routeMethods, error) {
+	methods := routeMethods{}
+	for label, allowed := range defaultRouteMethods {
+		methods[label] = allowed
+	}
+	for _, kv := range os.Environ() {
+		key, value, _ := strings.Cut(kv, "=")
+		name, ok := strings.CutPrefix(key, routeMethodEnvPrefix)
+		if !ok || name == "" {
+			continue
+		}
+		label := strings.ToLower(name)
+		if strings.TrimSpace(value) == "*" {
+			delete(methods, label)
+			continue
+		}
+		var allowed []string
+		for _, method := range strings.Split(value, ",") {
+			method = strings.ToUpper(strings.TrimSpace(method))
+			switch {
+			case method == "":
+				continue
+			case method == "TRACE" || method == "TRACK":
+				return nil, fmt.Errorf("%s: %s is always rejected", key, method)
+			case strings.ContainsFunc(method, func(r rune) bool { return r < 'A' || r > 'Z' }):
+				return nil, fmt.Errorf("%s: invalid method %q", key, method)
+			}
+			allowed = append(allowed, method)
+		}
+		if len(allowed) == 0 {
+			return nil, fmt.Errorf("%s: no methods; use * to accept any", key)
+		}
+		if slices.Contains(allowed, http.MethodGet) && !slices.Contains(allowed, http.MethodHead) {
+			allowed = append(allowed, http.MethodHead)
+		}
+		methods[label] = allowed
+	}
+	return methods, nil
+}
+
+// allows reports whether the route class accepts method, and if not, the
+// Allow header to answer with.
+func (m routeMethods) allows(label, method string) (string, bool) {
+	allowed, ok := m[label]
+	if !ok || slices.Contains(allowed, method) {
+		return "", true
+	}
+	return strings.Join(allowed, ", "), false
+}
+
+// methodNotAllowed answers 405 with the given Allow header.
+func methodNotAllowed(allow string) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Allow", allow)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// withTraceRejected answers TRACE and TRACK, which only help cross-site
+// tracing attacks, with a 405 on every path.
+func withTraceRejected(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodTrace || strings.EqualFold(r.Method, "TRACK") {
+			methodNotAllowed("GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS")(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,230 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/artefactual-labs/valence/internal/memcached"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsRegistry holds everything served on /metrics. A private registry
+// keeps metrics from libraries we embed from leaking in by accident. Site
+// labels are empty unless VALENCE_SITES_FILE lists several sites.
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	dependencyUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "valence_dependency_up",
+		Help: "Whether the last background check of a dependency succeeded.",
+	}, []string{"site", "dependency"})
+	dependencyLastCheck = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "valence_dependency_last_check_timestamp_seconds",
+		Help: "Unix time of the last background check of a dependency.",
+	}, []string{"site", "dependency"})
+	gearmandWorkers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "valence_gearmand_workers",
+		Help: "Workers registered with gearmand for the busiest function.",
+	}, []string{"site"})
+	gearmandJobs = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "valence_gearmand_jobs",
+		Help: "Jobs in gearmand's queue, pending or running, across functions.",
+	}, []string{"site", "state"})
+	jobsByStatus = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "valence_atom_jobs",
+		Help: "Jobs in AtoM's job table by status.",
+	}, []string{"site", "status"})
+	jobsOldestPendingAge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "valence_atom_jobs_oldest_pending_age_seconds",
+		Help: "Age of the oldest AtoM job still in progress.",
+	}, []string{"site"})
+	supervisedRestarts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "valence_supervised_restarts_total",
+		Help: "Restarts of supervised background tasks after a failure or panic.",
+	}, []string{"task"})
+	uploadsInProgress = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "valence_uploads_in_progress",
+		Help: "Request bodies being spooled to disk before reaching PHP.",
+	}, []string{"site"})
+	uploadBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "valence_upload_received_bytes_total",
+		Help: "Request body bytes accepted for PHP, counted as spooled bodies arrive.",
+	}, []string{"site"})
+	uploadsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "valence_uploads_total",
+		Help: "Request bodies by outcome: streamed, spooled, too_large or aborted.",
+	}, []string{"site", "result"})
+	pageCacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "valence_page_cache_requests_total",
+		Help: "Front controller requests by page cache result: hit, coalesced, miss or bypass.",
+	}, []string{"site", "result"})
+	pageCacheEvictions = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "valence_page_cache_evictions_total",
+		Help: "Pages dropped from the in-memory page cache to stay within VALENCE_PAGE_CACHE_MAX_SIZE.",
+	})
+	fileStats = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "valence_file_stats_total",
+		Help: "File system stats made while routing requests (stat cache misses), by whether a regular file was found (hit) or not (miss).",
+	}, []string{"site", "result"})
+	statCacheHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "valence_stat_cache_hits_total",
+		Help: "File lookups answered from the stat cache instead of the file system.",
+	}, []string{"site"})
+	servedBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "valence_served_bytes_total",
+		Help: "Response bytes valence served without PHP, by source: atom_root, data_dir, embedded, memory or memcached.",
+	}, []string{"site", "source"})
+	routeDecisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "valence_route_decisions_total",
+		Help: "Requests by routing decision, such as front_controller, static, deny_private or static_missing.",
+	}, []string{"site", "decision"})
+	phpThreadsByState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "valence_php_threads",
+		Help: "PHP threads by state: busy serving a request or idle.",
+	}, []string{"state"})
+	phpThreadLimit = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "valence_php_thread_limit",
+		Help: "PHP threads the pool uses now, between VALENCE_PHP_THREADS and VALENCE_PHP_MAX_THREADS.",
+	})
+	phpScalingDecisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "valence_php_thread_scaling_total",
+		Help: "PHP thread pool scaling decisions: up, down, or held_cpu when requests queued but the CPUs were busy.",
+	}, []string{"decision"})
+	phpQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "valence_php_queue_depth",
+		Help: "Requests waiting for a free PHP thread.",
+	})
+	phpQueueWait = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "valence_php_queue_wait_seconds",
+		Help:    "Time requests waited for a free PHP thread.",
+		Buckets: []float64{0.001, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	})
+	phpSaturationRejections = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "valence_php_saturation_rejections_total",
+		Help: "Requests answered 503 after waiting VALENCE_PHP_MAX_WAIT for a PHP thread.",
+	})
+	routeTimeoutsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "valence_route_timeouts_total",
+		Help: "Requests that ran past their route class timeout, by routing decision.",
+	}, []string{"site", "decision"})
+	notModifiedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "valence_not_modified_total",
+		Help: "Front controller pages answered 304 from their ETag or Last-Modified.",
+	}, []string{"site"})
+	loginThrottledTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "valence_login_throttled_total",
+		Help: "Login attempts refused before reaching PHP, by reason (ip, user or lockout).",
+	}, []string{"site", "reason"})
+	rateLimitedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "valence_rate_limited_total",
+		Help: "Requests answered 429 by a VALENCE_MIDDLEWARE_FILE rate limit, by routing decision.",
+	}, []string{"site", "decision"})
+	routeRuleMatches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "valence_route_rule_matches_total",
+		Help: "Requests matched by a VALENCE_ROUTE_RULES_FILE rule, by rule name.",
+	}, []string{"site", "rule"})
+	routeBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "valence_route_bytes_total",
+		Help: "Response bytes served, by routing decision.",
+	}, []string{"site", "decision"})
+	pathPrefixBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "valence_path_prefix_bytes_total",
+		Help: "Response bytes served, by VALENCE_BANDWIDTH_PREFIXES prefix.",
+	}, []string{"site", "prefix"})
+	shedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "valence_shed_total",
+		Help: "Low-priority requests refused under memory pressure, by reason (crawler or path).",
+	}, []string{"site", "reason"})
+	memoryShedding = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "valence_memory_shedding",
+		Help: "Whether low-priority requests are being shed under memory pressure (1) or not (0).",
+	}, func() float64 {
+		if loadShed.active() {
+			return 1
+		}
+		return 0
+	})
+	memoryBallastBytes = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "valence_memory_ballast_bytes",
+		Help: "Size of the VALENCE_MEMORY_BALLAST allocation.",
+	}, func() float64 { return float64(len(memoryBallast)) })
+	containerMemoryLimitBytes = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "valence_container_memory_limit_bytes",
+		Help: "Memory limit of the cgroup valence runs in, 0 for none.",
+	}, func() float64 { return float64(containerMemoryLimit()) })
+	embeddedCacheItems = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "valence_embedded_cache_items",
+		Help: "Items held by the embedded memcached-compatible cache.",
+	}, func() float64 { return float64(embeddedCacheStats().Items) })
+	embeddedCacheBytes = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "valence_embedded_cache_bytes",
+		Help: "Bytes held by the embedded cache, counted against VALENCE_EMBEDDED_CACHE_SIZE.",
+	}, func() float64 { return float64(embeddedCacheStats().Bytes) })
+	embeddedCacheHits = prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Name: "valence_embedded_cache_hits_total",
+		Help: "Keys the embedded cache found.",
+	}, func() float64 { return float64(embeddedCacheStats().Hits) })
+	embeddedCacheMisses = prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Name: "valence_embedded_cache_misses_total",
+		Help: "Keys the embedded cache did not have.",
+	}, func() float64 { return float64(embeddedCacheStats().Misses) })
+	embeddedCacheEvictions = prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Name: "valence_embedded_cache_evictions_total",
+		Help: "Items the embedded cache dropped to stay within its size.",
+	}, func() float64 { return float64(embeddedCacheStats().Evictions) })
+)
+
+// embeddedCacheStats reads the embedded cache's counters once it runs.
+var embeddedCacheStats = func() memcached.Stats { return memcached.Stats{} }
+
+func init() {
+	metricsRegistry.MustRegister(
+		// The GC and memory series include GOGC and GOMEMLIMIT as set by
+		// VALENCE_GOGC and VALENCE_MEMORY_LIMIT.
+		collectors.NewGoCollector(collectors.WithGoCollectorRuntimeMetrics(collectors.MetricsGC, collectors.MetricsMemory)),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		dependencyUp,
+		dependencyLastCheck,
+		gearmandWorkers,
+		gearmandJobs,
+		jobsByStatus,
+		jobsOldestPendingAge,
+		supervisedRestarts,
+		uploadsInProgress,
+		uploadBytes,
+		uploadsTotal,
+		pageCacheRequests,
+		pageCacheEvictions,
+		fileStats,
+		statCacheHits,
+		servedBytes,
+		routeDecisions,
+		phpThreadsByState,
+		phpThreadLimit,
+		phpScalingDecisions,
+		phpQueueDepth,
+		phpQueueWait,
+		phpSaturationRejections,
+		routeTimeoutsTotal,
+		notModifiedTotal,
+		loginThrottledTotal,
+		rateLimitedTotal,
+		routeRuleMatches,
+		routeBytes,
+		pathPrefixBytes,
+		shedTotal,
+		memoryShedding,
+		memoryBallastBytes,
+		containerMemoryLimitBytes,
+		embeddedCacheItems,
+		embeddedCacheBytes,
+		embeddedCacheHits,
+		embeddedCacheMisses,
+		embeddedCacheEvictions,
+	)
+}
+
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
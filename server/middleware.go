@@ -0,0 +1,490 @@
+package server
+
+import (
+	"cmp"
+	"compress/gzip"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// routeMiddleware is the middleware each route class goes through, read
+// from the JSON file VALENCE_MIDDLEWARE_FILE names, so deployments can
+// compose behaviour without code changes. Routes are keyed by routing
+// decision (front_controller, static, php_entry...); "*" covers the
+// classes not listed. Each class lists its middleware outermost first:
+//
+//	{"routes": {
+//	  "front_controller": [
+//	    {"use": "rate_limit", "rate": 5, "burst": 20},
+//	    {"use": "headers", "set": {"X-Frame-Options": "SAMEORIGIN"}},
+//	    {"use": "compress"},
+//	    {"use": "cache", "enabled": false}
+//	  ],
+//	  "php_entry": [{"use": "auth", "type": "basic", "users": {"ops": "$2y$10$..."}}],
+//	  "*": [{"use": "compress", "min_size": 4096}]
+//	}}
+//
+// compress gzips compressible responses; rate_limit answers 429 past rate
+// requests a second per client address, allowing bursts of burst; auth
+// asks for HTTP basic credentials (bcrypt hashes, as htpasswd -B writes
+// them) or, with type api_key, the internal token or an API key holding
+// scope; headers sets and deletes response headers, over what the handler
+// sent; cache, for front_controller only, turns the page cache and
+// conditional GETs off when disabled, and always sits innermost. An entry
+// with "enabled": false is skipped.
+type routeMiddleware struct {
+	byLabel  map[string]middlewareChain
+	fallback middlewareChain
+}
+
+type middlewareChain struct {
+	wraps   []func(site, label string, next http.Handler) http.Handler
+	noCache bool
+}
+
+type middlewareFile struct {
+	Routes map[string][]middlewareSpec `json:"routes"`
+}
+
+type middlewareSpec struct {
+	Use     string `json:"use"`
+	Enabled *bool  `json:"enabled,omitempty"`
+
+	// compress
+	Level   int      `json:"level,omitempty"`
+	MinSize int64    `json:"min_size,omitempty"`
+	Types   []string `json:"types,omitempty"`
+
+	// rate_limit
+	Rate  float64 `json:"rate,omitempty"`
+	Burst int     `json:"burst,omitempty"`
+
+	// auth
+	Type  string            `json:"type,omitempty"`
+	Realm string            `json:"realm,omitempty"`
+	Users map[string]string `json:"users,omitempty"`
+	Scope string            `json:"scope,omitempty"`
+
+	// headers
+	Set    map[string]string `json:"set,omitempty"`
+	Delete []string          `json:"delete,omitempty"`
+}
+
+// routeMiddlewareFromEnv returns nil when no file is set.
+func routeMiddlewareFromEnv() (*routeMiddleware, error) {
+	path := strings.TrimSpace(os.Getenv("VALENCE_MIDDLEWARE_FILE"))
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file middlewareFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	trusted, err := trustedProxiesFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	m := &routeMiddleware{byLabel: map[string]middlewareChain{}}
+	for label, specs := range file.Routes {
+		var chain middlewareChain
+		for i, spec := range specs {
+			if spec.Enabled != nil && !*spec.Enabled {
+				if spec.Use == "cache" {
+					chain.noCache = true
+				}
+				continue
+			}
+			wrap, err := spec.build(label, trusted)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s entry %d (%s): %w", path, label, i+1, spec.Use, err)
+			}
+			if wrap != nil {
+				chain.wraps = append(chain.wraps, wrap)
+			}
+		}
+		if label == "*" {
+			m.fallback = chain
+		} else {
+			m.byLabel[label] = chain
+		}
+	}
+	return m, nil
+}
+
+// build checks spec and returns its middleware, nil for cache.
+func (spec middlewareSpec) build(label string, trusted []netip.Prefix) (func(site, label string, next http.Handler) http.Handler, error) {
+	switch spec.Use {
+	case "compress":
+		return newCompressMiddleware(spec)
+	case "rate_limit":
+		return newRateLimitMiddleware(spec, trusted)
+	case "auth":
+		return newAuthMiddleware(spec)
+	case "headers":
+		if len(spec.Set) == 0 && len(spec.Delete) == 0 {
+			return nil, errors.New("set or delete is required")
+		}
+		return func(_, _ string, next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				next.ServeHTTP(&headerWriter{ResponseWriter: w, set: spec.Set, delete: spec.Delete}, r)
+			})
+		}, nil
+	case "cache":
+		if label != "front_controller" {
+			return nil, errors.New("cache only applies to front_controller")
+		}
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown middleware %q (want compress, rate_limit, auth, headers or cache)", spec.Use)
+	}
+}
+
+// chain returns the middleware of a route class.
+func (m *routeMiddleware) chain(label string) middlewareChain {
+	if m == nil {
+		return middlewareChain{}
+	}
+	if chain, ok := m.byLabel[label]; ok {
+		return chain
+	}
+	return m.fallback
+}
+
+// wrap puts next behind the middleware of its route class.
+func (m *routeMiddleware) wrap(site, label string, next http.Handler) http.Handler {
+	wraps := m.chain(label).wraps
+	for i := len(wraps) - 1; i >= 0; i-- {
+		next = wraps[i](site, label, next)
+	}
+	return next
+}
+
+// caches reports whether front controller pages may use the page cache and
+// conditional GETs.
+func (m *routeMiddleware) caches() bool {
+	return !m.chain("front_controller").noCache
+}
+
+// headerWriter applies a headers entry as the response starts.
+type headerWriter struct {
+	http.ResponseWriter
+	set     map[string]string
+	delete  []string
+	applied bool
+}
+
+func (w *headerWriter) apply() {
+	if w.applied {
+		return
+	}
+	w.applied = true
+	for _, name := range w.delete {
+		w.Header().Del(name)
+	}
+	for name, value := range w.set {
+		w.Header().Set(name, value)
+	}
+}
+
+func (w *headerWriter) WriteHeader(code int) {
+	w.apply()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *headerWriter) Write(p []byte) (int, error) {
+	w.apply()
+	return w.ResponseWriter.Write(p)
+}
+
+// ReadFrom keeps http.ServeFile's sendfile path through the wrapper.
+func (w *headerWriter) ReadFrom(src io.Reader) (int64, error) {
+	w.apply()
+	return io.Copy(w.ResponseWriter, src)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *headerWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+var defaultCompressTypes = []string{
+	"text/html", "text/css", "text/plain", "text/xml", "text/javascript",
+	"application/javascript", "application/json", "application/xml", "image/svg+xml",
+}
+
+func newCompressMiddleware(spec middlewareSpec) (func(site, label string, next http.Handler) http.Handler, error) {
+	level := spec.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+		return nil, fmt.Errorf("level %d is out of range", spec.Level)
+	}
+	minSize := spec.MinSize
+	if minSize == 0 {
+		minSize = 1024
+	}
+	types := spec.Types
+	if len(types) == 0 {
+		types = defaultCompressTypes
+	}
+	writers := &sync.Pool{New: func() any {
+		zw, _ := gzip.NewWriterLevel(io.Discard, level)
+		return zw
+	}}
+	return func(_, _ string, next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodHead || r.Header.Get("Range") != "" || !acceptsGzip(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			cw := &compressWriter{ResponseWriter: w, types: types, minSize: minSize, writers: writers}
+			defer cw.Close()
+			next.ServeHTTP(cw, r)
+		})
+	}, nil
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			continue
+		}
+		q, ok := strings.CutPrefix(strings.ReplaceAll(params, " ", ""), "q=")
+		return !ok || q != "0" && q != "0.0" && q != "0.00" && q != "0.000"
+	}
+	return false
+}
+
+// compressWriter gzips the response when its status, type and length
+// allow it, which it decides as the response starts.
+type compressWriter struct {
+	http.ResponseWriter
+	types   []string
+	minSize int64
+	writers *sync.Pool
+
+	decided bool
+	zw      *gzip.Writer
+}
+
+func (w *compressWriter) decide(status int) {
+	if w.decided {
+		return
+	}
+	w.decided = true
+	h := w.Header()
+	w.Header().Add("Vary", "Accept-Encoding")
+	if status < 200 || status == http.StatusNoContent || status == http.StatusNotModified || status == http.StatusPartialContent {
+		return
+	}
+	if h.Get("Content-Encoding") != "" {
+		return
+	}
+	if length, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64); err == nil && length < w.minSize {
+		return
+	}
+	mediaType, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	if !slices.Contains(w.types, mediaType) {
+		return
+	}
+	h.Del("Content-Length")
+	h.Set("Content-Encoding", "gzip")
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		// The bytes differ from the identity response's.
+		h.Set("ETag", "W/"+etag)
+	}
+	w.zw = w.writers.Get().(*gzip.Writer)
+	w.zw.Reset(w.ResponseWriter)
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	w.decide(code)
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	if !w.decided {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(p))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.zw == nil {
+		return w.ResponseWriter.Write(p)
+	}
+	return w.zw.Write(p)
+}
+
+// ReadFrom sends a response that is not compressed with sendfile; one that
+// is, or whose type is still to be sniffed, goes through Write.
+func (w *compressWriter) ReadFrom(src io.Reader) (int64, error) {
+	if !w.decided || w.zw != nil {
+		return io.Copy(struct{ io.Writer }{w}, src)
+	}
+	return io.Copy(w.ResponseWriter, src)
+}
+
+// Flush sends what has been compressed so far.
+func (w *compressWriter) Flush() {
+	if w.zw != nil {
+		_ = w.zw.Flush()
+	}
+	_ = http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Close ends the gzip stream.
+func (w *compressWriter) Close() {
+	if w.zw == nil {
+		return
+	}
+	_ = w.zw.Close()
+	w.writers.Put(w.zw)
+	w.zw = nil
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// rateLimiter is a token bucket per client address.
+type rateLimiter struct {
+	rate    float64
+	burst   float64
+	trusted []netip.Prefix
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimitMiddleware(spec middlewareSpec, trusted []netip.Prefix) (func(site, label string, next http.Handler) http.Handler, error) {
+	if spec.Rate <= 0 {
+		return nil, errors.New("rate must be positive")
+	}
+	l := &rateLimiter{
+		rate:    spec.Rate,
+		burst:   float64(max(spec.Burst, int(math.Ceil(spec.Rate)))),
+		trusted: trusted,
+		buckets: map[string]*tokenBucket{},
+	}
+	return func(site, label string, next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if wait, ok := l.allow(forwardedClientIP(r, l.trusted), time.Now()); !ok {
+				rateLimitedTotal.WithLabelValues(site, label).Inc()
+				w.Header().Set("Retry-After", strconv.Itoa(max(int(math.Ceil(wait.Seconds())), 1)))
+				http.Error(w, "too many requests", http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}, nil
+}
+
+// allow takes a token for client, or returns how long until there is one.
+func (l *rateLimiter) allow(client string, now time.Time) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// A bucket left alone this long is full again, as good as none.
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	if now.Sub(l.lastPrune) > full {
+		for key, b := range l.buckets {
+			if now.Sub(b.last) > full {
+				delete(l.buckets, key)
+			}
+		}
+		l.lastPrune = now
+	}
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / l.rate * float64(time.Second)), false
+	}
+	b.tokens--
+	return 0, true
+}
+
+func newAuthMiddleware(spec middlewareSpec) (func(site, label string, next http.Handler) http.Handler, error) {
+	switch spec.Type {
+	case "basic":
+		if len(spec.Users) == 0 {
+			return nil, errors.New("basic auth needs users")
+		}
+		for user, hash := range spec.Users {
+			if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+				return nil, fmt.Errorf("user %s: not a bcrypt hash", user)
+			}
+		}
+		realm := cmp.Or(spec.Realm, "valence")
+		return func(_, _ string, next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				user, password, ok := r.BasicAuth()
+				hash, known := spec.Users[user]
+				if ok && known && bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil {
+					next.ServeHTTP(w, r)
+					return
+				}
+				authFailures.record(r, "route_auth", http.StatusUnauthorized)
+				w.Header().Set("WWW-Authenticate", `Basic realm="`+realm+`", charset="UTF-8"`)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+			})
+		}, nil
+	case "api_key":
+		scope := spec.Scope
+		if !slices.Contains(apiScopes, scope) {
+			return nil, fmt.Errorf("invalid scope %q (want one of %s)", scope, strings.Join(apiScopes, ", "))
+		}
+		return func(_, _ string, next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if token := internalAPIToken(); token != "" && subtle.ConstantTimeCompare([]byte(strings.TrimSpace(r.Header.Get("Authorization"))), []byte("Bearer "+token)) == 1 {
+					next.ServeHTTP(w, r)
+					return
+				}
+				key, ok := bearerAPIKey(r)
+				if ok && key.allows(scope) {
+					next.ServeHTTP(w, r)
+					return
+				}
+				status := http.StatusUnauthorized
+				if ok {
+					status = http.StatusForbidden
+				}
+				authFailures.record(r, "route_auth", status)
+				http.Error(w, http.StatusText(status), status)
+			})
+		}, nil
+	default:
+		return nil, fmt.Errorf("invalid auth type %q (want basic or api_key)", spec.Type)
+	}
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/artefactual-labs/valence/internal/bootstrap"
+)
+
+// dependencyMonitor keeps probing dependencies after startup so their state
+// shows up in /health/deep, metrics and the log rather than only as PHP
+// stack traces. It refreshes the job queue metrics on the same interval.
+// VALENCE_MONITOR_INTERVAL=0 turns it off, in which case /health/deep
+// probes on demand.
+type dependencyMonitor struct {
+	site     string
+	cfg      bootstrap.Config
+	interval time.Duration
+	skip     map[string]bool
+
+	mu   sync.RWMutex
+	last *deepHealth
+
+	// mysqlDown trips the front controller circuit breaker.
+	mysqlDown atomic.Bool
+}
+
+func newDependencyMonitor(site string, cfg bootstrap.Config) *dependencyMonitor {
+	m := &dependencyMonitor{
+		site:     site,
+		cfg:      cfg,
+		interval: envDuration("VALENCE_MONITOR_INTERVAL", 30*time.Second),
+	}
+	if deps, err := dependencies(cfg); err == nil {
+		m.skip = skippedDependencies(deps)
+	}
+	return m
+}
+
+func (m *dependencyMonitor) run(ctx context.Context) {
+	if m.interval <= 0 {
+		return
+	}
+	for {
+		m.probe()
+		if !m.mysqlUnavailable() {
+			collectJobs(m.cfg).setMetrics(m.site)
+		}
+		// Re-check sooner while the breaker is open so the site comes back
+		// promptly once MySQL does.
+		wait := m.interval
+		if m.mysqlUnavailable() {
+			wait = min(wait, 5*time.Second)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (m *dependencyMonitor) probe() {
+	report, err := probeDependencies(m.cfg, m.skip)
+	if err != nil {
+		logWarnf("%sdependency monitor: %v", m.logPrefix(), err)
+		return
+	}
+
+	m.mu.Lock()
+	prev := m.last
+	m.last = &report
+	m.mu.Unlock()
+
+	for name, health := range report.Dependencies {
+		if health.Status == "skipped" {
+			continue
+		}
+		up := 0.0
+		if health.Status == "ok" {
+			up = 1
+		}
+		if name == "mysql" {
+			m.mysqlDown.Store(up == 0)
+		}
+		dependencyUp.WithLabelValues(m.site, name).Set(up)
+		dependencyLastCheck.WithLabelValues(m.site, name).Set(float64(report.CheckedAt.Unix()))
+		if health.Workers != nil {
+			gearmandWorkers.WithLabelValues(m.site).Set(float64(*health.Workers))
+		}
+
+		was := "ok" // startup waited for everything, so assume it was up
+		if prev != nil {
+			was = prev.Dependencies[name].Status
+		}
+		switch {
+		case was == health.Status:
+		case health.Status == "ok":
+			logInfof("%s%s recovered", m.logPrefix(), name)
+		default:
+			logWarnf("%s%s degraded: %s", m.logPrefix(), name, health.Error)
+		}
+	}
+}
+
+func (m *dependencyMonitor) logPrefix() string {
+	if m.site == "" {
+		return ""
+	}
+	return "site " + m.site + ": "
+}
+
+// mysqlUnavailable reports whether the last probe found MySQL down.
+func (m *dependencyMonitor) mysqlUnavailable() bool {
+	return m.mysqlDown.Load()
+}
+
+// report returns the last background result, or probes now when the
+// monitor is off.
+func (m *dependencyMonitor) report() (deepHealth, error) {
+	m.mu.RLock()
+	last := m.last
+	m.mu.RUnlock()
+	if last != nil {
+		return *last, nil
+	}
+	return probeDependencies(m.cfg, m.skip)
+}
@@ -0,0 +1,441 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pageCache keeps rendered front controller pages for anonymous visitors,
+// so a burst of traffic to one page costs one PHP render per TTL. It is
+// enabled with VALENCE_PAGE_CACHE=memory or memcached.
+//
+// A request is anonymous when it carries none of the cookies in
+// VALENCE_PAGE_CACHE_BYPASS_COOKIES (by default AtoM's login marker and
+// the session cookie, since a session can hold a culture the URL does not
+// show; monolingual sites may drop the latter to cache more). Pages are
+// keyed by site, host, path and query, which carries sf_culture. PHP's own
+// cache headers are ignored: its session handling marks every page
+// no-store. Responses that set cookies other than the session one are not
+// stored, and the session cookie is stripped from stored ones.
+type pageCache struct {
+	store         pageStore
+	ttl           time.Duration
+	maxEntry      int
+	bypassCookies []string
+	sessionCookie string
+	// wait bounds how long a request for a page being rendered waits for
+	// it instead of rendering it too.
+	wait time.Duration
+
+	mu       sync.Mutex
+	inflight map[string]chan struct{}
+}
+
+type cachedPage struct {
+	Status   int
+	Header   http.Header
+	Body     []byte
+	StoredAt time.Time
+}
+
+type pageStore interface {
+	// name is the valence_served_bytes_total source for hits.
+	name() string
+	get(key string) (*cachedPage, bool)
+	set(key string, page *cachedPage, ttl time.Duration)
+}
+
+// pageCacheFromEnv returns nil when VALENCE_PAGE_CACHE is unset.
+func pageCacheFromEnv() (*pageCache, error) {
+	sessionCookie := envOrDefault("ATOM_SESSION_NAME", "symfony")
+	pc := &pageCache{
+		ttl:           envDuration("VALENCE_PAGE_CACHE_TTL", 60*time.Second),
+		maxEntry:      512 << 10,
+		sessionCookie: sessionCookie,
+		wait:          envDuration("VALENCE_PAGE_CACHE_WAIT", 10*time.Second),
+		inflight:      map[string]chan struct{}{},
+	}
+	for _, name := range strings.Split(envOrDefault("VALENCE_PAGE_CACHE_BYPASS_COOKIES", "atom_authenticated,"+sessionCookie), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			pc.bypassCookies = append(pc.bypassCookies, name)
+		}
+	}
+	if val := strings.TrimSpace(os.Getenv("VALENCE_PAGE_CACHE_MAX_ENTRY")); val != "" {
+		size, err := parseByteSize(val)
+		if err != nil {
+			return nil, fmt.Errorf("VALENCE_PAGE_CACHE_MAX_ENTRY: %w", err)
+		}
+		pc.maxEntry = int(size)
+	}
+
+	switch kind := strings.ToLower(strings.TrimSpace(os.Getenv("VALENCE_PAGE_CACHE"))); kind {
+	case "":
+		return nil, nil
+	case "memory":
+		maxSize := int64(64 << 20)
+		if val := strings.TrimSpace(os.Getenv("VALENCE_PAGE_CACHE_MAX_SIZE")); val != "" {
+			size, err := parseByteSize(val)
+			if err != nil {
+				return nil, fmt.Errorf("VALENCE_PAGE_CACHE_MAX_SIZE: %w", err)
+			}
+			maxSize = size
+		}
+		pc.store = newMemoryPageStore(maxSize)
+	case "memcached":
+		host := envOrDefault("VALENCE_PAGE_CACHE_MEMCACHED_HOST", os.Getenv("ATOM_MEMCACHED_HOST"))
+		addr, err := hostPort(host, 11211)
+		if err != nil {
+			return nil, fmt.Errorf("VALENCE_PAGE_CACHE_MEMCACHED_HOST: %w", err)
+		}
+		pc.store = &memcachedPageStore{addr: addr, conns: make(chan *memcachedConn, 8)}
+	default:
+		return nil, fmt.Errorf("unknown VALENCE_PAGE_CACHE %q (want memory or memcached)", kind)
+	}
+	return pc, nil
+}
+
+// cacheable reports whether r may be answered from, and stored in, the
+// cache.
+func (pc *pageCache) cacheable(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if r.Header.Get("Authorization") != "" {
+		return false
+	}
+	for _, name := range pc.bypassCookies {
+		if _, err := r.Cookie(name); err == nil {
+			return false
+		}
+	}
+	return true
+}
+
+func pageKey(site string, r *http.Request) string {
+	sum := sha256.Sum256([]byte(site + "\n" + normalizeHost(r.Host) + "\n" + r.URL.Path + "?" + r.URL.Query().Encode()))
+	return "valence:page:" + hex.EncodeToString(sum[:])
+}
+
+// handler serves r from the cache or from next, storing what next renders.
+func (pc *pageCache) handler(site string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !pc.cacheable(r) {
+			pageCacheRequests.WithLabelValues(site, "bypass").Inc()
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := pageKey(site, r)
+		if page, ok := pc.store.get(key); ok {
+			pageCacheRequests.WithLabelValues(site, "hit").Inc()
+			pc.serve(w, r, site, page)
+			return
+		}
+
+		pc.mu.Lock()
+		done, rendering := pc.inflight[key]
+		if !rendering {
+			done = make(chan struct{})
+			pc.inflight[key] = done
+		}
+		pc.mu.Unlock()
+		if rendering {
+			select {
+			case <-done:
+			case <-time.After(pc.wait):
+			case <-r.Context().Done():
+				return
+			}
+			if page, ok := pc.store.get(key); ok {
+				pageCacheRequests.WithLabelValues(site, "coalesced").Inc()
+				pc.serve(w, r, site, page)
+				return
+			}
+			pageCacheRequests.WithLabelValues(site, "miss").Inc()
+			next.ServeHTTP(w, r)
+			return
+		}
+		defer func() {
+			pc.mu.Lock()
+			delete(pc.inflight, key)
+			pc.mu.Unlock()
+			close(done)
+		}()
+
+		pageCacheRequests.WithLabelValues(site, "miss").Inc()
+		w.Header().Set("X-Valence-Cache", "MISS")
+		rec := &pageRecorder{ResponseWriter: w, limit: pc.maxEntry}
+		next.ServeHTTP(rec, r)
+		if page := pc.storable(r, rec); page != nil {
+			pc.store.set(key, page, pc.ttl)
+		}
+	})
+}
+
+// storable returns the page to store from a recorded response, or nil.
+func (pc *pageCache) storable(r *http.Request, rec *pageRecorder) *cachedPage {
+	if r.Method != http.MethodGet || rec.status != http.StatusOK || rec.overflow {
+		return nil
+	}
+	header := rec.header.Clone()
+	for _, line := range header.Values("Set-Cookie") {
+		name, _, _ := strings.Cut(line, "=")
+		if strings.TrimSpace(name) != pc.sessionCookie {
+			return nil
+		}
+	}
+	header.Del("Set-Cookie")
+	header.Del("X-Valence-Cache")
+	return &cachedPage{Status: rec.status, Header: header, Body: rec.body.Bytes(), StoredAt: time.Now()}
+}
+
+func (pc *pageCache) serve(w http.ResponseWriter, r *http.Request, site string, page *cachedPage) {
+	for key, values := range page.Header {
+		w.Header()[key] = values
+	}
+	w.Header().Set("X-Valence-Cache", "HIT")
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(page.StoredAt).Seconds())))
+	w.Header().Set("Content-Length", strconv.Itoa(len(page.Body)))
+	w.WriteHeader(page.Status)
+	if r.Method != http.MethodHead {
+		n, _ := w.Write(page.Body)
+		servedBytes.WithLabelValues(site, pc.store.name()).Add(float64(n))
+	}
+}
+
+// pageRecorder passes a response through while keeping a copy of up to
+// limit bytes of it.
+type pageRecorder struct {
+	http.ResponseWriter
+	limit    int
+	status   int
+	header   http.Header
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (p *pageRecorder) WriteHeader(code int) {
+	if p.status == 0 {
+		p.status = code
+		p.header = p.ResponseWriter.Header().Clone()
+	}
+	p.ResponseWriter.WriteHeader(code)
+}
+
+func (p *pageRecorder) Write(b []byte) (int, error) {
+	if p.status == 0 {
+		p.WriteHeader(http.StatusOK)
+	}
+	if !p.overflow {
+		if p.body.Len()+len(b) > p.limit {
+			p.overflow = true
+			p.body = bytes.Buffer{}
+		} else {
+			p.body.Write(b)
+		}
+	}
+	return p.ResponseWriter.Write(b)
+}
+
+func (p *pageRecorder) Flush() {
+	if f, ok := p.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (p *pageRecorder) Unwrap() http.ResponseWriter {
+	return p.ResponseWriter
+}
+
+// memoryPageStore is an LRU bounded by the total size of the bodies.
+type memoryPageStore struct {
+	maxSize int64
+
+	mu    sync.Mutex
+	size  int64
+	order *list.List // front is most recently used
+	items map[string]*list.Element
+}
+
+type memoryPageEntry struct {
+	key     string
+	page    *cachedPage
+	expires time.Time
+}
+
+func newMemoryPageStore(maxSize int64) *memoryPageStore {
+	return &memoryPageStore{maxSize: maxSize, order: list.New(), items: map[string]*list.Element{}}
+}
+
+func (m *memoryPageStore) name() string { return "memory" }
+
+func (m *memoryPageStore) get(key string) (*cachedPage, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	el, ok := m.items[key]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*memoryPageEntry)
+	if time.Now().After(entry.expires) {
+		m.remove(el)
+		return nil, false
+	}
+	m.order.MoveToFront(el)
+	return entry.page, true
+}
+
+func (m *memoryPageStore) set(key string, page *cachedPage, ttl time.Duration) {
+	size := int64(len(page.Body))
+	if size > m.maxSize {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if el, ok := m.items[key]; ok {
+		m.remove(el)
+	}
+	for m.size+size > m.maxSize {
+		m.remove(m.order.Back())
+		pageCacheEvictions.Inc()
+	}
+	m.items[key] = m.order.PushFront(&memoryPageEntry{key: key, page: page, expires: time.Now().Add(ttl)})
+	m.size += size
+}
+
+func (m *memoryPageStore) remove(el *list.Element) {
+	entry := el.Value.(*memoryPageEntry)
+	m.order.Remove(el)
+	delete(m.items, entry.key)
+	m.size -= int64(len(entry.page.Body))
+}
+
+// memcachedPageStore shares pages between valence instances over the
+// memcached text protocol. Errors count as misses.
+type memcachedPageStore struct {
+	addr  string
+	conns chan *memcachedConn
+}
+
+type memcachedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (m *memcachedPageStore) name() string { return "memcached" }
+
+func (m *memcachedPageStore) conn() (*memcachedConn, error) {
+	select {
+	case c := <-m.conns:
+		return c, nil
+	default:
+	}
+	conn, err := net.DialTimeout("tcp", m.addr, 500*time.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+	return &memcachedConn{Conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+func (m *memcachedPageStore) release(c *memcachedConn, err error) {
+	if err != nil {
+		c.Close()
+		return
+	}
+	select {
+	case m.conns <- c:
+	default:
+		c.Close()
+	}
+}
+
+func (m *memcachedPageStore) get(key string) (*cachedPage, bool) {
+	c, err := m.conn()
+	if err != nil {
+		return nil, false
+	}
+	page, err := c.get(key)
+	m.release(c, err)
+	return page, page != nil
+}
+
+func (c *memcachedConn) get(key string) (*cachedPage, error) {
+	if err := c.SetDeadline(time.Now().Add(time.Second)); err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Fprintf(c, "get %s\r\n", key); err != nil {
+		return nil, err
+	}
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(line) == "END" {
+		return nil, nil
+	}
+	fields := strings.Fields(line)
+	if len(fields) != 4 || fields[0] != "VALUE" {
+		return nil, fmt.Errorf("unexpected reply %q", strings.TrimSpace(line))
+	}
+	n, err := strconv.Atoi(fields[3])
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, n+2)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return nil, err
+	}
+	if end, err := c.r.ReadString('\n'); err != nil || strings.TrimSpace(end) != "END" {
+		return nil, fmt.Errorf("unexpected end of get reply")
+	}
+	var page cachedPage
+	if err := gob.NewDecoder(bytes.NewReader(data[:n])).Decode(&page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+func (m *memcachedPageStore) set(key string, page *cachedPage, ttl time.Duration) {
+	var data bytes.Buffer
+	if err := gob.NewEncoder(&data).Encode(page); err != nil {
+		return
+	}
+	c, err := m.conn()
+	if err != nil {
+		return
+	}
+	m.release(c, c.set(key, data.Bytes(), ttl))
+}
+
+func (c *memcachedConn) set(key string, data []byte, ttl time.Duration) error {
+	if err := c.SetDeadline(time.Now().Add(time.Second)); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(c, "set %s 0 %d %d\r\n", key, max(int(ttl.Seconds()), 1), len(data)); err != nil {
+		return err
+	}
+	if _, err := c.Write(append(data, '\r', '\n')); err != nil {
+		return err
+	}
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	// SERVER_ERROR (object too large) leaves the connection usable.
+	if reply := strings.TrimSpace(line); reply != "STORED" && !strings.HasPrefix(reply, "SERVER_ERROR") {
+		return fmt.Errorf("unexpected reply %q", reply)
+	}
+	return nil
+}
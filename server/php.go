@@ -1,19 +1,41 @@
-package main
+package server
 
 import (
 	"errors"
 	"fmt"
-	"log"
+	"maps"
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 
+	"github.com/artefactual-labs/valence/hooks"
+	"github.com/artefactual-labs/valence/internal/bootstrap"
 	"github.com/dunglas/frankenphp"
 )
 
-func initPHPRuntime() error {
-	if err := frankenphp.Init(frankenphp.WithPhpIni(defaultPHPIni())); err != nil {
+func initPHPRuntime(cfg bootstrap.Config, uploads uploadLimits) error {
+	phpThreads = newPHPThreadPool()
+	ini := defaultPHPIni(cfg, uploads)
+	script, err := writePHPFatalScript()
+	if err != nil {
+		return fmt.Errorf("php fatal error handler: %w", err)
+	}
+	phpFatalScriptPath = script
+	ini["auto_prepend_file"] = script
+	if phpStatusScriptPath, err = writePHPStatusScript(); err != nil {
+		return fmt.Errorf("php status script: %w", err)
+	}
+	opts := []frankenphp.Option{
+		frankenphp.WithPhpIni(ini),
+		frankenphp.WithNumThreads(phpThreads.size()),
+	}
+	if phpThreads.autoscaling() {
+		opts = append(opts, frankenphp.WithMaxThreads(phpThreads.maxSize()))
+	}
+	if err := frankenphp.Init(opts...); err != nil {
 		return err
 	}
 	if !frankenphp.Config().ZTS {
@@ -23,11 +45,20 @@ func initPHPRuntime() error {
 	return nil
 }
 
+// phpFatalScriptPath is set by initPHPRuntime.
+var phpFatalScriptPath string
+
 func shutdownPHPRuntime() {
 	frankenphp.Shutdown()
+	if phpFatalScriptPath != "" {
+		_ = os.Remove(phpFatalScriptPath)
+	}
+	if phpStatusScriptPath != "" {
+		_ = os.RemoveAll(filepath.Dir(phpStatusScriptPath))
+	}
 }
 
-func defaultPHPIni() map[string]string {
+func defaultPHPIni(cfg bootstrap.Config, uploads uploadLimits) map[string]string {
 	ini := map[string]string{
 		"output_buffering":              "4096",
 		"expose_php":                    "0",
@@ -40,10 +71,8 @@ func defaultPHPIni() map[string]string {
 		"max_execution_time":            "120",
 		"max_input_time":                "120",
 		"memory_limit":                  "512M",
-		"post_max_size":                 "72M",
 		"default_charset":               "UTF-8",
 		"cgi.fix_pathinfo":              "0",
-		"upload_max_filesize":           "64M",
 		"max_file_uploads":              "20",
 		"date.timezone":                 "America/Vancouver",
 		"session.use_only_cookies":      "0",
@@ -52,9 +81,24 @@ func defaultPHPIni() map[string]string {
 		"opcache.validate_timestamps":   "0",
 	}
 
+	// valence enforces per-route body limits before PHP runs, so PHP only
+	// needs to allow the largest of them.
+	largest := strconv.FormatInt(uploads.largest(), 10)
+	ini["post_max_size"] = largest
+	ini["upload_max_filesize"] = largest
+
+	if cfg.Timezone != "" {
+		ini["date.timezone"] = cfg.Timezone
+	}
+	// symfony's session storage sets cookie params positionally, so
+	// SameSite only reaches the cookie through php.ini.
+	if cfg.SessionCookieSameSite != "" {
+		ini["session.cookie_samesite"] = cfg.SessionCookieSameSite
+	}
+
 	if extDir := detectExtensionDir(); extDir != "" {
 		ini["extension_dir"] = extDir
-		log.Printf("php extension_dir=%s", extDir)
+		logDebugf("php extension_dir=%s", extDir)
 	}
 
 	return ini
@@ -117,13 +161,13 @@ func extDirHasSo(dir string) bool {
 	return false
 }
 
-func runSymfonyPurge(root string) error {
-	log.Printf("running symfony tools:purge --demo")
-	return runSymfonyWithMemoryLimit(root, []string{"tools:purge", "--demo"}, "-1")
+func runSymfonyPurge(root string, args []string) error {
+	logInfof("running symfony tools:purge")
+	return runSymfonyWithMemoryLimit(root, append([]string{"tools:purge"}, args...), "-1")
 }
 
 func runSymfonyCacheClear(root string) error {
-	log.Printf("running symfony cc")
+	logInfof("running symfony cc")
 	return runSymfony(root, []string{"cc"})
 }
 
@@ -195,17 +239,85 @@ func writeSymfonyWrapper(root string, args []string, memoryLimit string) (string
 	return tmp.Name(), nil
 }
 
+// runTaskFunc defines $runTask for scripts that need a symfony task
+// in-process, e.g. to run it while holding a database lock.
+const runTaskFunc = `$runTask = function (array $args) use ($configuration) {
+  $application = new sfSymfonyCommandApplication($configuration->getEventDispatcher(), new sfFormatter(), ['symfony_lib_dir' => sfConfig::get('sf_symfony_lib_dir')]);
+
+  return (int) $application->run($args);
+};
+`
+
+// runAtomScript runs PHP code inside a booted qubit application context,
+// with $configuration and $runTask in scope.
+func runAtomScript(root, code string) error {
+	return runAtomScriptEnv(root, nil, code)
+}
+
+// runAtomScriptEnv is runAtomScript with env set inside the script rather
+// than in the process environment, so it needs no siteStartMu; PHP puts
+// back what putenv changed when the script ends.
+func runAtomScriptEnv(root string, env map[string]string, code string) error {
+	tmp, err := os.CreateTemp("", "valence-script-*.php")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	php := strings.Builder{}
+	php.WriteString("<?php\n")
+	for _, key := range slices.Sorted(maps.Keys(env)) {
+		name, value := phpEscape(key), phpEscape(env[key])
+		php.WriteString(fmt.Sprintf("putenv('%s=%s');\n", name, value))
+		php.WriteString(fmt.Sprintf("$_SERVER['%s'] = $_ENV['%s'] = '%s';\n", name, name, value))
+	}
+	php.WriteString(fmt.Sprintf("chdir('%s');\n", phpEscape(root)))
+	php.WriteString("require_once 'config/ProjectConfiguration.class.php';\n")
+	php.WriteString("$configuration = ProjectConfiguration::getApplicationConfiguration('qubit', 'cli', false);\n")
+	php.WriteString("sfContext::createInstance($configuration);\n")
+	php.WriteString(runTaskFunc)
+	php.WriteString(code)
+
+	if _, err := tmp.WriteString(php.String()); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+
+	exitCode := frankenphp.ExecuteScriptCLI(tmp.Name(), []string{tmp.Name()})
+	if exitCode != 0 {
+		return fmt.Errorf("php script failed with exit code %d", exitCode)
+	}
+	return nil
+}
+
 func phpEscape(value string) string {
 	value = strings.ReplaceAll(value, "\\", "\\\\")
 	return strings.ReplaceAll(value, "'", "\\'")
 }
 
 type frontControllerHandler struct {
+	site            string
 	phpRoot         string
 	frontController string
+	// dataDir is passed to PHP as ATOM_DATA_DIR, which tells sites sharing
+	// the atom root apart.
+	dataDir string
+	uploads *uploadSpool
 }
 
 func (h *frontControllerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.uploads != nil {
+		spooled, cleanup, ok := h.uploads.prepare(w, r)
+		if !ok {
+			return
+		}
+		defer cleanup()
+		r = spooled
+	}
+
 	// Route the request through the legacy Symfony front controller.
 	req, env := h.frontControllerRequest(r)
 	phpReq, err := frankenphp.NewRequestWithContext(
@@ -214,18 +326,39 @@ func (h *frontControllerHandler) ServeHTTP(w http.ResponseWriter, r *http.Reques
 		frankenphp.WithRequestEnv(env),
 	)
 	if err != nil {
-		log.Printf("php request build error for %s: %v", r.URL.Path, err)
+		logErrorf("php request build error for %s: %v", r.URL.Path, err)
 		http.Error(w, "php request build error", http.StatusBadGateway)
 		return
 	}
 
+	phpInFlight.Add(1)
+	defer phpInFlight.Add(-1)
+	release, ok := phpThreads.acquire(r.Context())
+	if !ok {
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "PHP is saturated", http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
+	defer phpStatus.begin(h.site, r)()
+	fatals := &phpFatalRecorder{ResponseWriter: w}
+	defer func() {
+		if fatals.fatal == "" {
+			return
+		}
+		phpStatus.fatal(h.site, r, fatals.fatal)
+		if state := requestReportState(r); state != nil {
+			state.phpFatal = fatals.fatal
+		}
+	}()
+	w = fatals
 	if err := frankenphp.ServeHTTP(w, phpReq); err != nil {
 		var rejected *frankenphp.ErrRejected
 		switch {
 		case errors.As(err, &rejected):
 			http.Error(w, "request rejected by PHP", http.StatusBadRequest)
 		default:
-			log.Printf("php error for %s: %v", r.URL.Path, err)
+			logErrorf("php error for %s: %v", r.URL.Path, err)
 			http.Error(w, "php execution error", http.StatusBadGateway)
 		}
 	}
@@ -238,10 +371,15 @@ func (h *frontControllerHandler) frontControllerRequest(r *http.Request) (*http.
 	clone.URL.Path = "/index.php"
 	clone.URL.RawPath = "/index.php"
 
-	env := map[string]string{
-		"SCRIPT_FILENAME": h.frontController,
-		"SCRIPT_NAME":     "/index.php",
-		"PATH_INFO":       originalPath,
+	// Hooks go first so that they cannot change how PHP is run.
+	env := map[string]string{}
+	hooks.SetPHPEnv(r, env)
+	delete(env, "ATOM_DATA_DIR")
+	env["SCRIPT_FILENAME"] = h.frontController
+	env["SCRIPT_NAME"] = "/index.php"
+	env["PATH_INFO"] = originalPath
+	if h.dataDir != "" {
+		env["ATOM_DATA_DIR"] = h.dataDir
 	}
 
 	return clone, env
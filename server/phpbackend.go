@@ -0,0 +1,240 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/artefactual-labs/valence/internal/fastcgi"
+)
+
+// VALENCE_PHP_BACKEND hands the requests that would run AtoM's front
+// controller in embedded FrankenPHP to an external PHP instead, for
+// installs that keep an existing PHP-FPM pool or web server:
+//
+//	fastcgi://host:9000          PHP-FPM over TCP
+//	fastcgi+unix:///run/php.sock PHP-FPM over a unix socket
+//	http://host:8080             a web server serving the atom root
+//
+// FastCGI requests name the front controller under
+// VALENCE_PHP_BACKEND_ROOT, the atom root as the backend sees it (default
+// the local one). HTTP requests are passed on with their path, Host and
+// X-Forwarded-* headers. Static files, storage, caching and the rest of
+// valence are unchanged; embedded PHP still runs tasks and CLI commands.
+type phpBackend struct {
+	// network and address are where FastCGI requests go; url is set
+	// instead for an HTTP backend.
+	network string
+	address string
+	url     *url.URL
+	root    string
+	timeout time.Duration
+}
+
+// phpBackendFromEnv returns nil when VALENCE_PHP_BACKEND is not set.
+func phpBackendFromEnv() (*phpBackend, error) {
+	raw := strings.TrimSpace(os.Getenv("VALENCE_PHP_BACKEND"))
+	if raw == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("VALENCE_PHP_BACKEND: %w", err)
+	}
+	b := &phpBackend{
+		root:    strings.TrimSpace(os.Getenv("VALENCE_PHP_BACKEND_ROOT")),
+		timeout: envDuration("VALENCE_PHP_BACKEND_TIMEOUT", 5*time.Second),
+	}
+	switch u.Scheme {
+	case "fastcgi":
+		if u.Host == "" {
+			return nil, fmt.Errorf("VALENCE_PHP_BACKEND %q has no host", raw)
+		}
+		b.network, b.address = "tcp", u.Host
+	case "fastcgi+unix":
+		if u.Path == "" {
+			return nil, fmt.Errorf("VALENCE_PHP_BACKEND %q has no socket path", raw)
+		}
+		b.network, b.address = "unix", u.Path
+	case "http", "https":
+		if u.Host == "" {
+			return nil, fmt.Errorf("VALENCE_PHP_BACKEND %q has no host", raw)
+		}
+		b.url = u
+	default:
+		return nil, fmt.Errorf("invalid VALENCE_PHP_BACKEND %q (want fastcgi://, fastcgi+unix:// or http(s)://)", raw)
+	}
+	if b.root != "" && !filepath.IsAbs(b.root) {
+		return nil, fmt.Errorf("VALENCE_PHP_BACKEND_ROOT must be absolute")
+	}
+	return b, nil
+}
+
+func (b *phpBackend) String() string {
+	if b.url != nil {
+		return b.url.String()
+	}
+	return b.network + ":" + b.address
+}
+
+// handler returns the handler that stands in for fallback.
+func (b *phpBackend) handler(fallback *frontControllerHandler) http.Handler {
+	h := &phpBackendHandler{frontControllerHandler: fallback, backend: b}
+	if b.url != nil {
+		h.proxy = &httputil.ReverseProxy{
+			Rewrite: func(pr *httputil.ProxyRequest) {
+				pr.SetURL(b.url)
+				pr.SetXForwarded()
+				pr.Out.Host = pr.In.Host
+			},
+			Transport: &http.Transport{
+				Proxy:                 http.ProxyFromEnvironment,
+				DialContext:           (&net.Dialer{Timeout: b.timeout}).DialContext,
+				TLSHandshakeTimeout:   b.timeout,
+				MaxIdleConnsPerHost:   32,
+				IdleConnTimeout:       90 * time.Second,
+				ExpectContinueTimeout: time.Second,
+			},
+			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+				logErrorf("php backend error for %s: %v", r.URL.Path, err)
+				http.Error(w, "php backend error", http.StatusBadGateway)
+			},
+		}
+	}
+	return h
+}
+
+// phpBackendHandler runs the front controller on a phpBackend. It shares
+// the embedded handler's site settings, upload spooling and environment.
+type phpBackendHandler struct {
+	*frontControllerHandler
+	backend *phpBackend
+	proxy   *httputil.ReverseProxy
+}
+
+func (h *phpBackendHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.uploads != nil {
+		spooled, cleanup, ok := h.uploads.prepare(w, r)
+		if !ok {
+			return
+		}
+		defer cleanup()
+		r = spooled
+	}
+
+	phpInFlight.Add(1)
+	defer phpInFlight.Add(-1)
+	defer phpStatus.begin(h.site, r)()
+	if h.proxy != nil {
+		h.proxy.ServeHTTP(w, r)
+		return
+	}
+	h.serveFastCGI(w, r)
+}
+
+func (h *phpBackendHandler) serveFastCGI(w http.ResponseWriter, r *http.Request) {
+	conn, err := (&net.Dialer{Timeout: h.backend.timeout}).DialContext(r.Context(), h.backend.network, h.backend.address)
+	if err != nil {
+		logErrorf("php backend unreachable for %s: %v", r.URL.Path, err)
+		http.Error(w, "php backend unavailable", http.StatusBadGateway)
+		return
+	}
+	defer conn.Close()
+	// A client that goes away stops the script's output being waited on.
+	stop := context.AfterFunc(r.Context(), func() { _ = conn.Close() })
+	defer stop()
+
+	rec := &statusRecorder{ResponseWriter: w}
+	var stderr strings.Builder
+	err = fastcgi.Do(conn, h.fastCGIParams(r), r.Body, rec, &stderr)
+	if msg := strings.TrimSpace(stderr.String()); msg != "" {
+		logWarnf("php backend stderr for %s: %s", r.URL.Path, msg)
+	}
+	if err == nil || errors.Is(r.Context().Err(), context.Canceled) {
+		return
+	}
+	logErrorf("php backend error for %s: %v", r.URL.Path, err)
+	if rec.status == 0 {
+		http.Error(w, "php backend error", http.StatusBadGateway)
+	}
+}
+
+// fastCGIParams describes r the way FrankenPHP does, with the front
+// controller's paths moved under the backend's root.
+func (h *phpBackendHandler) fastCGIParams(r *http.Request) map[string]string {
+	_, env := h.frontControllerRequest(r)
+	root := h.phpRoot
+	if h.backend.root != "" {
+		root = h.backend.root
+		if rel, err := filepath.Rel(h.phpRoot, h.frontController); err == nil && !strings.HasPrefix(rel, "..") {
+			env["SCRIPT_FILENAME"] = filepath.Join(root, rel)
+		}
+	}
+
+	scheme, https := "http", ""
+	if r.TLS != nil {
+		scheme, https = "https", "on"
+	}
+	host, port, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+		port = "80"
+		if r.TLS != nil {
+			port = "443"
+		}
+	}
+	remoteAddr, remotePort, _ := net.SplitHostPort(r.RemoteAddr)
+
+	params := map[string]string{
+		"GATEWAY_INTERFACE": "CGI/1.1",
+		"SERVER_SOFTWARE":   "valence",
+		"SERVER_PROTOCOL":   r.Proto,
+		"SERVER_NAME":       host,
+		"SERVER_PORT":       port,
+		"REQUEST_SCHEME":    scheme,
+		"HTTPS":             https,
+		"REMOTE_ADDR":       remoteAddr,
+		"REMOTE_HOST":       remoteAddr,
+		"REMOTE_PORT":       remotePort,
+		"REQUEST_METHOD":    r.Method,
+		"REQUEST_URI":       r.URL.RequestURI(),
+		"QUERY_STRING":      r.URL.RawQuery,
+		"DOCUMENT_ROOT":     root,
+		"DOCUMENT_URI":      "/index.php",
+		"PHP_SELF":          "/index.php",
+		"CONTENT_TYPE":      r.Header.Get("Content-Type"),
+		"CONTENT_LENGTH":    "",
+	}
+	if r.ContentLength > 0 {
+		params["CONTENT_LENGTH"] = strconv.FormatInt(r.ContentLength, 10)
+	}
+	for name, vals := range r.Header {
+		// Proxy would become HTTP_PROXY, which PHP clients read as their
+		// outbound proxy (httpoxy).
+		switch name {
+		case "Proxy", "Content-Type", "Content-Length":
+			continue
+		}
+		// X_Forwarded_For would map onto the same HTTP_X_FORWARDED_FOR as
+		// X-Forwarded-For and could override it, so drop underscored
+		// names as nginx does.
+		if strings.Contains(name, "_") {
+			continue
+		}
+		params["HTTP_"+strings.ToUpper(strings.ReplaceAll(name, "-", "_"))] = strings.Join(vals, ", ")
+	}
+	params["HTTP_HOST"] = r.Host
+	for key, value := range env {
+		params[key] = value
+	}
+	return params
+}
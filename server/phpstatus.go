@@ -0,0 +1,281 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dunglas/frankenphp"
+)
+
+// phpActivity tracks the requests inside the PHP runtime and the last
+// fatal errors it hit, for /v/php/status.
+type phpActivity struct {
+	mu     sync.Mutex
+	nextID uint64
+	active map[uint64]phpScript
+	fatals []phpFatal // newest last
+}
+
+// phpFatalsKept bounds the fatal errors phpActivity remembers.
+const phpFatalsKept = 20
+
+type phpScript struct {
+	Site      string    `json:"site,omitempty"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	StartedAt time.Time `json:"started_at"`
+	Elapsed   string    `json:"elapsed"`
+}
+
+type phpFatal struct {
+	Time    time.Time `json:"time"`
+	Site    string    `json:"site,omitempty"`
+	Method  string    `json:"method"`
+	Path    string    `json:"path"`
+	Message string    `json:"message"`
+}
+
+var phpStatus = &phpActivity{active: map[uint64]phpScript{}}
+
+// begin records r as running in PHP until end is called.
+func (a *phpActivity) begin(site string, r *http.Request) (end func()) {
+	a.mu.Lock()
+	a.nextID++
+	id := a.nextID
+	a.active[id] = phpScript{Site: site, Method: r.Method, Path: r.URL.Path, StartedAt: time.Now()}
+	a.mu.Unlock()
+	return func() {
+		a.mu.Lock()
+		delete(a.active, id)
+		a.mu.Unlock()
+	}
+}
+
+func (a *phpActivity) fatal(site string, r *http.Request, msg string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.fatals = append(a.fatals, phpFatal{Time: time.Now().UTC(), Site: site, Method: r.Method, Path: r.URL.Path, Message: msg})
+	if len(a.fatals) > phpFatalsKept {
+		a.fatals = a.fatals[len(a.fatals)-phpFatalsKept:]
+	}
+}
+
+// snapshot returns the running scripts, longest running first, and the
+// fatal errors, newest first.
+func (a *phpActivity) snapshot(now time.Time) ([]phpScript, []phpFatal) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	scripts := make([]phpScript, 0, len(a.active))
+	for _, script := range a.active {
+		script.Elapsed = now.Sub(script.StartedAt).Round(time.Millisecond).String()
+		scripts = append(scripts, script)
+	}
+	sort.Slice(scripts, func(i, j int) bool { return scripts[i].StartedAt.Before(scripts[j].StartedAt) })
+	fatals := make([]phpFatal, 0, len(a.fatals))
+	for i := len(a.fatals) - 1; i >= 0; i-- {
+		fatals = append(fatals, a.fatals[i])
+	}
+	return scripts, fatals
+}
+
+// opcacheStatus is the part of opcache_get_status() the status page shows.
+type opcacheStatus struct {
+	Enabled bool `json:"opcache_enabled"`
+	Memory  struct {
+		Used   int64 `json:"used_memory"`
+		Free   int64 `json:"free_memory"`
+		Wasted int64 `json:"wasted_memory"`
+	} `json:"memory_usage"`
+	Statistics struct {
+		CachedScripts int64   `json:"num_cached_scripts"`
+		Hits          int64   `json:"hits"`
+		Misses        int64   `json:"misses"`
+		HitRate       float64 `json:"opcache_hit_rate"`
+		OOMRestarts   int64   `json:"oom_restarts"`
+		HashRestarts  int64   `json:"hash_restarts"`
+		StartTime     int64   `json:"start_time"`
+	} `json:"opcache_statistics"`
+}
+
+// phpStatusScript reports opcache from inside the web runtime; the CLI
+// runtime valence uses for tasks has its own.
+const phpStatusScript = `<?php
+header('Content-Type: application/json');
+$status = function_exists('opcache_get_status') ? opcache_get_status(false) : false;
+echo json_encode(['opcache' => $status ?: null]);
+`
+
+// writePHPStatusScript writes phpStatusScript to its own document root and
+// returns the script's path. The directory is created fresh and private to
+// this process, so no other user can plant or swap the script.
+func writePHPStatusScript() (string, error) {
+	dir, err := os.MkdirTemp("", "valence-php-status-")
+	if err != nil {
+		return "", err
+	}
+	target := filepath.Join(dir, "status.php")
+	if err := os.WriteFile(target, []byte(phpStatusScript), 0o644); err != nil {
+		return "", err
+	}
+	return target, nil
+}
+
+// phpStatusScriptPath is set by initPHPRuntime.
+var phpStatusScriptPath string
+
+// readOpcacheStatus runs phpStatusScript on a PHP thread, waiting at most
+// a few seconds for one to free up.
+func readOpcacheStatus(ctx context.Context) (*opcacheStatus, error) {
+	if phpStatusScriptPath == "" {
+		return nil, fmt.Errorf("php runtime not started")
+	}
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "/status.php", nil)
+	if err != nil {
+		return nil, err
+	}
+	phpReq, err := frankenphp.NewRequestWithContext(req,
+		frankenphp.WithRequestDocumentRoot(filepath.Dir(phpStatusScriptPath), false),
+		frankenphp.WithRequestEnv(map[string]string{"SCRIPT_FILENAME": phpStatusScriptPath, "SCRIPT_NAME": "/status.php"}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	release, ok := phpThreads.acquire(ctx)
+	if !ok {
+		return nil, fmt.Errorf("no PHP thread free")
+	}
+	defer release()
+	w := &bufferedResponse{header: http.Header{}}
+	if err := frankenphp.ServeHTTP(w, phpReq); err != nil {
+		return nil, err
+	}
+	var body struct {
+		Opcache *opcacheStatus `json:"opcache"`
+	}
+	if err := json.Unmarshal(w.body.Bytes(), &body); err != nil {
+		return nil, fmt.Errorf("decode status script output: %w", err)
+	}
+	return body.Opcache, nil
+}
+
+// bufferedResponse keeps a response in memory.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header { return b.header }
+
+func (b *bufferedResponse) WriteHeader(code int) {
+	if b.status == 0 {
+		b.status = code
+	}
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	return b.body.Write(p)
+}
+
+type phpStatusReport struct {
+	StartedAt    time.Time      `json:"started_at"`
+	PHPVersion   string         `json:"php_version"`
+	Threads      int            `json:"threads"`
+	BusyThreads  int            `json:"busy_threads"`
+	IdleThreads  int            `json:"idle_threads"`
+	Queued       int64          `json:"queued"`
+	Active       []phpScript    `json:"active"`
+	Opcache      *opcacheStatus `json:"opcache"`
+	OpcacheError string         `json:"opcache_error,omitempty"`
+	RecentFatals []phpFatal     `json:"recent_fatals"`
+}
+
+// phpStatusHandler serves /v/php/status, like PHP-FPM's status page: as
+// text by default, as JSON with ?json, ?format=json or an Accept header
+// asking for it.
+func phpStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizeInternalAPI(w, r) {
+		return
+	}
+
+	now := time.Now()
+	report := phpStatusReport{
+		StartedAt:  processStart.UTC(),
+		PHPVersion: frankenphp.Config().Version.Version,
+	}
+	if phpThreads != nil {
+		report.Threads = phpThreads.size()
+		report.BusyThreads = phpThreads.busy()
+		report.IdleThreads = report.Threads - report.BusyThreads
+		report.Queued = max(phpInFlight.Load()-int64(report.BusyThreads), 0)
+	}
+	report.Active, report.RecentFatals = phpStatus.snapshot(now)
+	opcache, err := readOpcacheStatus(r.Context())
+	if err != nil {
+		report.OpcacheError = err.Error()
+	}
+	report.Opcache = opcache
+
+	w.Header().Set("Cache-Control", "no-store")
+	query := r.URL.Query()
+	if query.Has("json") || query.Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(report)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	writePHPStatusText(w, report, now)
+}
+
+func writePHPStatusText(w http.ResponseWriter, report phpStatusReport, now time.Time) {
+	fmt.Fprintf(w, "start time:           %s\n", report.StartedAt.Format(time.RFC3339))
+	fmt.Fprintf(w, "start since:          %d\n", int64(now.Sub(report.StartedAt).Seconds()))
+	fmt.Fprintf(w, "php version:          %s\n", report.PHPVersion)
+	fmt.Fprintf(w, "threads:              %d\n", report.Threads)
+	fmt.Fprintf(w, "busy threads:         %d\n", report.BusyThreads)
+	fmt.Fprintf(w, "idle threads:         %d\n", report.IdleThreads)
+	fmt.Fprintf(w, "queued requests:      %d\n", report.Queued)
+	switch {
+	case report.Opcache != nil:
+		o := report.Opcache
+		fmt.Fprintf(w, "opcache enabled:      %t\n", o.Enabled)
+		fmt.Fprintf(w, "opcache memory:       %d used, %d free, %d wasted\n", o.Memory.Used, o.Memory.Free, o.Memory.Wasted)
+		fmt.Fprintf(w, "opcache scripts:      %d\n", o.Statistics.CachedScripts)
+		fmt.Fprintf(w, "opcache hits:         %d (%.2f%%)\n", o.Statistics.Hits, o.Statistics.HitRate)
+		fmt.Fprintf(w, "opcache misses:       %d\n", o.Statistics.Misses)
+		fmt.Fprintf(w, "opcache restarts:     %d oom, %d hash\n", o.Statistics.OOMRestarts, o.Statistics.HashRestarts)
+	case report.OpcacheError != "":
+		fmt.Fprintf(w, "opcache:              unavailable (%s)\n", report.OpcacheError)
+	default:
+		fmt.Fprintf(w, "opcache:              not loaded\n")
+	}
+
+	fmt.Fprintf(w, "\nactive scripts (%d):\n", len(report.Active))
+	for _, script := range report.Active {
+		site := script.Site
+		if site == "" {
+			site = "-"
+		}
+		fmt.Fprintf(w, "  %10s  %-8s %-12s %s\n", script.Elapsed, script.Method, site, script.Path)
+	}
+	fmt.Fprintf(w, "\nrecent fatal errors (%d):\n", len(report.RecentFatals))
+	for _, fatal := range report.RecentFatals {
+		fmt.Fprintf(w, "  %s  %s %s\n    %s\n", fatal.Time.Format(time.RFC3339), fatal.Method, fatal.Path, fatal.Message)
+	}
+}
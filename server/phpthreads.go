@@ -0,0 +1,254 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// phpThreadPool admits requests to the PHP runtime one per thread, so
+// valence knows how busy PHP is and how long requests queue for it. With
+// VALENCE_PHP_MAX_WAIT set, a request that waits longer is answered 503
+// instead of piling up behind a saturated runtime. PHP runs in classic
+// mode, where threads are not restarted; supervised Go tasks report their
+// restarts in valence_supervised_restarts_total.
+//
+// VALENCE_PHP_THREADS threads (default two per CPU) start with PHP. With
+// VALENCE_PHP_MAX_THREADS above that, the pool scales between the two:
+// every VALENCE_PHP_SCALE_INTERVAL (default 5s) it grows by a quarter when
+// requests waited VALENCE_PHP_SCALE_UP_WAIT (default 100ms) on average,
+// unless the process already uses VALENCE_PHP_SCALE_MAX_CPU percent of its
+// CPUs (default 80), where more threads would only contend; and it drops a
+// thread each interval once fewer than half were busy for
+// VALENCE_PHP_SCALE_DOWN_AFTER (default 5m). FrankenPHP starts and stops
+// threads to match.
+type phpThreadPool struct {
+	// slots holds a token per busy thread, plus one per thread the pool
+	// may not use at its current size.
+	slots   chan struct{}
+	maxWait time.Duration
+
+	min       int
+	limit     atomic.Int64
+	waitNanos atomic.Int64
+	waits     atomic.Int64
+	peakBusy  atomic.Int64
+}
+
+// phpThreads is set by initPHPRuntime.
+var phpThreads *phpThreadPool
+
+func newPHPThreadPool() *phpThreadPool {
+	threads := max(envInt("VALENCE_PHP_THREADS", 2*runtime.NumCPU()), 1)
+	maxThreads := max(envInt("VALENCE_PHP_MAX_THREADS", threads), threads)
+	phpThreadsByState.WithLabelValues("busy").Set(0)
+	phpThreadsByState.WithLabelValues("idle").Set(float64(threads))
+	phpThreadLimit.Set(float64(threads))
+	p := &phpThreadPool{
+		slots:   make(chan struct{}, maxThreads),
+		maxWait: envDuration("VALENCE_PHP_MAX_WAIT", 0),
+		min:     threads,
+	}
+	p.limit.Store(int64(threads))
+	for range maxThreads - threads {
+		p.slots <- struct{}{}
+	}
+	return p
+}
+
+// size is the number of threads the pool uses now.
+func (p *phpThreadPool) size() int {
+	return int(p.limit.Load())
+}
+
+// maxSize is the most threads the pool scales to.
+func (p *phpThreadPool) maxSize() int {
+	return cap(p.slots)
+}
+
+func (p *phpThreadPool) autoscaling() bool {
+	return p.maxSize() > p.min
+}
+
+// busy is the number of threads running a request.
+func (p *phpThreadPool) busy() int {
+	return max(len(p.slots)-(p.maxSize()-p.size()), 0)
+}
+
+// acquire waits for a free thread. It returns false when the wait hits
+// VALENCE_PHP_MAX_WAIT or the client goes away; otherwise release must be
+// called once PHP is done.
+func (p *phpThreadPool) acquire(ctx context.Context) (release func(), ok bool) {
+	start := time.Now()
+	select {
+	case p.slots <- struct{}{}:
+	default:
+		phpQueueDepth.Inc()
+		ok = p.wait(ctx)
+		phpQueueDepth.Dec()
+		if !ok {
+			// A request given up on waited too, as far as scaling goes.
+			p.waitNanos.Add(int64(time.Since(start)))
+			p.waits.Add(1)
+			return nil, false
+		}
+	}
+	waited := time.Since(start)
+	phpQueueWait.Observe(waited.Seconds())
+	p.waitNanos.Add(int64(waited))
+	p.waits.Add(1)
+	for busy := int64(p.busy()); ; {
+		peak := p.peakBusy.Load()
+		if busy <= peak || p.peakBusy.CompareAndSwap(peak, busy) {
+			break
+		}
+	}
+	phpThreadsByState.WithLabelValues("busy").Inc()
+	phpThreadsByState.WithLabelValues("idle").Dec()
+	return func() {
+		phpThreadsByState.WithLabelValues("busy").Dec()
+		phpThreadsByState.WithLabelValues("idle").Inc()
+		<-p.slots
+	}, true
+}
+
+func (p *phpThreadPool) wait(ctx context.Context) bool {
+	var timeout <-chan time.Time
+	if p.maxWait > 0 {
+		timer := time.NewTimer(p.maxWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case p.slots <- struct{}{}:
+		return true
+	case <-timeout:
+		phpSaturationRejections.Inc()
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// resize moves the pool's size by delta threads, within its bounds, and
+// returns by how many it moved. Growing hands spare tokens back; shrinking
+// takes free slots, so it never waits for a busy thread.
+func (p *phpThreadPool) resize(delta int) int {
+	moved := 0
+	for ; delta > 0 && p.size() < p.maxSize(); delta-- {
+		<-p.slots
+		p.limit.Add(1)
+		moved++
+	}
+	for ; delta < 0 && p.size() > p.min; delta++ {
+		select {
+		case p.slots <- struct{}{}:
+		default:
+			delta = 0
+			continue
+		}
+		p.limit.Add(-1)
+		moved--
+	}
+	if moved != 0 {
+		phpThreadsByState.WithLabelValues("idle").Add(float64(moved))
+		phpThreadLimit.Set(float64(p.size()))
+	}
+	return moved
+}
+
+// phpScaler decides how the pool's size follows the load.
+type phpScaler struct {
+	interval  time.Duration
+	upWait    time.Duration
+	maxCPU    float64
+	downAfter time.Duration
+
+	lastCPU  time.Duration
+	lastTick time.Time
+	lowSince time.Time
+}
+
+func phpScalerFromEnv() (*phpScaler, error) {
+	s := &phpScaler{
+		interval:  envDuration("VALENCE_PHP_SCALE_INTERVAL", 5*time.Second),
+		upWait:    envDuration("VALENCE_PHP_SCALE_UP_WAIT", 100*time.Millisecond),
+		maxCPU:    float64(envInt("VALENCE_PHP_SCALE_MAX_CPU", 80)) / 100,
+		downAfter: envDuration("VALENCE_PHP_SCALE_DOWN_AFTER", 5*time.Minute),
+	}
+	if s.interval <= 0 {
+		return nil, fmt.Errorf("VALENCE_PHP_SCALE_INTERVAL must be positive")
+	}
+	if s.maxCPU <= 0 {
+		return nil, fmt.Errorf("VALENCE_PHP_SCALE_MAX_CPU must be positive")
+	}
+	return s, nil
+}
+
+// autoscale resizes the pool every interval until ctx is done.
+func (p *phpThreadPool) autoscale(ctx context.Context, s *phpScaler) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	s.lastCPU, s.lastTick = processCPUTime(), time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			p.scale(s, now)
+		}
+	}
+}
+
+// scale takes one scaling decision from the load since the last.
+func (p *phpThreadPool) scale(s *phpScaler, now time.Time) {
+	waits, waited, peak := p.waits.Swap(0), time.Duration(p.waitNanos.Swap(0)), int(p.peakBusy.Swap(int64(p.busy())))
+	cpuTime := processCPUTime()
+	cpu := float64(cpuTime-s.lastCPU) / float64(now.Sub(s.lastTick)) / float64(runtime.GOMAXPROCS(0))
+	s.lastCPU, s.lastTick = cpuTime, now
+	var avgWait time.Duration
+	if waits > 0 {
+		avgWait = waited / time.Duration(waits)
+	}
+
+	size := p.size()
+	switch {
+	case avgWait >= s.upWait && size < p.maxSize():
+		s.lowSince = time.Time{}
+		if cpu >= s.maxCPU {
+			phpScalingDecisions.WithLabelValues("held_cpu").Inc()
+			logDebugf("php threads: held at %d, wait %s but cpu %.0f%%", size, avgWait, cpu*100)
+			return
+		}
+		if moved := p.resize(max(size/4, 1)); moved > 0 {
+			phpScalingDecisions.WithLabelValues("up").Inc()
+			logInfof("php threads: %d -> %d (wait %s, cpu %.0f%%)", size, size+moved, avgWait.Round(time.Millisecond), cpu*100)
+		}
+	case avgWait < s.upWait && peak < size/2 && size > p.min:
+		if s.lowSince.IsZero() {
+			s.lowSince = now
+		}
+		if now.Sub(s.lowSince) < s.downAfter {
+			return
+		}
+		if moved := p.resize(-1); moved < 0 {
+			phpScalingDecisions.WithLabelValues("down").Inc()
+			logInfof("php threads: %d -> %d (peak busy %d)", size, size+moved, peak)
+		}
+	default:
+		s.lowSince = time.Time{}
+	}
+}
+
+// processCPUTime returns the CPU time the process has used, PHP threads
+// included.
+func processCPUTime() time.Duration {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return 0
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
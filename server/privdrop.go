@@ -0,0 +1,140 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// VALENCE_USER lets a bare-metal install start valence as root, to bind
+// ports below 1024, and run as an unprivileged user, named or given as
+// uid[:gid]. valence binds its listener and then switches user before any
+// site starts, so the symfony cache, uploads and logs are created by that
+// user, and stops if the dirs it writes are not writable by it. The atom
+// root is extracted for the user too, unless VALENCE_EXTRACT_OWNER says
+// otherwise.
+type runAsUser struct {
+	spec   string
+	uid    int
+	gid    int
+	groups []int
+}
+
+var uidGIDRe = regexp.MustCompile(`^(\d+)(?::(\d+))?$`)
+
+// runAsUserFromEnv returns nil when VALENCE_USER is not set.
+func runAsUserFromEnv() (*runAsUser, error) {
+	spec := strings.TrimSpace(os.Getenv("VALENCE_USER"))
+	if spec == "" {
+		return nil, nil
+	}
+	u := &runAsUser{spec: spec}
+	var account *user.User
+	var err error
+	if m := uidGIDRe.FindStringSubmatch(spec); m != nil {
+		u.uid, _ = strconv.Atoi(m[1])
+		u.gid = u.uid
+		if m[2] != "" {
+			u.gid, _ = strconv.Atoi(m[2])
+		} else if account, err = user.LookupId(m[1]); err == nil {
+			u.gid, _ = strconv.Atoi(account.Gid)
+		}
+	} else {
+		if account, err = user.Lookup(spec); err != nil {
+			return nil, fmt.Errorf("VALENCE_USER: %w", err)
+		}
+		u.uid, _ = strconv.Atoi(account.Uid)
+		u.gid, _ = strconv.Atoi(account.Gid)
+	}
+	u.groups = []int{u.gid}
+	if account != nil {
+		if ids, err := account.GroupIds(); err == nil {
+			for _, id := range ids {
+				if gid, err := strconv.Atoi(id); err == nil && gid != u.gid {
+					u.groups = append(u.groups, gid)
+				}
+			}
+		}
+	}
+	if u.uid == 0 {
+		return nil, errors.New("VALENCE_USER must not be root")
+	}
+	return u, nil
+}
+
+// drop switches the process to the user. Started as that user already,
+// there is nothing to do.
+func (u *runAsUser) drop() error {
+	switch euid := os.Geteuid(); {
+	case euid == u.uid:
+		return nil
+	case euid != 0:
+		return fmt.Errorf("VALENCE_USER=%s needs valence to start as root or as that user", u.spec)
+	}
+	if err := syscall.Setgroups(u.groups); err != nil {
+		return fmt.Errorf("setgroups: %w", err)
+	}
+	if err := syscall.Setgid(u.gid); err != nil {
+		return fmt.Errorf("setgid %d: %w", u.gid, err)
+	}
+	if err := syscall.Setuid(u.uid); err != nil {
+		return fmt.Errorf("setuid %d: %w", u.uid, err)
+	}
+	logInfof("running as uid %d, gid %d", u.uid, u.gid)
+	return nil
+}
+
+// chown hands a file opened before dropping, such as VALENCE_LOG_FILE,
+// to the user so it can still rotate it.
+func (u *runAsUser) chown(path string) error {
+	if os.Geteuid() != 0 {
+		return nil
+	}
+	return os.Chown(path, u.uid, u.gid)
+}
+
+// unwritableDirs returns the dirs a file cannot be created in, trying
+// each one that exists.
+func unwritableDirs(dirs []string) []string {
+	var failed []string
+	seen := map[string]bool{}
+	for _, dir := range dirs {
+		if dir == "" || seen[dir] {
+			continue
+		}
+		seen[dir] = true
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			continue
+		}
+		f, err := os.CreateTemp(dir, ".valence-write-check-*")
+		if err != nil {
+			failed = append(failed, dir)
+			continue
+		}
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}
+	return failed
+}
+
+// writableDirs lists what a site's PHP and valence write to.
+func writableDirs(cfg config) []string {
+	dataDir := cfg.atomDataDir
+	if dataDir == "" {
+		dataDir = cfg.phpRoot
+	}
+	return []string{
+		dataDir,
+		filepath.Join(dataDir, "uploads"),
+		filepath.Join(dataDir, "downloads"),
+		filepath.Join(dataDir, "tmp"),
+		filepath.Join(cfg.phpRoot, "cache"),
+		filepath.Join(cfg.phpRoot, "log"),
+	}
+}
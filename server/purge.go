@@ -0,0 +1,35 @@
+package server
+
+import (
+	"errors"
+)
+
+// purgeArgs picks the tools:purge options for this boot, or none when the
+// database is already installed: tools:purge drops every table, so it only
+// ever runs to install an empty database. That install loads demo content
+// (site title and the demo/demo administrator) when VALENCE_LOAD_DEMO_DATA
+// is set, and otherwise takes the administrator from ATOM_ADMIN_*.
+func purgeArgs(installed bool, admin adminAccount, haveAdmin bool) ([]string, error) {
+	if installed {
+		if envBool("VALENCE_LOAD_DEMO_DATA", false) {
+			logWarnf("VALENCE_LOAD_DEMO_DATA ignored: database already installed")
+		}
+		return nil, nil
+	}
+	if envBool("VALENCE_LOAD_DEMO_DATA", false) {
+		logInfof("loading demo data into empty database")
+		return []string{"--demo"}, nil
+	}
+	if !haveAdmin {
+		return nil, errors.New("installing an empty database needs ATOM_ADMIN_USERNAME, ATOM_ADMIN_EMAIL and ATOM_ADMIN_PASSWORD (or VALENCE_LOAD_DEMO_DATA=true)")
+	}
+	return []string{
+		"--no-confirmation",
+		"--title=" + envOrDefault("ATOM_SITE_TITLE", "AtoM"),
+		"--description=" + envOrDefault("ATOM_SITE_DESCRIPTION", ""),
+		"--url=" + envOrDefault("ATOM_SITE_BASE_URL", "http://127.0.0.1"),
+		"--username=" + admin.username,
+		"--email=" + admin.email,
+		"--password=" + admin.password,
+	}, nil
+}
@@ -0,0 +1,250 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// edgeRedirects sends clients to the one URL AtoM should see before any
+// routing happens: plain HTTP to HTTPS with VALENCE_REDIRECT_HTTPS, and
+// alias hosts to their canonical host. Aliases are VALENCE_REDIRECT_HOSTS,
+// which go to VALENCE_CANONICAL_HOST, and each manifest site's
+// redirect_hosts, which go to the site's first host. Behind a proxy the
+// scheme and host the client used come from X-Forwarded-Proto and
+// X-Forwarded-Host (or Forwarded), but only when the proxy's address is in
+// VALENCE_TRUSTED_PROXIES; with that set, the headers are dropped from
+// everyone else so PHP cannot be fooled by them either.
+type edgeRedirects struct {
+	https   bool
+	aliases map[string]string
+	trusted []netip.Prefix
+}
+
+// edgeExemptPaths answer on whatever scheme and host they are reached by,
+// so health checks, scrapers, ACME and internal callers keep working.
+var edgeExemptPaths = []string{"/health", "/metrics", "/v/", "/.well-known/acme-challenge/"}
+
+// forwardedHeaders are dropped from requests that do not come through a
+// trusted proxy.
+var forwardedHeaders = []string{"Forwarded", "X-Forwarded-Proto", "X-Forwarded-Host", "X-Forwarded-Port"}
+
+// edgeRedirectsFromEnv returns nil when there is nothing to do.
+func edgeRedirectsFromEnv(sites []*site) (*edgeRedirects, error) {
+	e := &edgeRedirects{
+		https:   envBool("VALENCE_REDIRECT_HTTPS", false),
+		aliases: map[string]string{},
+	}
+
+	canonical := normalizeHost(os.Getenv("VALENCE_CANONICAL_HOST"))
+	for _, alias := range strings.Split(os.Getenv("VALENCE_REDIRECT_HOSTS"), ",") {
+		if alias = normalizeHost(alias); alias == "" {
+			continue
+		}
+		if canonical == "" {
+			return nil, fmt.Errorf("VALENCE_REDIRECT_HOSTS needs VALENCE_CANONICAL_HOST")
+		}
+		e.aliases[alias] = canonical
+	}
+	for _, s := range sites {
+		for _, alias := range s.redirectHosts {
+			e.aliases[alias] = s.hosts[0]
+		}
+	}
+	for alias, target := range e.aliases {
+		if alias == target {
+			return nil, fmt.Errorf("%s redirects to itself", alias)
+		}
+	}
+
+	trusted, err := trustedProxiesFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	e.trusted = trusted
+
+	if !e.https && len(e.aliases) == 0 && len(e.trusted) == 0 {
+		return nil, nil
+	}
+	return e, nil
+}
+
+func (e *edgeRedirects) wrap(next http.Handler) http.Handler {
+	if e == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scheme, host := e.clientView(r)
+		for _, prefix := range edgeExemptPaths {
+			if r.URL.Path == strings.TrimSuffix(prefix, "/") || strings.HasPrefix(r.URL.Path, prefix) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		target := url.URL{Scheme: scheme, Host: host, Path: r.URL.Path, RawPath: r.URL.RawPath, RawQuery: r.URL.RawQuery}
+		decision := ""
+		if canonical, ok := e.aliases[normalizeHost(host)]; ok {
+			target.Host = canonical
+			decision = "redirect_canonical_host"
+		}
+		if e.https && scheme != "https" {
+			target.Scheme = "https"
+			if decision == "" {
+				// The plain HTTP port says nothing about the HTTPS one.
+				target.Host = hostWithoutPort(host)
+				decision = "redirect_https"
+			}
+		}
+		if decision == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// 308 keeps the method and body of anything but GET and HEAD.
+		status := http.StatusMovedPermanently
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			status = http.StatusPermanentRedirect
+		}
+		logRouteDecision(r, "-", decision, status, 0)
+		http.Redirect(w, r, target.String(), status)
+	})
+}
+
+// clientView returns the scheme and host the client asked for. It drops
+// forwarded headers from untrusted peers.
+func (e *edgeRedirects) clientView(r *http.Request) (scheme, host string) {
+	scheme, host = "http", r.Host
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if len(e.trusted) == 0 {
+		return scheme, host
+	}
+	if !e.fromTrustedProxy(r) {
+		for _, name := range forwardedHeaders {
+			r.Header.Del(name)
+		}
+		return scheme, host
+	}
+
+	if proto, fwdHost := parseForwarded(r.Header.Get("Forwarded")); proto != "" || fwdHost != "" {
+		if proto != "" {
+			scheme = strings.ToLower(proto)
+		}
+		if fwdHost != "" {
+			host = fwdHost
+		}
+		return scheme, host
+	}
+	if proto := firstListValue(r.Header.Get("X-Forwarded-Proto")); proto != "" {
+		scheme = strings.ToLower(proto)
+	}
+	if fwdHost := firstListValue(r.Header.Get("X-Forwarded-Host")); fwdHost != "" {
+		host = fwdHost
+	}
+	return scheme, host
+}
+
+func (e *edgeRedirects) fromTrustedProxy(r *http.Request) bool {
+	peer, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	return trustedAddr(e.trusted, peer.Addr())
+}
+
+// trustedProxiesFromEnv parses VALENCE_TRUSTED_PROXIES, addresses and
+// CIDRs separated by commas.
+func trustedProxiesFromEnv() ([]netip.Prefix, error) {
+	var trusted []netip.Prefix
+	for _, entry := range strings.Split(os.Getenv("VALENCE_TRUSTED_PROXIES"), ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(entry)
+			if addrErr != nil {
+				return nil, fmt.Errorf("VALENCE_TRUSTED_PROXIES: invalid address or CIDR %q", entry)
+			}
+			prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+		}
+		trusted = append(trusted, prefix.Masked())
+	}
+	return trusted, nil
+}
+
+func trustedAddr(trusted []netip.Prefix, addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseForwarded returns the proto and host of the first element of an
+// RFC 7239 Forwarded header, the one the client-facing proxy added.
+func parseForwarded(val string) (proto, host string) {
+	first, _, _ := strings.Cut(val, ",")
+	for _, pair := range strings.Split(first, ";") {
+		key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			continue
+		}
+		value = strings.Trim(value, `"`)
+		switch strings.ToLower(key) {
+		case "proto":
+			proto = value
+		case "host":
+			host = value
+		}
+	}
+	return proto, host
+}
+
+func firstListValue(val string) string {
+	first, _, _ := strings.Cut(val, ",")
+	return strings.TrimSpace(first)
+}
+
+func hostWithoutPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		if strings.Contains(h, ":") {
+			return "[" + h + "]"
+		}
+		return h
+	}
+	return host
+}
+
+// forwardedClientIP returns the peer's address, or behind trusted proxies
+// the rightmost X-Forwarded-For address that is not one of them.
+func forwardedClientIP(r *http.Request, trusted []netip.Prefix) string {
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peer = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(peer)
+	if err != nil || !trustedAddr(trusted, addr) {
+		return peer
+	}
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		addr = hop
+		if !trustedAddr(trusted, hop) {
+			break
+		}
+	}
+	return addr.Unmap().String()
+}
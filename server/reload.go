@@ -0,0 +1,176 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/artefactual-labs/valence/internal/bootstrap"
+	"github.com/artefactual-labs/valence/internal/secrets"
+)
+
+// atomReloader switches the running process to a new atom root, on
+// SIGUSR1 or POST /v/atom/reload: it fetches or extracts the archive
+// again, as at startup, rewrites each site's config against the new root,
+// clears its symfony cache and swaps in handlers serving from it. PHP runs
+// in classic mode with the document root set per request, so there are no
+// workers to restart and opcache compiles the new root's paths afresh.
+// Requests already in flight finish against the old root, which is kept
+// as a previous version; that is why reloading needs
+// VALENCE_ATOM_VERSIONS_DIR rather than one directory extracted in place.
+type atomReloader struct {
+	sites    []*site
+	provider secrets.Provider
+	tasks    *scheduler
+
+	mu   sync.Mutex
+	root atomic.Value // string
+}
+
+func newAtomReloader(root string, sites []*site, provider secrets.Provider, tasks *scheduler) *atomReloader {
+	rl := &atomReloader{sites: sites, provider: provider, tasks: tasks}
+	rl.root.Store(root)
+	return rl
+}
+
+// currentRoot is the atom root new requests are served from.
+func (rl *atomReloader) currentRoot() string {
+	return rl.root.Load().(string)
+}
+
+// reload resolves the atom root again and, when it changed, moves every
+// site to it. A site failing to prepare leaves all of them on the old one.
+func (rl *atomReloader) reload(ctx context.Context) (string, bool, error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if atomVersionsDir() == "" {
+		return "", false, errors.New("VALENCE_ATOM_VERSIONS_DIR is required to reload the atom root")
+	}
+	root, err := resolveAtomRoot()
+	if err != nil {
+		return "", false, err
+	}
+	if root == rl.currentRoot() {
+		return root, false, nil
+	}
+	frontController := filepath.Join(root, "index.php")
+	if info, err := os.Stat(frontController); err != nil || info.IsDir() {
+		return "", false, fmt.Errorf("front controller not found at %s", frontController)
+	}
+
+	// Symfony runs from the process's working directory and environment,
+	// which scheduled tasks and site startup also borrow.
+	rl.tasks.runMu.Lock()
+	defer rl.tasks.runMu.Unlock()
+	siteStartMu.Lock()
+	defer siteStartMu.Unlock()
+
+	prepared := make(map[*site]bool, len(rl.sites))
+	for _, s := range rl.sites {
+		if !s.ready.Load() {
+			continue
+		}
+		err := withSiteEnv(s.env, func() error {
+			bcfg, err := bootstrap.LoadConfig(ctx, root, rl.provider)
+			if err != nil {
+				return fmt.Errorf("bootstrap config error: %w", err)
+			}
+			if _, err := bootstrap.Apply(bcfg); err != nil {
+				return fmt.Errorf("bootstrap error: %w", err)
+			}
+			if err := runSymfonyCacheClear(root); err != nil {
+				return fmt.Errorf("symfony cache clear failed: %w", err)
+			}
+			prepared[s] = true
+			return nil
+		})
+		if err != nil {
+			if s.name != "" {
+				err = fmt.Errorf("site %s: %w", s.name, err)
+			}
+			return "", false, err
+		}
+	}
+
+	for _, s := range rl.sites {
+		s.cfg.phpRoot = root
+		s.cfg.frontController = frontController
+		if prepared[s] {
+			s.handler.Store(newAtomHandler(s.cfg, s.name, s.monitor, s.storage, s.rewrites))
+		}
+	}
+	rl.tasks.root = root
+	rl.root.Store(root)
+	return root, true, nil
+}
+
+// watchSignals reloads on every SIGUSR1 until ctx is done.
+func (rl *atomReloader) watchSignals(ctx context.Context) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR1)
+	defer signal.Stop(sig)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sig:
+			rl.logReload(ctx, "SIGUSR1")
+		}
+	}
+}
+
+func (rl *atomReloader) logReload(ctx context.Context, trigger string) (string, bool, error) {
+	logInfof("atom reload requested by %s", trigger)
+	root, changed, err := rl.reload(ctx)
+	switch {
+	case err != nil:
+		logErrorf("atom reload failed, still serving %s: %v", rl.currentRoot(), err)
+		reporter.report("reload", "error", "reload", err.Error(), nil, map[string]any{"trigger": trigger})
+	case changed:
+		logInfof("atom reloaded, now serving %s", root)
+	default:
+		logInfof("atom reload: %s is already served", root)
+	}
+	return root, changed, err
+}
+
+type atomReloadResponse struct {
+	Root    string `json:"root"`
+	Changed bool   `json:"changed"`
+}
+
+// atomReloadHandler serves POST /v/atom/reload.
+func atomReloadHandler(rl *atomReloader) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !authorizeInternalAPI(w, r) {
+			return
+		}
+		if !internalAPIConfigured() {
+			http.Error(w, "internal api token not configured", http.StatusForbidden)
+			return
+		}
+
+		root, changed, err := rl.logReload(context.WithoutCancel(r.Context()), "api")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		_ = json.NewEncoder(w).Encode(atomReloadResponse{Root: root, Changed: changed})
+	}
+}
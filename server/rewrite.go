@@ -0,0 +1,174 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// rewriteRules are a site's own redirects and rewrites, read from the JSON
+// file VALENCE_REWRITE_RULES_FILE names, so legacy URLs can be kept alive
+// without code changes. They run on the cleaned path before valence's
+// built-in rewrites and decideRoute. Exact rules are looked up first, which
+// keeps thousands of them cheap; prefix and regex rules follow in file
+// order, and the first match wins. A redirect answers at once; a rewrite
+// changes the path (and the query, when to has one) and routing carries on
+// with it.
+//
+//	{"rules": [
+//	  {"match": "exact", "from": "/old/page", "to": "/new-page", "action": "redirect"},
+//	  {"match": "prefix", "from": "/legacy/", "to": "/", "action": "rewrite"},
+//	  {"match": "regex", "from": "^/item/([0-9]+)$", "to": "/index.php/item-$1", "action": "redirect", "status": 302}
+//	]}
+type rewriteRules struct {
+	exact   map[string]rewriteRule
+	ordered []rewriteRule
+}
+
+type rewriteRuleFile struct {
+	Rules []rewriteRule `json:"rules"`
+}
+
+type rewriteRule struct {
+	// Match is exact, prefix or regex. A prefix rule appends the rest of
+	// the path to To; a regex rule expands $1, ${name}... in To.
+	Match string `json:"match"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+	// Action is redirect or rewrite. Redirects may go to another host.
+	Action string `json:"action"`
+	// Status is 301 (the default) or 302 for redirects.
+	Status int `json:"status,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// rewriteRulesFromEnv returns nil when no file is set.
+func rewriteRulesFromEnv() (*rewriteRules, error) {
+	path := strings.TrimSpace(os.Getenv("VALENCE_REWRITE_RULES_FILE"))
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file rewriteRuleFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	rules := &rewriteRules{exact: map[string]rewriteRule{}}
+	for i, rule := range file.Rules {
+		if err := rule.validate(); err != nil {
+			return nil, fmt.Errorf("%s: rule %d (%s): %w", path, i+1, rule.From, err)
+		}
+		if rule.Match == "exact" {
+			// Paths are matched cleaned, without a trailing slash.
+			rule.From = cleanPath(rule.From)
+			if _, ok := rules.exact[rule.From]; ok {
+				return nil, fmt.Errorf("%s: rule %d: %s is listed twice", path, i+1, rule.From)
+			}
+			rules.exact[rule.From] = rule
+			continue
+		}
+		if rule.Match == "regex" {
+			rule.re, err = regexp.Compile(rule.From)
+			if err != nil {
+				return nil, fmt.Errorf("%s: rule %d: %w", path, i+1, err)
+			}
+		}
+		rules.ordered = append(rules.ordered, rule)
+	}
+	logInfof("rewrite rules: %d exact, %d prefix or regex from %s", len(rules.exact), len(rules.ordered), path)
+	return rules, nil
+}
+
+func (rule *rewriteRule) validate() error {
+	switch rule.Match {
+	case "exact", "prefix", "regex":
+	default:
+		return fmt.Errorf("match must be exact, prefix or regex, not %q", rule.Match)
+	}
+	if rule.Match != "regex" && !strings.HasPrefix(rule.From, "/") {
+		return errors.New("from must start with /")
+	}
+	if rule.To == "" {
+		return errors.New("to is empty")
+	}
+	switch rule.Action {
+	case "redirect":
+		if rule.Status == 0 {
+			rule.Status = http.StatusMovedPermanently
+		}
+		if rule.Status != http.StatusMovedPermanently && rule.Status != http.StatusFound {
+			return fmt.Errorf("status must be 301 or 302, not %d", rule.Status)
+		}
+	case "rewrite":
+		if !strings.HasPrefix(rule.To, "/") {
+			return errors.New("a rewrite must go to a path starting with /")
+		}
+		if rule.Status != 0 {
+			return errors.New("status only applies to redirects")
+		}
+	default:
+		return fmt.Errorf("action must be redirect or rewrite, not %q", rule.Action)
+	}
+	return nil
+}
+
+// lookup returns the first rule matching reqPath and where it leads.
+func (rr *rewriteRules) lookup(reqPath string) (rewriteRule, string, bool) {
+	if rr == nil {
+		return rewriteRule{}, "", false
+	}
+	if rule, ok := rr.exact[reqPath]; ok {
+		return rule, rule.To, true
+	}
+	for _, rule := range rr.ordered {
+		switch rule.Match {
+		case "prefix":
+			if rest, ok := strings.CutPrefix(reqPath, rule.From); ok {
+				return rule, rule.To + rest, true
+			}
+		case "regex":
+			if match := rule.re.FindStringSubmatchIndex(reqPath); match != nil {
+				return rule, string(rule.re.ExpandString(nil, rule.To, reqPath, match)), true
+			}
+		}
+	}
+	return rewriteRule{}, "", false
+}
+
+// applyRewriteRules redirects r when a redirect rule matches, returning
+// false, or returns r with the path a rewrite rule leads to. The original
+// query is kept unless the target has its own.
+func (h *atomHandler) applyRewriteRules(w http.ResponseWriter, r *http.Request, reqPath string) (*http.Request, string, bool) {
+	rule, target, ok := h.rewrites.lookup(reqPath)
+	if !ok {
+		return r, reqPath, true
+	}
+	targetPath, query, hasQuery := strings.Cut(target, "?")
+	if !hasQuery {
+		query = r.URL.RawQuery
+	}
+
+	if rule.Action == "redirect" {
+		location := targetPath
+		if query != "" {
+			location += "?" + query
+		}
+		logRouteDecision(r, h.site, "rewrite_redirect", rule.Status, 0)
+		http.Redirect(w, r, location, rule.Status)
+		return nil, "", false
+	}
+
+	clone := r.Clone(r.Context())
+	clone.URL.Path = cleanPath(targetPath)
+	clone.URL.RawPath = ""
+	clone.URL.RawQuery = query
+	return clone, clone.URL.Path, true
+}
@@ -0,0 +1,219 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/artefactual-labs/valence/internal/routexpr"
+)
+
+// routeRules are routing decisions the fixed rules of decideRoute cannot
+// express, read from the JSON file VALENCE_ROUTE_RULES_FILE names. Each
+// rule's when is an expression over the request (see internal/routexpr),
+// compiled at startup:
+//
+//	{"rules": [
+//	  {"name": "bad-bots", "when": "header(\"User-Agent\") =~ `(?i)badbot`", "action": "deny"},
+//	  {"when": "method == \"POST\" && hasPrefix(path, \"/api/\") && !cidr(client_ip, \"10.0.0.0/8\")", "action": "deny", "status": 404},
+//	  {"when": "hasPrefix(path, \"/reports/\")", "action": "static", "root": "/srv/reports", "strip_prefix": "/reports"},
+//	  {"when": "host == \"old.example.org\"", "action": "redirect", "to": "https://example.org/"},
+//	  {"when": "query(\"format\") == \"xml\" && path == \"/feed\"", "action": "rewrite", "to": "/feed.xml"},
+//	  {"when": "hasPrefix(path, \"/media/\") && method in [\"PUT\", \"DELETE\"]", "action": "php"}
+//	]}
+//
+// Rules run in file order, after the rewrite rules and before
+// decideRoute. deny answers status (default 403); static serves files
+// from root, a directory Landlock must allow (VALENCE_LANDLOCK_READ);
+// redirect sends the client to to with status 301 (the default), 302, 307
+// or 308, keeping the query unless to has one; php hands the request to
+// the front controller, as decideRoute would; rewrite changes the path,
+// and the query when to has one, for the rules after it and for
+// decideRoute. The first rule with another action decides. valence's own
+// denials of private paths come first whatever the rules say.
+type routeRules struct {
+	rules   []routeRule
+	trusted []netip.Prefix
+}
+
+type routeRuleFile struct {
+	Rules []routeRule `json:"rules"`
+}
+
+type routeRule struct {
+	// Name labels the rule in valence_route_rule_matches_total; it
+	// defaults to its position, as rule 1, rule 2...
+	Name   string `json:"name,omitempty"`
+	When   string `json:"when"`
+	Action string `json:"action"`
+	// Status is the deny or redirect status.
+	Status int `json:"status,omitempty"`
+	// To is where redirect and rewrite go.
+	To string `json:"to,omitempty"`
+	// Root and StripPrefix locate static files: root joined with the path
+	// less the prefix.
+	Root        string `json:"root,omitempty"`
+	StripPrefix string `json:"strip_prefix,omitempty"`
+
+	when *routexpr.Program
+}
+
+// routeRulesFromEnv returns nil when no file is set.
+func routeRulesFromEnv() (*routeRules, error) {
+	path := strings.TrimSpace(os.Getenv("VALENCE_ROUTE_RULES_FILE"))
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file routeRuleFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	rr := &routeRules{}
+	if rr.trusted, err = trustedProxiesFromEnv(); err != nil {
+		return nil, err
+	}
+	for i, rule := range file.Rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule %d", i+1)
+		}
+		if err := rule.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", path, rule.Name, err)
+		}
+		rr.rules = append(rr.rules, rule)
+	}
+	logInfof("route rules: %d from %s", len(rr.rules), path)
+	return rr, nil
+}
+
+func (rule *routeRule) validate() error {
+	if strings.TrimSpace(rule.When) == "" {
+		return errors.New("when is empty")
+	}
+	var err error
+	if rule.when, err = routexpr.Compile(rule.When); err != nil {
+		return fmt.Errorf("when: %w", err)
+	}
+	switch rule.Action {
+	case "deny":
+		if rule.Status == 0 {
+			rule.Status = http.StatusForbidden
+		}
+		if rule.Status < 400 || rule.Status > 599 {
+			return fmt.Errorf("a deny status must be 4xx or 5xx, not %d", rule.Status)
+		}
+	case "static":
+		if !filepath.IsAbs(rule.Root) {
+			return errors.New("static needs an absolute root")
+		}
+	case "redirect":
+		if rule.To == "" {
+			return errors.New("to is empty")
+		}
+		if rule.Status == 0 {
+			rule.Status = http.StatusMovedPermanently
+		}
+		switch rule.Status {
+		case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		default:
+			return fmt.Errorf("status must be 301, 302, 307 or 308, not %d", rule.Status)
+		}
+	case "rewrite":
+		if !strings.HasPrefix(rule.To, "/") {
+			return errors.New("a rewrite must go to a path starting with /")
+		}
+	case "php":
+	default:
+		return fmt.Errorf("action must be deny, static, redirect, rewrite or php, not %q", rule.Action)
+	}
+	if rule.Status != 0 && rule.Action != "deny" && rule.Action != "redirect" {
+		return errors.New("status only applies to deny and redirect")
+	}
+	return nil
+}
+
+// match runs the rules on r. It returns the request as the rewrites left
+// it, and the rule that decides, if one does.
+func (rr *routeRules) match(site string, r *http.Request, reqPath string) (*http.Request, string, *routeRule) {
+	if rr == nil {
+		return r, reqPath, nil
+	}
+	req := &routexpr.Request{
+		Method:   r.Method,
+		Host:     normalizeHost(r.Host),
+		Path:     reqPath,
+		ClientIP: forwardedClientIP(r, rr.trusted),
+		Header:   r.Header,
+		Query:    r.URL.Query(),
+	}
+	for i := range rr.rules {
+		rule := &rr.rules[i]
+		if !rule.when.Match(req) {
+			continue
+		}
+		routeRuleMatches.WithLabelValues(site, rule.Name).Inc()
+		if rule.Action != "rewrite" {
+			return r, reqPath, rule
+		}
+		targetPath, query, hasQuery := strings.Cut(rule.To, "?")
+		clone := r.Clone(r.Context())
+		clone.URL.Path = cleanPath(targetPath)
+		clone.URL.RawPath = ""
+		if hasQuery {
+			clone.URL.RawQuery = query
+			req.Query = clone.URL.Query()
+		}
+		r, reqPath = clone, clone.URL.Path
+		req.Path = reqPath
+	}
+	return r, reqPath, nil
+}
+
+// ruleDecision routes a request the way rule says.
+func (h *atomHandler) ruleDecision(rule *routeRule, r *http.Request, reqPath string) routeDecision {
+	if decision, ok := h.denyDecision(reqPath); ok {
+		return decision
+	}
+	switch rule.Action {
+	case "deny":
+		return routeDecision{label: "rule_deny", handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			http.Error(w, strings.ToLower(http.StatusText(rule.Status)), rule.Status)
+		})}
+	case "static":
+		rel, ok := strings.CutPrefix(reqPath, rule.StripPrefix)
+		if !ok {
+			rel = reqPath
+		}
+		assetPath := filepath.Join(rule.Root, filepath.FromSlash(cleanPath("/"+rel)))
+		if !h.isFile(assetPath) {
+			return routeDecision{label: "rule_static", handler: http.NotFoundHandler()}
+		}
+		return routeDecision{
+			label:  "rule_static",
+			source: "route_rule",
+			handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				setStaticHeaders(w)
+				http.ServeFile(w, r, assetPath)
+			}),
+		}
+	case "redirect":
+		location := rule.To
+		if !strings.Contains(location, "?") && r.URL.RawQuery != "" {
+			location += "?" + r.URL.RawQuery
+		}
+		return routeDecision{label: "rule_redirect", handler: http.RedirectHandler(location, rule.Status)}
+	default: // php
+		if (h.monitor != nil && h.monitor.mysqlUnavailable()) || inMaintenance(h.maintenanceFlag) {
+			return routeDecision{label: "maintenance", handler: http.HandlerFunc(maintenanceHandler)}
+		}
+		return routeDecision{label: "rule_php", handler: h.fallback}
+	}
+}
@@ -0,0 +1,239 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/artefactual-labs/valence/internal/cron"
+)
+
+const scheduleEnvPrefix = "VALENCE_SCHEDULE_"
+
+// scheduledTask is a symfony task run on a cron schedule, configured as
+// VALENCE_SCHEDULE_<NAME>="<cron expression> <task> [args...]", e.g.
+// VALENCE_SCHEDULE_SITEMAP="30 2 * * * sitemap:generate".
+type scheduledTask struct {
+	name     string
+	schedule cron.Schedule
+	args     []string
+
+	mu      sync.Mutex
+	running bool
+	next    time.Time
+	last    *taskRun
+}
+
+type taskRun struct {
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at,omitzero"`
+	Duration   string    `json:"duration,omitempty"`
+	// Status is ok, failed, or skipped when the previous run was still
+	// going.
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// Attempts counts the restarts of a failing run plus the first try.
+	Attempts int `json:"attempts,omitempty"`
+}
+
+type scheduledTaskStatus struct {
+	Name     string    `json:"name"`
+	Schedule string    `json:"schedule"`
+	Task     string    `json:"task"`
+	Running  bool      `json:"running"`
+	NextRun  time.Time `json:"next_run,omitzero"`
+	LastRun  *taskRun  `json:"last_run"`
+}
+
+// scheduler runs scheduled tasks through the embedded runtime while
+// valence serves. Runs of the same task never overlap: a tick that finds
+// the previous run still going is recorded as skipped. A failed run is
+// retried under the restart policy. Set VALENCE_SCHEDULER=false to turn it
+// off, e.g. on all but one replica.
+type scheduler struct {
+	root     string // guarded by runMu, which an atom reload takes
+	loc      *time.Location
+	jitter   time.Duration
+	restarts restartPolicy
+	tasks    []*scheduledTask
+
+	// runMu runs one task at a time; they share the PHP runtime with the
+	// site and are usually heavy.
+	runMu sync.Mutex
+}
+
+func newScheduler(root, timezone string, restarts restartPolicy) (*scheduler, error) {
+	s := &scheduler{
+		root:     root,
+		loc:      time.Local,
+		jitter:   envDuration("VALENCE_SCHEDULER_JITTER", 0),
+		restarts: restarts,
+	}
+	if !envBool("VALENCE_SCHEDULER", true) {
+		return s, nil
+	}
+	if timezone != "" {
+		if loc, err := time.LoadLocation(timezone); err == nil {
+			s.loc = loc
+		} else {
+			logWarnf("scheduler: unknown timezone %q, using %s", timezone, s.loc)
+		}
+	}
+	tasks, err := scheduledTasksFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	s.tasks = tasks
+	return s, nil
+}
+
+func scheduledTasksFromEnv() ([]*scheduledTask, error) {
+	var tasks []*scheduledTask
+	for _, kv := range os.Environ() {
+		key, value, _ := strings.Cut(kv, "=")
+		name, ok := strings.CutPrefix(key, scheduleEnvPrefix)
+		if !ok || name == "" {
+			continue
+		}
+		name = strings.ToLower(strings.ReplaceAll(name, "_", "-"))
+		task, err := parseScheduledTask(name, value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		tasks = append(tasks, task)
+	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].name < tasks[j].name })
+	return tasks, nil
+}
+
+// parseScheduledTask splits "<cron expression> <task> [args...]"; the
+// expression is five fields, or one for the @daily style macros.
+func parseScheduledTask(name, value string) (*scheduledTask, error) {
+	fields := strings.Fields(value)
+	n := 5
+	if len(fields) > 0 && strings.HasPrefix(fields[0], "@") {
+		n = 1
+	}
+	if len(fields) <= n {
+		return nil, fmt.Errorf("want \"<cron expression> <task> [args...]\", got %q", value)
+	}
+	schedule, err := cron.Parse(strings.Join(fields[:n], " "))
+	if err != nil {
+		return nil, err
+	}
+	return &scheduledTask{name: name, schedule: schedule, args: fields[n:]}, nil
+}
+
+func (s *scheduler) run(ctx context.Context) {
+	for _, task := range s.tasks {
+		logInfof("scheduler: %s runs %q at %q", task.name, strings.Join(task.args, " "), task.schedule)
+		go supervise(ctx, "scheduler: "+task.name, s.restarts, func(ctx context.Context) error {
+			s.loop(ctx, task)
+			return nil
+		})
+	}
+}
+
+func (s *scheduler) loop(ctx context.Context, task *scheduledTask) {
+	for {
+		next := task.schedule.Next(time.Now().In(s.loc))
+		if next.IsZero() {
+			logWarnf("scheduler: %s: schedule %q never fires", task.name, task.schedule)
+			return
+		}
+		// Jitter spreads tasks that share a schedule, and replicas that
+		// share a configuration, over the window.
+		if s.jitter > 0 {
+			next = next.Add(rand.N(s.jitter))
+		}
+		task.mu.Lock()
+		task.next = next
+		task.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(next)):
+		}
+		go s.fire(ctx, task)
+	}
+}
+
+func (s *scheduler) fire(ctx context.Context, task *scheduledTask) {
+	task.mu.Lock()
+	if task.running {
+		task.last = &taskRun{StartedAt: time.Now(), Status: "skipped"}
+		task.mu.Unlock()
+		logWarnf("scheduler: %s: previous run still going, skipping", task.name)
+		return
+	}
+	task.running = true
+	task.mu.Unlock()
+
+	run := &taskRun{StartedAt: time.Now(), Status: "ok"}
+	err := supervise(ctx, "scheduled task "+task.name, s.restarts, func(context.Context) error {
+		// Hold runMu per attempt, not across the backoff between them.
+		s.runMu.Lock()
+		defer s.runMu.Unlock()
+		run.Attempts++
+		logInfof("scheduler: %s: running symfony %s", task.name, strings.Join(task.args, " "))
+		return runSymfonyWithMemoryLimit(s.root, task.args, "-1")
+	})
+	run.FinishedAt = time.Now()
+	run.Duration = run.FinishedAt.Sub(run.StartedAt).Round(time.Millisecond).String()
+	if err != nil {
+		run.Status = "failed"
+		run.Error = err.Error()
+		logErrorf("scheduler: %s failed after %s: %v", task.name, run.Duration, err)
+	} else {
+		logInfof("scheduler: %s finished in %s", task.name, run.Duration)
+	}
+
+	task.mu.Lock()
+	task.running = false
+	task.last = run
+	task.mu.Unlock()
+}
+
+func (s *scheduler) status() []scheduledTaskStatus {
+	statuses := make([]scheduledTaskStatus, 0, len(s.tasks))
+	for _, task := range s.tasks {
+		task.mu.Lock()
+		statuses = append(statuses, scheduledTaskStatus{
+			Name:     task.name,
+			Schedule: task.schedule.String(),
+			Task:     strings.Join(task.args, " "),
+			Running:  task.running,
+			NextRun:  task.next,
+			LastRun:  task.last,
+		})
+		task.mu.Unlock()
+	}
+	return statuses
+}
+
+func schedulerHandler(s *scheduler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !authorizeInternalAPI(w, r) {
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(struct {
+			Timezone string                `json:"timezone"`
+			Tasks    []scheduledTaskStatus `json:"tasks"`
+		}{s.loc.String(), s.status()})
+	}
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+var migrationFileRe = regexp.MustCompile(`^arMigration(\d+)\.class\.php$`)
+
+// schemaScript reads AtoM's schema version from the database and, when
+// $upgrade is set and the schema is behind, runs tools:upgrade-sql under a
+// MySQL named lock so only one replica migrates. The versions seen are
+// written as JSON to $result.
+const schemaScript = `
+$conn = Propel::getConnection();
+$version = function () use ($conn) {
+  try {
+    $stmt = $conn->prepare("SELECT i.value FROM setting s JOIN setting_i18n i ON i.id = s.id AND i.culture = s.source_culture WHERE s.name = 'version'");
+    $stmt->execute();
+    $value = $stmt->fetchColumn();
+  } catch (PDOException $e) {
+    return null;
+  }
+
+  return false === $value ? null : (int) $value;
+};
+
+$before = $version();
+$after = $before;
+if ($upgrade && null !== $before && $before < $target) {
+  $stmt = $conn->prepare('SELECT GET_LOCK(?, ?)');
+  $stmt->execute(['valence_upgrade_sql', $lockTimeout]);
+  if (1 != $stmt->fetchColumn()) {
+    fwrite(STDERR, "timed out waiting for the upgrade lock\n");
+    exit(1);
+  }
+  try {
+    if ($version() < $target) {
+      if (0 != $status = $runTask(['tools:upgrade-sql', '--no-confirmation'])) {
+        exit($status);
+      }
+    }
+  } finally {
+    $conn->prepare('SELECT RELEASE_LOCK(?)')->execute(['valence_upgrade_sql']);
+  }
+  $after = $version();
+}
+
+file_put_contents($result, json_encode(['before' => $before, 'after' => $after]));
+`
+
+type schemaVersions struct {
+	Before *int `json:"before"`
+	After  *int `json:"after"`
+}
+
+func upgradeSQLEnabled() bool {
+	return envBool("VALENCE_UPGRADE_SQL", false)
+}
+
+func upgradeLockTimeout() time.Duration {
+	val := envOrDefault("VALENCE_UPGRADE_LOCK_TIMEOUT", "10m")
+	timeout, err := time.ParseDuration(val)
+	if err != nil || timeout <= 0 {
+		logWarnf("invalid VALENCE_UPGRADE_LOCK_TIMEOUT %q; using 10m", val)
+		return 10 * time.Minute
+	}
+	return timeout
+}
+
+// schemaTargetVersion is the highest migration shipped in the atom root.
+func schemaTargetVersion(root string) (int, error) {
+	entries, err := os.ReadDir(filepath.Join(root, "lib", "task", "migrate", "migrations"))
+	if err != nil {
+		return 0, err
+	}
+	target := 0
+	for _, entry := range entries {
+		m := migrationFileRe.FindStringSubmatch(entry.Name())
+		if m == nil {
+			continue
+		}
+		if n, _ := strconv.Atoi(m[1]); n > target {
+			target = n
+		}
+	}
+	if target == 0 {
+		return 0, fmt.Errorf("no migrations found")
+	}
+	return target, nil
+}
+
+// checkSchema compares the database schema with the embedded AtoM release,
+// upgrading it when VALENCE_UPGRADE_SQL is set, and reports whether AtoM is
+// installed at all. A database that is still behind afterwards is an error,
+// since Propel fails obscurely against it.
+func checkSchema(root string) (bool, error) {
+	target, err := schemaTargetVersion(root)
+	if err != nil {
+		return false, fmt.Errorf("schema target version: %w", err)
+	}
+	upgrade := upgradeSQLEnabled()
+
+	result, err := os.CreateTemp("", "valence-schema-*.json")
+	if err != nil {
+		return false, err
+	}
+	result.Close()
+	defer os.Remove(result.Name())
+
+	code := fmt.Sprintf("$target = %d;\n$upgrade = %t;\n$lockTimeout = %d;\n$result = '%s';\n%s",
+		target, upgrade, int(upgradeLockTimeout().Seconds()), phpEscape(result.Name()), schemaScript)
+	if err := runAtomScript(root, code); err != nil {
+		return false, err
+	}
+
+	data, err := os.ReadFile(result.Name())
+	if err != nil {
+		return false, err
+	}
+	var versions schemaVersions
+	if err := json.Unmarshal(data, &versions); err != nil {
+		return false, fmt.Errorf("decode schema versions: %w", err)
+	}
+
+	switch {
+	case versions.After == nil:
+		logInfof("schema: no version recorded; database not installed yet")
+		return false, nil
+	case *versions.After < target:
+		return true, fmt.Errorf("database schema is at version %d but AtoM expects %d; set VALENCE_UPGRADE_SQL=true or run `symfony tools:upgrade-sql`", *versions.After, target)
+	case versions.Before != nil && *versions.Before != *versions.After:
+		logInfof("schema: upgraded from version %d to %d", *versions.Before, *versions.After)
+	default:
+		logInfof("schema: version %d is current", *versions.After)
+	}
+	return true, nil
+}
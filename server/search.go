@@ -0,0 +1,176 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// searchTypes are the document types AtoM's search:populate indexes, in
+// the order it indexes them.
+var searchTypes = []string{"accession", "actor", "aip", "function", "repository", "term", "informationobject"}
+
+// populateStateFile records the types indexed by an interrupted
+// search:populate, so --resume can skip them.
+const populateStateFile = ".valence-populate.json"
+
+type populateState struct {
+	Started time.Time `json:"started"`
+	Done    []string  `json:"done"`
+}
+
+// searchPopulateCommand rebuilds the Elasticsearch indexes one type at a
+// time, printing progress between types. It exits non-zero if any type
+// fails; --resume then continues after the last type that finished.
+func searchPopulateCommand(args []string) error {
+	fs := flag.NewFlagSet("search:populate", flag.ContinueOnError)
+	only := fs.String("types", "", "comma-separated types to index (default all)")
+	exclude := fs.String("exclude-types", "", "comma-separated types to skip")
+	slicesFlag := fs.Int("slices", 0, "split each type into this many slices (passed to search:populate)")
+	batchSize := fs.Int("batch-size", 0, "documents per bulk request (passed to search:populate)")
+	update := fs.Bool("update", false, "update documents in place instead of recreating the indexes")
+	resume := fs.Bool("resume", false, "skip types an interrupted run already indexed")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	root, err := atomRootFromEnv()
+	if err != nil {
+		return err
+	}
+	root = realAtomRoot(root)
+	if info, err := os.Stat(root); err != nil || !info.IsDir() {
+		return fmt.Errorf("atom root not found at %s", root)
+	}
+
+	types, err := selectSearchTypes(*only, *exclude)
+	if err != nil {
+		return err
+	}
+
+	statePath := populateStatePath(root)
+	state := populateState{Started: time.Now().UTC()}
+	if *resume {
+		if previous, err := readPopulateState(statePath); err == nil {
+			state = previous
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	var todo []string
+	for _, t := range types {
+		if !slices.Contains(state.Done, t) {
+			todo = append(todo, t)
+		}
+	}
+	if len(todo) < len(types) {
+		fmt.Printf("resuming: %s already indexed\n", strings.Join(state.Done, ", "))
+	}
+
+	for i, t := range todo {
+		fmt.Printf("[%d/%d] indexing %s\n", i+1, len(todo), t)
+		start := time.Now()
+		populate := []string{"search:populate", "--exclude-types=" + strings.Join(otherSearchTypes(t), ",")}
+		if *slicesFlag > 0 {
+			populate = append(populate, "--slices="+strconv.Itoa(*slicesFlag))
+		}
+		if *batchSize > 0 {
+			populate = append(populate, "--batch-size="+strconv.Itoa(*batchSize))
+		}
+		if *update {
+			populate = append(populate, "--update")
+		}
+		if err := runSymfonyWithMemoryLimit(root, populate, "-1"); err != nil {
+			return fmt.Errorf("index %s: %w (rerun with --resume to continue)", t, err)
+		}
+		state.Done = append(state.Done, t)
+		if err := writePopulateState(statePath, state); err != nil {
+			return err
+		}
+		fmt.Printf("[%d/%d] indexed %s in %s\n", i+1, len(todo), t, time.Since(start).Round(time.Second))
+	}
+
+	if err := os.Remove(statePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	fmt.Printf("search index populated in %s\n", time.Since(state.Started).Round(time.Second))
+	return nil
+}
+
+func selectSearchTypes(only, exclude string) ([]string, error) {
+	types := searchTypes
+	if requested := splitList(only); len(requested) > 0 {
+		types = requested
+	}
+	excluded := splitList(exclude)
+	var selected []string
+	for _, t := range types {
+		if !slices.Contains(searchTypes, t) {
+			return nil, fmt.Errorf("unknown search type %q (want one of %s)", t, strings.Join(searchTypes, ", "))
+		}
+		if !slices.Contains(excluded, t) {
+			selected = append(selected, t)
+		}
+	}
+	if len(selected) == 0 {
+		return nil, errors.New("no search types left to index")
+	}
+	return selected, nil
+}
+
+func otherSearchTypes(t string) []string {
+	var others []string
+	for _, other := range searchTypes {
+		if other != t {
+			others = append(others, other)
+		}
+	}
+	return others
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.ToLower(strings.TrimSpace(item)); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// populateStatePath keeps the state with the site's data when
+// ATOM_DATA_DIR is set, so it survives a new atom root.
+func populateStatePath(root string) string {
+	if dir := strings.TrimSpace(os.Getenv("ATOM_DATA_DIR")); dir != "" {
+		return filepath.Join(dir, populateStateFile)
+	}
+	return filepath.Join(root, populateStateFile)
+}
+
+func readPopulateState(path string) (populateState, error) {
+	var state populateState
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return state, err
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, fmt.Errorf("read %s: %w", path, err)
+	}
+	return state, nil
+}
+
+func writePopulateState(path string, state populateState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
@@ -0,0 +1,239 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/artefactual-labs/valence/internal/bootstrap"
+)
+
+// searchHealth is what /v/search/health reports about a site's index.
+// AtoM keeps one index per document type, named after
+// ATOM_ELASTICSEARCH_INDEX (atom by default) as in atom_qubitactor.
+// search:populate recreates them, so the oldest creation time is when the
+// index was last fully populated; --update runs do not move it.
+// MappingHash tells whether two instances index with the same mappings.
+type searchHealth struct {
+	Status      string         `json:"status"` // ok, empty, stale or down
+	CheckedAt   time.Time      `json:"checked_at"`
+	Cluster     *esCluster     `json:"cluster,omitempty"`
+	Index       string         `json:"index"`
+	Documents   int64          `json:"documents"`
+	Indices     []searchIndex  `json:"indices"`
+	Populated   *time.Time     `json:"last_populated,omitempty"`
+	Interrupted *populateState `json:"interrupted_populate,omitempty"`
+	Error       string         `json:"error,omitempty"`
+}
+
+type esCluster struct {
+	Name             string `json:"cluster_name"`
+	Status           string `json:"status"`
+	Nodes            int    `json:"number_of_nodes"`
+	ActiveShards     int    `json:"active_shards"`
+	UnassignedShards int    `json:"unassigned_shards"`
+}
+
+type searchIndex struct {
+	Name        string    `json:"name"`
+	Health      string    `json:"health"`
+	Documents   int64     `json:"documents"`
+	CreatedAt   time.Time `json:"created_at"`
+	MappingHash string    `json:"mapping_hash,omitempty"`
+}
+
+// esClient talks to the first of a site's Elasticsearch nodes that answers.
+type esClient struct {
+	cfg    bootstrap.Config
+	nodes  []string
+	client *http.Client
+}
+
+func newESClient(cfg bootstrap.Config) (*esClient, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	tlsConfig, err := cfg.ElasticsearchTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig = tlsConfig
+	c := &esClient{cfg: cfg, client: &http.Client{Transport: transport, Timeout: 5 * time.Second}}
+	for _, node := range cfg.ElasticsearchNodes() {
+		base := node
+		if !strings.Contains(base, "://") {
+			base = "http://" + base
+		}
+		u, err := url.Parse(base)
+		if err != nil {
+			return nil, fmt.Errorf("parse elasticsearch host: %w", err)
+		}
+		if u.Port() == "" {
+			u.Host = u.Host + ":9200"
+		}
+		u.User = nil
+		c.nodes = append(c.nodes, strings.TrimSuffix(u.String(), "/"))
+	}
+	if len(c.nodes) == 0 {
+		return nil, errors.New("no elasticsearch host configured")
+	}
+	return c, nil
+}
+
+// get decodes the JSON at path into v, trying each node in turn.
+func (c *esClient) get(ctx context.Context, path string, v any) error {
+	var lastErr error
+	for _, node := range c.nodes {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, node+path, nil)
+		if err != nil {
+			return err
+		}
+		switch {
+		case c.cfg.ElasticsearchAPIKey != "":
+			req.Header.Set("Authorization", "ApiKey "+c.cfg.ElasticsearchAPIKey)
+		case c.cfg.ElasticsearchUsername != "":
+			req.SetBasicAuth(c.cfg.ElasticsearchUsername, c.cfg.ElasticsearchPassword)
+		}
+		resp, err := c.client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return fmt.Errorf("GET %s: %s", path, resp.Status)
+		}
+		err = json.NewDecoder(resp.Body).Decode(v)
+		resp.Body.Close()
+		return err
+	}
+	return lastErr
+}
+
+// checkSearchHealth reports on the index of the site described by cfg.
+// dataDir holds an interrupted valence search:populate's state.
+func checkSearchHealth(ctx context.Context, cfg bootstrap.Config, dataDir string) searchHealth {
+	report := searchHealth{Status: "ok", CheckedAt: time.Now().UTC(), Index: cfg.ElasticsearchIndex, Indices: []searchIndex{}}
+	if report.Index == "" {
+		report.Index = "atom"
+	}
+	if state, err := readPopulateState(filepath.Join(dataDir, populateStateFile)); err == nil {
+		report.Interrupted = &state
+	}
+	down := func(err error) searchHealth {
+		report.Status = "down"
+		report.Error = err.Error()
+		return report
+	}
+
+	es, err := newESClient(cfg)
+	if err != nil {
+		return down(err)
+	}
+	var cluster esCluster
+	if err := es.get(ctx, "/_cluster/health", &cluster); err != nil {
+		return down(err)
+	}
+	report.Cluster = &cluster
+	if cluster.Status == "red" {
+		report.Status = "down"
+	}
+
+	pattern := url.PathEscape(report.Index) + "*"
+	var rows []struct {
+		Index     string `json:"index"`
+		Health    string `json:"health"`
+		Documents string `json:"docs.count"`
+		Created   string `json:"creation.date"`
+	}
+	if err := es.get(ctx, "/_cat/indices/"+pattern+"?format=json&h=index,health,docs.count,creation.date", &rows); err != nil {
+		return down(err)
+	}
+	var mappings map[string]json.RawMessage
+	if err := es.get(ctx, "/"+pattern+"/_mapping", &mappings); err != nil {
+		return down(err)
+	}
+	for _, row := range rows {
+		// Skip other sites' indices that share the prefix.
+		if row.Index != report.Index && !strings.HasPrefix(row.Index, report.Index+"_qubit") {
+			continue
+		}
+		index := searchIndex{Name: row.Index, Health: row.Health}
+		index.Documents, _ = strconv.ParseInt(row.Documents, 10, 64)
+		if ms, err := strconv.ParseInt(row.Created, 10, 64); err == nil {
+			index.CreatedAt = time.UnixMilli(ms).UTC()
+		}
+		if mapping, ok := mappings[row.Index]; ok {
+			sum := sha256.Sum256(mapping)
+			index.MappingHash = hex.EncodeToString(sum[:6])
+		}
+		report.Documents += index.Documents
+		if report.Populated == nil || index.CreatedAt.Before(*report.Populated) {
+			created := index.CreatedAt
+			report.Populated = &created
+		}
+		report.Indices = append(report.Indices, index)
+	}
+	sort.Slice(report.Indices, func(i, j int) bool { return report.Indices[i].Name < report.Indices[j].Name })
+
+	maxAge := envDuration("VALENCE_SEARCH_MAX_AGE", 0)
+	switch {
+	case report.Status != "ok":
+	case report.Documents == 0:
+		report.Status = "empty"
+	case report.Interrupted != nil:
+		report.Status = "stale"
+	case maxAge > 0 && report.Populated != nil && time.Since(*report.Populated) > maxAge:
+		report.Status = "stale"
+	}
+	return report
+}
+
+// searchHealthHandler serves GET /v/search/health for the site the Host
+// names. Anything but ok answers 503, for monitors that only look at the
+// status code; VALENCE_SEARCH_MAX_AGE marks an index populated longer ago
+// than that stale.
+func searchHealthHandler(router *siteRouter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !authorizeInternalAPI(w, r) {
+			return
+		}
+		s := router.siteFor(r.Host)
+		if s == nil {
+			http.Error(w, "unknown site", http.StatusNotFound)
+			return
+		}
+		h := s.handler.Load()
+		if h == nil {
+			http.Error(w, "site unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		dataDir := h.atomDataDir
+		if dataDir == "" {
+			dataDir = h.phpRoot
+		}
+
+		report := checkSearchHealth(r.Context(), s.bootstrap, dataDir)
+		code := http.StatusOK
+		if report.Status != "ok" {
+			code = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(code)
+		_ = json.NewEncoder(w).Encode(report)
+	}
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/artefactual-labs/valence/internal/bootstrap"
+	"github.com/artefactual-labs/valence/internal/secrets"
+)
+
+// runtimeSecrets holds secrets resolved from the configured provider so
+// handlers see rotated values without a restart.
+var runtimeSecrets struct {
+	mu            sync.RWMutex
+	internalToken string
+	signedURLKey  string
+}
+
+func internalAPIToken() string {
+	runtimeSecrets.mu.RLock()
+	defer runtimeSecrets.mu.RUnlock()
+	return runtimeSecrets.internalToken
+}
+
+func loadInternalAPIToken(ctx context.Context, provider secrets.Provider) error {
+	token, err := provider.Lookup(ctx, "ATOM_VALENCE_INTERNAL_TOKEN")
+	if err != nil {
+		return err
+	}
+	runtimeSecrets.mu.Lock()
+	runtimeSecrets.internalToken = token
+	runtimeSecrets.mu.Unlock()
+	return nil
+}
+
+func signedURLKey() string {
+	runtimeSecrets.mu.RLock()
+	defer runtimeSecrets.mu.RUnlock()
+	return runtimeSecrets.signedURLKey
+}
+
+func loadSignedURLKey(ctx context.Context, provider secrets.Provider) error {
+	key, err := provider.Lookup(ctx, "VALENCE_SIGNED_URL_KEY")
+	if err != nil {
+		return err
+	}
+	runtimeSecrets.mu.Lock()
+	runtimeSecrets.signedURLKey = key
+	runtimeSecrets.mu.Unlock()
+	return nil
+}
+
+func secretsRefreshInterval() time.Duration {
+	val := strings.TrimSpace(os.Getenv("VALENCE_SECRETS_REFRESH_INTERVAL"))
+	if val == "" {
+		return 0
+	}
+	interval, err := time.ParseDuration(val)
+	if err != nil || interval < 0 {
+		logWarnf("invalid VALENCE_SECRETS_REFRESH_INTERVAL %q; rotation disabled", val)
+		return 0
+	}
+	return interval
+}
+
+// watchSecrets periodically re-resolves secrets and re-applies bootstrap when
+// the MySQL credentials rotate.
+func watchSecrets(ctx context.Context, provider secrets.Provider, current bootstrap.Config) {
+	interval := secretsRefreshInterval()
+	if interval == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := loadInternalAPIToken(ctx, provider); err != nil {
+			logWarnf("secrets refresh: internal api token: %v", err)
+		}
+		if err := loadSignedURLKey(ctx, provider); err != nil {
+			logWarnf("secrets refresh: signed url key: %v", err)
+		}
+
+		next, err := bootstrap.LoadConfig(ctx, current.AtomDir, provider)
+		if err != nil {
+			logWarnf("secrets refresh: %v", err)
+			continue
+		}
+		if next.MySQLDSN == current.MySQLDSN &&
+			next.MySQLUsername == current.MySQLUsername &&
+			next.MySQLPassword == current.MySQLPassword {
+			continue
+		}
+		summary, err := bootstrap.Apply(next)
+		if err != nil {
+			logErrorf("secrets refresh: bootstrap error: %v", err)
+			continue
+		}
+		current = next
+		logInfof("mysql credentials rotated from %s: wrote=%d skipped=%d", provider.Name(), len(summary.Written), len(summary.Skipped))
+	}
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Signed URLs let a client fetch a finished export or a digital object
+// master straight from disk, or an AIP file from the Archivematica Storage
+// Service, without a PHP thread, once AtoM has decided it may. AtoM (or
+// another trusted caller) asks /v/signed-urls for a URL under /signed/;
+// valence serves the file while the HMAC, keyed with VALENCE_SIGNED_URL_KEY,
+// checks out and the URL has not expired. The signature covers the site
+// name, so a URL only opens its own site's file.
+
+// signedPathRe matches the files a URL may be issued for, and
+// signedURLRe the issued URLs.
+var (
+	signedPathRe = regexp.MustCompile(`^/(downloads|uploads|aips)/.+`)
+	signedURLRe  = regexp.MustCompile(`^/signed/(downloads|uploads|aips)/.+`)
+)
+
+type signedURLRequest struct {
+	Path string `json:"path"`
+	// TTLSeconds defaults to VALENCE_SIGNED_URL_TTL and is capped by
+	// VALENCE_SIGNED_URL_MAX_TTL.
+	TTLSeconds int `json:"ttl_seconds,omitempty"`
+}
+
+type signedURLResponse struct {
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// signURL returns the signed URL for reqPath, which must already be clean.
+func signURL(key, site, reqPath string, expires time.Time) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	query := url.Values{
+		"expires":   {exp},
+		"signature": {signature(key, site, reqPath, exp)},
+	}
+	return "/signed" + reqPath + "?" + query.Encode()
+}
+
+func signature(key, site, reqPath, expires string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	fmt.Fprintf(mac, "%s\n%s\n%s", site, reqPath, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifySignedURL checks a request for /signed/<path> and returns <path>
+// and the time it stops being valid. status is the HTTP status to answer
+// when the URL is not valid.
+func verifySignedURL(r *http.Request, site, reqPath string, now time.Time) (string, time.Time, int) {
+	key := signedURLKey()
+	if key == "" {
+		return "", time.Time{}, http.StatusNotFound
+	}
+	filePath := strings.TrimPrefix(reqPath, "/signed")
+	exp := r.URL.Query().Get("expires")
+	unix, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil {
+		return "", time.Time{}, http.StatusForbidden
+	}
+	want := signature(key, site, filePath, exp)
+	if !hmac.Equal([]byte(want), []byte(r.URL.Query().Get("signature"))) {
+		return "", time.Time{}, http.StatusForbidden
+	}
+	expires := time.Unix(unix, 0)
+	if !now.Before(expires) {
+		return "", time.Time{}, http.StatusGone
+	}
+	return filePath, expires, http.StatusOK
+}
+
+// signedFileDecision serves a /signed/ request from the site's data dir.
+func (h *atomHandler) signedFileDecision(r *http.Request, reqPath string) routeDecision {
+	filePath, expires, status := verifySignedURL(r, h.site, reqPath, time.Now())
+	if status != http.StatusOK {
+		return routeDecision{label: "signed_denied", handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			http.Error(w, http.StatusText(status), status)
+		})}
+	}
+	if aipPathRe.MatchString(filePath) {
+		if h.storage == nil {
+			return routeDecision{label: "signed_missing", handler: http.NotFoundHandler()}
+		}
+		return routeDecision{
+			label: "signed_storage_service",
+			handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Cache-Control", "private, no-store")
+				h.storage.serve(w, r, filePath)
+			}),
+		}
+	}
+	base := h.atomDataDir
+	if base == "" {
+		base = h.phpRoot
+	}
+	diskPath := filepath.Join(base, filepath.FromSlash(strings.TrimPrefix(filePath, "/")))
+	if !h.isFile(diskPath) {
+		return routeDecision{label: "signed_missing", handler: http.NotFoundHandler()}
+	}
+	source := "data_dir"
+	if h.atomDataDir == "" {
+		source = "atom_root"
+	}
+	return routeDecision{
+		label:  "signed",
+		source: source,
+		handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			maxAge := max(int(time.Until(expires).Seconds()), 0)
+			w.Header().Set("Cache-Control", "private, max-age="+strconv.Itoa(maxAge))
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(diskPath)))
+			http.ServeFile(w, r, diskPath)
+		}),
+	}
+}
+
+// signedURLHandler issues signed URLs for the site the request's Host
+// names. Callers are expected to have checked the user's access first.
+func signedURLHandler(router *siteRouter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !authorizeInternalAPI(w, r) {
+			return
+		}
+		if !internalAPIConfigured() {
+			http.Error(w, "internal api token not configured", http.StatusForbidden)
+			return
+		}
+		key := signedURLKey()
+		if key == "" {
+			http.Error(w, "VALENCE_SIGNED_URL_KEY is not configured", http.StatusServiceUnavailable)
+			return
+		}
+		s := router.siteFor(r.Host)
+		if s == nil {
+			http.Error(w, "unknown site", http.StatusNotFound)
+			return
+		}
+
+		var req signedURLRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+		reqPath := cleanPath(req.Path)
+		if reqPath != req.Path || !signedPathRe.MatchString(reqPath) || uploadsConfRe.MatchString(reqPath) {
+			http.Error(w, "path must be a file under /downloads/ or /uploads/, or /aips/<uuid>[/<file>]", http.StatusBadRequest)
+			return
+		}
+		if strings.HasPrefix(reqPath, "/aips/") {
+			if !aipPathRe.MatchString(reqPath) {
+				http.Error(w, "path must be /aips/<uuid>[/<file>]", http.StatusBadRequest)
+				return
+			}
+			if s.storage == nil {
+				http.Error(w, "ARCHIVEMATICA_SS_URL is not configured for this site", http.StatusBadRequest)
+				return
+			}
+		}
+
+		ttl := s.cfg.signedURLTTL
+		if req.TTLSeconds > 0 {
+			// Cap before converting so a huge ttl_seconds cannot overflow.
+			ttl = time.Duration(min(int64(req.TTLSeconds), int64(s.cfg.signedURLMaxTTL/time.Second))) * time.Second
+		}
+		ttl = min(ttl, s.cfg.signedURLMaxTTL)
+		expires := time.Now().Add(ttl).Truncate(time.Second).UTC()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		_ = json.NewEncoder(w).Encode(signedURLResponse{
+			URL:       signURL(key, s.name, reqPath, expires),
+			ExpiresAt: expires,
+		})
+	}
+}
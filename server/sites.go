@@ -0,0 +1,359 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/artefactual-labs/valence/internal/bootstrap"
+	"github.com/artefactual-labs/valence/internal/secrets"
+)
+
+// siteManifest is read from VALENCE_SITES_FILE to serve several AtoM sites
+// from one process, picked by the request's Host header. Sites share the
+// atom root and the PHP runtime; each overlays its own environment (database,
+// cache, admin account...) on the process's and needs its own data dir,
+// which holds its generated config, cache and uploads. A site that fails to
+// start answers 503 and is retried in the background while the others
+// serve.
+type siteManifest struct {
+	Sites []siteSpec `json:"sites"`
+	// Default names the site that answers unknown hosts; without it they
+	// get a 404.
+	Default string `json:"default,omitempty"`
+}
+
+// siteSpec is one manifest entry. The named settings are shorthands for
+// their env variables, which may not be set in Env as well.
+type siteSpec struct {
+	Name               string            `json:"name"`
+	Hosts              []string          `json:"hosts"`
+	DataDir            string            `json:"data_dir"`            // ATOM_DATA_DIR
+	MySQLDSN           string            `json:"mysql_dsn"`           // ATOM_MYSQL_DSN
+	ElasticsearchIndex string            `json:"elasticsearch_index"` // ATOM_ELASTICSEARCH_INDEX
+	UploadsDir         string            `json:"uploads_dir"`         // ATOM_UPLOADS_DIR
+	Env                map[string]string `json:"env"`
+	// RedirectHosts are answered with a redirect to the first of Hosts.
+	RedirectHosts []string `json:"redirect_hosts,omitempty"`
+}
+
+// environ merges the named settings into Env.
+func (spec siteSpec) environ() (map[string]string, error) {
+	env := make(map[string]string, len(spec.Env)+4)
+	for key, value := range spec.Env {
+		env[key] = value
+	}
+	for key, value := range map[string]string{
+		"ATOM_DATA_DIR":            spec.DataDir,
+		"ATOM_MYSQL_DSN":           spec.MySQLDSN,
+		"ATOM_ELASTICSEARCH_INDEX": spec.ElasticsearchIndex,
+		"ATOM_UPLOADS_DIR":         spec.UploadsDir,
+	} {
+		if value == "" {
+			continue
+		}
+		if _, ok := env[key]; ok {
+			return nil, fmt.Errorf("%s is set both as a site setting and in env", key)
+		}
+		env[key] = value
+	}
+	return env, nil
+}
+
+// site is one AtoM served by this process. The single-site setup is a site
+// with no name, hosts or env.
+type site struct {
+	name      string
+	hosts     []string
+	env       map[string]string
+	cfg       config
+	bootstrap bootstrap.Config
+	monitor   *dependencyMonitor
+	storage   *storageService
+	rewrites  *rewriteRules
+	handler   atomic.Pointer[atomHandler]
+	// redirectHosts are aliases edgeRedirects sends to hosts[0].
+	redirectHosts []string
+	// fallback sites also answer hosts no site lists.
+	fallback bool
+	// ready is set once the site has started and handler is in place.
+	ready atomic.Bool
+}
+
+// siteStartMu runs one site's startup at a time, since each borrows the
+// process environment, and keeps atom reloads from overlapping them.
+var siteStartMu sync.Mutex
+
+// start runs the startup sequence with the site's env.
+func (s *site) start(provider secrets.Provider) error {
+	siteStartMu.Lock()
+	defer siteStartMu.Unlock()
+	return withSiteEnv(s.env, func() error {
+		var err error
+		s.bootstrap, err = startSite(s.cfg, provider)
+		if err != nil {
+			return err
+		}
+		s.storage, err = storageServiceFromEnv(context.Background(), provider)
+		if err != nil {
+			return err
+		}
+		s.rewrites, err = rewriteRulesFromEnv()
+		if err != nil {
+			return err
+		}
+		s.cfg.denyPaths, err = denyPatternsFromEnv()
+		if err != nil {
+			return err
+		}
+		s.cfg.middleware, err = routeMiddlewareFromEnv()
+		if err != nil {
+			return err
+		}
+		s.cfg.routeRules, err = routeRulesFromEnv()
+		if err != nil {
+			return err
+		}
+		s.cfg.signedURLTTL = envDuration("VALENCE_SIGNED_URL_TTL", time.Hour)
+		s.cfg.signedURLMaxTTL = envDuration("VALENCE_SIGNED_URL_MAX_TTL", 24*time.Hour)
+		return nil
+	})
+}
+
+// activate starts the site's monitor and begins serving it.
+func (s *site) activate(ctx context.Context, restarts restartPolicy) {
+	s.monitor = newDependencyMonitor(s.name, s.bootstrap)
+	go supervise(ctx, strings.TrimSpace("dependency monitor "+s.name), restarts, func(ctx context.Context) error {
+		s.monitor.run(ctx)
+		return nil
+	})
+	// Taken with siteStartMu so an atom reload cannot change s.cfg midway.
+	siteStartMu.Lock()
+	s.handler.Store(newAtomHandler(s.cfg, s.name, s.monitor, s.storage, s.rewrites))
+	siteStartMu.Unlock()
+	s.ready.Store(true)
+}
+
+// retry keeps restarting a site that failed to start, under the restart
+// policy, and activates it once it does.
+func (s *site) retry(ctx context.Context, provider secrets.Provider, restarts restartPolicy) {
+	err := supervise(ctx, "site "+s.name+" startup", restarts, func(context.Context) error {
+		return s.start(provider)
+	})
+	if err != nil {
+		logErrorf("site %s is unavailable: %v", s.name, err)
+		reporter.report("bootstrap", "error", "bootstrap", err.Error(), nil, map[string]any{"site": s.name})
+		return
+	}
+	logInfof("site %s started", s.name)
+	s.activate(ctx, restarts)
+}
+
+func (s *site) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.ready.Load() {
+		if name, ok := embeddedAssetPath(cleanPath(r.URL.Path)); ok {
+			embeddedAssetDecision("valence_asset", name).handler.ServeHTTP(w, r)
+			return
+		}
+		logRouteDecision(r, s.name, "site_unavailable", http.StatusServiceUnavailable, 0)
+		maintenanceHandler(w, r)
+		return
+	}
+	s.handler.Load().ServeHTTP(w, r)
+}
+
+// loadSites returns the sites to serve: those in VALENCE_SITES_FILE, with
+// the default one first, or the single site cfg describes.
+func loadSites(cfg config) ([]*site, error) {
+	path := strings.TrimSpace(os.Getenv("VALENCE_SITES_FILE"))
+	if path == "" {
+		return []*site{{cfg: cfg, fallback: true}}, nil
+	}
+	manifest, err := readSiteManifest(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	sites := make([]*site, 0, len(manifest.Sites))
+	for _, spec := range manifest.Sites {
+		env, err := spec.environ()
+		if err != nil {
+			return nil, fmt.Errorf("site %s: %w", spec.Name, err)
+		}
+		s := &site{name: spec.Name, env: env, cfg: cfg, fallback: spec.Name == manifest.Default}
+		for _, host := range spec.Hosts {
+			s.hosts = append(s.hosts, normalizeHost(host))
+		}
+		for _, host := range spec.RedirectHosts {
+			s.redirectHosts = append(s.redirectHosts, normalizeHost(host))
+		}
+		dataDir, err := filepath.Abs(strings.TrimSpace(env["ATOM_DATA_DIR"]))
+		if err != nil {
+			return nil, fmt.Errorf("site %s: %w", spec.Name, err)
+		}
+		s.cfg.atomDataDir = dataDir
+		if s.fallback {
+			sites = append([]*site{s}, sites...)
+		} else {
+			sites = append(sites, s)
+		}
+	}
+	return sites, nil
+}
+
+func readSiteManifest(path string) (siteManifest, error) {
+	var manifest siteManifest
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return manifest, err
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return manifest, err
+	}
+	if len(manifest.Sites) == 0 {
+		return manifest, errors.New("no sites")
+	}
+
+	names := map[string]bool{}
+	hosts := map[string]string{}
+	dataDirs := map[string]string{}
+	for _, spec := range manifest.Sites {
+		switch {
+		case spec.Name == "":
+			return manifest, errors.New("site without a name")
+		case names[spec.Name]:
+			return manifest, fmt.Errorf("site %s is listed twice", spec.Name)
+		case len(spec.Hosts) == 0:
+			return manifest, fmt.Errorf("site %s has no hosts", spec.Name)
+		}
+		names[spec.Name] = true
+		for _, host := range spec.Hosts {
+			host = normalizeHost(host)
+			if other, ok := hosts[host]; ok {
+				return manifest, fmt.Errorf("host %s belongs to sites %s and %s", host, other, spec.Name)
+			}
+			hosts[host] = spec.Name
+		}
+	}
+	for _, spec := range manifest.Sites {
+		for _, host := range spec.RedirectHosts {
+			host = normalizeHost(host)
+			if other, ok := hosts[host]; ok {
+				return manifest, fmt.Errorf("redirect host %s of site %s is already used by site %s", host, spec.Name, other)
+			}
+			hosts[host] = spec.Name
+		}
+	}
+	for _, spec := range manifest.Sites {
+		env, err := spec.environ()
+		if err != nil {
+			return manifest, fmt.Errorf("site %s: %w", spec.Name, err)
+		}
+		dataDir := filepath.Clean(strings.TrimSpace(env["ATOM_DATA_DIR"]))
+		if dataDir == "." {
+			return manifest, fmt.Errorf("site %s needs its own data_dir", spec.Name)
+		}
+		if other, ok := dataDirs[dataDir]; ok {
+			return manifest, fmt.Errorf("sites %s and %s share ATOM_DATA_DIR %s", other, spec.Name, dataDir)
+		}
+		dataDirs[dataDir] = spec.Name
+	}
+	if manifest.Default != "" && !names[manifest.Default] {
+		return manifest, fmt.Errorf("default site %s is not listed", manifest.Default)
+	}
+	return manifest, nil
+}
+
+// withSiteEnv runs fn with the site's env set in the process environment,
+// restoring it afterwards. Callers hold siteStartMu: site startups and
+// retries, bootstrap status checks, cache clears and atom reloads, all of
+// which read config or run symfony through the environment, also while
+// other sites serve. Request handlers therefore never read the
+// environment; what they need is read into the site's config at startup.
+func withSiteEnv(env map[string]string, fn func() error) error {
+	type saved struct {
+		value string
+		set   bool
+	}
+	previous := make(map[string]saved, len(env))
+	for key, value := range env {
+		old, set := os.LookupEnv(key)
+		previous[key] = saved{old, set}
+		if err := os.Setenv(key, value); err != nil {
+			return err
+		}
+	}
+	defer func() {
+		for key, old := range previous {
+			if old.set {
+				_ = os.Setenv(key, old.value)
+			} else {
+				_ = os.Unsetenv(key)
+			}
+		}
+	}()
+	return fn()
+}
+
+// siteRouter hands each request to the site its Host names.
+type siteRouter struct {
+	hosts    map[string]*site
+	fallback *site
+}
+
+func newSiteRouter(sites []*site) *siteRouter {
+	router := &siteRouter{hosts: map[string]*site{}}
+	for _, s := range sites {
+		for _, host := range s.hosts {
+			router.hosts[host] = s
+		}
+		if s.fallback {
+			router.fallback = s
+		}
+	}
+	return router
+}
+
+// siteFor returns the site that serves host, or nil.
+func (sr *siteRouter) siteFor(host string) *site {
+	if s, ok := sr.hosts[normalizeHost(host)]; ok {
+		return s
+	}
+	return sr.fallback
+}
+
+func (sr *siteRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s := sr.siteFor(r.Host); s != nil {
+		s.ServeHTTP(w, r)
+		return
+	}
+	logRouteDecision(r, "-", "unknown_host", http.StatusNotFound, 0)
+	http.Error(w, "unknown site", http.StatusNotFound)
+}
+
+// normalizeHost lowercases a Host header value and drops its port.
+func normalizeHost(host string) string {
+	host = strings.ToLower(strings.TrimSpace(host))
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(host, ".")
+}
+
+func logSites(sites []*site) {
+	if len(sites) == 1 && sites[0].name == "" {
+		return
+	}
+	for _, s := range sites {
+		logInfof("site %s: hosts=%s data_dir=%s", s.name, strings.Join(s.hosts, ","), s.cfg.atomDataDir)
+	}
+}
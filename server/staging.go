@@ -0,0 +1,38 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+)
+
+// VALENCE_ENVIRONMENT names the deployment, production when unset. Any
+// other environment, such as staging, is kept out of search engines: every
+// response carries X-Robots-Tag: noindex and robots.txt disallows
+// everything, whatever the atom root's says. VALENCE_NOINDEX overrides
+// this either way.
+func valenceEnvironment() string {
+	return strings.ToLower(envOrDefault("VALENCE_ENVIRONMENT", "production"))
+}
+
+func noindexFromEnv() bool {
+	return envBool("VALENCE_NOINDEX", valenceEnvironment() != "production")
+}
+
+var disallowAllRobots = []byte("User-agent: *\nDisallow: /\n")
+
+// withNoindex tags every response noindex and answers robots.txt itself.
+func withNoindex(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Robots-Tag", "noindex, nofollow")
+		if r.URL.Path == "/robots.txt" && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Header().Set("Cache-Control", "no-store")
+			w.WriteHeader(http.StatusOK)
+			if r.Method == http.MethodGet {
+				_, _ = w.Write(disallowAllRobots)
+			}
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
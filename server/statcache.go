@@ -0,0 +1,84 @@
+package server
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// statCache remembers whether routing found a regular file at a path, so
+// the stats decideRoute makes for every request (often against an NFS
+// mounted atom root) are not repeated for each one. Found files are kept
+// VALENCE_STAT_CACHE_TTL (5s), missing ones VALENCE_STAT_CACHE_NEGATIVE_TTL
+// (1s), which bounds how long a new file, such as a finished export, can
+// go unnoticed. A TTL of 0 turns that side of the cache off.
+type statCache struct {
+	ttl         time.Duration
+	negativeTTL time.Duration
+	maxEntries  int
+
+	mu      sync.Mutex
+	entries map[string]statEntry
+}
+
+type statEntry struct {
+	isFile  bool
+	expires time.Time
+}
+
+func newStatCacheFromEnv() *statCache {
+	return &statCache{
+		ttl:         envDuration("VALENCE_STAT_CACHE_TTL", 5*time.Second),
+		negativeTTL: envDuration("VALENCE_STAT_CACHE_NEGATIVE_TTL", time.Second),
+		maxEntries:  max(envInt("VALENCE_STAT_CACHE_SIZE", 10000), 1),
+		entries:     map[string]statEntry{},
+	}
+}
+
+// isFile reports whether path is a regular file. stat reports whether the
+// file system was asked rather than the cache.
+func (c *statCache) isFile(path string, now time.Time) (isFile, stat bool) {
+	if c == nil || (c.ttl <= 0 && c.negativeTTL <= 0) {
+		return statIsFile(path), true
+	}
+	c.mu.Lock()
+	entry, ok := c.entries[path]
+	c.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.isFile, false
+	}
+
+	isFile = statIsFile(path)
+	ttl := c.ttl
+	if !isFile {
+		ttl = c.negativeTTL
+	}
+	if ttl <= 0 {
+		return isFile, true
+	}
+	c.mu.Lock()
+	if len(c.entries) >= c.maxEntries {
+		c.pruneLocked(now)
+	}
+	c.entries[path] = statEntry{isFile: isFile, expires: now.Add(ttl)}
+	c.mu.Unlock()
+	return isFile, true
+}
+
+// pruneLocked drops expired entries, and everything when that is not
+// enough; a cold cache only costs a round of stats.
+func (c *statCache) pruneLocked(now time.Time) {
+	for path, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, path)
+		}
+	}
+	if len(c.entries) >= c.maxEntries {
+		clear(c.entries)
+	}
+}
+
+func statIsFile(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir()
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// VALENCE_STATE_STORE=local keeps the data valence owns, API keys, the
+// task API's job history and the audit log, in a database file of its own
+// instead of the AtoM database, for operators who want the AtoM schema
+// left as AtoM made it. The file is VALENCE_STATE_DB, by default valence.db
+// in ATOM_DATA_DIR (or the atom root, outside any versions dir). It is a
+// bbolt file rather than SQLite: the SQLite drivers need cgo and their own
+// copy of SQLite linked next to PHP, or are a large pure Go translation,
+// while a key-value file covers what valence keeps. With mysql, the
+// default, keys live in the valence_api_key table, job history only in
+// memory and the audit log only in VALENCE_AUDIT_LOG_FILE. Storage
+// locations are not stored: valence serves a fixed list.
+//
+// Each use opens and closes the file, which bbolt locks, so valence
+// api-key can change it while the server runs.
+
+const stateOpenTimeout = 5 * time.Second
+
+var (
+	stateAPIKeysBucket  = []byte("api_keys")
+	stateTaskJobsBucket = []byte("task_jobs")
+	stateAuditBucket    = []byte("audit")
+)
+
+// stateDBFromEnv returns the path of the state database, or "" when
+// VALENCE_STATE_STORE keeps state in the AtoM database.
+func stateDBFromEnv() (string, error) {
+	switch store := strings.ToLower(envOrDefault("VALENCE_STATE_STORE", "mysql")); store {
+	case "mysql":
+		return "", nil
+	case "local":
+	default:
+		return "", fmt.Errorf("invalid VALENCE_STATE_STORE %q (want mysql or local)", store)
+	}
+	if path := strings.TrimSpace(os.Getenv("VALENCE_STATE_DB")); path != "" {
+		return filepath.Abs(path)
+	}
+	dir := strings.TrimSpace(os.Getenv("ATOM_DATA_DIR"))
+	if dir == "" {
+		dir = atomVersionsDir()
+	}
+	if dir == "" {
+		dir = strings.TrimSpace(os.Getenv("VALENCE_ATOM_SRC_DIR"))
+	}
+	if dir == "" {
+		return "", errors.New("VALENCE_STATE_DB is required without ATOM_DATA_DIR")
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "valence.db"), nil
+}
+
+// stateView reads the state database at path. A database not created yet
+// reads as empty: fn sees no buckets.
+func stateView(path string, fn func(tx *bbolt.Tx) error) error {
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	db, err := bbolt.Open(path, 0o600, &bbolt.Options{Timeout: stateOpenTimeout, ReadOnly: true})
+	if err != nil {
+		return fmt.Errorf("state db %s: %w", path, err)
+	}
+	defer db.Close()
+	return db.View(fn)
+}
+
+// stateUpdate changes the state database at path, creating it.
+func stateUpdate(path string, fn func(tx *bbolt.Tx) error) error {
+	db, err := bbolt.Open(path, 0o600, &bbolt.Options{Timeout: stateOpenTimeout})
+	if err != nil {
+		return fmt.Errorf("state db %s: %w", path, err)
+	}
+	defer db.Close()
+	return db.Update(fn)
+}
@@ -1,9 +1,8 @@
-package main
+package server
 
 import (
 	"encoding/json"
 	"net/http"
-	"os"
 	"strings"
 )
 
@@ -38,14 +37,26 @@ func storageLocationsHandler(w http.ResponseWriter, r *http.Request) {
 	_ = json.NewEncoder(w).Encode(storageLocationsResponse{Locations: locations})
 }
 
+// authorizeInternalAPI lets r through with the internal API token, or an
+// API key holding the scope the endpoint needs. With neither configured
+// the internal API is open.
 func authorizeInternalAPI(w http.ResponseWriter, r *http.Request) bool {
-	token := strings.TrimSpace(os.Getenv("ATOM_VALENCE_INTERNAL_TOKEN"))
-	if token == "" {
+	token := internalAPIToken()
+	if !internalAPIConfigured() {
 		return true
 	}
-	if strings.TrimSpace(r.Header.Get("Authorization")) == "Bearer "+token {
+	if token != "" && strings.TrimSpace(r.Header.Get("Authorization")) == "Bearer "+token {
 		return true
 	}
+	if key, ok := bearerAPIKey(r); ok {
+		if scope := requiredScope(r); !key.allows(scope) {
+			authFailures.record(r, "internal_api", http.StatusForbidden)
+			http.Error(w, "api key lacks scope "+scope, http.StatusForbidden)
+			return false
+		}
+		return true
+	}
+	authFailures.record(r, "internal_api", http.StatusUnauthorized)
 	http.Error(w, "unauthorized", http.StatusUnauthorized)
 	return false
 }
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"time"
+)
+
+// errGaveUp is returned by supervise once a function has been restarted
+// restartPolicy.maxRestarts times without a stable run in between.
+var errGaveUp = errors.New("too many restarts")
+
+// restartPolicy is how supervise restarts a function that fails: after
+// backoff, doubling up to maxBackoff, at most maxRestarts times in a row
+// (0 for no limit). A run that lasts maxBackoff counts as stable and resets
+// both.
+type restartPolicy struct {
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	maxRestarts int
+}
+
+// restartPolicyFromEnv reads VALENCE_RESTART_BACKOFF,
+// VALENCE_RESTART_MAX_BACKOFF and VALENCE_RESTART_MAX.
+func restartPolicyFromEnv() restartPolicy {
+	p := restartPolicy{
+		backoff:     envDuration("VALENCE_RESTART_BACKOFF", time.Second),
+		maxBackoff:  envDuration("VALENCE_RESTART_MAX_BACKOFF", 5*time.Minute),
+		maxRestarts: envInt("VALENCE_RESTART_MAX", 5),
+	}
+	if p.backoff <= 0 {
+		p.backoff = time.Second
+	}
+	p.maxBackoff = max(p.maxBackoff, p.backoff)
+	return p
+}
+
+// supervise runs fn until it returns nil or ctx is done, restarting it
+// under policy when it returns an error or panics. It returns the last
+// error, wrapped in errGaveUp when the restart limit was hit.
+func supervise(ctx context.Context, name string, policy restartPolicy, fn func(context.Context) error) error {
+	backoff := policy.backoff
+	restarts := 0
+	for {
+		start := time.Now()
+		err := runRecovered(ctx, fn)
+		ran := time.Since(start)
+		switch {
+		case ctx.Err() != nil:
+			logInfof("%s stopped", name)
+			return ctx.Err()
+		case err == nil:
+			if restarts > 0 {
+				logInfof("%s finished after %d restarts", name, restarts)
+			}
+			return nil
+		}
+
+		if ran >= policy.maxBackoff {
+			backoff, restarts = policy.backoff, 0
+		}
+		if policy.maxRestarts > 0 && restarts >= policy.maxRestarts {
+			logErrorf("%s failed: %v; giving up after %d restarts", name, err, restarts)
+			return fmt.Errorf("%w: %w", errGaveUp, err)
+		}
+		restarts++
+		supervisedRestarts.WithLabelValues(name).Inc()
+		logWarnf("%s failed after %s: %v; restarting in %s (attempt %d)", name, ran.Round(time.Millisecond), err, backoff, restarts)
+
+		select {
+		case <-ctx.Done():
+			logInfof("%s stopped", name)
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, policy.maxBackoff)
+	}
+}
+
+// runRecovered turns a panic in fn into an error carrying the stack.
+func runRecovered(ctx context.Context, fn func(context.Context) error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			stack := debug.Stack()
+			reporter.report("panic", "fatal", "panic", fmt.Sprint(r), nil, map[string]any{"stack": string(stack)})
+			err = fmt.Errorf("panic: %v\n%s", r, stack)
+		}
+	}()
+	return fn(ctx)
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/artefactual-labs/valence/internal/atomembed"
+	"github.com/artefactual-labs/valence/internal/bootstrap"
+	"github.com/dunglas/frankenphp"
+)
+
+// processStart is when valence started, for uptime.
+var processStart = time.Now()
+
+type systemInfo struct {
+	Valence  buildInfo             `json:"valence"`
+	Atom     atomembed.ArchiveInfo `json:"atom"`
+	AtomRoot struct {
+		Path   string `json:"path"`
+		SHA256 string `json:"sha256"`
+	} `json:"atom_root"`
+	VersionsDir   string     `json:"versions_dir,omitempty"`
+	PHPExtensions []string   `json:"php_extensions"`
+	Sites         []siteInfo `json:"sites"`
+	StartedAt     time.Time  `json:"started_at"`
+	UptimeSeconds int64      `json:"uptime_seconds"`
+}
+
+// siteInfo describes one site's data dirs and dependencies. Hosts are
+// reported without credentials; sites still starting have no dependencies.
+type siteInfo struct {
+	Name         string            `json:"name,omitempty"`
+	Ready        bool              `json:"ready"`
+	DataDir      string            `json:"data_dir,omitempty"`
+	UploadsSpool string            `json:"uploads_spool,omitempty"`
+	Dependencies map[string]string `json:"dependencies,omitempty"`
+}
+
+// systemInfoHandler reports what valence and the loaded AtoM archive were
+// built from, which archive the served atom root was extracted from (they
+// differ when an older version is pinned), the PHP extensions loaded and
+// each site's dirs and dependency hosts, for fleet inventory. phpRoot
+// follows reloads.
+func systemInfoHandler(phpRoot func() string, sites []*site) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !authorizeInternalAPI(w, r) {
+			return
+		}
+
+		var info systemInfo
+		info.Valence = currentBuild()
+		info.Atom, _ = atomembed.Info()
+		root := phpRoot()
+		info.AtomRoot.Path = root
+		info.AtomRoot.SHA256 = atomembed.InstalledHash(root)
+		info.VersionsDir = atomVersionsDir()
+		var err error
+		if info.PHPExtensions, err = loadedPHPExtensions(); err != nil {
+			logWarnf("system info: php extensions: %v", err)
+		}
+		for _, s := range sites {
+			info.Sites = append(info.Sites, s.info())
+		}
+		info.StartedAt = processStart.UTC()
+		info.UptimeSeconds = int64(time.Since(processStart).Seconds())
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		_ = json.NewEncoder(w).Encode(info)
+	}
+}
+
+func (s *site) info() siteInfo {
+	info := siteInfo{Name: s.name, Ready: s.ready.Load()}
+	if h := s.handler.Load(); h != nil {
+		info.DataDir = h.atomDataDir
+		info.UploadsSpool = uploadSpoolDir(config{phpRoot: h.phpRoot, atomDataDir: h.atomDataDir})
+	} else {
+		info.DataDir = s.cfg.atomDataDir
+	}
+	if info.Ready {
+		info.Dependencies = dependencyHosts(s.bootstrap)
+	}
+	return info
+}
+
+// dependencyHosts lists where a site's dependencies live, leaving out
+// user names, passwords and keys.
+func dependencyHosts(cfg bootstrap.Config) map[string]string {
+	hosts := map[string]string{}
+	if dsn, err := bootstrap.ParseMySQLDSN(cfg.MySQLDSN); err == nil {
+		_, addr := dsn.Network()
+		hosts["mysql"] = addr + "/" + dsn.DBName
+	}
+	var nodes []string
+	for _, node := range cfg.ElasticsearchNodes() {
+		nodes = append(nodes, redactHost(node))
+	}
+	hosts["elasticsearch"] = strings.Join(nodes, ",")
+	if cfg.CacheEngine == "redis" {
+		hosts["redis"] = redactHost(cfg.RedisHost)
+	} else {
+		hosts["memcached"] = redactHost(cfg.MemcachedHost)
+	}
+	hosts["gearmand"] = redactHost(cfg.GearmandHost)
+	if cfg.SMTPHost != "" {
+		hosts["smtp"] = fmt.Sprintf("%s:%d", cfg.SMTPHost, cfg.SMTPPort)
+	}
+	for name, host := range hosts {
+		if host == "" {
+			delete(hosts, name)
+		}
+	}
+	return hosts
+}
+
+// redactHost drops the user info from a host or URL.
+func redactHost(host string) string {
+	host = strings.TrimSpace(host)
+	if !strings.Contains(host, "://") {
+		if _, after, ok := strings.Cut(host, "@"); ok {
+			return after
+		}
+		return host
+	}
+	u, err := url.Parse(host)
+	if err != nil {
+		return ""
+	}
+	u.User = nil
+	return u.String()
+}
+
+const phpExtensionsScript = `<?php
+$extensions = get_loaded_extensions();
+foreach (get_loaded_extensions(true) as $zend) {
+  $extensions[] = $zend;
+}
+file_put_contents($argv[1], json_encode($extensions));
+`
+
+// loadedPHPExtensions lists the runtime's extensions, asked once through a
+// CLI script since they cannot change while valence runs.
+var loadedPHPExtensions = sync.OnceValues(func() ([]string, error) {
+	script, err := os.CreateTemp("", "valence-extensions-*.php")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(script.Name())
+	_, err = script.WriteString(phpExtensionsScript)
+	script.Close()
+	if err != nil {
+		return nil, err
+	}
+	result := script.Name() + ".json"
+	defer os.Remove(result)
+
+	if code := frankenphp.ExecuteScriptCLI(script.Name(), []string{script.Name(), result}); code != 0 {
+		return nil, fmt.Errorf("php exited with code %d", code)
+	}
+	data, err := os.ReadFile(result)
+	if err != nil {
+		return nil, err
+	}
+	var extensions []string
+	if err := json.Unmarshal(data, &extensions); err != nil {
+		return nil, err
+	}
+	sort.Strings(extensions)
+	return extensions, nil
+})
@@ -0,0 +1,522 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// taskAPI runs allowlisted symfony tasks for the site the request's Host
+// names, in the background, through POST /v/tasks:
+//
+//	{"task": "search:populate", "options": {"exclude-types": "term"}}
+//
+// Options are passed as --name=value, or --name when the value is empty,
+// and only those listed in allowedTasks are accepted. csv:import reads a
+// file uploaded first to POST /v/tasks/files or an upload URL from
+// POST /v/uploads, named by "file". Jobs run
+// one at a time, after any scheduled task, and their output is kept for
+// GET /v/tasks/<id> with the last taskJobsKept jobs, across restarts with
+// VALENCE_STATE_STORE=local.
+type taskAPI struct {
+	router      *siteRouter
+	tasks       *scheduler
+	root        func() string
+	uploadLimit int64
+
+	mu   sync.Mutex
+	jobs []*taskJob // oldest first
+	// uploaded maps the files stored through upload URLs to when their
+	// URL expires, so a URL stays used after a job removes its file.
+	uploaded map[string]time.Time
+	// state is the state database jobs are recorded in, if any.
+	state string
+}
+
+// allowedTasks maps each task the API runs to the options it accepts.
+var allowedTasks = map[string][]string{
+	"search:populate":  {"exclude-types", "slices", "batch-size", "update"},
+	"sitemap:generate": {"base-url", "output-directory", "indent", "no-compress"},
+	"csv:import": {
+		"source-name", "default-parent-slug", "default-legacy-parent-id", "update", "skip-matched",
+		"skip-unmatched", "skip-derivatives", "skip-nested-set-build", "index", "limit", "keep-digital-objects", "roundtrip",
+	},
+}
+
+// tasksWithFile read the uploaded file named in the request, passed as
+// their argument.
+var tasksWithFile = []string{"csv:import"}
+
+const (
+	taskJobsKept = 50
+	// taskOutputKept bounds the output kept per job, from the end.
+	taskOutputKept = 64 << 10
+)
+
+var taskFileRe = regexp.MustCompile(`^[0-9a-f]{16}$`)
+
+type taskJob struct {
+	ID         string     `json:"id"`
+	Site       string     `json:"site,omitempty"`
+	Task       string     `json:"task"`
+	Args       []string   `json:"args"`
+	Status     string     `json:"status"` // queued, running, done or failed
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	Output     string     `json:"output,omitempty"`
+
+	outputPath string
+	filePath   string
+}
+
+type taskRequest struct {
+	Task    string            `json:"task"`
+	Options map[string]string `json:"options"`
+	File    string            `json:"file,omitempty"`
+}
+
+func newTaskAPI(router *siteRouter, tasks *scheduler, root func() string) (*taskAPI, error) {
+	api := &taskAPI{router: router, tasks: tasks, root: root, uploadLimit: 512 << 20, uploaded: map[string]time.Time{}}
+	if val := strings.TrimSpace(os.Getenv("VALENCE_TASK_UPLOAD_LIMIT")); val != "" {
+		limit, err := parseByteSize(val)
+		if err != nil {
+			return nil, fmt.Errorf("VALENCE_TASK_UPLOAD_LIMIT: %w", err)
+		}
+		api.uploadLimit = limit
+	}
+	var err error
+	if api.state, err = stateDBFromEnv(); err != nil {
+		return nil, err
+	}
+	if api.state != "" {
+		if api.jobs, err = loadTaskJobs(api.state); err != nil {
+			return nil, err
+		}
+	}
+	return api, nil
+}
+
+// taskFilesDir holds a site's uploaded task files until a job uses them.
+func taskFilesDir(h *atomHandler) string {
+	dataDir := h.atomDataDir
+	if dataDir == "" {
+		dataDir = h.phpRoot
+	}
+	return filepath.Join(dataDir, "tmp", "tasks")
+}
+
+func newTaskID() string {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// taskArgs validates req against the allowlist and returns the task's
+// symfony arguments.
+func taskArgs(req taskRequest) ([]string, error) {
+	allowed, ok := allowedTasks[req.Task]
+	if !ok {
+		names := make([]string, 0, len(allowedTasks))
+		for name := range allowedTasks {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("task must be one of %s", strings.Join(names, ", "))
+	}
+	args := []string{req.Task}
+	names := make([]string, 0, len(req.Options))
+	for name := range req.Options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !slices.Contains(allowed, name) {
+			return nil, fmt.Errorf("%s does not accept option %q", req.Task, name)
+		}
+		if value := req.Options[name]; value != "" {
+			args = append(args, "--"+name+"="+value)
+		} else {
+			args = append(args, "--"+name)
+		}
+	}
+	needsFile := slices.Contains(tasksWithFile, req.Task)
+	switch {
+	case needsFile && !taskFileRe.MatchString(req.File):
+		return nil, fmt.Errorf("%s needs a file uploaded to /v/tasks/files", req.Task)
+	case !needsFile && req.File != "":
+		return nil, fmt.Errorf("%s does not take a file", req.Task)
+	}
+	return args, nil
+}
+
+func (api *taskAPI) start(s *site, h *atomHandler, req taskRequest) (taskJob, error) {
+	args, err := taskArgs(req)
+	if err != nil {
+		return taskJob{}, err
+	}
+	job := &taskJob{ID: newTaskID(), Site: s.name, Task: req.Task, Args: args, Status: "queued", CreatedAt: time.Now().UTC()}
+	if req.File != "" {
+		job.filePath = filepath.Join(taskFilesDir(h), req.File)
+		if _, err := os.Stat(job.filePath); err != nil {
+			return taskJob{}, fmt.Errorf("file %s not found", req.File)
+		}
+		job.Args = append(job.Args, job.filePath)
+	}
+	output, err := os.CreateTemp("", "valence-task-*.log")
+	if err != nil {
+		return taskJob{}, err
+	}
+	output.Close()
+	job.outputPath = output.Name()
+
+	api.mu.Lock()
+	api.jobs = append(api.jobs, job)
+	if len(api.jobs) > taskJobsKept {
+		api.jobs = api.jobs[len(api.jobs)-taskJobsKept:]
+	}
+	snapshot := *job
+	api.mu.Unlock()
+	api.persist(snapshot)
+
+	go api.run(s, job)
+	return snapshot, nil
+}
+
+func (api *taskAPI) run(s *site, job *taskJob) {
+	// Tasks share the PHP runtime with scheduled tasks, and the atom root
+	// with cache clears and reloads. The site's env is handed to the
+	// script, so startup, retries and status checks of other sites do not
+	// wait for a long task.
+	api.tasks.runMu.Lock()
+	defer api.tasks.runMu.Unlock()
+
+	api.mu.Lock()
+	now := time.Now().UTC()
+	job.StartedAt = &now
+	job.Status = "running"
+	api.mu.Unlock()
+	logInfof("task %s: running symfony %s", job.ID, strings.Join(job.Args, " "))
+
+	err := runTaskScript(api.root(), s.env, job.Args, job.outputPath)
+
+	output, _ := tailFile(job.outputPath, taskOutputKept)
+	_ = os.Remove(job.outputPath)
+	if job.filePath != "" {
+		_ = os.Remove(job.filePath)
+	}
+
+	api.mu.Lock()
+	defer func() {
+		snapshot := *job
+		api.mu.Unlock()
+		api.persist(snapshot)
+	}()
+	finished := time.Now().UTC()
+	job.FinishedAt = &finished
+	job.Output = output
+	job.outputPath = ""
+	job.Status = "done"
+	if err != nil {
+		job.Status = "failed"
+		job.Error = err.Error()
+		logErrorf("task %s: %s failed: %v", job.ID, job.Task, err)
+	} else {
+		logInfof("task %s: %s finished in %s", job.ID, job.Task, finished.Sub(*job.StartedAt).Round(time.Millisecond))
+	}
+}
+
+// taskScript runs $args in-process, appending what the task logs and
+// prints to $output.
+const taskScript = `ini_set('memory_limit', '-1');
+$configuration->getEventDispatcher()->connect('command.log', function (sfEvent $event) use ($output) {
+  foreach ($event->getParameters() as $message) {
+    file_put_contents($output, $message."\n", FILE_APPEND);
+  }
+});
+ob_start(function ($buffer) use ($output) {
+  file_put_contents($output, $buffer, FILE_APPEND);
+
+  return '';
+}, 4096);
+$status = $runTask($args);
+ob_end_flush();
+exit($status);
+`
+
+func runTaskScript(root string, env map[string]string, args []string, output string) error {
+	code := strings.Builder{}
+	code.WriteString("$args = [\n")
+	for _, arg := range args {
+		code.WriteString(fmt.Sprintf("  '%s',\n", phpEscape(arg)))
+	}
+	code.WriteString("];\n")
+	code.WriteString(fmt.Sprintf("$output = '%s';\n", phpEscape(output)))
+	code.WriteString(taskScript)
+	return runAtomScriptEnv(root, env, code.String())
+}
+
+// tailFile returns up to the last n bytes of path.
+func tailFile(path string, n int64) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	if info.Size() > n {
+		if _, err := f.Seek(info.Size()-n, io.SeekStart); err != nil {
+			return "", err
+		}
+	}
+	data, err := io.ReadAll(f)
+	return string(data), err
+}
+
+// job returns a copy of the job with its output so far.
+func (api *taskAPI) job(id string) (taskJob, bool) {
+	api.mu.Lock()
+	var found *taskJob
+	for _, job := range api.jobs {
+		if job.ID == id {
+			found = job
+		}
+	}
+	if found == nil {
+		api.mu.Unlock()
+		return taskJob{}, false
+	}
+	job := *found
+	api.mu.Unlock()
+	if job.outputPath != "" {
+		job.Output, _ = tailFile(job.outputPath, taskOutputKept)
+	}
+	return job, true
+}
+
+// list returns the kept jobs, newest first, without their output.
+func (api *taskAPI) list() []taskJob {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	jobs := make([]taskJob, 0, len(api.jobs))
+	for i := len(api.jobs) - 1; i >= 0; i-- {
+		job := *api.jobs[i]
+		job.Output = ""
+		jobs = append(jobs, job)
+	}
+	return jobs
+}
+
+// loadTaskJobs reads the jobs recorded in the state database. Jobs that
+// had not finished were cut short by the restart.
+func loadTaskJobs(path string) ([]*taskJob, error) {
+	var jobs []*taskJob
+	err := stateView(path, func(tx *bbolt.Tx) error {
+		b := tx.Bucket(stateTaskJobsBucket)
+		if b == nil {
+			return nil
+		}
+		var err error
+		jobs, err = readTaskJobs(b)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("task jobs: %w", err)
+	}
+	for _, job := range jobs {
+		if job.Status == "queued" || job.Status == "running" {
+			job.Status = "failed"
+			job.Error = "interrupted by a restart"
+		}
+	}
+	return jobs[max(len(jobs)-taskJobsKept, 0):], nil
+}
+
+// readTaskJobs returns the jobs in b, oldest first.
+func readTaskJobs(b *bbolt.Bucket) ([]*taskJob, error) {
+	var jobs []*taskJob
+	err := b.ForEach(func(_, data []byte) error {
+		job := &taskJob{}
+		if err := json.Unmarshal(data, job); err != nil {
+			return err
+		}
+		jobs = append(jobs, job)
+		return nil
+	})
+	sort.SliceStable(jobs, func(i, j int) bool { return jobs[i].CreatedAt.Before(jobs[j].CreatedAt) })
+	return jobs, err
+}
+
+// persist records job in the state database, if there is one, and drops
+// the jobs older than the last taskJobsKept.
+func (api *taskAPI) persist(job taskJob) {
+	if api.state == "" {
+		return
+	}
+	data, err := json.Marshal(job)
+	if err == nil {
+		err = stateUpdate(api.state, func(tx *bbolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists(stateTaskJobsBucket)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(job.ID), data); err != nil {
+				return err
+			}
+			jobs, err := readTaskJobs(b)
+			if err != nil {
+				return err
+			}
+			for _, old := range jobs[:max(len(jobs)-taskJobsKept, 0)] {
+				if err := b.Delete([]byte(old.ID)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	if err != nil {
+		logWarnf("task %s: recording job: %v", job.ID, err)
+	}
+}
+
+// upload stores a task file for the site and returns its name.
+func (api *taskAPI) upload(w http.ResponseWriter, r *http.Request, h *atomHandler) (string, error) {
+	name := newTaskID()
+	return name, api.store(w, r, h, name)
+}
+
+// store writes the request body to the task file name, failing with
+// os.ErrExist when it is already there.
+func (api *taskAPI) store(w http.ResponseWriter, r *http.Request, h *atomHandler, name string) error {
+	dir := taskFilesDir(h)
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o640)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, http.MaxBytesReader(w, r.Body, api.uploadLimit))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+	}
+	return err
+}
+
+// tasksHandler serves POST /v/tasks, GET /v/tasks, GET /v/tasks/<id> and
+// POST /v/tasks/files.
+func tasksHandler(api *taskAPI) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorizeInternalAPI(w, r) {
+			return
+		}
+
+		id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/v/tasks"), "/")
+		if r.Method == http.MethodPost && !internalAPIConfigured() {
+			http.Error(w, "internal api token not configured", http.StatusForbidden)
+			return
+		}
+		var (
+			body any
+			code = http.StatusOK
+		)
+		switch {
+		case id == "" && r.Method == http.MethodGet:
+			body = api.list()
+		case id == "" && r.Method == http.MethodPost:
+			s, h, ok := api.site(w, r)
+			if !ok {
+				return
+			}
+			var req taskRequest
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+				http.Error(w, "invalid json", http.StatusBadRequest)
+				return
+			}
+			job, err := api.start(s, h, req)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Location", "/v/tasks/"+job.ID)
+			body, code = job, http.StatusAccepted
+		case id == "files" && r.Method == http.MethodPost:
+			_, h, ok := api.site(w, r)
+			if !ok {
+				return
+			}
+			name, err := api.upload(w, r, h)
+			var tooLarge *http.MaxBytesError
+			switch {
+			case errors.As(err, &tooLarge):
+				http.Error(w, "file too large", http.StatusRequestEntityTooLarge)
+				return
+			case err != nil:
+				logWarnf("task file upload: %v", err)
+				http.Error(w, "store file", http.StatusInternalServerError)
+				return
+			}
+			body, code = map[string]string{"file": name}, http.StatusCreated
+		case id == "":
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		case id == "files":
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		case r.Method != http.MethodGet:
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		default:
+			job, ok := api.job(id)
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			body = job
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(code)
+		_ = json.NewEncoder(w).Encode(body)
+	}
+}
+
+// site returns the ready site the request's Host names.
+func (api *taskAPI) site(w http.ResponseWriter, r *http.Request) (*site, *atomHandler, bool) {
+	s := api.router.siteFor(r.Host)
+	if s == nil {
+		http.Error(w, "unknown site", http.StatusNotFound)
+		return nil, nil, false
+	}
+	h := s.handler.Load()
+	if h == nil {
+		http.Error(w, "site unavailable", http.StatusServiceUnavailable)
+		return nil, nil, false
+	}
+	return s, h, true
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"fmt"
+)
+
+// enableThemeScript swaps the theme plugin stored in AtoM's "plugins"
+// setting for the requested one, leaving non-theme plugins alone.
+const enableThemeScript = `
+$setting = QubitSetting::getByName('plugins');
+if (null === $setting) {
+  fwrite(STDERR, "plugins setting not found; is the database installed?\n");
+  exit(1);
+}
+$plugins = unserialize($setting->getValue(['sourceCulture' => true]));
+if (!is_array($plugins)) {
+  $plugins = [];
+}
+
+$isTheme = function ($name) {
+  $class = $name.'Configuration';
+  $file = sfConfig::get('sf_plugins_dir').'/'.$name.'/config/'.$class.'.class.php';
+  if (!is_file($file)) {
+    return false;
+  }
+  require_once $file;
+
+  return isset($class::$summary) && false !== stripos($class::$summary, 'theme');
+};
+
+$enabled = [];
+foreach ($plugins as $plugin) {
+  if ($plugin !== $theme && !$isTheme($plugin)) {
+    $enabled[] = $plugin;
+  }
+}
+$enabled[] = $theme;
+
+if ($enabled === array_values($plugins)) {
+  exit(0);
+}
+$setting->setValue(serialize($enabled), ['sourceCulture' => true]);
+$setting->save();
+echo "enabled theme $theme\n";
+`
+
+func runEnableTheme(root, theme string) error {
+	logInfof("enabling theme %s", theme)
+	return runAtomScript(root, fmt.Sprintf("$theme = '%s';\n%s", phpEscape(theme), enableThemeScript))
+}
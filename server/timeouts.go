@@ -0,0 +1,245 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Route timeouts bound how long valence waits for a route class to answer,
+// whatever PHP's max_execution_time says. VALENCE_ROUTE_TIMEOUT_<LABEL> sets
+// a class's budget (the label in upper case, 0 for none),
+// VALENCE_PATH_TIMEOUT_<NAME>="<path prefix> <duration>" overrides it for
+// paths such as exports that need longer, the longest prefix winning, and
+// VALENCE_ROUTE_TIMEOUT covers every other class. A request that runs out
+// before writing anything is answered with a 503 page; one that already
+// started its response is cut short.
+const (
+	routeTimeoutEnvPrefix = "VALENCE_ROUTE_TIMEOUT_"
+	pathTimeoutEnvPrefix  = "VALENCE_PATH_TIMEOUT_"
+)
+
+// defaultRouteTimeouts keep the classes that answer from Go alone short.
+var defaultRouteTimeouts = map[string]time.Duration{
+	"static_missing":     5 * time.Second,
+	"deny_private":       5 * time.Second,
+	"deny_uploads_conf":  5 * time.Second,
+	"deny_configured":    5 * time.Second,
+	"deny_direct_file":   5 * time.Second,
+	"method_not_allowed": 5 * time.Second,
+	"maintenance":        5 * time.Second,
+	"shed_memory":        5 * time.Second,
+}
+
+type routeTimeouts struct {
+	fallback time.Duration
+	byLabel  map[string]time.Duration
+	byPath   []pathTimeout
+}
+
+type pathTimeout struct {
+	prefix  string
+	timeout time.Duration
+}
+
+func routeTimeoutsFromEnv() (routeTimeouts, error) {
+	t := routeTimeouts{
+		fallback: envDuration("VALENCE_ROUTE_TIMEOUT", 0),
+		byLabel:  map[string]time.Duration{},
+	}
+	for label, timeout := range defaultRouteTimeouts {
+		t.byLabel[label] = timeout
+	}
+	for _, kv := range os.Environ() {
+		key, value, _ := strings.Cut(kv, "=")
+		if name, ok := strings.CutPrefix(key, routeTimeoutEnvPrefix); ok && name != "" {
+			timeout, err := time.ParseDuration(strings.TrimSpace(value))
+			if err != nil || timeout < 0 {
+				return t, fmt.Errorf("%s: invalid duration %q", key, value)
+			}
+			t.byLabel[strings.ToLower(name)] = timeout
+			continue
+		}
+		if name, ok := strings.CutPrefix(key, pathTimeoutEnvPrefix); ok && name != "" {
+			prefix, val, ok := strings.Cut(strings.TrimSpace(value), " ")
+			if !ok || !strings.HasPrefix(prefix, "/") {
+				return t, fmt.Errorf("%s: want \"<path prefix> <duration>\", got %q", key, value)
+			}
+			timeout, err := time.ParseDuration(strings.TrimSpace(val))
+			if err != nil || timeout < 0 {
+				return t, fmt.Errorf("%s: invalid duration %q", key, val)
+			}
+			t.byPath = append(t.byPath, pathTimeout{prefix: prefix, timeout: timeout})
+		}
+	}
+	slices.SortFunc(t.byPath, func(a, b pathTimeout) int {
+		return len(b.prefix) - len(a.prefix)
+	})
+	return t, nil
+}
+
+func (t routeTimeouts) timeoutFor(label, reqPath string) time.Duration {
+	for _, p := range t.byPath {
+		if strings.HasPrefix(reqPath, p.prefix) {
+			return p.timeout
+		}
+	}
+	if timeout, ok := t.byLabel[label]; ok {
+		return timeout
+	}
+	return t.fallback
+}
+
+// wrap bounds next by the decision's timeout. Unlike http.TimeoutHandler
+// it does not buffer the response, so files and PHP output still stream.
+func (t routeTimeouts) wrap(site, label, reqPath string, next http.Handler) http.Handler {
+	timeout := t.timeoutFor(label, reqPath)
+	if timeout <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		tw := &timeoutWriter{w: w, header: w.Header().Clone(), deadline: time.Now().Add(timeout)}
+		done := make(chan struct{})
+		panicked := make(chan any, 1)
+		go func() {
+			defer func() {
+				if p := recover(); p != nil {
+					panicked <- p
+				}
+				close(done)
+			}()
+			next.ServeHTTP(tw, r.WithContext(ctx))
+		}()
+
+		select {
+		case <-done:
+			select {
+			case p := <-panicked:
+				panic(p)
+			default:
+			}
+		case <-ctx.Done():
+			// The handler may keep running (PHP does not stop), but
+			// nothing it writes reaches the client any more.
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				routeTimeoutsTotal.WithLabelValues(site, label).Inc()
+				logWarnf("%s %s: %s route timed out after %s", r.Method, reqPath, label, timeout)
+			}
+			tw.stop(errors.Is(ctx.Err(), context.DeadlineExceeded))
+		}
+	})
+}
+
+// timeoutWriter forwards to w until stop, keeping its own header map so a
+// late handler cannot race the timeout page for w's.
+type timeoutWriter struct {
+	w        http.ResponseWriter
+	header   http.Header
+	deadline time.Time
+
+	mu          sync.Mutex
+	wroteHeader bool
+	stopped     bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	tw.writeHeaderLocked(code)
+}
+
+func (tw *timeoutWriter) writeHeaderLocked(code int) {
+	if tw.stopped || tw.wroteHeader {
+		return
+	}
+	tw.wroteHeader = true
+	dst := tw.w.Header()
+	for key, values := range tw.header {
+		dst[key] = values
+	}
+	tw.w.WriteHeader(code)
+}
+
+func (tw *timeoutWriter) Write(p []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.stopped {
+		return 0, http.ErrHandlerTimeout
+	}
+	tw.writeHeaderLocked(http.StatusOK)
+	return tw.w.Write(p)
+}
+
+// ReadFrom keeps http.ServeFile's sendfile path through the wrapper. The
+// copy holds the lock, so the connection's write deadline is what cuts it
+// short when the route runs out of time.
+func (tw *timeoutWriter) ReadFrom(src io.Reader) (int64, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.stopped {
+		return 0, http.ErrHandlerTimeout
+	}
+	tw.writeHeaderLocked(http.StatusOK)
+	_ = http.NewResponseController(tw.w).SetWriteDeadline(tw.deadline)
+	return io.Copy(tw.w, src)
+}
+
+// Flush keeps streamed responses flowing through the wrapper.
+func (tw *timeoutWriter) Flush() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.stopped {
+		return
+	}
+	_ = http.NewResponseController(tw.w).Flush()
+}
+
+// stop cuts the handler off, answering with the timeout page when it has
+// not written anything and timedOut is set.
+func (tw *timeoutWriter) stop(timedOut bool) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if timedOut && !tw.wroteHeader {
+		timeoutHandler(tw.w, nil)
+	}
+	tw.stopped = true
+}
+
+var timeoutPage = []byte(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Request timed out</title>
+<link rel="icon" href="/favicon.ico">
+<link rel="stylesheet" href="/_valence/error.css">
+</head>
+<body>
+<main>
+<h1>Request timed out</h1>
+<p>The site took too long to answer this request. Please try again in a moment.</p>
+</main>
+</body>
+</html>
+`)
+
+func timeoutHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Retry-After", "30")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	_, _ = w.Write(timeoutPage)
+}
@@ -0,0 +1,240 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// certStore picks the server certificate by SNI so one listener can serve
+// every site and alias domain. A certificate from VALENCE_TLS_CERT_DIR whose
+// names cover the host wins, then ACME for the hosts it manages, then the
+// default pair from VALENCE_TLS_CERT_FILE and VALENCE_TLS_KEY_FILE.
+type certStore struct {
+	dir      string
+	certFile string
+	keyFile  string
+	acme     *autocert.Manager
+	acmeHost map[string]bool
+
+	mu     sync.RWMutex
+	byName map[string]*tls.Certificate
+	def    *tls.Certificate
+	// stamp lists the files last loaded with their sizes and mod times, so
+	// reloads only happen when something changed.
+	stamp string
+}
+
+// tlsConfigFromEnv returns the listener's TLS config, or nil when TLS is not
+// configured. hosts are the site hosts ACME may request certificates for.
+func tlsConfigFromEnv(hosts []string) (*tls.Config, *certStore, error) {
+	store := &certStore{
+		dir:      strings.TrimSpace(os.Getenv("VALENCE_TLS_CERT_DIR")),
+		certFile: strings.TrimSpace(os.Getenv("VALENCE_TLS_CERT_FILE")),
+		keyFile:  strings.TrimSpace(os.Getenv("VALENCE_TLS_KEY_FILE")),
+	}
+	if (store.certFile == "") != (store.keyFile == "") {
+		return nil, nil, errors.New("VALENCE_TLS_CERT_FILE and VALENCE_TLS_KEY_FILE must be set together")
+	}
+	if envBool("VALENCE_TLS_ACME", false) {
+		if err := store.setupACME(hosts); err != nil {
+			return nil, nil, err
+		}
+	}
+	if store.dir == "" && store.certFile == "" && store.acme == nil {
+		return nil, nil, nil
+	}
+	if err := store.load(); err != nil {
+		return nil, nil, err
+	}
+
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{"h2", "http/1.1"},
+		GetCertificate: store.getCertificate,
+	}
+	if store.acme != nil {
+		// Lets the ACME server validate hosts over this listener
+		// (tls-alpn-01), so no port 80 listener is needed.
+		cfg.NextProtos = append(cfg.NextProtos, acme.ALPNProto)
+	}
+	return cfg, store, nil
+}
+
+// setupACME configures certificates from an ACME CA (Let's Encrypt by
+// default) for the site hosts and VALENCE_TLS_ACME_HOSTS.
+func (s *certStore) setupACME(hosts []string) error {
+	cacheDir := strings.TrimSpace(os.Getenv("VALENCE_TLS_ACME_CACHE_DIR"))
+	if cacheDir == "" {
+		return errors.New("VALENCE_TLS_ACME needs VALENCE_TLS_ACME_CACHE_DIR to keep account keys and certificates")
+	}
+	for _, host := range strings.Split(os.Getenv("VALENCE_TLS_ACME_HOSTS"), ",") {
+		if host = normalizeHost(host); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	if len(hosts) == 0 {
+		return errors.New("VALENCE_TLS_ACME needs site hosts or VALENCE_TLS_ACME_HOSTS")
+	}
+	s.acmeHost = map[string]bool{}
+	for _, host := range hosts {
+		s.acmeHost[host] = true
+	}
+	s.acme = &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cacheDir),
+		HostPolicy: autocert.HostWhitelist(hosts...),
+		Email:      strings.TrimSpace(os.Getenv("VALENCE_TLS_ACME_EMAIL")),
+	}
+	if url := strings.TrimSpace(os.Getenv("VALENCE_TLS_ACME_DIRECTORY_URL")); url != "" {
+		s.acme.Client = &acme.Client{DirectoryURL: url}
+	}
+	return nil
+}
+
+// load reads the default pair and every <name>.crt/<name>.key pair in the
+// certificate dir. A certificate is served for the DNS names it carries,
+// wildcards included; the file name does not matter.
+func (s *certStore) load() error {
+	stamp, err := s.currentStamp()
+	if err != nil {
+		return err
+	}
+
+	var def *tls.Certificate
+	if s.certFile != "" {
+		cert, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+		if err != nil {
+			return fmt.Errorf("load %s: %w", s.certFile, err)
+		}
+		def = &cert
+	}
+
+	byName := map[string]*tls.Certificate{}
+	if s.dir != "" {
+		certs, err := filepath.Glob(filepath.Join(s.dir, "*.crt"))
+		if err != nil {
+			return err
+		}
+		for _, certFile := range certs {
+			keyFile := strings.TrimSuffix(certFile, ".crt") + ".key"
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				return fmt.Errorf("load %s: %w", certFile, err)
+			}
+			if len(cert.Leaf.DNSNames) == 0 {
+				return fmt.Errorf("%s has no DNS names", certFile)
+			}
+			for _, name := range cert.Leaf.DNSNames {
+				name = strings.ToLower(name)
+				if _, ok := byName[name]; ok {
+					return fmt.Errorf("%s: %s is covered by another certificate", certFile, name)
+				}
+				byName[name] = &cert
+			}
+		}
+	}
+
+	s.mu.Lock()
+	s.byName, s.def, s.stamp = byName, def, stamp
+	s.mu.Unlock()
+	logInfof("tls: loaded %d certificate names from %q, default certificate=%t, acme hosts=%d", len(byName), s.dir, def != nil, len(s.acmeHost))
+	return nil
+}
+
+func (s *certStore) currentStamp() (string, error) {
+	files := []string{}
+	if s.certFile != "" {
+		files = append(files, s.certFile, s.keyFile)
+	}
+	if s.dir != "" {
+		matches, err := filepath.Glob(filepath.Join(s.dir, "*.crt"))
+		if err != nil {
+			return "", err
+		}
+		keys, err := filepath.Glob(filepath.Join(s.dir, "*.key"))
+		if err != nil {
+			return "", err
+		}
+		files = append(files, matches...)
+		files = append(files, keys...)
+	}
+	slices.Sort(files)
+	var b strings.Builder
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, "%s %d %d\n", file, info.Size(), info.ModTime().UnixNano())
+	}
+	return b.String(), nil
+}
+
+// watch reloads the certificates when the files change, checking every
+// VALENCE_TLS_RELOAD_INTERVAL. A bad reload keeps serving the last good set.
+func (s *certStore) watch(ctx context.Context) {
+	if s.dir == "" && s.certFile == "" {
+		return
+	}
+	ticker := time.NewTicker(envDuration("VALENCE_TLS_RELOAD_INTERVAL", time.Minute))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		stamp, err := s.currentStamp()
+		if err != nil {
+			logWarnf("tls: check certificates: %v", err)
+			continue
+		}
+		s.mu.RLock()
+		changed := stamp != s.stamp
+		s.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := s.load(); err != nil {
+			logWarnf("tls: reload certificates, keeping the previous ones: %v", err)
+		}
+	}
+}
+
+func (s *certStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if s.acme != nil && slices.Contains(hello.SupportedProtos, acme.ALPNProto) {
+		return s.acme.GetCertificate(hello)
+	}
+	name := normalizeHost(hello.ServerName)
+
+	s.mu.RLock()
+	cert := s.byName[name]
+	if cert == nil {
+		if _, parent, ok := strings.Cut(name, "."); ok {
+			cert = s.byName["*."+parent]
+		}
+	}
+	def := s.def
+	s.mu.RUnlock()
+
+	switch {
+	case cert != nil:
+		return cert, nil
+	case s.acme != nil && s.acmeHost[name]:
+		return s.acme.GetCertificate(hello)
+	case def != nil:
+		return def, nil
+	}
+	return nil, fmt.Errorf("no certificate for %q", hello.ServerName)
+}
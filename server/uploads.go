@@ -0,0 +1,212 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const uploadLimitEnvPrefix = "VALENCE_UPLOAD_LIMIT_"
+
+// uploadLimits caps request bodies before they reach PHP. Bodies over the
+// route's limit are refused with a 413 as soon as Content-Length or the
+// bytes read so far show it, and large or chunked bodies are spooled to a
+// temp file under the data dir first, so a slow client holds a goroutine
+// rather than a PHP thread. php.ini's upload limits follow the largest
+// route limit, leaving enforcement to valence.
+type uploadLimits struct {
+	// maxBody applies to routes no VALENCE_UPLOAD_LIMIT_<NAME> covers.
+	maxBody int64
+	// spoolThreshold is the Content-Length from which a body is spooled;
+	// chunked bodies always are.
+	spoolThreshold int64
+	routes         []routeUploadLimit
+}
+
+// routeUploadLimit is one VALENCE_UPLOAD_LIMIT_<NAME>="<path prefix> <size>".
+type routeUploadLimit struct {
+	prefix  string
+	maxBody int64
+}
+
+func uploadLimitsFromEnv() (uploadLimits, error) {
+	limits := uploadLimits{maxBody: 72 << 20, spoolThreshold: 1 << 20}
+	var err error
+	if val := strings.TrimSpace(os.Getenv("VALENCE_UPLOAD_MAX_BODY")); val != "" {
+		if limits.maxBody, err = parseByteSize(val); err != nil {
+			return limits, fmt.Errorf("VALENCE_UPLOAD_MAX_BODY: %w", err)
+		}
+	}
+	if val := strings.TrimSpace(os.Getenv("VALENCE_UPLOAD_SPOOL_THRESHOLD")); val != "" {
+		if limits.spoolThreshold, err = parseByteSize(val); err != nil {
+			return limits, fmt.Errorf("VALENCE_UPLOAD_SPOOL_THRESHOLD: %w", err)
+		}
+	}
+	for _, kv := range os.Environ() {
+		key, value, _ := strings.Cut(kv, "=")
+		name, ok := strings.CutPrefix(key, uploadLimitEnvPrefix)
+		if !ok || name == "" {
+			continue
+		}
+		prefix, size, ok := strings.Cut(strings.TrimSpace(value), " ")
+		if !ok || !strings.HasPrefix(prefix, "/") {
+			return limits, fmt.Errorf("%s: want \"<path prefix> <size>\", got %q", key, value)
+		}
+		maxBody, err := parseByteSize(strings.TrimSpace(size))
+		if err != nil {
+			return limits, fmt.Errorf("%s: %w", key, err)
+		}
+		limits.routes = append(limits.routes, routeUploadLimit{prefix: prefix, maxBody: maxBody})
+	}
+	// The longest prefix wins.
+	slices.SortFunc(limits.routes, func(a, b routeUploadLimit) int {
+		return len(b.prefix) - len(a.prefix)
+	})
+	return limits, nil
+}
+
+// parseByteSize reads a size in bytes with an optional K, M or G suffix, as
+// php.ini writes them.
+func parseByteSize(val string) (int64, error) {
+	if val == "" {
+		return 0, errors.New("empty size")
+	}
+	shift := 0
+	switch strings.ToUpper(val[len(val)-1:]) {
+	case "K":
+		shift = 10
+	case "M":
+		shift = 20
+	case "G":
+		shift = 30
+	}
+	if shift > 0 {
+		val = val[:len(val)-1]
+	}
+	n, err := strconv.ParseInt(val, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q", val)
+	}
+	return n << shift, nil
+}
+
+func (l uploadLimits) limitFor(reqPath string) int64 {
+	for _, route := range l.routes {
+		if strings.HasPrefix(reqPath, route.prefix) {
+			return route.maxBody
+		}
+	}
+	return l.maxBody
+}
+
+// largest is the biggest body any route accepts, which php.ini must allow.
+func (l uploadLimits) largest() int64 {
+	largest := l.maxBody
+	for _, route := range l.routes {
+		largest = max(largest, route.maxBody)
+	}
+	return largest
+}
+
+// uploadSpool applies uploadLimits for one site.
+type uploadSpool struct {
+	limits uploadLimits
+	site   string
+	dir    string
+}
+
+// prepare enforces the body limit for r and, when the body is large or of
+// unknown length, reads it into a temp file that becomes the body PHP sees.
+// It returns false after answering the request itself; otherwise the
+// caller must run cleanup once PHP is done.
+func (s *uploadSpool) prepare(w http.ResponseWriter, r *http.Request) (*http.Request, func(), bool) {
+	noop := func() {}
+	if r.Body == nil || r.Body == http.NoBody || r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return r, noop, true
+	}
+	limit := s.limits.limitFor(r.URL.Path)
+	if r.ContentLength > limit {
+		s.reject(w, "too_large", limit)
+		return nil, noop, false
+	}
+	if r.ContentLength >= 0 && r.ContentLength < s.limits.spoolThreshold {
+		uploadsTotal.WithLabelValues(s.site, "streamed").Inc()
+		uploadBytes.WithLabelValues(s.site).Add(float64(r.ContentLength))
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		return r, noop, true
+	}
+
+	if err := os.MkdirAll(s.dir, 0o700); err != nil {
+		http.Error(w, "upload spool unavailable", http.StatusInternalServerError)
+		return nil, noop, false
+	}
+	file, err := os.CreateTemp(s.dir, "upload-*")
+	if err != nil {
+		http.Error(w, "upload spool unavailable", http.StatusInternalServerError)
+		return nil, noop, false
+	}
+	cleanup := func() {
+		file.Close()
+		os.Remove(file.Name())
+	}
+
+	uploadsInProgress.WithLabelValues(s.site).Inc()
+	n, err := io.Copy(file, &countingReader{r: http.MaxBytesReader(w, r.Body, limit), site: s.site})
+	uploadsInProgress.WithLabelValues(s.site).Dec()
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		cleanup()
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			s.reject(w, "too_large", limit)
+		} else {
+			uploadsTotal.WithLabelValues(s.site, "aborted").Inc()
+			http.Error(w, "upload aborted", http.StatusBadRequest)
+		}
+		return nil, noop, false
+	}
+	uploadsTotal.WithLabelValues(s.site, "spooled").Inc()
+
+	spooled := r.Clone(r.Context())
+	spooled.Body = file
+	spooled.ContentLength = n
+	spooled.TransferEncoding = nil
+	spooled.Header.Set("Content-Length", strconv.FormatInt(n, 10))
+	return spooled, cleanup, true
+}
+
+func (s *uploadSpool) reject(w http.ResponseWriter, reason string, limit int64) {
+	uploadsTotal.WithLabelValues(s.site, reason).Inc()
+	w.Header().Set("Connection", "close")
+	http.Error(w, fmt.Sprintf("request body exceeds %d bytes", limit), http.StatusRequestEntityTooLarge)
+}
+
+// countingReader feeds the received-bytes counter as a spooled body
+// arrives, so long uploads show progress.
+type countingReader struct {
+	r    io.Reader
+	site string
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	uploadBytes.WithLabelValues(c.site).Add(float64(n))
+	return n, err
+}
+
+// uploadSpoolDir is where a site's request bodies are spooled.
+func uploadSpoolDir(cfg config) string {
+	dataDir := cfg.atomDataDir
+	if dataDir == "" {
+		dataDir = cfg.phpRoot
+	}
+	return filepath.Join(dataDir, "tmp", "uploads")
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Upload URLs let a bulk ingest client put a file straight into a site's
+// task files, next to those from POST /v/tasks/files, without holding the
+// internal API token or going through AtoM's admin UI. A trusted caller
+// asks POST /v/uploads for a URL; the client PUTs the file to it before it
+// expires, once, and the returned reference is what /v/tasks takes as
+// "file". The path is reported too, for CSV digitalObjectPath columns.
+// URLs are signed like /signed/ ones, with VALENCE_SIGNED_URL_KEY.
+
+type uploadURLRequest struct {
+	// TTLSeconds defaults to VALENCE_SIGNED_URL_TTL and is capped by
+	// VALENCE_SIGNED_URL_MAX_TTL.
+	TTLSeconds int `json:"ttl_seconds,omitempty"`
+}
+
+type uploadURLResponse struct {
+	URL       string    `json:"url"`
+	File      string    `json:"file"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type uploadedFile struct {
+	File string `json:"file"`
+	Path string `json:"path"`
+}
+
+// uploadURLHandler serves POST /v/uploads, which issues an upload URL for
+// the site the Host names, and PUT /v/uploads/<file>, which stores the
+// file while the URL is valid.
+func uploadURLHandler(api *taskAPI) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/v/uploads"), "/")
+		if name == "" {
+			api.issueUploadURL(w, r)
+			return
+		}
+		if r.Method != http.MethodPut {
+			w.Header().Set("Allow", http.MethodPut)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !taskFileRe.MatchString(name) {
+			http.NotFound(w, r)
+			return
+		}
+		api.receiveUpload(w, r, name)
+	}
+}
+
+func (api *taskAPI) issueUploadURL(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizeInternalAPI(w, r) {
+		return
+	}
+	if !internalAPIConfigured() {
+		http.Error(w, "internal api token not configured", http.StatusForbidden)
+		return
+	}
+	key := signedURLKey()
+	if key == "" {
+		http.Error(w, "VALENCE_SIGNED_URL_KEY is not configured", http.StatusServiceUnavailable)
+		return
+	}
+	s, _, ok := api.site(w, r)
+	if !ok {
+		return
+	}
+
+	var req uploadURLRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req)
+	if err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+	ttl := s.cfg.signedURLTTL
+	if req.TTLSeconds > 0 {
+		ttl = time.Duration(min(int64(req.TTLSeconds), int64(s.cfg.signedURLMaxTTL/time.Second))) * time.Second
+	}
+	ttl = min(ttl, s.cfg.signedURLMaxTTL)
+	expires := time.Now().Add(ttl).Truncate(time.Second).UTC()
+
+	name := newTaskID()
+	// signURL prefixes /signed, which upload URLs are not served under.
+	url := strings.TrimPrefix(signURL(key, s.name, "/v/uploads/"+name, expires), "/signed")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(uploadURLResponse{URL: url, File: name, ExpiresAt: expires})
+}
+
+// receiveUpload stores the body of a PUT to a signed upload URL, once per
+// URL.
+func (api *taskAPI) receiveUpload(w http.ResponseWriter, r *http.Request, name string) {
+	s, h, ok := api.site(w, r)
+	if !ok {
+		return
+	}
+	// verifySignedURL strips /signed, leaving the path as signed.
+	_, expires, status := verifySignedURL(r, s.name, r.URL.Path, time.Now())
+	if status != http.StatusOK {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	if !api.claimUpload(name, expires) {
+		http.Error(w, "upload url already used", http.StatusConflict)
+		return
+	}
+
+	err := api.store(w, r, h, name)
+	if err != nil && !errors.Is(err, os.ErrExist) {
+		// Let the client retry a failed upload while the URL is valid.
+		api.releaseUpload(name)
+	}
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.Is(err, os.ErrExist):
+		http.Error(w, "upload url already used", http.StatusConflict)
+		return
+	case errors.As(err, &tooLarge):
+		http.Error(w, "file too large", http.StatusRequestEntityTooLarge)
+		return
+	case err != nil:
+		logWarnf("upload %s: %v", name, err)
+		http.Error(w, "store file", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(uploadedFile{File: name, Path: filepath.Join(taskFilesDir(h), name)})
+}
+
+// claimUpload marks name as uploaded until expires, reporting false when
+// it already was.
+func (api *taskAPI) claimUpload(name string, expires time.Time) bool {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	now := time.Now()
+	for used, until := range api.uploaded {
+		if now.After(until) {
+			delete(api.uploaded, used)
+		}
+	}
+	if _, ok := api.uploaded[name]; ok {
+		return false
+	}
+	api.uploaded[name] = expires
+	return true
+}
+
+func (api *taskAPI) releaseUpload(name string) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	delete(api.uploaded, name)
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/artefactual-labs/valence/internal/atomembed"
+	"github.com/artefactual-labs/valence/internal/bootstrap"
+)
+
+func verifyCommand(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	ignore := fs.String("ignore", "", "comma-separated paths under the atom root to skip")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	root, err := atomRootFromEnv()
+	if err != nil {
+		return err
+	}
+	root = realAtomRoot(root)
+	if url := strings.TrimSpace(os.Getenv("VALENCE_ATOM_ARCHIVE_URL")); url != "" {
+		if _, err := useRemoteArchive(context.Background(), url, ""); err != nil {
+			return fmt.Errorf("remote atom archive: %w", err)
+		}
+	}
+	if installed := atomembed.InstalledHash(root); installed != atomembed.ArchiveHash() {
+		return fmt.Errorf("%s was not extracted from this archive (installed %q)", root, installed)
+	}
+	dataDir := strings.TrimSpace(os.Getenv("ATOM_DATA_DIR"))
+	if dataDir != "" {
+		if dataDir, err = filepath.Abs(dataDir); err != nil {
+			return err
+		}
+	}
+	report, err := auditAtomRoot(root, dataDir, strings.Split(*ignore, ","))
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return err
+		}
+	} else {
+		for _, path := range report.Modified {
+			fmt.Printf("%-9s %s\n", "modified", path)
+		}
+		for _, path := range report.Missing {
+			fmt.Printf("%-9s %s\n", "missing", path)
+		}
+		for _, path := range report.Extra {
+			fmt.Printf("%-9s %s\n", "extra", path)
+		}
+	}
+	if !report.Clean() {
+		return errors.New("atom root differs from the embedded archive")
+	}
+	return nil
+}
+
+// verifyAtomRootOnStartup runs the audit when VALENCE_VERIFY_ATOM is "warn"
+// (log differences) or "fail" (refuse to start on any).
+func verifyAtomRootOnStartup(root, dataDir string) error {
+	mode := strings.ToLower(envOrDefault("VALENCE_VERIFY_ATOM", "off"))
+	switch mode {
+	case "off":
+		return nil
+	case "warn", "fail":
+	default:
+		return fmt.Errorf("invalid VALENCE_VERIFY_ATOM %q (want off, warn or fail)", mode)
+	}
+
+	if atomembed.InstalledHash(root) != atomembed.ArchiveHash() {
+		logWarnf("atom verify: %s was not extracted from the loaded archive; skipping", root)
+		return nil
+	}
+	report, err := auditAtomRoot(root, dataDir, nil)
+	if errors.Is(err, atomembed.ErrNoManifest) {
+		logWarnf("atom verify: %v; skipping", err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if report.Clean() {
+		logInfof("atom verify: %s matches the embedded archive", root)
+		return nil
+	}
+	logWarnf("atom verify: %d modified, %d missing, %d extra files under %s", len(report.Modified), len(report.Missing), len(report.Extra), root)
+	for _, path := range report.Modified {
+		logInfof("atom verify: modified %s", path)
+	}
+	for _, path := range report.Missing {
+		logInfof("atom verify: missing %s", path)
+	}
+	for _, path := range report.Extra {
+		logInfof("atom verify: extra %s", path)
+	}
+	if mode == "fail" {
+		return errors.New("atom root differs from the embedded archive")
+	}
+	return nil
+}
+
+// auditAtomRoot audits root, leaving out the files bootstrap manages there
+// (per its last summary) and their backups.
+func auditAtomRoot(root, dataDir string, ignore []string) (atomembed.AuditReport, error) {
+	summaryPath := bootstrap.Config{AtomDir: root, AtomDataDir: dataDir}.SummaryPath()
+	managed := []string{summaryPath}
+	if data, err := os.ReadFile(summaryPath); err == nil {
+		var summary bootstrap.Summary
+		if err := json.Unmarshal(data, &summary); err != nil {
+			return atomembed.AuditReport{}, fmt.Errorf("read %s: %w", summaryPath, err)
+		}
+		for _, file := range summary.Files {
+			managed = append(managed, file.Path)
+		}
+	}
+
+	var backups []string
+	for _, path := range managed {
+		rel, err := filepath.Rel(root, path)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		rel = filepath.ToSlash(rel)
+		ignore = append(ignore, rel)
+		backups = append(backups, rel+".bak.")
+	}
+
+	report, err := atomembed.Audit(root, ignore)
+	if err != nil {
+		return report, err
+	}
+	extra := report.Extra[:0]
+	for _, path := range report.Extra {
+		if !hasAnyPrefix(path, backups) {
+			extra = append(extra, path)
+		}
+	}
+	report.Extra = extra
+	return report, nil
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
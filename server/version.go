@@ -0,0 +1,101 @@
+package server
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/artefactual-labs/valence/internal/atomembed"
+	"github.com/dunglas/frankenphp"
+)
+
+// version is set at build time with
+// -ldflags "-X github.com/artefactual-labs/valence/cmd.version=...".
+var version = "dev"
+
+// buildInfo identifies the running binary.
+type buildInfo struct {
+	Version           string `json:"version"`
+	Commit            string `json:"commit,omitempty"`
+	CommitTime        string `json:"commit_time,omitempty"`
+	Modified          bool   `json:"modified,omitempty"`
+	GoVersion         string `json:"go_version"`
+	FrankenPHPVersion string `json:"frankenphp_version,omitempty"`
+	PHPVersion        string `json:"php_version"`
+	ZTS               bool   `json:"zts"`
+}
+
+func currentBuild() buildInfo {
+	php := frankenphp.Config()
+	info := buildInfo{
+		Version:    version,
+		GoVersion:  runtime.Version(),
+		PHPVersion: php.Version.Version,
+		ZTS:        php.ZTS,
+	}
+	build, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	for _, setting := range build.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			info.Commit = setting.Value
+		case "vcs.time":
+			info.CommitTime = setting.Value
+		case "vcs.modified":
+			info.Modified = setting.Value == "true"
+		}
+	}
+	for _, dep := range build.Deps {
+		if dep.Path == "github.com/dunglas/frankenphp" {
+			info.FrankenPHPVersion = dep.Version
+			if dep.Replace != nil {
+				info.FrankenPHPVersion = dep.Replace.Version
+			}
+		}
+	}
+	return info
+}
+
+func versionCommand(args []string) error {
+	fs := flag.NewFlagSet("version", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	build := currentBuild()
+	atom, _ := atomembed.Info()
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(struct {
+			Valence buildInfo             `json:"valence"`
+			Atom    atomembed.ArchiveInfo `json:"atom"`
+		}{build, atom})
+	}
+
+	commit := build.Commit
+	if commit == "" {
+		commit = "unknown"
+	} else if build.Modified {
+		commit += " (modified)"
+	}
+	fmt.Printf("valence %s\n", build.Version)
+	fmt.Printf("commit:      %s\n", commit)
+	fmt.Printf("go:          %s\n", build.GoVersion)
+	fmt.Printf("frankenphp:  %s\n", build.FrankenPHPVersion)
+	fmt.Printf("php:         %s (zts=%t)\n", build.PHPVersion, build.ZTS)
+	if !atomembed.ArchiveAvailable() {
+		fmt.Printf("atom:        no embedded archive\n")
+		return nil
+	}
+	fmt.Printf("atom:        %s\n", atom.AtomVersion)
+	fmt.Printf("atom commit: %s\n", atom.Commit)
+	fmt.Printf("atom sha256: %s\n", atom.SHA256)
+	return nil
+}
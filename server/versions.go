@@ -0,0 +1,150 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/artefactual-labs/valence/internal/atomembed"
+)
+
+// atomVersionsDir is VALENCE_ATOM_VERSIONS_DIR made absolute; when set,
+// each archive is extracted to its own directory there and
+// VALENCE_ATOM_SRC_DIR is ignored.
+func atomVersionsDir() string {
+	dir := strings.TrimSpace(os.Getenv("VALENCE_ATOM_VERSIONS_DIR"))
+	if dir == "" {
+		return ""
+	}
+	if abs, err := filepath.Abs(dir); err == nil {
+		return abs
+	}
+	return dir
+}
+
+const restartNotice = "reload (SIGUSR1 or POST /v/atom/reload) or restart valence to serve the new version"
+
+// atomCommand manages versions: list, use <name>, rollback and unpin.
+func atomCommand(args []string) error {
+	fs := flag.NewFlagSet("atom", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	base := atomVersionsDir()
+	if base == "" {
+		return errors.New("VALENCE_ATOM_VERSIONS_DIR is not set")
+	}
+
+	switch fs.Arg(0) {
+	case "", "list":
+		versions, err := atomembed.Versions(base)
+		if err != nil {
+			return err
+		}
+		for _, v := range versions {
+			flags := ""
+			if v.Current {
+				flags += " current"
+			}
+			if v.Pinned {
+				flags += " pinned"
+			}
+			fmt.Printf("%s  %s%s\n", v.Name, v.Extracted.Format("2006-01-02 15:04:05"), flags)
+		}
+		return nil
+	case "use":
+		if fs.NArg() != 2 {
+			return errors.New("usage: valence atom use <version>")
+		}
+		if err := atomembed.Use(base, fs.Arg(1)); err != nil {
+			return err
+		}
+		fmt.Printf("now using %s; %s\n", fs.Arg(1), restartNotice)
+		return nil
+	case "rollback":
+		name, err := atomembed.Rollback(base)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("rolled back to %s; %s\n", name, restartNotice)
+		return nil
+	case "unpin":
+		return atomembed.Unpin(base)
+	default:
+		return fmt.Errorf("unknown atom subcommand %q", fs.Arg(0))
+	}
+}
+
+type atomVersionsResponse struct {
+	Versions        []atomembed.Version `json:"versions"`
+	RestartRequired bool                `json:"restart_required,omitempty"`
+}
+
+// atomVersionsHandler serves GET /v/atom/versions and POST
+// /v/atom/versions/use (body {"name": ...}) and /v/atom/versions/rollback.
+// Switching needs the internal API token to be configured.
+func atomVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorizeInternalAPI(w, r) {
+		return
+	}
+	base := atomVersionsDir()
+	if base == "" {
+		http.Error(w, "atom versions are not enabled", http.StatusNotFound)
+		return
+	}
+
+	action := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/v/atom/versions"), "/")
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+	case action == "use" || action == "rollback":
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !internalAPIConfigured() {
+			http.Error(w, "internal api token not configured", http.StatusForbidden)
+			return
+		}
+		var err error
+		if action == "rollback" {
+			_, err = atomembed.Rollback(base)
+		} else {
+			var body struct {
+				Name string `json:"name"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, "invalid body", http.StatusBadRequest)
+				return
+			}
+			err = atomembed.Use(base, body.Name)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+	case action == "":
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	versions, err := atomembed.Versions(base)
+	if err != nil {
+		http.Error(w, "list versions", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(atomVersionsResponse{
+		Versions:        versions,
+		RestartRequired: r.Method == http.MethodPost,
+	})
+}
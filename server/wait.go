@@ -0,0 +1,74 @@
+package server
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// waitPolicy paces dependency checks at startup. The defaults keep the
+// original fixed 30×2s schedule; managed databases that take minutes to
+// resume want more attempts or backoff, and CI wants a short deadline.
+type waitPolicy struct {
+	attempts int
+	delay    time.Duration // before the second attempt
+	maxDelay time.Duration
+	backoff  float64 // delay multiplier per attempt; 1 keeps it fixed
+	jitter   float64 // fraction of each delay randomised, 0..1
+	deadline time.Time
+}
+
+func waitPolicyFromEnv() waitPolicy {
+	p := waitPolicy{
+		attempts: envInt("VALENCE_WAIT_ATTEMPTS", 30),
+		delay:    envDuration("VALENCE_WAIT_DELAY", 2*time.Second),
+		maxDelay: envDuration("VALENCE_WAIT_MAX_DELAY", 30*time.Second),
+		backoff:  envFloat("VALENCE_WAIT_BACKOFF", 1),
+		jitter:   envFloat("VALENCE_WAIT_JITTER", 0),
+	}
+	if p.attempts < 1 {
+		logWarnf("invalid VALENCE_WAIT_ATTEMPTS %d; using 1", p.attempts)
+		p.attempts = 1
+	}
+	if p.delay < 0 {
+		p.delay = 0
+	}
+	if p.maxDelay < p.delay {
+		p.maxDelay = p.delay
+	}
+	if p.backoff < 1 {
+		logWarnf("invalid VALENCE_WAIT_BACKOFF %g; using 1", p.backoff)
+		p.backoff = 1
+	}
+	p.jitter = min(max(p.jitter, 0), 1)
+	if timeout := envDuration("VALENCE_WAIT_TIMEOUT", 0); timeout > 0 {
+		p.deadline = time.Now().Add(timeout)
+	}
+	return p
+}
+
+// next returns how long to sleep after failed attempt i (0-based). It
+// reports false when the deadline has passed; otherwise the sleep is cut
+// short so the final attempt happens at the deadline.
+func (p waitPolicy) next(i int) (time.Duration, bool) {
+	delay := float64(p.delay)
+	for range i {
+		delay *= p.backoff
+		if delay >= float64(p.maxDelay) {
+			break
+		}
+	}
+	delay = min(delay, float64(p.maxDelay))
+	if p.jitter > 0 {
+		delay += delay * p.jitter * (2*rand.Float64() - 1)
+	}
+	d := time.Duration(delay)
+
+	if p.deadline.IsZero() {
+		return d, true
+	}
+	remaining := time.Until(p.deadline)
+	if remaining <= 0 {
+		return 0, false
+	}
+	return min(d, remaining), true
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// wellKnown serves /.well-known/. Files in VALENCE_WELL_KNOWN_DIR are
+// served as they are and take precedence; security.txt is otherwise
+// generated from VALENCE_SECURITY_* when VALENCE_SECURITY_CONTACT is set,
+// and change-password redirects to AtoM's password page. Anything else is
+// a 404.
+type wellKnown struct {
+	dir            string
+	securityTxt    string
+	changePassword string
+}
+
+func wellKnownFromEnv() (*wellKnown, error) {
+	wk := &wellKnown{
+		dir:            strings.TrimSpace(os.Getenv("VALENCE_WELL_KNOWN_DIR")),
+		changePassword: envOrDefault("VALENCE_CHANGE_PASSWORD_URL", "/user/passwordEdit"),
+	}
+	txt, err := securityTxtFromEnv(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	wk.securityTxt = txt
+	return wk, nil
+}
+
+// securityTxtFromEnv renders an RFC 9116 security.txt, or "" without a
+// contact. Expires defaults to a year after startup.
+func securityTxtFromEnv(now time.Time) (string, error) {
+	contacts := commaList(os.Getenv("VALENCE_SECURITY_CONTACT"))
+	if len(contacts) == 0 {
+		return "", nil
+	}
+	expires := now.AddDate(1, 0, 0).UTC().Truncate(time.Second)
+	if val := strings.TrimSpace(os.Getenv("VALENCE_SECURITY_EXPIRES")); val != "" {
+		var err error
+		expires, err = time.Parse(time.RFC3339, val)
+		if err != nil {
+			return "", fmt.Errorf("VALENCE_SECURITY_EXPIRES: %w", err)
+		}
+		if !expires.After(now) {
+			logWarnf("VALENCE_SECURITY_EXPIRES %s has passed; security.txt is stale", val)
+		}
+	}
+
+	var b strings.Builder
+	for _, contact := range contacts {
+		if !strings.Contains(contact, ":") {
+			// A bare address is the common case.
+			contact = "mailto:" + contact
+		}
+		fmt.Fprintf(&b, "Contact: %s\n", contact)
+	}
+	fmt.Fprintf(&b, "Expires: %s\n", expires.Format(time.RFC3339))
+	for _, field := range []struct{ name, env string }{
+		{"Encryption", "VALENCE_SECURITY_ENCRYPTION"},
+		{"Acknowledgments", "VALENCE_SECURITY_ACKNOWLEDGMENTS"},
+		{"Policy", "VALENCE_SECURITY_POLICY"},
+		{"Hiring", "VALENCE_SECURITY_HIRING"},
+	} {
+		for _, val := range commaList(os.Getenv(field.env)) {
+			fmt.Fprintf(&b, "%s: %s\n", field.name, val)
+		}
+	}
+	if langs := commaList(os.Getenv("VALENCE_SECURITY_PREFERRED_LANGUAGES")); len(langs) > 0 {
+		fmt.Fprintf(&b, "Preferred-Languages: %s\n", strings.Join(langs, ", "))
+	}
+	return b.String(), nil
+}
+
+// commaList splits a comma-separated env value, keeping case.
+func commaList(val string) []string {
+	var items []string
+	for _, item := range strings.Split(val, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func (wk *wellKnown) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(cleanPath(r.URL.Path), "/.well-known/")
+	if name == "" || strings.HasPrefix(name, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	if file := wk.file(name); file != "" {
+		if name == "security.txt" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		}
+		http.ServeFile(w, r, file)
+		return
+	}
+
+	switch name {
+	case "security.txt":
+		if wk.securityTxt != "" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Header().Set("Cache-Control", "public, max-age=86400")
+			_, _ = w.Write([]byte(wk.securityTxt))
+			return
+		}
+	case "change-password":
+		http.Redirect(w, r, wk.changePassword, http.StatusFound)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// file returns the operator-provided file for name, or "". Hidden files
+// and directories are never served.
+func (wk *wellKnown) file(name string) string {
+	if wk.dir == "" {
+		return ""
+	}
+	for _, segment := range strings.Split(name, "/") {
+		if strings.HasPrefix(segment, ".") {
+			return ""
+		}
+	}
+	target := filepath.Join(wk.dir, filepath.FromSlash(name))
+	info, err := os.Stat(target)
+	if err != nil || !info.Mode().IsRegular() {
+		return ""
+	}
+	return target
+}